@@ -0,0 +1,720 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm/clause"
+)
+
+// Administration statuses
+const (
+	doseTaken   = "taken"
+	doseLate    = "late"
+	doseSkipped = "skipped"
+)
+
+// Who recorded an administration
+const (
+	sourceStaff  = "staff"
+	sourceDevice = "device"
+)
+
+// A dose taken this long after it was due counts as late
+var adherenceLateAfter = time.Hour
+
+// Window adherence covers by default, and in generated reports
+const adherenceWindowDays = 30
+
+// Apply ADHERENCE_LATE_AFTER, called from main once the environment is loaded
+func loadAdherenceConfig() {
+	if d, err := time.ParseDuration(os.Getenv("ADHERENCE_LATE_AFTER")); err == nil && d > 0 {
+		adherenceLateAfter = d
+	}
+}
+
+// Sorting and filtering accepted by getMedicationAdministrations
+var administrationListSpec = listSpec{
+	sort: map[string]string{
+		"scheduledAt": "scheduled_at",
+		"createdAt":   "created_at",
+	},
+	defaultSort: "-scheduledAt",
+	filters: []listFilter{
+		{"status", "status", filterEquals},
+		{"source", "source", filterEquals},
+		{"from", "scheduled_at", filterFrom},
+		{"to", "scheduled_at", filterTo},
+	},
+}
+
+// A dose being recorded, by staff or by a patient's device
+type administrationRequest struct {
+	MedicationID uuid.UUID `json:"medicationId"` // device API only
+	ScheduledAt  string    `json:"scheduledAt"`  // the dose in the timeline, optional for as-needed medications
+	Status       string    `json:"status"`       // taken, late or skipped
+	TakenAt      string    `json:"takenAt"`      // defaults to now when taken
+	DoseQuantity float64   `json:"doseQuantity"` // defaults to the prescribed dose
+	Reason       string    `json:"reason"`       // why a dose was skipped
+	Notes        string    `json:"notes"`
+}
+
+// Validate a dose against the medication's schedule and build its record.
+// Doses taken more than adherenceLateAfter after they were due are late.
+func (r *administrationRequest) record(m Medication) (MedicationAdministration, error) {
+	a := MedicationAdministration{
+		MedicationID: m.ID,
+		PatientID:    m.PatientID,
+		Status:       strings.ToLower(strings.TrimSpace(r.Status)),
+		DoseQuantity: r.DoseQuantity,
+		Reason:       strings.TrimSpace(r.Reason),
+		Notes:        r.Notes,
+	}
+	if m.Schedule == nil {
+		return a, fmt.Errorf("the medication has no dosing schedule, set a schedule or a frequency such as \"twice daily\"")
+	}
+	if a.Status != doseTaken && a.Status != doseLate && a.Status != doseSkipped {
+		return a, fmt.Errorf("status must be taken, late or skipped")
+	}
+	if a.DoseQuantity < 0 {
+		return a, fmt.Errorf("doseQuantity cannot be negative")
+	}
+
+	now := clinicNow()
+	var taken time.Time
+	if a.Status != doseSkipped {
+		taken = now.Truncate(time.Minute)
+		if r.TakenAt != "" {
+			t, err := parseAppointmentTime(r.TakenAt)
+			if err != nil {
+				return a, fmt.Errorf("takenAt must be a date and time like 2006-01-02T15:04")
+			}
+			if t.After(now.Add(5 * time.Minute)) {
+				return a, fmt.Errorf("takenAt cannot be in the future")
+			}
+			taken = t
+		}
+		a.TakenAt = taken.Format(appointmentTimeLayout)
+	}
+
+	if m.Schedule.Kind == schedulePRN {
+		// As-needed doses are not scheduled, they are recorded when taken
+		if a.Status != doseTaken {
+			return a, fmt.Errorf("doses of an as-needed medication can only be recorded as taken")
+		}
+		a.ScheduledAt = a.TakenAt
+		if r.ScheduledAt != "" {
+			return a, fmt.Errorf("as-needed medications have no scheduled doses, leave out scheduledAt")
+		}
+	} else {
+		scheduled, err := parseAppointmentTime(r.ScheduledAt)
+		if err != nil {
+			return a, fmt.Errorf("scheduledAt is required as YYYY-MM-DDTHH:MM, the time of a dose in the timeline")
+		}
+		doses := expandDoses(m, scheduled, scheduled.Add(time.Minute))
+		if len(doses) == 0 {
+			return a, fmt.Errorf("no dose of the medication is due at %s", scheduled.Format(appointmentTimeLayout))
+		}
+		a.ScheduledAt = doses[0].DateTime
+		if a.DoseQuantity == 0 {
+			a.DoseQuantity = doses[0].DoseQuantity
+		}
+		if a.Status == doseTaken && taken.Sub(scheduled) > adherenceLateAfter {
+			a.Status = doseLate
+		}
+	}
+	if a.DoseQuantity == 0 {
+		a.DoseQuantity = m.DoseQuantity
+	}
+	return a, nil
+}
+
+// Save a dose, replacing an earlier record of the same dose
+func saveAdministration(a *MedicationAdministration) error {
+	a.ID = uuid.New()
+	if err := db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "medication_id"}, {Name: "scheduled_at"}},
+		DoUpdates: clause.AssignmentColumns([]string{
+			"status", "taken_at", "dose_quantity", "reason", "notes", "source", "recorded_by", "device_id", "updated_at", "deleted_at",
+		}),
+	}).Create(a).Error; err != nil {
+		return err
+	}
+	// An earlier record keeps its ID
+	var saved MedicationAdministration
+	if err := db.First(&saved, "medication_id = ? AND scheduled_at = ?", a.MedicationID, a.ScheduledAt).Error; err != nil {
+		return err
+	}
+	*a = saved
+	return nil
+}
+
+// Adherence to one medication over a window
+type adherenceSummary struct {
+	MedicationID *uuid.UUID `json:"medicationId,omitempty"` // empty in overall summaries
+	Name         string     `json:"name,omitempty"`
+	Expected     int        `json:"expected"` // scheduled doses due in the window, up to now
+	Taken        int        `json:"taken"`    // on time
+	Late         int        `json:"late"`
+	Skipped      int        `json:"skipped"`
+	Missed       int        `json:"missed"`    // due without any record
+	AsNeeded     int        `json:"asNeeded"`  // as-needed doses taken
+	Adherence    *float64   `json:"adherence"` // percentage of expected doses taken, on time or late
+	OnTime       *float64   `json:"onTime"`    // percentage of expected doses taken on time
+}
+
+func percentage(part, whole int) *float64 {
+	if whole == 0 {
+		return nil
+	}
+	p := float64(int(float64(part)/float64(whole)*1000+0.5)) / 10
+	return &p
+}
+
+func (s *adherenceSummary) add(o adherenceSummary) {
+	s.Expected += o.Expected
+	s.Taken += o.Taken
+	s.Late += o.Late
+	s.Skipped += o.Skipped
+	s.Missed += o.Missed
+	s.AsNeeded += o.AsNeeded
+}
+
+func (s *adherenceSummary) finish() {
+	s.Adherence = percentage(s.Taken+s.Late, s.Expected)
+	s.OnTime = percentage(s.Taken, s.Expected)
+}
+
+// Compare a medication's recorded doses with those due from from up to to,
+// or up to now if that is earlier
+func medicationAdherence(m Medication, records []MedicationAdministration, from, to time.Time) adherenceSummary {
+	summary := adherenceSummary{MedicationID: &m.ID, Name: m.Name}
+	if now := clinicNow(); now.Before(to) {
+		to = now
+	}
+
+	byDose := make(map[string]string, len(records))
+	for _, r := range records {
+		byDose[r.ScheduledAt] = r.Status
+	}
+	if m.Schedule != nil && m.Schedule.Kind == schedulePRN {
+		for _, r := range records {
+			if t, err := parseAppointmentTime(r.ScheduledAt); err == nil && !t.Before(from) && t.Before(to) {
+				summary.AsNeeded++
+			}
+		}
+		summary.finish()
+		return summary
+	}
+
+	// Doses due too recently to be late are not counted until recorded
+	pending := clinicNow().Add(-adherenceLateAfter).Format(appointmentTimeLayout)
+	for _, dose := range expandDoses(m, from, to) {
+		status, ok := byDose[dose.DateTime]
+		if !ok && dose.DateTime > pending {
+			continue
+		}
+		summary.Expected++
+		switch status {
+		case doseTaken:
+			summary.Taken++
+		case doseLate:
+			summary.Late++
+		case doseSkipped:
+			summary.Skipped++
+		default:
+			summary.Missed++
+		}
+	}
+	summary.finish()
+	return summary
+}
+
+// Adherence of each of a patient's medications with a schedule, and overall
+func patientAdherence(patientID uuid.UUID, from, to time.Time) ([]adherenceSummary, adherenceSummary, error) {
+	var medications []Medication
+	if err := db.Where("patient_id = ? AND schedule IS NOT NULL", patientID).Order("name").Find(&medications).Error; err != nil {
+		return nil, adherenceSummary{}, err
+	}
+	var records []MedicationAdministration
+	if err := db.Where("patient_id = ?", patientID).
+		Where("scheduled_at >= ? AND scheduled_at < ?", from.Format(appointmentTimeLayout), to.Format(appointmentTimeLayout)).
+		Find(&records).Error; err != nil {
+		return nil, adherenceSummary{}, err
+	}
+	byMedication := make(map[uuid.UUID][]MedicationAdministration)
+	for _, r := range records {
+		byMedication[r.MedicationID] = append(byMedication[r.MedicationID], r)
+	}
+
+	summaries := make([]adherenceSummary, 0, len(medications))
+	var overall adherenceSummary
+	for _, m := range medications {
+		s := medicationAdherence(m, byMedication[m.ID], from, to)
+		if s.Expected == 0 && s.AsNeeded == 0 {
+			continue
+		}
+		summaries = append(summaries, s)
+		overall.add(s)
+	}
+	overall.finish()
+	return summaries, overall, nil
+}
+
+// Parse the from and to dates of an adherence window, by default the last
+// 30 days. The window runs from the start of from to the end of to.
+func adherenceWindow(c *fiber.Ctx) (time.Time, time.Time, error) {
+	today := clinicNow().Truncate(24 * time.Hour)
+	from, to := today.AddDate(0, 0, -adherenceWindowDays+1), today
+	for param, date := range map[string]*time.Time{"from": &from, "to": &to} {
+		if v := c.Query(param); v != "" {
+			t, err := time.Parse(scheduleDateLayout, v)
+			if err != nil {
+				return from, to, fmt.Errorf("'%s' must be a date like 2006-01-02", param)
+			}
+			*date = t
+		}
+	}
+	if to.Before(from) || to.Sub(from) > maxTimelineDays*24*time.Hour {
+		return from, to, fmt.Errorf("the range must run forwards and span at most %d days", maxTimelineDays)
+	}
+	return from, to.AddDate(0, 0, 1), nil
+}
+
+// Record a dose of a medication as taken, late or skipped
+func createMedicationAdministration(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var medication Medication
+	if err := db.Scopes(scopePatientRecords(c)).First(&medication, "id = ?", id).Error; err != nil {
+		auditAccess(c, "create", "medication_administration", "", uuid.Nil, auditNotFound)
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Medication not found",
+		})
+	}
+
+	req := new(administrationRequest)
+	if err := c.BodyParser(req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "Invalid request body",
+		})
+	}
+	administration, err := req.record(medication)
+	if err != nil {
+		return c.Status(422).JSON(fiber.Map{
+			"success": false,
+			"message": "Invalid dose: " + err.Error(),
+		})
+	}
+	recordedBy := currentDoctorID(c)
+	administration.Source = sourceStaff
+	administration.RecordedBy = &recordedBy
+
+	if err := saveAdministration(&administration); err != nil {
+		auditAccess(c, "create", "medication_administration", "", medication.PatientID, auditError)
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to record dose",
+		})
+	}
+
+	auditAccess(c, "create", "medication_administration", administration.ID.String(), medication.PatientID, auditSuccess)
+	return c.Status(201).JSON(fiber.Map{
+		"success": true,
+		"message": "Dose recorded successfully",
+		"data":    administration,
+	})
+}
+
+// List the recorded doses of a medication
+func getMedicationAdministrations(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var medication Medication
+	if err := db.Scopes(scopePatientRecords(c)).First(&medication, "id = ?", id).Error; err != nil {
+		auditAccess(c, "list", "medication_administration", "", uuid.Nil, auditNotFound)
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Medication not found",
+		})
+	}
+
+	var administrations []MedicationAdministration
+	meta, err := listPage(c, db.Model(&MedicationAdministration{}).Where("medication_id = ?", medication.ID),
+		administrationListSpec, &administrations)
+	if err != nil {
+		auditAccess(c, "list", "medication_administration", "", medication.PatientID, auditError)
+		return listError(c, err, "Failed to fetch doses")
+	}
+
+	auditAccess(c, "list", "medication_administration", "", medication.PatientID, auditSuccess)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Doses retrieved successfully",
+		"data":    administrations,
+		"meta":    meta,
+	})
+}
+
+// Adherence to one medication between from and to
+func getMedicationAdherence(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var medication Medication
+	if err := db.Scopes(scopePatientRecords(c)).First(&medication, "id = ?", id).Error; err != nil {
+		auditAccess(c, "read", "adherence", id, uuid.Nil, auditNotFound)
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Medication not found",
+		})
+	}
+	from, to, err := adherenceWindow(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "Invalid range: " + err.Error(),
+		})
+	}
+
+	var records []MedicationAdministration
+	if err := db.Where("medication_id = ?", medication.ID).
+		Where("scheduled_at >= ? AND scheduled_at < ?", from.Format(appointmentTimeLayout), to.Format(appointmentTimeLayout)).
+		Find(&records).Error; err != nil {
+		auditAccess(c, "read", "adherence", id, medication.PatientID, auditError)
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to calculate adherence",
+		})
+	}
+
+	auditAccess(c, "read", "adherence", id, medication.PatientID, auditSuccess)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Adherence calculated successfully",
+		"data":    medicationAdherence(medication, records, from, to),
+		"meta": fiber.Map{
+			"from": from.Format(scheduleDateLayout),
+			"to":   to.AddDate(0, 0, -1).Format(scheduleDateLayout),
+		},
+	})
+}
+
+// Adherence to each of a patient's medications, and overall, between from and to
+func getPatientAdherence(c *fiber.Ctx) error {
+	patientID, err := uuid.Parse(c.Params("id"))
+	if err != nil || !canAccessPatient(c, patientID) {
+		auditAccess(c, "read", "adherence", "", patientID, auditNotFound)
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Patient not found",
+		})
+	}
+	from, to, err := adherenceWindow(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "Invalid range: " + err.Error(),
+		})
+	}
+
+	summaries, overall, err := patientAdherence(patientID, from, to)
+	if err != nil {
+		auditAccess(c, "read", "adherence", "", patientID, auditError)
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to calculate adherence",
+		})
+	}
+
+	auditAccess(c, "read", "adherence", "", patientID, auditSuccess)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Adherence calculated successfully",
+		"data": fiber.Map{
+			"medications": summaries,
+			"overall":     overall,
+		},
+		"meta": fiber.Map{
+			"from": from.Format(scheduleDateLayout),
+			"to":   to.AddDate(0, 0, -1).Format(scheduleDateLayout),
+		},
+	})
+}
+
+// Register a device, such as a phone app or a smart pill dispenser, to
+// record a patient's doses. The token is only shown once.
+func createPatientDevice(c *fiber.Ctx) error {
+	patientID, err := uuid.Parse(c.Params("id"))
+	if err != nil || !canAccessPatient(c, patientID) {
+		auditAccess(c, "create", "patient_device", "", patientID, auditNotFound)
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Patient not found",
+		})
+	}
+	req := new(struct {
+		Label string `json:"label"`
+	})
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(req); err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"success": false,
+				"message": "Invalid request body",
+			})
+		}
+	}
+
+	token, err := generateOpaqueToken()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to register device",
+		})
+	}
+	device := PatientDevice{
+		ID:        uuid.New(),
+		PatientID: patientID,
+		TokenHash: hashToken(token),
+		Label:     req.Label,
+		CreatedBy: currentDoctorID(c),
+	}
+	if err := db.Create(&device).Error; err != nil {
+		auditAccess(c, "create", "patient_device", "", patientID, auditError)
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to register device",
+		})
+	}
+
+	auditAccess(c, "create", "patient_device", device.ID.String(), patientID, auditSuccess)
+	return c.Status(201).JSON(fiber.Map{
+		"success": true,
+		"message": "Device registered, the token will not be shown again",
+		"data": fiber.Map{
+			"device": device,
+			"token":  token,
+		},
+	})
+}
+
+// List a patient's devices
+func getPatientDevices(c *fiber.Ctx) error {
+	patientID, err := uuid.Parse(c.Params("id"))
+	if err != nil || !canAccessPatient(c, patientID) {
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Patient not found",
+		})
+	}
+
+	var devices []PatientDevice
+	if err := db.Where("patient_id = ?", patientID).Order("created_at").Find(&devices).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to fetch devices",
+		})
+	}
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Devices retrieved successfully",
+		"data":    devices,
+	})
+}
+
+// Revoke a patient's device, its token stops working at once
+func revokePatientDevice(c *fiber.Ctx) error {
+	patientID, err := uuid.Parse(c.Params("id"))
+	id := c.Params("deviceId")
+	if err != nil || !canAccessPatient(c, patientID) {
+		auditAccess(c, "revoke", "patient_device", id, patientID, auditNotFound)
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Patient not found",
+		})
+	}
+
+	result := db.Model(&PatientDevice{}).
+		Where("id = ? AND patient_id = ? AND revoked_at IS NULL", id, patientID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to revoke device",
+		})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Device not found",
+		})
+	}
+
+	auditAccess(c, "revoke", "patient_device", id, patientID, auditSuccess)
+	return c.SendStatus(204)
+}
+
+// Authenticate a patient device by the bearer token it was registered with,
+// storing the device in c.Locals("device")
+func deviceAuth() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		token, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+		var device PatientDevice
+		if !ok || token == "" || db.Where("token_hash = ? AND revoked_at IS NULL", hashToken(token)).First(&device).Error != nil {
+			return c.Status(401).JSON(fiber.Map{
+				"success": false,
+				"message": "Invalid or revoked device token",
+			})
+		}
+		// The patient must not be archived
+		var count int64
+		if db.Model(&Patient{}).Where("id = ?", device.PatientID).Count(&count); count == 0 {
+			return c.Status(401).JSON(fiber.Map{
+				"success": false,
+				"message": "Invalid or revoked device token",
+			})
+		}
+
+		now := time.Now()
+		db.Model(&device).Update("last_used_at", &now)
+		c.Locals("device", device)
+		return c.Next()
+	}
+}
+
+// Record a device's access to a patient's records
+func auditDevice(c *fiber.Ctx, action, resourceID, outcome string) {
+	device := c.Locals("device").(PatientDevice)
+	details, _ := json.Marshal(fiber.Map{"deviceId": device.ID})
+	recordAuditEvent(AuditEvent{
+		Action:       action,
+		ResourceType: "medication_administration",
+		ResourceID:   resourceID,
+		PatientID:    &device.PatientID,
+		IP:           c.IP(),
+		Outcome:      outcome,
+		Details:      string(details),
+	})
+}
+
+// List the device's patient's current medications with the doses due on a
+// date (default today), and what has been recorded for them
+func getDeviceMedications(c *fiber.Ctx) error {
+	device := c.Locals("device").(PatientDevice)
+	day := clinicNow().Truncate(24 * time.Hour)
+	if v := c.Query("date"); v != "" {
+		t, err := time.Parse(scheduleDateLayout, v)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"success": false,
+				"message": "Invalid 'date', expected YYYY-MM-DD",
+			})
+		}
+		day = t
+	}
+
+	var medications []Medication
+	if err := db.Where("patient_id = ? AND schedule IS NOT NULL", device.PatientID).
+		Where("end_date = '' OR end_date IS NULL OR end_date >= ?", day.Format(scheduleDateLayout)).
+		Order("name").Find(&medications).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to fetch medications",
+		})
+	}
+	var records []MedicationAdministration
+	if err := db.Where("patient_id = ?", device.PatientID).
+		Where("scheduled_at >= ? AND scheduled_at < ?", day.Format(appointmentTimeLayout), day.AddDate(0, 0, 1).Format(appointmentTimeLayout)).
+		Find(&records).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to fetch medications",
+		})
+	}
+	recorded := make(map[string]MedicationAdministration, len(records))
+	for _, r := range records {
+		recorded[r.MedicationID.String()+r.ScheduledAt] = r
+	}
+
+	// Only what a patient needs to take their doses, no clinical notes
+	type deviceDose struct {
+		scheduledDose
+		Status string `json:"status"` // empty until recorded
+	}
+	data := make([]fiber.Map, 0, len(medications))
+	for _, m := range medications {
+		doses := []deviceDose{}
+		for _, dose := range expandDoses(m, day, day.AddDate(0, 0, 1)) {
+			doses = append(doses, deviceDose{dose, recorded[m.ID.String()+dose.DateTime].Status})
+		}
+		if len(doses) == 0 && m.Schedule.Kind != schedulePRN {
+			continue
+		}
+		data = append(data, fiber.Map{
+			"id":           m.ID,
+			"name":         m.Name,
+			"dosage":       m.Dosage,
+			"doseQuantity": m.DoseQuantity,
+			"doseUnit":     m.DoseUnit,
+			"route":        m.Route,
+			"asNeeded":     m.Schedule.Kind == schedulePRN,
+			"doses":        doses,
+		})
+	}
+
+	auditDevice(c, "device.read", "", auditSuccess)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Medications retrieved successfully",
+		"data":    data,
+		"meta":    fiber.Map{"date": day.Format(scheduleDateLayout)},
+	})
+}
+
+// Record a dose from a patient's device
+func createDeviceAdministration(c *fiber.Ctx) error {
+	device := c.Locals("device").(PatientDevice)
+	req := new(administrationRequest)
+	if err := c.BodyParser(req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "Invalid request body",
+		})
+	}
+
+	var medication Medication
+	if err := db.First(&medication, "id = ? AND patient_id = ?", req.MedicationID, device.PatientID).Error; err != nil {
+		auditDevice(c, "device.dose", "", auditNotFound)
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Medication not found",
+		})
+	}
+	administration, err := req.record(medication)
+	if err != nil {
+		return c.Status(422).JSON(fiber.Map{
+			"success": false,
+			"message": "Invalid dose: " + err.Error(),
+		})
+	}
+	administration.Source = sourceDevice
+	administration.DeviceID = &device.ID
+
+	if err := saveAdministration(&administration); err != nil {
+		auditDevice(c, "device.dose", "", auditError)
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to record dose",
+		})
+	}
+
+	auditDevice(c, "device.dose", administration.ID.String(), auditSuccess)
+	return c.Status(201).JSON(fiber.Map{
+		"success": true,
+		"message": "Dose recorded successfully",
+		"data":    administration,
+	})
+}
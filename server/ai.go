@@ -128,7 +128,8 @@ func generateMedicalReport(c *fiber.Ctx) error {
 	
 	// Fetch patient data
 	var patient Patient
-	if err := db.First(&patient, "id = ?", req.PatientID).Error; err != nil {
+	if err := db.Scopes(scopePatients(c)).First(&patient, "id = ?", req.PatientID).Error; err != nil {
+		auditAccess(c, "generate", "report", "", uuid.Nil, auditNotFound)
 		return c.Status(404).JSON(fiber.Map{
 			"success": false,
 			"message": "Patient not found",
@@ -147,11 +148,15 @@ func generateMedicalReport(c *fiber.Ctx) error {
 	}
 	
 	if err := db.Create(&report).Error; err != nil {
+		auditAccess(c, "generate", "report", "", patient.ID, auditError)
 		return c.Status(500).JSON(fiber.Map{
 			"success": false,
 			"message": "Failed to create report",
 		})
 	}
+
+	// The patient's full record is disclosed to the external AI provider
+	auditAccess(c, "disclose.ai", "report", reportID.String(), patient.ID, auditSuccess)
 	
 	// Start AI report generation in a goroutine
 	go generateReportContent(reportID.String(), patient)
@@ -208,6 +213,13 @@ func generateReportContent(reportID string, patient Patient) {
 		updateReportStatus(reportID, "failed", "Database error fetching metrics", "")
 		return
 	}
+	today := clinicNow().Truncate(24 * time.Hour)
+	adherence, overallAdherence, err := patientAdherence(patient.ID, today.AddDate(0, 0, -adherenceWindowDays+1), today.AddDate(0, 0, 1))
+	if err != nil {
+		log.Printf("ERROR: ReportID %s: Failed to calculate adherence for patient %d: %v", reportID, patient.ID, err)
+		updateReportStatus(reportID, "failed", "Database error calculating medication adherence", "")
+		return
+	}
 
 
 	// Convert data to JSON for the AI prompt, check errors
@@ -235,6 +247,12 @@ func generateReportContent(reportID string, patient Patient) {
 		updateReportStatus(reportID, "failed", "Internal error processing health metrics", "")
 		return
 	}
+	adherenceJSON, err := json.MarshalIndent(fiber.Map{"medications": adherence, "overall": overallAdherence}, "", "  ")
+	if err != nil {
+		log.Printf("ERROR: ReportID %s: Failed to marshal adherence data: %v", reportID, err)
+		updateReportStatus(reportID, "failed", "Internal error processing medication adherence", "")
+		return
+	}
 
 	// Create comprehensive prompt
 	prompt := fmt.Sprintf(`You are an experienced medical professional generating a comprehensive health report.
@@ -246,6 +264,9 @@ PATIENT INFORMATION:
 MEDICATIONS:
 %s
 
+MEDICATION ADHERENCE (last %d days; percentages of scheduled doses taken, null when none were due; poor adherence may explain other findings):
+%s
+
 APPOINTMENT HISTORY:
 %s
 
@@ -277,6 +298,8 @@ Include at least 3-5 detailed sections and 3-5 specific recommendations.
 Generate ONLY the JSON object as requested.`,
 		string(patientJSON),
 		string(medicationsJSON),
+		adherenceWindowDays,
+		string(adherenceJSON),
 		string(appointmentsJSON),
 		string(metricsJSON))
 	
@@ -385,22 +408,50 @@ func updateReportStatus(reportID, status, summary, content string) {
 		"summary": summary,
 		"content": content,
 	})
+
+	// Completed summaries are searchable
+	var report Report
+	if err := db.Select("patient_id").First(&report, "id = ?", reportID).Error; err == nil {
+		reindexPatient(report.PatientID)
+	}
+}
+
+// Sorting and filtering accepted by getReports
+var reportListSpec = listSpec{
+	sort: map[string]string{
+		"generatedAt": "generated_at",
+		"patientName": "patient_name",
+		"status":      "status",
+	},
+	defaultSort: "-generatedAt",
+	filters: []listFilter{
+		{"patientId", "patient_id", filterUUID},
+		{"status", "status", filterEquals},
+		{"reportType", "report_type", filterEquals},
+		{"from", "generated_at", filterFrom},
+		{"to", "generated_at", filterTo},
+	},
 }
 
 // Get a list of all reports
 func getReports(c *fiber.Ctx) error {
 	var reports []Report
-	if err := db.Find(&reports).Error; err != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"success": false,
-			"message": "Failed to fetch reports",
-		})
+	meta, err := listPage(c, db.Model(&Report{}).Scopes(scopePatientRecords(c)), reportListSpec, &reports)
+	if err != nil {
+		return listError(c, err, "Failed to fetch reports")
 	}
+
+	patientIDs := make([]uuid.UUID, len(reports))
+	for i, report := range reports {
+		patientIDs[i] = report.PatientID
+	}
+	auditList(c, "report", patientIDs)
 	
 	return c.JSON(fiber.Map{
 		"success": true,
 		"message": "Reports retrieved successfully",
 		"data":    reports,
+		"meta":    meta,
 	})
 }
 
@@ -409,7 +460,8 @@ func getReport(c *fiber.Ctx) error {
 	reportID := c.Params("id")
 	
 	var report Report
-	if err := db.First(&report, "id = ?", reportID).Error; err != nil {
+	if err := db.Scopes(scopePatientRecords(c)).First(&report, "id = ?", reportID).Error; err != nil {
+		auditAccess(c, "read", "report", reportID, uuid.Nil, auditNotFound)
 		return c.Status(404).JSON(fiber.Map{
 			"success": false,
 			"message": "Report not found",
@@ -467,6 +519,8 @@ func getReport(c *fiber.Ctx) error {
 		}
 	}
 	
+	auditAccess(c, "read", "report", reportID, report.PatientID, auditSuccess)
+
 	return c.JSON(fiber.Map{
 		"success": true,
 		"message": "Report retrieved successfully",
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// Allergy severities
+const (
+	allergyMild     = "mild"
+	allergyModerate = "moderate"
+	allergySevere   = "severe" // e.g. anaphylaxis, makes prescribing the allergen contraindicated
+)
+
+// List a patient's structured allergies
+func getPatientAllergies(c *fiber.Ctx) error {
+	patientID, err := uuid.Parse(c.Params("id"))
+	if err != nil || !canAccessPatient(c, patientID) {
+		auditAccess(c, "list", "allergy", "", patientID, auditNotFound)
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Patient not found",
+		})
+	}
+
+	var allergies []PatientAllergy
+	if err := db.Where("patient_id = ?", patientID).Order("substance").Find(&allergies).Error; err != nil {
+		auditAccess(c, "list", "allergy", "", patientID, auditError)
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to fetch allergies",
+		})
+	}
+
+	auditAccess(c, "list", "allergy", "", patientID, auditSuccess)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Allergies retrieved successfully",
+		"data":    allergies,
+	})
+}
+
+// Record an allergy for a patient
+func createPatientAllergy(c *fiber.Ctx) error {
+	patientID, err := uuid.Parse(c.Params("id"))
+	if err != nil || !canAccessPatient(c, patientID) {
+		auditAccess(c, "create", "allergy", "", patientID, auditNotFound)
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Patient not found",
+		})
+	}
+
+	allergy := new(PatientAllergy)
+	if err := c.BodyParser(allergy); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "Invalid request body",
+		})
+	}
+	allergy.Substance = strings.TrimSpace(allergy.Substance)
+	allergy.Severity = strings.ToLower(strings.TrimSpace(allergy.Severity))
+	if normalizeDrug(allergy.Substance) == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "Substance is required",
+		})
+	}
+	switch allergy.Severity {
+	case "", allergyMild, allergyModerate, allergySevere:
+	default:
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "Severity must be mild, moderate or severe",
+		})
+	}
+	allergy.ID = uuid.New()
+	allergy.PatientID = patientID
+
+	if err := db.Create(allergy).Error; err != nil {
+		auditAccess(c, "create", "allergy", "", patientID, auditError)
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to create allergy",
+		})
+	}
+
+	auditAccess(c, "create", "allergy", allergy.ID.String(), patientID, auditSuccess)
+	return c.Status(201).JSON(fiber.Map{
+		"success": true,
+		"message": "Allergy created successfully",
+		"data":    allergy,
+	})
+}
+
+// Remove an allergy from a patient's record
+func deletePatientAllergy(c *fiber.Ctx) error {
+	patientID, err := uuid.Parse(c.Params("id"))
+	id := c.Params("allergyId")
+	if err != nil || !canAccessPatient(c, patientID) {
+		auditAccess(c, "delete", "allergy", id, patientID, auditNotFound)
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Patient not found",
+		})
+	}
+
+	result := db.Where("id = ? AND patient_id = ?", id, patientID).Delete(&PatientAllergy{})
+	if result.Error != nil {
+		auditAccess(c, "delete", "allergy", id, patientID, auditError)
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to delete allergy",
+		})
+	}
+	if result.RowsAffected == 0 {
+		auditAccess(c, "delete", "allergy", id, patientID, auditNotFound)
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Allergy not found",
+		})
+	}
+
+	auditAccess(c, "delete", "allergy", id, patientID, auditSuccess)
+	return c.SendStatus(204)
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Appointment statuses
+const (
+	statusRequested   = "requested"
+	statusScheduled   = "scheduled"
+	statusCheckedIn   = "checked-in"
+	statusInProgress  = "in-progress"
+	statusCompleted   = "completed"
+	statusCancelled   = "cancelled"
+	statusNoShow      = "no-show"
+	statusRescheduled = "rescheduled"
+)
+
+// Statuses an appointment can move to from each status. Completed, cancelled,
+// no-show and rescheduled appointments are final.
+var appointmentTransitions = map[string][]string{
+	statusRequested:   {statusScheduled, statusCancelled},
+	statusScheduled:   {statusCheckedIn, statusCancelled, statusNoShow, statusRescheduled},
+	statusCheckedIn:   {statusInProgress, statusCancelled},
+	statusInProgress:  {statusCompleted},
+	statusCompleted:   nil,
+	statusCancelled:   nil,
+	statusNoShow:      nil,
+	statusRescheduled: nil,
+}
+
+// Returned when an appointment's status changed after it was read, by a
+// request made at the same time
+var errStatusChanged = fiber.NewError(fiber.StatusConflict, "The appointment's status has just changed, reload it and try again")
+
+// Other spellings of statuses, as sent by older clients
+var statusAliases = map[string]string{
+	"canceled":  statusCancelled,
+	"confirmed": statusScheduled,
+	"noshow":    statusNoShow,
+}
+
+// Lowercase a status and resolve aliases
+func normalizeStatus(status string) string {
+	status = strings.ToLower(strings.TrimSpace(status))
+	if canonical, ok := statusAliases[status]; ok {
+		return canonical
+	}
+	return status
+}
+
+// Check that an appointment may move from one status to another
+func checkTransition(from, to string) error {
+	if _, ok := appointmentTransitions[to]; !ok {
+		return fiber.NewError(fiber.StatusUnprocessableEntity, "Unknown status '"+to+"'")
+	}
+	allowed := appointmentTransitions[from]
+	for _, s := range allowed {
+		if s == to {
+			return nil
+		}
+	}
+	if len(allowed) == 0 {
+		return fiber.NewError(fiber.StatusUnprocessableEntity, "The appointment is "+from+" and can no longer change status")
+	}
+	return fiber.NewError(fiber.StatusUnprocessableEntity,
+		"Cannot change an appointment from "+from+" to "+to+", expected one of: "+strings.Join(allowed, ", "))
+}
+
+// Check the status of a new appointment, which starts out requested or scheduled
+func checkInitialStatus(status string) error {
+	if status != statusRequested && status != statusScheduled {
+		return fiber.NewError(fiber.StatusUnprocessableEntity, "New appointments must be requested or scheduled")
+	}
+	return nil
+}
+
+// Add a status change to an appointment's history
+func recordStatusChange(tx *gorm.DB, c *fiber.Ctx, appointmentID uuid.UUID, from, to, reason string) error {
+	var changedBy *uuid.UUID
+	if id := currentDoctorID(c); id != uuid.Nil {
+		changedBy = &id
+	}
+	return tx.Create(&AppointmentStatusChange{
+		AppointmentID: appointmentID,
+		FromStatus:    from,
+		ToStatus:      to,
+		Reason:        reason,
+		ChangedBy:     changedBy,
+		ChangedAt:     time.Now().UTC(),
+	}).Error
+}
+
+// Bring statuses stored before the lifecycle was enforced in line with it and
+// start the history of appointments that have none. Called from initDB.
+func migrateAppointmentStatuses() {
+	for alias, status := range statusAliases {
+		db.Model(&Appointment{}).Unscoped().Where("status = ?", alias).Update("status", status)
+	}
+	db.Model(&Appointment{}).Unscoped().Where("status = '' OR status IS NULL").Update("status", statusScheduled)
+
+	result := db.Exec(`INSERT INTO appointment_status_changes (appointment_id, from_status, to_status, reason, changed_at)
+		SELECT id, '', status, '', created_at FROM appointments
+		WHERE id NOT IN (SELECT appointment_id FROM appointment_status_changes)`)
+	if result.Error != nil {
+		log.Printf("Failed to start appointment status history: %v", result.Error)
+	}
+}
+
+// Move an appointment to the given status, as the transition endpoints do.
+// Cancelling needs a reason.
+func transitionAppointment(to string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id := c.Params("id")
+		req := new(struct {
+			Reason string `json:"reason"`
+		})
+		if len(c.Body()) > 0 {
+			if err := c.BodyParser(req); err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+			}
+		}
+
+		var appointment Appointment
+		if err := db.Scopes(scopePatientRecords(c)).First(&appointment, "id = ?", id).Error; err != nil {
+			auditAccess(c, "update", "appointment", id, uuid.Nil, auditNotFound)
+			return c.Status(404).JSON(fiber.Map{"error": "Appointment not found"})
+		}
+
+		if err := checkTransition(appointment.Status, to); err != nil {
+			return c.Status(422).JSON(fiber.Map{"error": err.(*fiber.Error).Message})
+		}
+		updates := map[string]interface{}{"status": to}
+		if to == statusCancelled {
+			if strings.TrimSpace(req.Reason) == "" {
+				return c.Status(422).JSON(fiber.Map{"error": "A reason is required to cancel an appointment"})
+			}
+			updates["cancellation_reason"] = req.Reason
+		}
+
+		from, freed := appointment.Status, appointment
+		err := db.Transaction(func(tx *gorm.DB) error {
+			result := tx.Model(&appointment).Where("status = ?", from).Updates(updates)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return errStatusChanged
+			}
+			return recordStatusChange(tx, c, appointment.ID, from, to, req.Reason)
+		})
+		if err == errStatusChanged {
+			return c.Status(409).JSON(fiber.Map{"error": errStatusChanged.Message})
+		}
+		if err != nil {
+			auditAccess(c, "update", "appointment", id, appointment.PatientID, auditError)
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to update appointment status"})
+		}
+
+		auditAccess(c, "update", "appointment", id, appointment.PatientID, auditSuccess)
+		if to == statusCancelled {
+			releaseSlot(freed)
+		}
+		appointment.Status = to
+		if to == statusCancelled {
+			appointment.CancellationReason = req.Reason
+		}
+		return c.JSON(appointment)
+	}
+}
+
+// Move an appointment to a new time. The appointment becomes rescheduled and
+// a new scheduled appointment replaces it, so the history of both is kept.
+func rescheduleAppointment(c *fiber.Ctx) error {
+	id := c.Params("id")
+	req := new(struct {
+		DateTime string    `json:"dateTime"`
+		DoctorID uuid.UUID `json:"doctorId"`
+		Type     string    `json:"type"`
+		Reason   string    `json:"reason"`
+	})
+	if err := c.BodyParser(req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	var existing Appointment
+	if err := db.Scopes(scopePatientRecords(c)).First(&existing, "id = ?", id).Error; err != nil {
+		auditAccess(c, "update", "appointment", id, uuid.Nil, auditNotFound)
+		return c.Status(404).JSON(fiber.Map{"error": "Appointment not found"})
+	}
+	if err := checkTransition(existing.Status, statusRescheduled); err != nil {
+		return c.Status(422).JSON(fiber.Map{"error": err.(*fiber.Error).Message})
+	}
+	if req.DateTime == "" {
+		return c.Status(422).JSON(fiber.Map{"error": "dateTime is required"})
+	}
+
+	replacement := Appointment{
+		PatientID:       existing.PatientID,
+		DoctorID:        existing.DoctorID,
+		DateTime:        req.DateTime,
+		Type:            existing.Type,
+		Notes:           existing.Notes,
+		Status:          statusScheduled,
+		SeriesID:        existing.SeriesID,
+		RecurrenceID:    existing.RecurrenceID,
+		RescheduledFrom: &existing.ID,
+	}
+	if req.DoctorID != uuid.Nil {
+		replacement.DoctorID = req.DoctorID
+	}
+	if req.Type != "" {
+		replacement.Type = req.Type
+	}
+
+	bookingMu.Lock()
+	defer bookingMu.Unlock()
+	// The slot being given up does not conflict with its replacement
+	if err := checkBooking(&replacement, existing.ID); err != nil {
+		auditAccess(c, "update", "appointment", id, existing.PatientID, auditDenied)
+		return bookingErrorResponse(c, err)
+	}
+
+	from, freed := existing.Status, existing
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&existing).Where("status = ?", from).Update("status", statusRescheduled)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errStatusChanged
+		}
+		if err := recordStatusChange(tx, c, existing.ID, from, statusRescheduled, req.Reason); err != nil {
+			return err
+		}
+		if err := tx.Create(&replacement).Error; err != nil {
+			return err
+		}
+		return recordStatusChange(tx, c, replacement.ID, "", statusScheduled, req.Reason)
+	})
+	if err == errStatusChanged {
+		return c.Status(409).JSON(fiber.Map{"error": errStatusChanged.Message})
+	}
+	if err != nil {
+		auditAccess(c, "update", "appointment", id, existing.PatientID, auditError)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to reschedule appointment"})
+	}
+
+	auditAccess(c, "update", "appointment", id, existing.PatientID, auditSuccess)
+	auditAccess(c, "create", "appointment", replacement.ID.String(), replacement.PatientID, auditSuccess)
+	releaseSlot(freed)
+	return c.Status(201).JSON(replacement)
+}
+
+// Minutes between the first changes to two statuses, if both happened
+func minutesBetween(changes []AppointmentStatusChange, from, to string) *float64 {
+	var start, end *time.Time
+	for i := range changes {
+		if changes[i].ToStatus == from && start == nil {
+			start = &changes[i].ChangedAt
+		}
+		if changes[i].ToStatus == to && end == nil {
+			end = &changes[i].ChangedAt
+		}
+	}
+	if start == nil || end == nil {
+		return nil
+	}
+	minutes := end.Sub(*start).Minutes()
+	return &minutes
+}
+
+// Get the status history of an appointment
+func getAppointmentHistory(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var appointment Appointment
+	if err := db.Scopes(scopePatientRecords(c)).First(&appointment, "id = ?", id).Error; err != nil {
+		auditAccess(c, "read", "appointment", id, uuid.Nil, auditNotFound)
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Appointment not found",
+		})
+	}
+
+	var changes []AppointmentStatusChange
+	if err := db.Where("appointment_id = ?", appointment.ID).Order("changed_at, id").Find(&changes).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to fetch appointment history",
+		})
+	}
+
+	auditAccess(c, "read", "appointment", id, appointment.PatientID, auditSuccess)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Appointment history retrieved successfully",
+		"data":    changes,
+		"meta": fiber.Map{
+			"status":          appointment.Status,
+			"waitMinutes":     minutesBetween(changes, statusCheckedIn, statusInProgress),
+			"durationMinutes": minutesBetween(changes, statusInProgress, statusCompleted),
+		},
+	})
+}
+
+// Summarize appointment outcomes over a date range: counts per status, the
+// no-show rate and the average wait between check-in and the start of the
+// appointment
+func getAppointmentStatusStats(c *fiber.Ctx) error {
+	query := db.Model(&Appointment{}).Scopes(scopePatientRecords(c))
+	query, err := applyListFilters(c, query, listSpec{filters: []listFilter{
+		{"from", "date_time", filterFrom},
+		{"to", "date_time", filterTo},
+		{"doctorId", "doctor_id", filterUUID},
+	}})
+	if err != nil {
+		return listError(c, err, "Failed to compute appointment statistics")
+	}
+
+	var rows []struct {
+		Status string
+		Count  int64
+	}
+	if err := query.Session(&gorm.Session{}).Select("status, COUNT(*) AS count").Group("status").Scan(&rows).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to compute appointment statistics",
+		})
+	}
+	counts := make(map[string]int64)
+	var total int64
+	for _, r := range rows {
+		counts[r.Status] = r.Count
+		total += r.Count
+	}
+
+	// Of the appointments that were due and not called off, how many were missed
+	var noShowRate *float64
+	if due := counts[statusCompleted] + counts[statusNoShow]; due > 0 {
+		rate := float64(counts[statusNoShow]) / float64(due)
+		noShowRate = &rate
+	}
+
+	var wait struct {
+		Average *float64
+		Count   int64
+	}
+	err = db.Raw(`SELECT AVG((julianday(started.changed_at) - julianday(arrived.changed_at)) * 1440) AS average, COUNT(*) AS count
+		FROM appointment_status_changes arrived
+		JOIN appointment_status_changes started ON started.appointment_id = arrived.appointment_id AND started.to_status = ?
+		WHERE arrived.to_status = ? AND arrived.appointment_id IN (?)`,
+		statusInProgress, statusCheckedIn, query.Session(&gorm.Session{}).Select("id")).Scan(&wait).Error
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to compute appointment statistics",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Appointment statistics retrieved successfully",
+		"data": fiber.Map{
+			"total":              total,
+			"byStatus":           counts,
+			"noShowRate":         noShowRate,
+			"averageWaitMinutes": wait.Average,
+			"waitSamples":        wait.Count,
+		},
+	})
+}
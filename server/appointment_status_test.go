@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+func TestCheckTransition(t *testing.T) {
+	// Every allowed move; any other between two statuses is refused
+	allowed := map[string]bool{
+		"requested>scheduled":    true,
+		"requested>cancelled":    true,
+		"scheduled>checked-in":   true,
+		"scheduled>cancelled":    true,
+		"scheduled>no-show":      true,
+		"scheduled>rescheduled":  true,
+		"checked-in>in-progress": true,
+		"checked-in>cancelled":   true,
+		"in-progress>completed":  true,
+	}
+	statuses := []string{statusRequested, statusScheduled, statusCheckedIn, statusInProgress,
+		statusCompleted, statusCancelled, statusNoShow, statusRescheduled}
+	for _, from := range statuses {
+		for _, to := range statuses {
+			err := checkTransition(from, to)
+			if want := allowed[from+">"+to]; (err == nil) != want {
+				t.Errorf("checkTransition(%s, %s) = %v, want allowed %v", from, to, err, want)
+			}
+		}
+	}
+
+	tests := []struct {
+		from, to string
+		want     string
+	}{
+		{statusCompleted, statusScheduled, "The appointment is completed and can no longer change status"},
+		{statusScheduled, statusCompleted, "Cannot change an appointment from scheduled to completed, expected one of: checked-in, cancelled, no-show, rescheduled"},
+		{statusScheduled, "done", "Unknown status 'done'"},
+	}
+	for _, tt := range tests {
+		err := checkTransition(tt.from, tt.to)
+		if err == nil || err.(*fiber.Error).Message != tt.want || err.(*fiber.Error).Code != http.StatusUnprocessableEntity {
+			t.Errorf("checkTransition(%s, %s) = %v, want 422 %q", tt.from, tt.to, err, tt.want)
+		}
+	}
+
+	// Every status has a row, so no status is left without its moves
+	var listed []string
+	for status := range appointmentTransitions {
+		listed = append(listed, status)
+	}
+	sort.Strings(listed)
+	sort.Strings(statuses)
+	if strings.Join(listed, ",") != strings.Join(statuses, ",") {
+		t.Errorf("appointmentTransitions lists %v, want %v", listed, statuses)
+	}
+}
+
+func TestNormalizeStatus(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{" Scheduled ", statusScheduled},
+		{"canceled", statusCancelled},
+		{"Confirmed", statusScheduled},
+		{"noshow", statusNoShow},
+		{"no-show", statusNoShow},
+	}
+	for _, tt := range tests {
+		if got := normalizeStatus(tt.in); got != tt.want {
+			t.Errorf("normalizeStatus(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+	for _, status := range []string{statusRequested, statusScheduled} {
+		if err := checkInitialStatus(status); err != nil {
+			t.Errorf("checkInitialStatus(%s) = %v, want nil", status, err)
+		}
+	}
+	if err := checkInitialStatus(statusCheckedIn); err == nil {
+		t.Errorf("checkInitialStatus(%s) = nil, want an error", statusCheckedIn)
+	}
+}
+
+// A status change that finds the status changed since it was read, as by a
+// check-in at the same time, is refused and rolled back
+func TestStatusChangedMeanwhile(t *testing.T) {
+	setupTestDB(t)
+	app := newTestApp()
+	doctor, token := createTestUser(t, RolePhysician, "password123")
+	patient := createTestPatient(t, "Ada Lovelace", doctor)
+
+	resp := doRequest(t, app, http.MethodPost, "/api/appointments", token, fiber.Map{
+		"patientId": patient.ID,
+		"dateTime":  nextMonday(9).Format(appointmentTimeLayout),
+		"type":      "Consultation",
+	})
+	var appointment Appointment
+	decodeBody(t, resp, &appointment)
+	resp = doRequest(t, app, http.MethodPost, "/api/appointments/series", token, fiber.Map{
+		"patientId": patient.ID,
+		"dateTime":  nextMonday(11).Format(appointmentTimeLayout),
+		"rrule":     "FREQ=WEEKLY;COUNT=2",
+		"type":      "Consultation",
+	})
+	var series seriesResponse
+	decodeBody(t, resp, &series)
+	occurrence := series.Data.Occurrences[0]
+
+	// Check the appointments in, in the update's transaction, after they were read
+	db.Callback().Update().Before("gorm:update").Register("test:check_in_meanwhile", func(tx *gorm.DB) {
+		if tx.Statement.Table == "appointments" {
+			tx.Session(&gorm.Session{NewDB: true}).Exec("UPDATE appointments SET status = ?", statusCheckedIn)
+		}
+	})
+	defer db.Callback().Update().Remove("test:check_in_meanwhile")
+
+	cancel := fiber.Map{"status": statusCancelled, "cancellationReason": "Doctor away", "reason": "Doctor away"}
+	tests := []struct {
+		name   string
+		method string
+		path   string
+	}{
+		{"update", http.MethodPut, "/api/appointments/" + appointment.ID.String()},
+		{"cancel", http.MethodPost, "/api/appointments/" + appointment.ID.String() + "/cancel"},
+		{"reschedule", http.MethodPost, "/api/appointments/" + appointment.ID.String() + "/reschedule"},
+		{"series update", http.MethodPut, "/api/appointments/" + occurrence.ID.String() + "?scope=all"},
+	}
+	for _, tt := range tests {
+		body := cancel
+		if tt.name == "reschedule" {
+			body = fiber.Map{"dateTime": nextMonday(15).Format(appointmentTimeLayout)}
+		}
+		resp := doRequest(t, app, tt.method, tt.path, token, body)
+		if resp.StatusCode != http.StatusConflict {
+			t.Errorf("%s: status = %d, want %d", tt.name, resp.StatusCode, http.StatusConflict)
+		}
+	}
+
+	var statuses []string
+	db.Model(&Appointment{}).Distinct().Pluck("status", &statuses)
+	if len(statuses) != 1 || statuses[0] != statusScheduled {
+		t.Errorf("statuses = %q, want every appointment still %s", statuses, statusScheduled)
+	}
+	var changes int64
+	db.Model(&AppointmentStatusChange{}).Where("from_status <> ''").Count(&changes)
+	if changes != 0 {
+		t.Errorf("%d status changes recorded, want none", changes)
+	}
+}
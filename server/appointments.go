@@ -1,14 +1,52 @@
 package main
 
-import "github.com/gofiber/fiber/v2"
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Sorting and filtering accepted by getAllAppointments
+var appointmentListSpec = listSpec{
+	sort: map[string]string{
+		"dateTime":  "date_time",
+		"status":    "status",
+		"type":      "type",
+		"createdAt": "created_at",
+	},
+	defaultSort: "dateTime",
+	filters: []listFilter{
+		{"patientId", "patient_id", filterUUID},
+		{"seriesId", "series_id", filterUUID},
+		{"status", "status", filterEquals},
+		{"type", "type", filterEquals},
+		{"from", "date_time", filterFrom},
+		{"to", "date_time", filterTo},
+	},
+}
 
 func getAllAppointments(c *fiber.Ctx) error {
 	var appointments []Appointment
-	result := db.Find(&appointments) // empty condition
-	if result.Error != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch appointments"})
+	query := db.Model(&Appointment{}).Scopes(scopePatientRecords(c)) // caller's patients only
+	meta, err := listPage(c, query, appointmentListSpec, &appointments)
+	if err != nil {
+		return listError(c, err, "Failed to fetch appointments")
 	}
-	return c.JSON(appointments)
+
+	patientIDs := make([]uuid.UUID, len(appointments))
+	for i, appointment := range appointments {
+		patientIDs[i] = appointment.PatientID
+	}
+	auditList(c, "appointment", patientIDs)
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Appointments retrieved successfully",
+		"data":    appointments,
+		"meta":    meta,
+	})
 }
 
 func createAppointment(c *fiber.Ctx) error {
@@ -17,44 +55,212 @@ func createAppointment(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
 	}
 
-	result := db.Create(&appointment)
-	if result.Error != nil {
+	if !canAccessPatient(c, appointment.PatientID) {
+		auditAccess(c, "create", "appointment", "", appointment.PatientID, auditNotFound)
+		return c.Status(404).JSON(fiber.Map{"error": "Patient not found"})
+	}
+
+	// Booked with the caller unless another doctor is given
+	if appointment.DoctorID == uuid.Nil {
+		appointment.DoctorID = defaultDoctorID(c)
+	}
+
+	appointment.Status = normalizeStatus(appointment.Status)
+	if appointment.Status == "" {
+		appointment.Status = statusScheduled
+	}
+	if err := checkInitialStatus(appointment.Status); err != nil {
+		return c.Status(422).JSON(fiber.Map{"error": err.(*fiber.Error).Message})
+	}
+	// Set through the status endpoints only
+	appointment.CancellationReason, appointment.RescheduledFrom = "", nil
+
+	bookingMu.Lock()
+	defer bookingMu.Unlock()
+	if err := checkBooking(appointment); err != nil {
+		auditAccess(c, "create", "appointment", "", appointment.PatientID, auditDenied)
+		return bookingErrorResponse(c, err)
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&appointment).Error; err != nil {
+			return err
+		}
+		return recordStatusChange(tx, c, appointment.ID, "", appointment.Status, "")
+	})
+	if err != nil {
+		auditAccess(c, "create", "appointment", "", appointment.PatientID, auditError)
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to create appointment"})
 	}
 
+	auditAccess(c, "create", "appointment", appointment.ID.String(), appointment.PatientID, auditSuccess)
 	return c.JSON(appointment)
 }
 
 func getAppointment(c *fiber.Ctx) error {
 	id := c.Params("id")
 	var appointment Appointment
-	result := db.First(&appointment, "id = ?", id)
+	result := db.Scopes(scopePatientRecords(c)).First(&appointment, "id = ?", id)
 	if result.Error != nil {
+		auditAccess(c, "read", "appointment", id, uuid.Nil, auditNotFound)
 		return c.Status(404).JSON(fiber.Map{"error": "Appointment not found"})
 	}
 
+	auditAccess(c, "read", "appointment", id, appointment.PatientID, auditSuccess)
 	return c.JSON(appointment)
 }
 
 func updateAppointment(c *fiber.Ctx) error {
 	id := c.Params("id")
+	scope, ok := seriesScope(c)
+	if !ok {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid scope, expected this, following or all"})
+	}
+
 	appointment := new(Appointment)
 	if err := c.BodyParser(appointment); err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
 	}
 
-	result := db.Model(&Appointment{}).Where("id = ?", id).Updates(appointment)
-	if result.Error != nil {
+	// moving an appointment to another patient requires access to that patient too
+	if appointment.PatientID != uuid.Nil && !canAccessPatient(c, appointment.PatientID) {
+		auditAccess(c, "update", "appointment", id, appointment.PatientID, auditNotFound)
+		return c.Status(404).JSON(fiber.Map{"error": "Patient not found"})
+	}
+
+	var existing Appointment
+	if err := db.Scopes(scopePatientRecords(c)).First(&existing, "id = ?", id).Error; err != nil {
+		auditAccess(c, "update", "appointment", id, uuid.Nil, auditNotFound)
+		return c.Status(404).JSON(fiber.Map{"error": "Appointment not found"})
+	}
+
+	if existing.SeriesID != nil && scope != scopeThis {
+		return updateSeriesOccurrences(c, existing, scope)
+	}
+
+	// The appointment as it will be after the update
+	updated := existing
+	if appointment.PatientID != uuid.Nil {
+		updated.PatientID = appointment.PatientID
+	}
+	if appointment.DoctorID != uuid.Nil {
+		updated.DoctorID = appointment.DoctorID
+	}
+	if appointment.DateTime != "" {
+		updated.DateTime = appointment.DateTime
+	}
+	if appointment.Type != "" {
+		updated.Type = appointment.Type
+	}
+	if appointment.Status != "" {
+		updated.Status = normalizeStatus(appointment.Status)
+		appointment.Status = updated.Status
+	}
+	if updated.DoctorID == uuid.Nil {
+		updated.DoctorID = defaultDoctorID(c)
+	}
+
+	// Status changes follow the same lifecycle as the status endpoints
+	statusChanged := updated.Status != existing.Status
+	if statusChanged {
+		if updated.Status == statusRescheduled {
+			return c.Status(422).JSON(fiber.Map{"error": "Use POST /api/appointments/:id/reschedule to reschedule"})
+		}
+		if err := checkTransition(existing.Status, updated.Status); err != nil {
+			return c.Status(422).JSON(fiber.Map{"error": err.(*fiber.Error).Message})
+		}
+		if updated.Status == statusCancelled && strings.TrimSpace(appointment.CancellationReason) == "" {
+			return c.Status(422).JSON(fiber.Map{"error": "A cancellationReason is required to cancel an appointment"})
+		}
+	} else {
+		appointment.CancellationReason = ""
+	}
+	appointment.RescheduledFrom = nil
+
+	bookingMu.Lock()
+	defer bookingMu.Unlock()
+	// Only changes to when, what or with whom need a free slot
+	if updated.PatientID != existing.PatientID || updated.DoctorID != existing.DoctorID ||
+		updated.DateTime != existing.DateTime || updated.Type != existing.Type {
+		if err := checkBooking(&updated); err != nil {
+			auditAccess(c, "update", "appointment", id, existing.PatientID, auditDenied)
+			return bookingErrorResponse(c, err)
+		}
+		appointment.DoctorID = updated.DoctorID
+		appointment.DateTime = updated.DateTime
+		appointment.EndTime = updated.EndTime
+		appointment.Duration = updated.Duration
+		appointment.Type = updated.Type
+	}
+	// Derived from the type, never set directly
+	if appointment.DateTime == "" {
+		appointment.EndTime, appointment.Duration = "", 0
+	}
+
+	from, freed := existing.Status, existing
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if !statusChanged {
+			return tx.Model(&existing).Updates(appointment).Error
+		}
+		// The status endpoints do not take bookingMu, so the status may have
+		// changed since it was read
+		result := tx.Model(&existing).Where("status = ?", from).Updates(appointment)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errStatusChanged
+		}
+		return recordStatusChange(tx, c, existing.ID, from, updated.Status, appointment.CancellationReason)
+	})
+	if err == errStatusChanged {
+		return c.Status(409).JSON(fiber.Map{"error": errStatusChanged.Message})
+	}
+	if err != nil {
+		auditAccess(c, "update", "appointment", id, existing.PatientID, auditError)
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to update appointment"})
 	}
+
+	auditAccess(c, "update", "appointment", id, existing.PatientID, auditSuccess)
+	// A cancelled or moved appointment frees its slot for the waitlist
+	if updated.Status == statusCancelled || updated.DoctorID != freed.DoctorID || updated.DateTime != freed.DateTime {
+		releaseSlot(freed)
+	}
 	return c.SendStatus(204)
 }
 
 func deleteAppointment(c *fiber.Ctx) error {
 	id := c.Params("id")
-	result := db.Delete(&Appointment{}, "id = ?", id)
-	if result.Error != nil {
+	scope, ok := seriesScope(c)
+	if !ok {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid scope, expected this, following or all"})
+	}
+
+	var existing Appointment
+	if err := db.Scopes(scopePatientRecords(c)).First(&existing, "id = ?", id).Error; err != nil {
+		auditAccess(c, "delete", "appointment", id, uuid.Nil, auditNotFound)
+		return c.Status(404).JSON(fiber.Map{"error": "Appointment not found"})
+	}
+
+	if existing.SeriesID != nil && scope != scopeThis {
+		return deleteSeriesOccurrences(c, existing, scope)
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&existing).Error; err != nil {
+			return err
+		}
+		if existing.SeriesID != nil {
+			return addSeriesException(tx, existing)
+		}
+		return nil
+	})
+	if err != nil {
+		auditAccess(c, "delete", "appointment", id, existing.PatientID, auditError)
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete appointment"})
 	}
+
+	auditAccess(c, "delete", "appointment", id, existing.PatientID, auditSuccess)
+	releaseSlot(existing)
 	return c.SendStatus(204) // No Content
 }
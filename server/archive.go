@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Deleting a patient or clinical record archives it: the row is kept with
+// deleted_at set and GORM hides it from normal queries. Archiving a patient
+// archives every record belonging to them with the same timestamp, so
+// restoring the patient brings back exactly the records archived with them.
+
+// Models holding records that belong to a patient
+var patientRecordModels = []interface{}{&Appointment{}, &WaitlistEntry{}, &Medication{}, &MedicationAdministration{}, &RefillRequest{}, &PatientAllergy{}, &HealthMetric{}, &Report{}}
+
+// How long archived records are kept before being purged, 0 keeps them forever
+var retentionPeriod = 90 * 24 * time.Hour
+
+// Apply RETENTION_DAYS, called from main once the environment is loaded
+func loadRetentionConfig() {
+	if v, err := strconv.Atoi(os.Getenv("RETENTION_DAYS")); err == nil && v >= 0 {
+		retentionPeriod = time.Duration(v) * 24 * time.Hour
+	}
+}
+
+// Archive a patient together with all of their records
+func archivePatient(tx *gorm.DB, patientID uuid.UUID) error {
+	// UTC so the stored timestamp compares equal when read back for restore
+	now := time.Now().UTC()
+	for _, model := range patientRecordModels {
+		if err := tx.Model(model).Where("patient_id = ?", patientID).Update("deleted_at", now).Error; err != nil {
+			return err
+		}
+	}
+	return tx.Model(&Patient{}).Where("id = ?", patientID).Update("deleted_at", now).Error
+}
+
+// Restore an archived patient and the records that were archived with them.
+// Records deleted individually before the patient was archived stay archived.
+func restoreArchivedPatient(tx *gorm.DB, patient Patient) error {
+	for _, model := range patientRecordModels {
+		if err := tx.Unscoped().Model(model).
+			Where("patient_id = ? AND deleted_at = ?", patient.ID, patient.DeletedAt.Time).
+			Update("deleted_at", nil).Error; err != nil {
+			return err
+		}
+	}
+	return tx.Unscoped().Model(&Patient{}).Where("id = ?", patient.ID).Update("deleted_at", nil).Error
+}
+
+// Model for a trash record type, as used in the trash routes
+func trashModel(kind string) (interface{}, bool) {
+	switch kind {
+	case "appointments":
+		return &Appointment{}, true
+	case "medications":
+		return &Medication{}, true
+	case "metrics":
+		return &HealthMetric{}, true
+	case "reports":
+		return &Report{}, true
+	}
+	return nil, false
+}
+
+// Query for archived rows only
+func archived(tx *gorm.DB) *gorm.DB {
+	return tx.Unscoped().Where("deleted_at IS NOT NULL")
+}
+
+// Sorting accepted by getTrash
+var trashListSpec = listSpec{
+	sort: map[string]string{
+		"deletedAt": "deleted_at",
+		"createdAt": "created_at",
+	},
+	defaultSort: "-deletedAt",
+	filters: []listFilter{
+		{"deletedFrom", "deleted_at", filterFrom},
+		{"deletedTo", "deleted_at", filterTo},
+	},
+}
+
+// List archived patients or records of the given type, restricted to the
+// caller's patients
+func getTrash(c *fiber.Ctx) error {
+	kind := c.Query("type", "patients")
+
+	var data interface{}
+	var meta fiber.Map
+	var patientIDs []uuid.UUID
+	var err error
+
+	switch kind {
+	case "patients":
+		var patients []Patient
+		meta, err = listPage(c, archived(db.Model(&Patient{}).Scopes(scopePatients(c))), trashListSpec, &patients)
+		for _, p := range patients {
+			patientIDs = append(patientIDs, p.ID)
+		}
+		data = patients
+	case "appointments":
+		var appointments []Appointment
+		meta, err = listPage(c, archived(db.Model(&Appointment{}).Scopes(scopePatientRecords(c))), trashListSpec, &appointments)
+		for _, a := range appointments {
+			patientIDs = append(patientIDs, a.PatientID)
+		}
+		data = appointments
+	case "medications":
+		var medications []Medication
+		meta, err = listPage(c, archived(db.Model(&Medication{}).Scopes(scopePatientRecords(c))), trashListSpec, &medications)
+		for _, m := range medications {
+			patientIDs = append(patientIDs, m.PatientID)
+		}
+		data = medications
+	case "metrics":
+		var metrics []HealthMetric
+		meta, err = listPage(c, archived(db.Model(&HealthMetric{}).Scopes(scopePatientRecords(c))), trashListSpec, &metrics)
+		for _, m := range metrics {
+			patientIDs = append(patientIDs, m.PatientID)
+		}
+		data = metrics
+	case "reports":
+		var reports []Report
+		meta, err = listPage(c, archived(db.Model(&Report{}).Scopes(scopePatientRecords(c))), trashListSpec, &reports)
+		for _, r := range reports {
+			patientIDs = append(patientIDs, r.PatientID)
+		}
+		data = reports
+	default:
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "Unknown type, expected patients, appointments, medications, metrics or reports",
+		})
+	}
+
+	if err != nil {
+		return listError(c, err, "Failed to fetch archived records")
+	}
+
+	auditList(c, "trash:"+kind, patientIDs)
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Archived records retrieved successfully",
+		"data":    data,
+		"meta":    meta,
+	})
+}
+
+// Restore an archived patient, with their records, or a single archived record
+func restoreFromTrash(c *fiber.Ctx) error {
+	kind, id := c.Params("type"), c.Params("id")
+
+	if kind == "patients" {
+		var patient Patient
+		if err := archived(db.Scopes(scopePatients(c))).First(&patient, "id = ?", id).Error; err != nil {
+			auditAccess(c, "restore", "patient", id, uuid.Nil, auditNotFound)
+			return c.Status(404).JSON(fiber.Map{
+				"success": false,
+				"message": "Archived patient not found",
+			})
+		}
+
+		if err := db.Transaction(func(tx *gorm.DB) error {
+			return restoreArchivedPatient(tx, patient)
+		}); err != nil {
+			auditAccess(c, "restore", "patient", id, patient.ID, auditError)
+			return c.Status(500).JSON(fiber.Map{
+				"success": false,
+				"message": "Failed to restore patient",
+			})
+		}
+
+		auditAccess(c, "restore", "patient", id, patient.ID, auditSuccess)
+		reindexPatient(patient.ID)
+		patient.DeletedAt = gorm.DeletedAt{}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"message": "Patient restored",
+			"data":    patient,
+		})
+	}
+
+	model, ok := trashModel(kind)
+	if !ok {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "Unknown type, expected patients, appointments, medications, metrics or reports",
+		})
+	}
+
+	var record struct {
+		PatientID uuid.UUID
+	}
+	if err := archived(db.Model(model).Scopes(scopePatientRecords(c))).Where("id = ?", id).Take(&record).Error; err != nil {
+		auditAccess(c, "restore", kind, id, uuid.Nil, auditNotFound)
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Archived record not found",
+		})
+	}
+
+	// A record cannot come back while its patient is still archived
+	var active int64
+	db.Model(&Patient{}).Where("id = ?", record.PatientID).Count(&active)
+	if active == 0 {
+		return c.Status(409).JSON(fiber.Map{
+			"success": false,
+			"message": "The patient is archived, restore the patient first",
+		})
+	}
+
+	if err := db.Unscoped().Model(model).Where("id = ?", id).Update("deleted_at", nil).Error; err != nil {
+		auditAccess(c, "restore", kind, id, record.PatientID, auditError)
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to restore record",
+		})
+	}
+
+	auditAccess(c, "restore", kind, id, record.PatientID, auditSuccess)
+	reindexPatient(record.PatientID)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Record restored",
+	})
+}
+
+// Permanently delete records archived for longer than the retention period,
+// along with everything belonging to purged patients
+func purgeArchivedRecords() error {
+	cutoff := time.Now().UTC().Add(-retentionPeriod)
+	counts := make(map[string]int64)
+
+	var patientIDs []uuid.UUID
+	if err := db.Unscoped().Model(&Patient{}).Where("deleted_at < ?", cutoff).Pluck("id", &patientIDs).Error; err != nil {
+		return err
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, model := range patientRecordModels {
+			result := tx.Unscoped().Where("deleted_at < ? OR patient_id IN ?", cutoff, patientIDs).Delete(model)
+			if result.Error != nil {
+				return result.Error
+			}
+			counts[result.Statement.Table] += result.RowsAffected
+		}
+		for _, model := range []interface{}{&CareTeamMember{}, &PatientDevice{}} {
+			if err := tx.Where("patient_id IN ?", patientIDs).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		// Series are templates, gone once no occurrence is left
+		if err := tx.Where("id NOT IN (?)", tx.Unscoped().Model(&Appointment{}).Select("series_id").Where("series_id IS NOT NULL")).
+			Delete(&AppointmentSeries{}).Error; err != nil {
+			return err
+		}
+		for _, model := range []interface{}{&AppointmentReminder{}, &AppointmentStatusChange{}} {
+			if err := tx.Where("appointment_id NOT IN (?)", tx.Unscoped().Model(&Appointment{}).Select("id")).
+				Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		for _, model := range []interface{}{&WaitlistWindow{}, &WaitlistOffer{}} {
+			if err := tx.Where("entry_id NOT IN (?)", tx.Unscoped().Model(&WaitlistEntry{}).Select("id")).
+				Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		result := tx.Unscoped().Where("id IN ?", patientIDs).Delete(&Patient{})
+		counts["patients"] = result.RowsAffected
+		return result.Error
+	})
+	if err != nil {
+		return err
+	}
+	dropFromSearchIndex(patientIDs)
+
+	var total int64
+	for _, n := range counts {
+		total += n
+	}
+	if total == 0 {
+		return nil
+	}
+
+	details, _ := json.Marshal(counts)
+	recordAuditEvent(AuditEvent{
+		Action:       "retention.purge",
+		ResourceType: "archive",
+		Outcome:      auditSuccess,
+		Details:      string(details),
+	})
+	log.Printf("Purged %d archived records older than %s", total, cutoff.Format(time.RFC3339))
+	return nil
+}
+
+// Purge expired archived records once an hour
+func runRetentionPurge() {
+	for {
+		time.Sleep(time.Hour)
+
+		if retentionPeriod == 0 {
+			continue
+		}
+		if err := purgeArchivedRecords(); err != nil {
+			log.Printf("ERROR: Failed to purge archived records: %v", err)
+		}
+	}
+}
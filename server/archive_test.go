@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestPurgeArchivedRecords(t *testing.T) {
+	setupTestDB(t)
+	doctor, _ := createTestUser(t, RolePhysician, "password123")
+	purged := createTestPatient(t, "Maria Lopez", doctor)
+	kept := createTestPatient(t, "Robert Jones", doctor)
+
+	for _, p := range []Patient{purged, kept} {
+		appointment := Appointment{PatientID: p.ID, DoctorID: doctor.ID, DateTime: nextMonday(9).Format(appointmentTimeLayout), Status: statusScheduled}
+		if err := db.Create(&appointment).Error; err != nil {
+			t.Fatalf("failed to create an appointment: %v", err)
+		}
+		db.Create(&AppointmentStatusChange{AppointmentID: appointment.ID, ToStatus: statusScheduled, ChangedAt: time.Now()})
+		db.Create(&PatientDevice{ID: uuid.New(), PatientID: p.ID, TokenHash: uuid.NewString(), Label: "Pill dispenser"})
+	}
+	db.Model(&Patient{}).Where("id = ?", purged.ID).Update("deleted_at", time.Now().Add(-retentionPeriod-time.Hour))
+
+	if err := purgeArchivedRecords(); err != nil {
+		t.Fatalf("purge failed: %v", err)
+	}
+
+	for _, model := range []interface{}{&Appointment{}, &CareTeamMember{}, &PatientDevice{}} {
+		var purgedRows, keptRows int64
+		db.Unscoped().Model(model).Where("patient_id = ?", purged.ID).Count(&purgedRows)
+		db.Unscoped().Model(model).Where("patient_id = ?", kept.ID).Count(&keptRows)
+		if purgedRows != 0 || keptRows == 0 {
+			t.Errorf("%T: %d rows of the purged patient and %d of the other, want 0 and some", model, purgedRows, keptRows)
+		}
+	}
+
+	var changes []AppointmentStatusChange
+	db.Find(&changes)
+	if len(changes) != 1 {
+		t.Fatalf("%d status changes left, want 1", len(changes))
+	}
+	var appointment Appointment
+	if err := db.First(&appointment, "id = ?", changes[0].AppointmentID).Error; err != nil || appointment.PatientID != kept.ID {
+		t.Errorf("the status change left belongs to %v, want an appointment of the other patient", changes[0].AppointmentID)
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Outcomes recorded on audit events
+const (
+	auditSuccess  = "success"
+	auditNotFound = "not_found"
+	auditDenied   = "denied"
+	auditError    = "error"
+)
+
+var errAuditAppendOnly = errors.New("audit log is append-only")
+
+// Serializes appends so each event chains onto the one before it
+var auditMu sync.Mutex
+
+// Hash of an event's contents chained onto the previous event's hash. Keyed
+// with AUDIT_CHAIN_KEY when set, so the chain cannot be recomputed by someone
+// with only database access.
+func auditHash(e AuditEvent) string {
+	var h hash.Hash
+	if key := os.Getenv("AUDIT_CHAIN_KEY"); key != "" {
+		h = hmac.New(sha256.New, []byte(key))
+	} else {
+		h = sha256.New()
+	}
+
+	optional := func(id *uuid.UUID) string {
+		if id == nil {
+			return ""
+		}
+		return id.String()
+	}
+
+	fields := []string{
+		e.PrevHash,
+		e.Timestamp.UTC().Format(time.RFC3339Nano),
+		optional(e.ActorID),
+		e.ActorEmail,
+		e.Action,
+		e.ResourceType,
+		e.ResourceID,
+		optional(e.PatientID),
+		e.IP,
+		e.Outcome,
+		e.Details,
+	}
+	for _, f := range fields {
+		// Length-prefix each field so values cannot bleed into each other
+		fmt.Fprintf(h, "%d:%s;", len(f), f)
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Append an event to the audit log. Failures are logged rather than returned
+// so auditing never breaks the request being audited.
+func recordAuditEvent(event AuditEvent) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+	// Stored timestamps round-trip at microsecond precision
+	event.Timestamp = event.Timestamp.UTC().Truncate(time.Microsecond)
+	if event.PatientID != nil && *event.PatientID == uuid.Nil {
+		event.PatientID = nil
+	}
+
+	var last AuditEvent
+	db.Select("hash").Order("id DESC").Limit(1).Find(&last)
+	event.PrevHash = last.Hash
+	event.Hash = auditHash(event)
+
+	if err := db.Create(&event).Error; err != nil {
+		log.Printf("ERROR: Failed to record audit event %s: %v", event.Action, err)
+	}
+}
+
+// Record an access to patient data by the authenticated caller
+func auditAccess(c *fiber.Ctx, action, resourceType, resourceID string, patientID uuid.UUID, outcome string) {
+	actorID := currentDoctorID(c)
+	email, _ := c.Locals("email").(string)
+	recordAuditEvent(AuditEvent{
+		ActorID:      &actorID,
+		ActorEmail:   email,
+		Action:       action,
+		ResourceType: resourceType,
+		ResourceID:   resourceID,
+		PatientID:    &patientID,
+		IP:           c.IP(),
+		Outcome:      outcome,
+	})
+}
+
+// Record a listing of patient data, noting which patients' records were returned
+func auditList(c *fiber.Ctx, resourceType string, patientIDs []uuid.UUID) {
+	seen := make(map[uuid.UUID]bool)
+	unique := make([]uuid.UUID, 0, len(patientIDs))
+	for _, id := range patientIDs {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+
+	details, _ := json.Marshal(fiber.Map{
+		"count":      len(patientIDs),
+		"patientIds": unique,
+	})
+
+	actorID := currentDoctorID(c)
+	email, _ := c.Locals("email").(string)
+	event := AuditEvent{
+		ActorID:      &actorID,
+		ActorEmail:   email,
+		Action:       "list",
+		ResourceType: resourceType,
+		IP:           c.IP(),
+		Outcome:      auditSuccess,
+		Details:      string(details),
+	}
+	// A listing for a single patient is attributed to that patient
+	if len(unique) == 1 {
+		event.PatientID = &unique[0]
+	}
+	recordAuditEvent(event)
+}
+
+// Hash any events recorded before hash-chaining existed and install triggers
+// that reject changes to the audit table. Runs once at startup.
+func sealAuditLog() error {
+	var unsealed []AuditEvent
+	if err := db.Where("hash = ''").Order("id").Find(&unsealed).Error; err != nil {
+		return err
+	}
+
+	if len(unsealed) > 0 {
+		var prev AuditEvent
+		db.Select("hash").Where("id < ? AND hash <> ''", unsealed[0].ID).Order("id DESC").Limit(1).Find(&prev)
+		prevHash := prev.Hash
+
+		for _, event := range unsealed {
+			event.Timestamp = event.Timestamp.UTC().Truncate(time.Microsecond)
+			event.PrevHash = prevHash
+			event.Hash = auditHash(event)
+			if err := db.Session(&gorm.Session{SkipHooks: true}).Model(&AuditEvent{}).Where("id = ?", event.ID).
+				Updates(map[string]interface{}{
+					"timestamp": event.Timestamp,
+					"prev_hash": event.PrevHash,
+					"hash":      event.Hash,
+				}).Error; err != nil {
+				return err
+			}
+			prevHash = event.Hash
+		}
+		log.Printf("Sealed %d audit events into the hash chain", len(unsealed))
+	}
+
+	for _, stmt := range []string{
+		`CREATE TRIGGER IF NOT EXISTS audit_events_no_update BEFORE UPDATE ON audit_events
+		BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END`,
+		`CREATE TRIGGER IF NOT EXISTS audit_events_no_delete BEFORE DELETE ON audit_events
+		BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END`,
+	} {
+		if err := db.Exec(stmt).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply the query string filters shared by the audit listing and export
+func auditQuery(c *fiber.Ctx) (*gorm.DB, error) {
+	query := db.Model(&AuditEvent{})
+
+	if patientID := c.Query("patientId"); patientID != "" {
+		query = query.Where("patient_id = ?", patientID)
+	}
+	if actorID := c.Query("actorId"); actorID != "" {
+		query = query.Where("actor_id = ?", actorID)
+	}
+	if action := c.Query("action"); action != "" {
+		query = query.Where("action = ?", action)
+	}
+	if resourceType := c.Query("resourceType"); resourceType != "" {
+		query = query.Where("resource_type = ?", resourceType)
+	}
+	if from := c.Query("from"); from != "" {
+		t, err := time.Parse(time.RFC3339, from)
+		if err != nil {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid 'from' timestamp, expected RFC 3339")
+		}
+		query = query.Where("timestamp >= ?", t.UTC())
+	}
+	if to := c.Query("to"); to != "" {
+		t, err := time.Parse(time.RFC3339, to)
+		if err != nil {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid 'to' timestamp, expected RFC 3339")
+		}
+		query = query.Where("timestamp < ?", t.UTC())
+	}
+
+	return query, nil
+}
+
+// Record that the audit log itself was read
+func auditAuditAccess(c *fiber.Ctx, action string) {
+	actorID := currentDoctorID(c)
+	email, _ := c.Locals("email").(string)
+	recordAuditEvent(AuditEvent{
+		ActorID:      &actorID,
+		ActorEmail:   email,
+		Action:       action,
+		ResourceType: "audit_log",
+		IP:           c.IP(),
+		Outcome:      auditSuccess,
+		Details:      c.Request().URI().QueryArgs().String(),
+	})
+}
+
+// Query the audit log, filtered by patient, actor, action or time range
+func getAuditEvents(c *fiber.Ctx) error {
+	query, err := auditQuery(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": err.(*fiber.Error).Message,
+		})
+	}
+
+	limit, _ := strconv.Atoi(c.Query("limit", "100"))
+	if limit < 1 || limit > 1000 {
+		limit = 100
+	}
+	offset, _ := strconv.Atoi(c.Query("offset", "0"))
+	if offset < 0 {
+		offset = 0
+	}
+
+	var total int64
+	query.Count(&total)
+
+	var events []AuditEvent
+	if err := query.Order("id DESC").Limit(limit).Offset(offset).Find(&events).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to fetch audit events",
+		})
+	}
+
+	auditAuditAccess(c, "audit.read")
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Audit events retrieved successfully",
+		"data":    events,
+		"meta": fiber.Map{
+			"total":  total,
+			"limit":  limit,
+			"offset": offset,
+		},
+	})
+}
+
+// Export the audit log as CSV or JSON, with the same filters as the listing
+func exportAuditEvents(c *fiber.Ctx) error {
+	query, err := auditQuery(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": err.(*fiber.Error).Message,
+		})
+	}
+
+	var events []AuditEvent
+	if err := query.Order("id").Find(&events).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to export audit events",
+		})
+	}
+
+	auditAuditAccess(c, "audit.export")
+
+	filename := "audit-" + time.Now().Format("20060102-150405")
+	if c.Query("format", "csv") == "json" {
+		c.Set("Content-Disposition", `attachment; filename="`+filename+`.json"`)
+		return c.JSON(events)
+	}
+
+	c.Set("Content-Type", "text/csv")
+	c.Set("Content-Disposition", `attachment; filename="`+filename+`.csv"`)
+
+	w := csv.NewWriter(c)
+	w.Write([]string{"id", "timestamp", "actor_id", "actor_email", "action", "resource_type", "resource_id", "patient_id", "ip", "outcome", "details", "prev_hash", "hash"})
+	for _, e := range events {
+		actorID, patientID := "", ""
+		if e.ActorID != nil {
+			actorID = e.ActorID.String()
+		}
+		if e.PatientID != nil {
+			patientID = e.PatientID.String()
+		}
+		w.Write([]string{
+			strconv.FormatUint(uint64(e.ID), 10),
+			e.Timestamp.UTC().Format(time.RFC3339Nano),
+			actorID, e.ActorEmail, e.Action, e.ResourceType, e.ResourceID, patientID,
+			e.IP, e.Outcome, e.Details, e.PrevHash, e.Hash,
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// Walk the whole chain and report the first event whose hash does not match
+func verifyAuditLog(c *fiber.Ctx) error {
+	var events []AuditEvent
+	if err := db.Order("id").Find(&events).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to read audit log",
+		})
+	}
+
+	prevHash := ""
+	for _, e := range events {
+		if e.PrevHash != prevHash || auditHash(e) != e.Hash {
+			return c.JSON(fiber.Map{
+				"success": true,
+				"message": "Audit log has been tampered with",
+				"data": fiber.Map{
+					"valid":    false,
+					"checked":  len(events),
+					"brokenAt": e.ID,
+				},
+			})
+		}
+		prevHash = e.Hash
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Audit log is intact",
+		"data": fiber.Map{
+			"valid":   true,
+			"checked": len(events),
+		},
+	})
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"log"
 	"os"
 	"time"
 
@@ -17,9 +18,12 @@ func init() {
 	}
 }
 
+// Bcrypt work factor for password hashes, lowered in tests
+var bcryptCost = 14
+
 // Password hashing with bcrypt
 func hashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
+	bytes, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
 	return string(bytes), err
 }
 
@@ -29,8 +33,9 @@ func checkPasswordHash(password, hash string) bool {
 	return err == nil
 }
 
-// Generate JWT token with custom claims
-func generateToken(doctor Doctor) (string, error) {
+// Generate JWT token with custom claims. mfa records whether the session
+// passed two-factor authentication.
+func generateToken(doctor Doctor, mfa bool) (string, error) {
 	// Create a new token object
 	token := jwt.New(jwt.SigningMethodHS256)
 
@@ -40,7 +45,10 @@ func generateToken(doctor Doctor) (string, error) {
 	claims["email"] = doctor.Email
 	claims["name"] = doctor.Name
 	claims["specialization"] = doctor.Specialization
-	claims["exp"] = time.Now().Add(time.Hour * 72).Unix() // 3 days expiration
+	claims["role"] = doctor.Role
+	claims["mfa"] = mfa
+	claims["emailVerified"] = doctor.EmailVerifiedAt != nil
+	claims["exp"] = time.Now().Add(accessTokenTTL).Unix() // short-lived, renewed with a refresh token
 
 	// Generate signed token
 	t, err := token.SignedString(jwtSecret)
@@ -69,10 +77,17 @@ func login(c *fiber.Ctx) error {
 		})
 	}
 
+	// Per-account throttling, checked before the password so it stays cheap
+	if blocked, err := rejectLockedLogin(c, req.Email); blocked {
+		return err
+	}
+
 	// Find doctor by email
 	var doctor Doctor
 	result := db.Where("email = ?", req.Email).First(&doctor)
 	if result.Error != nil {
+		// Unknown emails are tracked too so lockouts don't reveal which accounts exist
+		recordLoginFailure(c, req.Email)
 		return c.Status(401).JSON(fiber.Map{
 			"success": false,
 			"message": "Invalid email or password",
@@ -81,14 +96,37 @@ func login(c *fiber.Ctx) error {
 
 	// Verify password
 	if !checkPasswordHash(req.Password, doctor.Password) {
+		recordLoginFailure(c, req.Email)
 		return c.Status(401).JSON(fiber.Map{
 			"success": false,
 			"message": "Invalid email or password",
 		})
 	}
 
-	// Generate JWT token
-	token, err := generateToken(doctor)
+	// Enrolled accounts must complete the second step at /api/auth/login/2fa
+	if doctor.TOTPEnabled {
+		mfaToken, err := generateMFAChallenge(doctor)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"success": false,
+				"message": "Authentication failed, please try again",
+			})
+		}
+
+		return c.JSON(fiber.Map{
+			"success": true,
+			"message": "Two-factor authentication required",
+			"data": fiber.Map{
+				"mfaRequired": true,
+				"mfaToken":    mfaToken,
+			},
+		})
+	}
+
+	accountLockout.recordSuccess(req.Email)
+
+	// Generate access and refresh tokens
+	token, refreshToken, err := issueTokens(c, doctor, false)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"success": false,
@@ -103,8 +141,11 @@ func login(c *fiber.Ctx) error {
 		"success": true,
 		"message": "Login successful",
 		"data": fiber.Map{
-			"token": token,
-			"user": doctor,
+			"token":                 token,
+			"refreshToken":          refreshToken,
+			"expiresIn":             int(accessTokenTTL.Seconds()),
+			"user":                  doctor,
+			"mfaEnrollmentRequired": getSecurityPolicy().Require2FA,
 		},
 	})
 }
@@ -153,6 +194,7 @@ func signup(c *fiber.Ctx) error {
 		Name:           req.Name,
 		Specialization: req.Specialization,
 		LicenseNumber:  req.LicenseNumber,
+		Role:           RolePhysician,
 		CreatedAt:      time.Now(),
 		UpdatedAt:      time.Now(),
 	}
@@ -166,8 +208,13 @@ func signup(c *fiber.Ctx) error {
 		})
 	}
 
-	// Generate JWT token
-	token, err := generateToken(doctor)
+	// Unverified accounts can log in but not reach clinical data
+	if err := sendVerificationEmail(doctor); err != nil {
+		log.Printf("ERROR: Failed to send verification email to %s: %v", doctor.Email, err)
+	}
+
+	// Generate access and refresh tokens
+	token, refreshToken, err := issueTokens(c, doctor, false)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"success": false,
@@ -182,8 +229,10 @@ func signup(c *fiber.Ctx) error {
 		"success": true,
 		"message": "Account created successfully",
 		"data": fiber.Map{
-			"token": token,
-			"user": doctor,
+			"token":        token,
+			"refreshToken": refreshToken,
+			"expiresIn":    int(accessTokenTTL.Seconds()),
+			"user":         doctor,
 		},
 	})
 }
@@ -218,20 +267,35 @@ func getCurrentUser(c *fiber.Ctx) error {
 	})
 }
 
-// Refresh token endpoint
+// Refresh token endpoint, exchanges a refresh token for a new token pair
 func refreshToken(c *fiber.Ctx) error {
-	// Get doctor ID from middleware
-	doctorId, ok := c.Locals("doctorId").(uuid.UUID)
-	if !ok {
+	req := new(struct {
+		RefreshToken string `json:"refreshToken"`
+	})
+	if err := c.BodyParser(req); err != nil || req.RefreshToken == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "Refresh token is required",
+		})
+	}
+
+	record, newRefreshToken, err := rotateRefreshToken(c, req.RefreshToken)
+	if err == errRefreshTokenInvalid || err == errRefreshTokenReused {
 		return c.Status(401).JSON(fiber.Map{
 			"success": false,
-			"message": "Authentication required",
+			"message": "Invalid or expired refresh token",
+		})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to refresh token",
 		})
 	}
 
 	// Find doctor in database
 	var doctor Doctor
-	result := db.First(&doctor, "id = ?", doctorId)
+	result := db.First(&doctor, "id = ?", record.DoctorID)
 	if result.Error != nil {
 		return c.Status(404).JSON(fiber.Map{
 			"success": false,
@@ -239,8 +303,8 @@ func refreshToken(c *fiber.Ctx) error {
 		})
 	}
 
-	// Generate new token
-	token, err := generateToken(doctor)
+	// Generate new access token, picking up any role changes
+	token, err := generateToken(doctor, record.MFA)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"success": false,
@@ -252,7 +316,53 @@ func refreshToken(c *fiber.Ctx) error {
 		"success": true,
 		"message": "Token refreshed",
 		"data": fiber.Map{
-			"token": token,
+			"token":        token,
+			"refreshToken": newRefreshToken,
+			"expiresIn":    int(accessTokenTTL.Seconds()),
 		},
 	})
 }
+
+// Logout endpoint, revokes the session the refresh token belongs to
+func logout(c *fiber.Ctx) error {
+	req := new(struct {
+		RefreshToken string `json:"refreshToken"`
+	})
+	if err := c.BodyParser(req); err != nil || req.RefreshToken == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "Refresh token is required",
+		})
+	}
+
+	// Unknown tokens are treated as already logged out
+	var record RefreshToken
+	if err := db.Where("token_hash = ?", hashToken(req.RefreshToken)).First(&record).Error; err == nil {
+		if err := revokeTokenFamily(record.FamilyID); err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"success": false,
+				"message": "Failed to log out",
+			})
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Logged out",
+	})
+}
+
+// Logout endpoint for every session of the current user
+func logoutAll(c *fiber.Ctx) error {
+	if err := revokeAllTokens(currentDoctorID(c)); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to log out",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Logged out of all sessions",
+	})
+}
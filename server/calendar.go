@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Appointments are exported as iCalendar (RFC 5545) events, either one at a
+// time, as a calendar for the authenticated user, or through a subscribable
+// feed URL that calendar apps poll without logging in. Feeds identify patients
+// by initials only, unless full names are turned on or patients left out.
+
+// How feeds show patients: "full" names, "initials" or "none"
+var calendarFeedPatientNames = "initials"
+
+// Span of appointments in calendars, around the current time
+const (
+	calendarPast   = 30 * 24 * time.Hour
+	calendarFuture = 365 * 24 * time.Hour
+)
+
+// Apply CALENDAR_FEED_PATIENT_NAMES, called from main once the environment is loaded
+func loadCalendarConfig() {
+	switch v := os.Getenv("CALENDAR_FEED_PATIENT_NAMES"); v {
+	case "":
+	case "full", "initials", "none":
+		calendarFeedPatientNames = v
+	default:
+		log.Printf("WARN: Unknown CALENDAR_FEED_PATIENT_NAMES %q, using %q", v, calendarFeedPatientNames)
+	}
+}
+
+// Initials of a name, e.g. "J.D." for "John Doe"
+func nameInitials(name string) string {
+	var initials strings.Builder
+	for _, part := range strings.Fields(name) {
+		r, _ := utf8.DecodeRuneInString(part)
+		initials.WriteString(strings.ToUpper(string(r)) + ".")
+	}
+	return initials.String()
+}
+
+// Builds an iCalendar object
+type icsWriter struct {
+	b strings.Builder
+}
+
+// Write a content line, folded at 75 octets as RFC 5545 requires
+func (w *icsWriter) line(name, value string) {
+	s := name + ":" + value
+	limit := 75
+	for len(s) > limit {
+		// Never split a UTF-8 sequence
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		w.b.WriteString(s[:cut] + "\r\n ")
+		s = s[cut:]
+		limit = 74 // continuation lines start with a space
+	}
+	w.b.WriteString(s + "\r\n")
+}
+
+// Escape a TEXT value
+func icsText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+func icsTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// Convert a stored clinic local time to an instant
+func appointmentInstant(s string) (time.Time, error) {
+	t, err := parseAppointmentTime(s)
+	if err != nil {
+		return t, err
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.Local), nil
+}
+
+// Render appointments as a calendar, showing each patient as label returns
+func renderCalendar(name string, appointments []Appointment, label func(Appointment) string) []byte {
+	w := &icsWriter{}
+	w.line("BEGIN", "VCALENDAR")
+	w.line("VERSION", "2.0")
+	w.line("PRODID", "-//MedThing//Appointments//EN")
+	w.line("CALSCALE", "GREGORIAN")
+	w.line("METHOD", "PUBLISH")
+	w.line("X-WR-CALNAME", icsText(name))
+
+	appURL := os.Getenv("APP_URL")
+	if appURL == "" {
+		appURL = "http://localhost:3000"
+	}
+
+	for _, a := range appointments {
+		start, err := appointmentInstant(a.DateTime)
+		if err != nil {
+			continue
+		}
+		end, err := appointmentInstant(a.EndTime)
+		if err != nil || !end.After(start) {
+			end = start.Add(30 * time.Minute)
+		}
+
+		summary := a.Type
+		if patient := label(a); patient != "" {
+			summary += " - " + patient
+		}
+		status := "CONFIRMED"
+		switch a.Status {
+		case statusRequested:
+			status = "TENTATIVE"
+		case statusCancelled, statusNoShow, statusRescheduled:
+			status = "CANCELLED"
+		}
+
+		w.line("BEGIN", "VEVENT")
+		w.line("UID", a.ID.String()+"@medthing")
+		w.line("DTSTAMP", icsTime(a.UpdatedAt))
+		w.line("LAST-MODIFIED", icsTime(a.UpdatedAt))
+		w.line("DTSTART", icsTime(start))
+		w.line("DTEND", icsTime(end))
+		w.line("SUMMARY", icsText(summary))
+		w.line("STATUS", status)
+		w.line("URL", appURL+"/appointments/"+a.ID.String())
+		w.line("END", "VEVENT")
+	}
+
+	w.line("END", "VCALENDAR")
+	return []byte(w.b.String())
+}
+
+// Send a calendar response
+func sendCalendar(c *fiber.Ctx, filename string, body []byte) error {
+	c.Set(fiber.HeaderContentType, "text/calendar; charset=utf-8")
+	if filename != "" {
+		c.Set(fiber.HeaderContentDisposition, `attachment; filename="`+filename+`"`)
+	}
+	return c.Send(body)
+}
+
+// Limit a query to the default calendar span, oldest first
+func calendarWindow(tx *gorm.DB) *gorm.DB {
+	now := clinicNow()
+	return tx.Where("datetime(date_time) >= datetime(?) AND datetime(date_time) <= datetime(?)",
+		now.Add(-calendarPast).Format(sqliteTimeLayout), now.Add(calendarFuture).Format(sqliteTimeLayout)).
+		Order("date_time")
+}
+
+// Export a single appointment as an .ics file
+func exportAppointmentICS(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var appointment Appointment
+	if err := db.Scopes(scopePatientRecords(c)).Preload("Patient").First(&appointment, "id = ?", id).Error; err != nil {
+		auditAccess(c, "read", "appointment", id, uuid.Nil, auditNotFound)
+		return c.Status(404).JSON(fiber.Map{"error": "Appointment not found"})
+	}
+
+	auditAccess(c, "export", "appointment", id, appointment.PatientID, auditSuccess)
+	body := renderCalendar("MedThing appointment", []Appointment{appointment}, func(a Appointment) string {
+		return a.Patient.Name
+	})
+	return sendCalendar(c, "appointment-"+id+".ics", body)
+}
+
+// Calendar of the caller's appointments, or another doctor's with doctorId
+func getAppointmentCalendar(c *fiber.Ctx) error {
+	query := db.Model(&Appointment{}).Scopes(scopePatientRecords(c))
+	if c.Query("doctorId") == "" {
+		query = query.Where("doctor_id = ?", currentDoctorID(c))
+	}
+	query, err := applyListFilters(c, query, listSpec{filters: []listFilter{
+		{"doctorId", "doctor_id", filterUUID},
+		{"from", "date_time", filterFrom},
+		{"to", "date_time", filterTo},
+	}})
+	if err != nil {
+		return listError(c, err, "Failed to fetch appointments")
+	}
+	if c.Query("from") == "" && c.Query("to") == "" {
+		query = calendarWindow(query)
+	} else {
+		query = query.Order("date_time")
+	}
+
+	var appointments []Appointment
+	if err := query.Preload("Patient").Limit(5000).Find(&appointments).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to fetch appointments",
+		})
+	}
+
+	patientIDs := make([]uuid.UUID, len(appointments))
+	for i, a := range appointments {
+		patientIDs[i] = a.PatientID
+	}
+	auditList(c, "appointment", patientIDs)
+
+	body := renderCalendar("MedThing appointments", appointments, func(a Appointment) string {
+		return a.Patient.Name
+	})
+	return sendCalendar(c, "appointments.ics", body)
+}
+
+// Create a feed URL for the caller's calendar app. The URL is only shown once.
+func createCalendarFeed(c *fiber.Ctx) error {
+	req := new(struct {
+		Label string `json:"label"`
+	})
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(req); err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"success": false,
+				"message": "Invalid request body",
+			})
+		}
+	}
+
+	token, err := generateOpaqueToken()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to create calendar feed",
+		})
+	}
+	feed := CalendarFeed{
+		ID:        uuid.New(),
+		DoctorID:  currentDoctorID(c),
+		TokenHash: hashToken(token),
+		Label:     req.Label,
+	}
+	if err := db.Create(&feed).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to create calendar feed",
+		})
+	}
+
+	auditAccess(c, "create", "calendar_feed", feed.ID.String(), uuid.Nil, auditSuccess)
+	return c.Status(201).JSON(fiber.Map{
+		"success": true,
+		"message": "Calendar feed created, the URL will not be shown again",
+		"data": fiber.Map{
+			"feed": feed,
+			"url":  c.BaseURL() + "/api/calendar/feed/" + token + ".ics",
+		},
+	})
+}
+
+// List the caller's calendar feeds
+func getCalendarFeeds(c *fiber.Ctx) error {
+	var feeds []CalendarFeed
+	if err := db.Where("doctor_id = ?", currentDoctorID(c)).Order("created_at").Find(&feeds).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to fetch calendar feeds",
+		})
+	}
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Calendar feeds retrieved successfully",
+		"data":    feeds,
+	})
+}
+
+// Revoke one of the caller's calendar feeds, its URL stops working at once
+func revokeCalendarFeed(c *fiber.Ctx) error {
+	id := c.Params("id")
+	result := db.Model(&CalendarFeed{}).
+		Where("id = ? AND doctor_id = ? AND revoked_at IS NULL", id, currentDoctorID(c)).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to revoke calendar feed",
+		})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Calendar feed not found",
+		})
+	}
+
+	auditAccess(c, "revoke", "calendar_feed", id, uuid.Nil, auditSuccess)
+	return c.SendStatus(204)
+}
+
+// Serve a doctor's appointments to a calendar app. Public, the token in the
+// URL authenticates the request.
+func serveCalendarFeed(c *fiber.Ctx) error {
+	token := strings.TrimSuffix(c.Params("token"), ".ics")
+
+	var feed CalendarFeed
+	if err := db.Where("token_hash = ? AND revoked_at IS NULL", hashToken(token)).First(&feed).Error; err != nil {
+		return c.Status(404).SendString("Calendar not found")
+	}
+	var doctor Doctor
+	if err := db.First(&doctor, "id = ?", feed.DoctorID).Error; err != nil {
+		return c.Status(404).SendString("Calendar not found")
+	}
+
+	var appointments []Appointment
+	query := calendarWindow(db.Where("doctor_id = ?", feed.DoctorID))
+	if calendarFeedPatientNames != "none" {
+		query = query.Preload("Patient")
+	}
+	if err := query.Find(&appointments).Error; err != nil {
+		return c.Status(500).SendString("Failed to load calendar")
+	}
+
+	now := time.Now()
+	db.Model(&feed).Update("last_used_at", &now)
+
+	// The feed discloses patient names and appointment times to whoever holds the URL
+	patientIDs := make([]uuid.UUID, 0, len(appointments))
+	seen := make(map[uuid.UUID]bool)
+	for _, a := range appointments {
+		if !seen[a.PatientID] {
+			seen[a.PatientID] = true
+			patientIDs = append(patientIDs, a.PatientID)
+		}
+	}
+	details, _ := json.Marshal(fiber.Map{
+		"count":        len(appointments),
+		"patientIds":   patientIDs,
+		"patientNames": calendarFeedPatientNames,
+	})
+	recordAuditEvent(AuditEvent{
+		ActorID:      &doctor.ID,
+		ActorEmail:   doctor.Email,
+		Action:       "calendar.feed",
+		ResourceType: "calendar_feed",
+		ResourceID:   feed.ID.String(),
+		IP:           c.IP(),
+		Outcome:      auditSuccess,
+		Details:      string(details),
+	})
+
+	body := renderCalendar("MedThing - "+doctor.Name, appointments, func(a Appointment) string {
+		switch calendarFeedPatientNames {
+		case "full":
+			return a.Patient.Name
+		case "initials":
+			return nameInitials(a.Patient.Name)
+		}
+		return ""
+	})
+	return sendCalendar(c, "", body)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+func TestICSLineFolding(t *testing.T) {
+	// The 75th octet falls within the first "Ü"
+	value := strings.Repeat("x", 66) + strings.Repeat("Ü", 60)
+	w := &icsWriter{}
+	w.line("SUMMARY", value)
+	out := w.b.String()
+
+	if !strings.HasSuffix(out, "\r\n") {
+		t.Fatalf("line %q does not end with CRLF", out)
+	}
+	for i, l := range strings.Split(strings.TrimSuffix(out, "\r\n"), "\r\n") {
+		if len(l) > 75 {
+			t.Errorf("line %d is %d octets, want at most 75", i, len(l))
+		}
+		if i > 0 && !strings.HasPrefix(l, " ") {
+			t.Errorf("continuation line %d %q does not start with a space", i, l)
+		}
+		if !utf8.ValidString(l) {
+			t.Errorf("line %d %q splits a UTF-8 sequence", i, l)
+		}
+	}
+	if unfolded := strings.ReplaceAll(out, "\r\n ", ""); unfolded != "SUMMARY:"+value+"\r\n" {
+		t.Errorf("unfolded line = %q, want the value back", unfolded)
+	}
+}
+
+func TestICSText(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Follow-up", "Follow-up"},
+		{"Doe, John; ref C:\\files", `Doe\, John\; ref C:\\files`},
+		{"line one\r\nline two\nline three", `line one\nline two\nline three`},
+	}
+	for _, tt := range tests {
+		if got := icsText(tt.in); got != tt.want {
+			t.Errorf("icsText(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNameInitials(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"John Doe", "J.D."},
+		{"  ada   lovelace ", "A.L."},
+		{"Élodie Ørsted", "É.Ø."},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := nameInitials(tt.in); got != tt.want {
+			t.Errorf("nameInitials(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRenderCalendarStatuses(t *testing.T) {
+	tests := []struct {
+		status string
+		want   string
+	}{
+		{statusRequested, "STATUS:TENTATIVE"},
+		{statusScheduled, "STATUS:CONFIRMED"},
+		{statusCheckedIn, "STATUS:CONFIRMED"},
+		{statusCancelled, "STATUS:CANCELLED"},
+		{statusNoShow, "STATUS:CANCELLED"},
+		{statusRescheduled, "STATUS:CANCELLED"},
+	}
+	for _, tt := range tests {
+		a := Appointment{ID: uuid.New(), DateTime: "2025-06-02T09:00", EndTime: "2025-06-02T09:45", Type: "Consultation", Status: tt.status}
+		out := string(renderCalendar("Dr. Doe", []Appointment{a}, func(Appointment) string { return "Doe, J." }))
+		if !strings.Contains(out, "\r\n"+tt.want+"\r\n") {
+			t.Errorf("%s appointment: calendar lacks %s:\n%s", tt.status, tt.want, out)
+		}
+		if !strings.Contains(out, "\r\nSUMMARY:Consultation - Doe\\, J.\r\n") {
+			t.Errorf("%s appointment: summary not escaped:\n%s", tt.status, out)
+		}
+		if !strings.Contains(out, "\r\nUID:"+a.ID.String()+"@medthing\r\n") {
+			t.Errorf("%s appointment: calendar lacks the appointment's UID", tt.status)
+		}
+	}
+}
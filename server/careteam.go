@@ -0,0 +1,213 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Get the authenticated doctor's ID set by the protected() middleware
+func currentDoctorID(c *fiber.Ctx) uuid.UUID {
+	doctorID, _ := c.Locals("doctorId").(uuid.UUID)
+	return doctorID
+}
+
+// Subquery selecting the IDs of every patient on the caller's care teams
+func careTeamPatientIDs(c *fiber.Ctx) *gorm.DB {
+	return db.Model(&CareTeamMember{}).Select("patient_id").Where("doctor_id = ?", currentDoctorID(c))
+}
+
+// Scope for Patient queries, restricting results to the caller's patients
+func scopePatients(c *fiber.Ctx) func(*gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		if hasPermission(c, PermPatientsAll) {
+			return tx
+		}
+		return tx.Where("patients.id IN (?)", careTeamPatientIDs(c))
+	}
+}
+
+// Scope for tables with a patient_id column (appointments, medications, metrics, reports)
+func scopePatientRecords(c *fiber.Ctx) func(*gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		if hasPermission(c, PermPatientsAll) {
+			return tx
+		}
+		return tx.Where("patient_id IN (?)", careTeamPatientIDs(c))
+	}
+}
+
+// Check whether the caller is on the care team of the given patient, or may
+// see every patient. Archived patients are not accessible.
+func canAccessPatient(c *fiber.Ctx, patientID uuid.UUID) bool {
+	var count int64
+	db.Model(&Patient{}).Scopes(scopePatients(c)).Where("id = ?", patientID).Count(&count)
+	return count > 0
+}
+
+// Assign patients without any care team to the given doctor. Used once at
+// startup so records created before care teams existed are not orphaned.
+func claimOrphanedPatients(doctorEmail string) (int64, error) {
+	var doctor Doctor
+	if err := db.Where("email = ?", doctorEmail).First(&doctor).Error; err != nil {
+		return 0, err
+	}
+
+	var orphanIDs []uuid.UUID
+	if err := db.Model(&Patient{}).
+		Where("id NOT IN (?)", db.Model(&CareTeamMember{}).Select("patient_id")).
+		Pluck("id", &orphanIDs).Error; err != nil {
+		return 0, err
+	}
+
+	for _, patientID := range orphanIDs {
+		member := CareTeamMember{
+			PatientID: patientID,
+			DoctorID:  doctor.ID,
+			Role:      "primary",
+			CreatedAt: time.Now(),
+		}
+		if err := db.Create(&member).Error; err != nil {
+			return 0, err
+		}
+	}
+
+	return int64(len(orphanIDs)), nil
+}
+
+// Get the care team for a patient
+func getCareTeam(c *fiber.Ctx) error {
+	patientID, err := uuid.Parse(c.Params("id"))
+	if err != nil || !canAccessPatient(c, patientID) {
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Patient not found",
+		})
+	}
+
+	var members []CareTeamMember
+	if err := db.Preload("Doctor").Where("patient_id = ?", patientID).Find(&members).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to fetch care team",
+		})
+	}
+
+	auditAccess(c, "read", "care_team", patientID.String(), patientID, auditSuccess)
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Care team retrieved successfully",
+		"data":    members,
+	})
+}
+
+// Add a doctor to a patient's care team
+func addCareTeamMember(c *fiber.Ctx) error {
+	patientID, err := uuid.Parse(c.Params("id"))
+	if err != nil || !canAccessPatient(c, patientID) {
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Patient not found",
+		})
+	}
+
+	req := new(struct {
+		DoctorID string `json:"doctorId"`
+		Email    string `json:"email"`
+		Role     string `json:"role"`
+	})
+	if err := c.BodyParser(req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "Invalid request body",
+		})
+	}
+
+	// Look up the doctor by ID or email
+	var doctor Doctor
+	var result *gorm.DB
+	switch {
+	case req.DoctorID != "":
+		result = db.First(&doctor, "id = ?", req.DoctorID)
+	case req.Email != "":
+		result = db.Where("email = ?", req.Email).First(&doctor)
+	default:
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "Doctor ID or email is required",
+		})
+	}
+	if result.Error != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Doctor not found",
+		})
+	}
+
+	if req.Role == "" {
+		req.Role = "consulting"
+	}
+
+	member := CareTeamMember{
+		PatientID: patientID,
+		DoctorID:  doctor.ID,
+		Role:      req.Role,
+		CreatedAt: time.Now(),
+	}
+	if err := db.Save(&member).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to add care team member",
+		})
+	}
+
+	auditAccess(c, "grant", "care_team", doctor.ID.String(), patientID, auditSuccess)
+
+	member.Doctor = doctor
+	return c.Status(201).JSON(fiber.Map{
+		"success": true,
+		"message": "Care team member added",
+		"data":    member,
+	})
+}
+
+// Remove a doctor from a patient's care team
+func removeCareTeamMember(c *fiber.Ctx) error {
+	patientID, err := uuid.Parse(c.Params("id"))
+	if err != nil || !canAccessPatient(c, patientID) {
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Patient not found",
+		})
+	}
+
+	// Never leave a patient without anyone able to see them
+	var count int64
+	db.Model(&CareTeamMember{}).Where("patient_id = ?", patientID).Count(&count)
+	if count <= 1 {
+		return c.Status(409).JSON(fiber.Map{
+			"success": false,
+			"message": "A patient must have at least one care team member",
+		})
+	}
+
+	result := db.Where("patient_id = ? AND doctor_id = ?", patientID, c.Params("doctorId")).Delete(&CareTeamMember{})
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to remove care team member",
+		})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Care team member not found",
+		})
+	}
+
+	auditAccess(c, "revoke", "care_team", c.Params("doctorId"), patientID, auditSuccess)
+	return c.SendStatus(204)
+}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// Medications carry a structured dose (quantity, unit and route) and a dosing
+// schedule alongside the free-text Dosage and Frequency. Free text is parsed
+// into the structured fields where possible, so existing clients keep working.
+
+// Kinds of dosing schedule
+const (
+	scheduleInterval = "interval" // every N hours around the clock
+	scheduleTimes    = "times"    // at fixed times of day, every N days
+	schedulePRN      = "prn"      // as needed, nothing is scheduled
+	scheduleTaper    = "taper"    // steps of changing doses, each for some days
+)
+
+// Longest span a dose timeline may cover
+const maxTimelineDays = 366
+
+// Dose units, keyed by accepted spellings
+var doseUnits = map[string]string{
+	"mg": "mg", "milligram": "mg", "milligrams": "mg",
+	"g": "g", "gram": "g", "grams": "g",
+	"mcg": "mcg", "µg": "mcg", "ug": "mcg", "microgram": "mcg", "micrograms": "mcg",
+	"ml": "ml", "millilitre": "ml", "milliliter": "ml", "millilitres": "ml", "milliliters": "ml",
+	"l": "l", "litre": "l", "liter": "l",
+	"unit": "unit", "units": "unit", "u": "unit", "iu": "IU",
+	"mmol": "mmol", "meq": "mEq",
+	"tablet": "tablet", "tablets": "tablet", "tab": "tablet", "tabs": "tablet",
+	"capsule": "capsule", "capsules": "capsule", "cap": "capsule", "caps": "capsule",
+	"drop": "drop", "drops": "drop", "gtt": "drop",
+	"puff": "puff", "puffs": "puff",
+	"spray": "spray", "sprays": "spray",
+	"patch": "patch", "patches": "patch",
+	"sachet": "sachet", "sachets": "sachet",
+	"suppository": "suppository", "suppositories": "suppository",
+	"application": "application", "applications": "application",
+}
+
+// Routes of administration, keyed by accepted spellings and abbreviations
+var doseRoutes = map[string]string{
+	"oral": "oral", "po": "oral", "by mouth": "oral",
+	"sublingual": "sublingual", "sl": "sublingual",
+	"buccal":      "buccal",
+	"intravenous": "intravenous", "iv": "intravenous",
+	"intramuscular": "intramuscular", "im": "intramuscular",
+	"subcutaneous": "subcutaneous", "sc": "subcutaneous", "sq": "subcutaneous", "subcut": "subcutaneous",
+	"intradermal": "intradermal", "id": "intradermal",
+	"topical":     "topical",
+	"transdermal": "transdermal",
+	"inhaled":     "inhaled", "inh": "inhaled",
+	"nasal": "nasal", "intranasal": "nasal",
+	"ophthalmic": "ophthalmic", "eye": "ophthalmic",
+	"otic": "otic", "ear": "otic",
+	"rectal": "rectal", "pr": "rectal",
+	"vaginal": "vaginal", "pv": "vaginal",
+}
+
+// When doses are taken for a number of doses a day
+var defaultDoseTimes = map[int][]string{
+	1: {"08:00"},
+	2: {"08:00", "20:00"},
+	3: {"08:00", "14:00", "20:00"},
+	4: {"08:00", "12:00", "16:00", "20:00"},
+	5: {"06:00", "10:00", "14:00", "18:00", "22:00"},
+	6: {"00:00", "04:00", "08:00", "12:00", "16:00", "20:00"},
+}
+
+// DosingSchedule says when a medication's doses are due
+type DosingSchedule struct {
+	Kind             string      `json:"kind"`                       // interval, times, prn or taper
+	EveryHours       float64     `json:"everyHours,omitempty"`       // interval
+	FirstDose        string      `json:"firstDose,omitempty"`        // interval, time of the first dose on the start date, "08:00" by default
+	Times            []string    `json:"times,omitempty"`            // times, times of day as "08:00"
+	EveryDays        int         `json:"everyDays,omitempty"`        // times, 1 (daily) by default
+	MaxPerDay        int         `json:"maxPerDay,omitempty"`        // prn, 0 for no limit
+	MinIntervalHours float64     `json:"minIntervalHours,omitempty"` // prn
+	Steps            []TaperStep `json:"steps,omitempty"`            // taper
+}
+
+// TaperStep is a dose taken at the given times of day for a number of days
+type TaperStep struct {
+	Days         int      `json:"days"`
+	DoseQuantity float64  `json:"doseQuantity"`
+	Times        []string `json:"times"`
+}
+
+// A dose due at a clinic local time
+type scheduledDose struct {
+	DateTime     string  `json:"dateTime"` // "2006-01-02T15:04"
+	DoseQuantity float64 `json:"doseQuantity"`
+	DoseUnit     string  `json:"doseUnit"`
+	Route        string  `json:"route"`
+	Step         int     `json:"step,omitempty"` // taper step, from 1
+}
+
+// Validate and normalize a schedule
+func (s *DosingSchedule) validate() error {
+	validTimes := func(times []string) ([]string, error) {
+		if len(times) == 0 {
+			return nil, fmt.Errorf("at least one time of day is required")
+		}
+		seen := make(map[int]bool)
+		for _, t := range times {
+			m, err := parseClock(t)
+			if err != nil || m >= 24*60 {
+				return nil, fmt.Errorf("invalid time of day %q, expected HH:MM", t)
+			}
+			if seen[m] {
+				return nil, fmt.Errorf("time of day %s is given twice", t)
+			}
+			seen[m] = true
+		}
+		sorted := append([]string(nil), times...)
+		sort.Strings(sorted)
+		return sorted, nil
+	}
+
+	var err error
+	switch s.Kind {
+	case scheduleInterval:
+		if s.EveryHours <= 0 || s.EveryHours > 168 {
+			return fmt.Errorf("everyHours must be more than 0 and at most 168")
+		}
+		if s.FirstDose != "" {
+			if m, err := parseClock(s.FirstDose); err != nil || m >= 24*60 {
+				return fmt.Errorf("invalid firstDose %q, expected HH:MM", s.FirstDose)
+			}
+		}
+	case scheduleTimes:
+		if s.Times, err = validTimes(s.Times); err != nil {
+			return err
+		}
+		if s.EveryDays < 0 {
+			return fmt.Errorf("everyDays must be positive")
+		}
+		if s.EveryDays == 0 {
+			s.EveryDays = 1
+		}
+	case schedulePRN:
+		if s.MaxPerDay < 0 || s.MinIntervalHours < 0 {
+			return fmt.Errorf("maxPerDay and minIntervalHours cannot be negative")
+		}
+	case scheduleTaper:
+		if len(s.Steps) == 0 {
+			return fmt.Errorf("a taper needs at least one step")
+		}
+		for i := range s.Steps {
+			step := &s.Steps[i]
+			if step.Days < 1 || step.DoseQuantity <= 0 {
+				return fmt.Errorf("step %d needs days and a doseQuantity above 0", i+1)
+			}
+			if step.Times, err = validTimes(step.Times); err != nil {
+				return fmt.Errorf("step %d: %v", i+1, err)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown schedule kind %q, expected interval, times, prn or taper", s.Kind)
+	}
+	return nil
+}
+
+// Describe a schedule in words, for the free-text Frequency
+func (s *DosingSchedule) String() string {
+	switch s.Kind {
+	case scheduleInterval:
+		return "every " + strconv.FormatFloat(s.EveryHours, 'f', -1, 64) + " hours"
+	case scheduleTimes:
+		every := "daily"
+		switch {
+		case s.EveryDays == 2:
+			every = "every other day"
+		case s.EveryDays == 7:
+			every = "weekly"
+		case s.EveryDays > 1:
+			every = fmt.Sprintf("every %d days", s.EveryDays)
+		}
+		return every + " at " + strings.Join(s.Times, ", ")
+	case schedulePRN:
+		return "as needed"
+	case scheduleTaper:
+		days := 0
+		for _, step := range s.Steps {
+			days += step.Days
+		}
+		return fmt.Sprintf("tapering over %d days", days)
+	}
+	return ""
+}
+
+var (
+	dosagePattern     = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*([a-zµ]+)\.?$`)
+	clockPattern      = regexp.MustCompile(`\b([01]?\d|2[0-3]):([0-5]\d)\b`)
+	everyHoursPattern = regexp.MustCompile(`^(?:every|q)\s*(\d+(?:\.\d+)?)\s*(?:hours?|hrs?|h)$`)
+	everyDaysPattern  = regexp.MustCompile(`^every\s+(\d+)\s+days?$`)
+	timesADayPattern  = regexp.MustCompile(`^(\d|one|two|three|four|five|six)\s*(?:x|times?)\s*(?:a|per|/)?\s*(?:day|daily)$`)
+	prnPattern        = regexp.MustCompile(`\s*(?:prn|as needed|as required|when required|if needed)$`)
+)
+
+// Parse a free-text dosage like "500mg" or "2 tablets"
+func parseDosage(text string) (float64, string, bool) {
+	m := dosagePattern.FindStringSubmatch(strings.ToLower(strings.TrimSpace(text)))
+	if m == nil {
+		return 0, "", false
+	}
+	unit, ok := doseUnits[m[2]]
+	if !ok {
+		return 0, "", false
+	}
+	quantity, err := strconv.ParseFloat(m[1], 64)
+	if err != nil || quantity <= 0 {
+		return 0, "", false
+	}
+	return quantity, unit, true
+}
+
+// Parse a free-text frequency like "twice daily", "q8h", "every other day",
+// "at 08:00 and 20:00" or "every 6 hours as needed"
+func parseFrequency(text string) (*DosingSchedule, bool) {
+	s := strings.ToLower(strings.TrimSpace(text))
+	s = strings.TrimSuffix(strings.Join(strings.Fields(s), " "), ".")
+	if s == "" {
+		return nil, false
+	}
+
+	// "As needed" alone, or limiting a regular frequency
+	if loc := prnPattern.FindStringIndex(s); loc != nil {
+		rest := strings.TrimSpace(s[:loc[0]])
+		prn := &DosingSchedule{Kind: schedulePRN}
+		if rest == "" {
+			return prn, true
+		}
+		regular, ok := parseFrequency(rest)
+		if !ok || regular.Kind == schedulePRN {
+			return nil, false
+		}
+		switch regular.Kind {
+		case scheduleInterval:
+			prn.MinIntervalHours = regular.EveryHours
+		case scheduleTimes:
+			if regular.EveryDays == 1 {
+				prn.MaxPerDay = len(regular.Times)
+			}
+		}
+		return prn, true
+	}
+
+	// Explicit times of day
+	if clocks := clockPattern.FindAllString(s, -1); len(clocks) > 0 {
+		times := make([]string, len(clocks))
+		for i, c := range clocks {
+			h, m, _ := strings.Cut(c, ":")
+			times[i] = fmt.Sprintf("%02s:%s", h, m)
+		}
+		schedule := &DosingSchedule{Kind: scheduleTimes, Times: times, EveryDays: 1}
+		if strings.Contains(s, "every other day") || strings.Contains(s, "alternate days") {
+			schedule.EveryDays = 2
+		} else if strings.Contains(s, "weekly") || strings.Contains(s, "week") {
+			schedule.EveryDays = 7
+		}
+		if schedule.validate() != nil {
+			return nil, false
+		}
+		return schedule, true
+	}
+
+	timesPerDay := map[string]int{
+		"once daily": 1, "daily": 1, "once a day": 1, "every day": 1, "od": 1, "qd": 1, "once": 1,
+		"twice daily": 2, "twice a day": 2, "bid": 2, "bd": 2,
+		"three times daily": 3, "tid": 3, "tds": 3, "thrice daily": 3,
+		"four times daily": 4, "qid": 4, "qds": 4,
+	}
+	if n, ok := timesPerDay[s]; ok {
+		return &DosingSchedule{Kind: scheduleTimes, Times: defaultDoseTimes[n], EveryDays: 1}, true
+	}
+	if m := timesADayPattern.FindStringSubmatch(s); m != nil {
+		words := map[string]int{"one": 1, "two": 2, "three": 3, "four": 4, "five": 5, "six": 6}
+		n, ok := words[m[1]]
+		if !ok {
+			n, _ = strconv.Atoi(m[1])
+		}
+		if times, ok := defaultDoseTimes[n]; ok {
+			return &DosingSchedule{Kind: scheduleTimes, Times: times, EveryDays: 1}, true
+		}
+		return nil, false
+	}
+
+	switch s {
+	case "every morning", "in the morning", "mane", "qam":
+		return &DosingSchedule{Kind: scheduleTimes, Times: []string{"08:00"}, EveryDays: 1}, true
+	case "every evening", "in the evening":
+		return &DosingSchedule{Kind: scheduleTimes, Times: []string{"20:00"}, EveryDays: 1}, true
+	case "at night", "at bedtime", "nightly", "every night", "nocte", "qhs", "hs":
+		return &DosingSchedule{Kind: scheduleTimes, Times: []string{"22:00"}, EveryDays: 1}, true
+	case "every other day", "alternate days", "qod":
+		return &DosingSchedule{Kind: scheduleTimes, Times: []string{"08:00"}, EveryDays: 2}, true
+	case "weekly", "once weekly", "once a week", "every week":
+		return &DosingSchedule{Kind: scheduleTimes, Times: []string{"08:00"}, EveryDays: 7}, true
+	}
+
+	if m := everyHoursPattern.FindStringSubmatch(s); m != nil {
+		hours, _ := strconv.ParseFloat(m[1], 64)
+		schedule := &DosingSchedule{Kind: scheduleInterval, EveryHours: hours}
+		if schedule.validate() != nil {
+			return nil, false
+		}
+		return schedule, true
+	}
+	if m := everyDaysPattern.FindStringSubmatch(s); m != nil {
+		days, _ := strconv.Atoi(m[1])
+		if days < 1 {
+			return nil, false
+		}
+		return &DosingSchedule{Kind: scheduleTimes, Times: []string{"08:00"}, EveryDays: days}, true
+	}
+	return nil, false
+}
+
+// Fill in the structured dose and schedule from the free text where they are
+// missing, and the free text from the structured fields, then validate them
+func structureDosing(m *Medication) error {
+	if m.DoseUnit == "" && m.DoseQuantity == 0 && m.Dosage != "" {
+		m.DoseQuantity, m.DoseUnit, _ = parseDosage(m.Dosage)
+	}
+	if m.Schedule == nil && m.Frequency != "" {
+		m.Schedule, _ = parseFrequency(m.Frequency)
+	}
+
+	if m.DoseUnit != "" || m.DoseQuantity != 0 {
+		unit, ok := doseUnits[strings.ToLower(m.DoseUnit)]
+		if !ok {
+			return fmt.Errorf("unknown doseUnit %q", m.DoseUnit)
+		}
+		// A taper's doses are given by its steps
+		tapering := m.Schedule != nil && m.Schedule.Kind == scheduleTaper
+		if m.DoseQuantity < 0 || (m.DoseQuantity == 0 && !tapering) {
+			return fmt.Errorf("doseQuantity must be more than 0")
+		}
+		m.DoseUnit = unit
+	}
+	if m.Route != "" {
+		route, ok := doseRoutes[strings.ToLower(strings.TrimSpace(m.Route))]
+		if !ok {
+			return fmt.Errorf("unknown route %q", m.Route)
+		}
+		m.Route = route
+	}
+	if m.Schedule != nil {
+		if err := m.Schedule.validate(); err != nil {
+			return fmt.Errorf("invalid schedule: %v", err)
+		}
+		if m.Schedule.Kind == scheduleTaper && m.DoseUnit == "" {
+			return fmt.Errorf("a tapering schedule needs a doseUnit")
+		}
+	}
+
+	for _, date := range []string{m.StartDate, m.EndDate} {
+		if _, err := parseMedicationDate(date); date != "" && err != nil {
+			return fmt.Errorf("invalid date %q, expected YYYY-MM-DD", date)
+		}
+	}
+	if start, end := m.StartDate, m.EndDate; start != "" && end != "" {
+		s, _ := parseMedicationDate(start)
+		e, _ := parseMedicationDate(end)
+		if e.Before(s) {
+			return fmt.Errorf("endDate must not be before startDate")
+		}
+	}
+
+	if m.Dosage == "" && m.DoseQuantity > 0 {
+		m.Dosage = strconv.FormatFloat(m.DoseQuantity, 'f', -1, 64) + " " + m.DoseUnit
+	}
+	if m.Frequency == "" && m.Schedule != nil {
+		m.Frequency = m.Schedule.String()
+	}
+	return nil
+}
+
+// Parse a medication start or end date, given as a date or a timestamp
+func parseMedicationDate(s string) (time.Time, error) {
+	if len(s) > len(scheduleDateLayout) {
+		s = s[:len(scheduleDateLayout)]
+	}
+	return time.Parse(scheduleDateLayout, s)
+}
+
+// Expand a medication's schedule into the doses due from from up to to, clinic
+// local times. Doses are only due between the start and end dates, inclusive.
+func expandDoses(m Medication, from, to time.Time) []scheduledDose {
+	if m.Schedule == nil {
+		return nil
+	}
+	start, err := parseMedicationDate(m.StartDate)
+	if err != nil {
+		start = m.CreatedAt.Truncate(24 * time.Hour)
+	}
+	end := to
+	if e, err := parseMedicationDate(m.EndDate); err == nil && e.AddDate(0, 0, 1).Before(end) {
+		end = e.AddDate(0, 0, 1)
+	}
+
+	var doses []scheduledDose
+	add := func(t time.Time, quantity float64, step int) {
+		if !t.Before(from) && !t.Before(start) && t.Before(end) {
+			doses = append(doses, scheduledDose{
+				DateTime:     t.Format(appointmentTimeLayout),
+				DoseQuantity: quantity,
+				DoseUnit:     m.DoseUnit,
+				Route:        m.Route,
+				Step:         step,
+			})
+		}
+	}
+	atClock := func(day time.Time, clock string) time.Time {
+		minutes, _ := parseClock(clock)
+		return day.Add(time.Duration(minutes) * time.Minute)
+	}
+
+	s := m.Schedule
+	switch s.Kind {
+	case scheduleInterval:
+		first := "08:00"
+		if s.FirstDose != "" {
+			first = s.FirstDose
+		}
+		every := time.Duration(s.EveryHours * float64(time.Hour))
+		t := atClock(start, first)
+		// Skip ahead to the range without stepping through every dose before it
+		if t.Before(from) {
+			t = t.Add(from.Sub(t) / every * every)
+		}
+		for ; t.Before(end); t = t.Add(every) {
+			add(t, m.DoseQuantity, 0)
+		}
+	case scheduleTimes:
+		day := start
+		if day.Before(from) {
+			periods := int(from.Sub(day).Hours()/24) / s.EveryDays
+			day = day.AddDate(0, 0, periods*s.EveryDays)
+		}
+		for ; day.Before(end); day = day.AddDate(0, 0, s.EveryDays) {
+			for _, clock := range s.Times {
+				add(atClock(day, clock), m.DoseQuantity, 0)
+			}
+		}
+	case scheduleTaper:
+		day := start
+		for i, step := range s.Steps {
+			for d := 0; d < step.Days && day.Before(end); d++ {
+				for _, clock := range step.Times {
+					add(atClock(day, clock), step.DoseQuantity, i+1)
+				}
+				day = day.AddDate(0, 0, 1)
+			}
+		}
+	}
+	return doses
+}
+
+// Parse existing free-text dosages and frequencies into structured fields
+func structureExistingMedications() {
+	var medications []Medication
+	if err := db.Unscoped().Where("(dose_unit = '' OR dose_unit IS NULL) AND schedule IS NULL").
+		Where("dosage <> '' OR frequency <> ''").Find(&medications).Error; err != nil {
+		log.Printf("Failed to load medications to structure: %v", err)
+		return
+	}
+
+	structured := 0
+	for _, m := range medications {
+		quantity, unit, dosageOK := parseDosage(m.Dosage)
+		schedule, frequencyOK := parseFrequency(m.Frequency)
+		if !dosageOK && !frequencyOK {
+			continue
+		}
+		columns := []string{}
+		if dosageOK {
+			m.DoseQuantity, m.DoseUnit = quantity, unit
+			columns = append(columns, "dose_quantity", "dose_unit")
+		}
+		if frequencyOK {
+			m.Schedule = schedule
+			columns = append(columns, "schedule")
+		}
+		if err := db.Unscoped().Model(&m).Select(columns).Updates(&m).Error; err != nil {
+			log.Printf("Failed to structure medication %s: %v", m.ID, err)
+			continue
+		}
+		structured++
+	}
+	if structured > 0 {
+		log.Printf("Parsed the dosage or frequency of %d existing medications", structured)
+	}
+}
+
+// Expand a medication into the doses due between from and to (dates,
+// defaulting to the medication's start date and 30 days on or its end date)
+func getMedicationTimeline(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var medication Medication
+	if err := db.Scopes(scopePatientRecords(c)).First(&medication, "id = ?", id).Error; err != nil {
+		auditAccess(c, "read", "medication", id, uuid.Nil, auditNotFound)
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Medication not found",
+		})
+	}
+	if medication.Schedule == nil {
+		return c.Status(422).JSON(fiber.Map{
+			"success": false,
+			"message": "The medication has no dosing schedule, set a schedule or a frequency such as \"twice daily\"",
+		})
+	}
+
+	from, err := parseMedicationDate(medication.StartDate)
+	if err != nil {
+		from = medication.CreatedAt.Truncate(24 * time.Hour)
+	}
+	var to time.Time
+	for param, date := range map[string]*time.Time{"from": &from, "to": &to} {
+		if v := c.Query(param); v != "" {
+			t, err := time.Parse(scheduleDateLayout, v)
+			if err != nil {
+				return c.Status(400).JSON(fiber.Map{
+					"success": false,
+					"message": "Invalid '" + param + "' date, expected YYYY-MM-DD",
+				})
+			}
+			*date = t
+		}
+	}
+	// By default the timeline runs to the end date, or 30 days without one,
+	// and at most as far as a requested range may
+	if to.IsZero() {
+		to = from.AddDate(0, 0, 30)
+		if end, err := parseMedicationDate(medication.EndDate); err == nil && !end.Before(from) {
+			to = end
+		}
+		if limit := from.AddDate(0, 0, maxTimelineDays); to.After(limit) {
+			to = limit
+		}
+	}
+	if to.Before(from) || to.Sub(from) > maxTimelineDays*24*time.Hour {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("The range must run forwards and span at most %d days", maxTimelineDays),
+		})
+	}
+
+	doses := expandDoses(medication, from, to.AddDate(0, 0, 1))
+	if doses == nil {
+		doses = []scheduledDose{}
+	}
+
+	auditAccess(c, "read", "medication", id, medication.PatientID, auditSuccess)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Dose timeline retrieved successfully",
+		"data":    doses,
+		"meta": fiber.Map{
+			"medicationId": medication.ID,
+			"from":         from.Format(scheduleDateLayout),
+			"to":           to.Format(scheduleDateLayout),
+			"schedule":     medication.Schedule,
+			"total":        len(doses),
+		},
+	})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestMedicationTimelineRange(t *testing.T) {
+	setupTestDB(t)
+	app := newTestApp()
+	doctor, token := createTestUser(t, RolePhysician, "password123")
+	patient := createTestPatient(t, "Maria Lopez", doctor)
+
+	daily := &DosingSchedule{Kind: "times", Times: []string{"08:00"}, EveryDays: 1}
+	tests := []struct {
+		name      string
+		endDate   string
+		query     string
+		want      int
+		wantRange [2]string
+	}{
+		{"no end date", "", "", http.StatusOK, [2]string{"2025-01-01", "2025-01-31"}},
+		{"end date", "2025-03-01", "", http.StatusOK, [2]string{"2025-01-01", "2025-03-01"}},
+		{"long-term prescription", "2027-01-01", "", http.StatusOK, [2]string{"2025-01-01", "2026-01-02"}},
+		{"end date before a requested start", "2025-03-01", "?from=2025-06-01", http.StatusOK, [2]string{"2025-06-01", "2025-07-01"}},
+		{"requested range", "2027-01-01", "?from=2025-02-01&to=2025-02-07", http.StatusOK, [2]string{"2025-02-01", "2025-02-07"}},
+		{"requested range too long", "", "?from=2025-01-01&to=2026-06-01", http.StatusBadRequest, [2]string{}},
+		{"requested range backwards", "", "?to=2024-12-01", http.StatusBadRequest, [2]string{}},
+	}
+	for _, tt := range tests {
+		medication := Medication{PatientID: patient.ID, Name: "Metformin", Schedule: daily, StartDate: "2025-01-01", EndDate: tt.endDate}
+		if err := db.Create(&medication).Error; err != nil {
+			t.Fatalf("%s: failed to create the medication: %v", tt.name, err)
+		}
+
+		resp := doRequest(t, app, http.MethodGet, "/api/medications/"+medication.ID.String()+"/timeline"+tt.query, token, nil)
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, resp.StatusCode, tt.want)
+			continue
+		}
+		if tt.want != http.StatusOK {
+			continue
+		}
+		var body struct {
+			Meta struct {
+				From string `json:"from"`
+				To   string `json:"to"`
+			} `json:"meta"`
+		}
+		decodeBody(t, resp, &body)
+		if got := [2]string{body.Meta.From, body.Meta.To}; got != tt.wantRange {
+			t.Errorf("%s: range = %v, want %v", tt.name, got, tt.wantRange)
+		}
+	}
+}
@@ -21,3 +21,11 @@ func (u *HealthMetric) BeforeCreate(tx *gorm.DB) (err error) {
 	u.ID = uuid.New()
 	return nil
 }
+
+// The audit log is append-only, see also the triggers created by sealAuditLog()
+func (e *AuditEvent) BeforeUpdate(tx *gorm.DB) (err error) {
+	return errAuditAppendOnly
+}
+func (e *AuditEvent) BeforeDelete(tx *gorm.DB) (err error) {
+	return errAuditAppendOnly
+}
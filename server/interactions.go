@@ -0,0 +1,611 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Interaction severities, from least to most severe
+const (
+	severityMinor           = "minor"
+	severityModerate        = "moderate"
+	severityMajor           = "major"
+	severityContraindicated = "contraindicated"
+)
+
+var severityRank = map[string]int{
+	severityMinor:           1,
+	severityModerate:        2,
+	severityMajor:           3,
+	severityContraindicated: 4,
+}
+
+// Prescribing despite a warning this severe needs an override reason
+const overrideSeverity = severityMajor
+
+// Starter dataset, loaded when no interactions have been imported. It is not
+// exhaustive; clinics are expected to import a vetted dataset.
+//
+//go:embed data/interactions.json
+var defaultInteractionData []byte
+
+// interactionDataset is the importable JSON form of the dataset: drug classes
+// with their member drugs, and interactions between drugs or classes
+type interactionDataset struct {
+	Classes      map[string][]string `json:"classes"`
+	Interactions []DrugInteraction   `json:"interactions"`
+}
+
+// A warning raised when checking a medication
+type interactionWarning struct {
+	Kind         string     `json:"kind"` // "drug" or "allergy"
+	Severity     string     `json:"severity"`
+	Drug         string     `json:"drug"` // the medication checked
+	With         string     `json:"with"` // the other medication, or the allergen
+	MedicationID *uuid.UUID `json:"medicationId,omitempty"`
+	AllergyID    *uuid.UUID `json:"allergyId,omitempty"`
+	Description  string     `json:"description"`
+}
+
+// The dataset in memory, rebuilt from the database after every import
+type interactionIndex struct {
+	vocabulary []string            // drug and class names
+	classes    map[string][]string // classes of each drug
+	pairs      map[[2]string]DrugInteraction
+}
+
+var (
+	interactionsMu sync.RWMutex
+	interactions   = &interactionIndex{}
+)
+
+// Split a drug name into lower case words, keeping hyphenated names whole
+func drugWords(name string) []string {
+	return strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-'
+	})
+}
+
+func normalizeDrug(name string) string {
+	return strings.Join(drugWords(name), " ")
+}
+
+// Key of an interaction, independent of the order of the drugs
+func interactionKey(a, b string) [2]string {
+	if b < a {
+		a, b = b, a
+	}
+	return [2]string{a, b}
+}
+
+// The drugs and classes a medication name refers to. Names are matched as
+// whole words, so "Amoxicillin 500mg capsules" refers to amoxicillin and to
+// its class, penicillin.
+func (ix *interactionIndex) terms(name string) map[string]bool {
+	text := " " + normalizeDrug(name) + " "
+	terms := make(map[string]bool)
+	for _, term := range ix.vocabulary {
+		if strings.Contains(text, " "+term+" ") {
+			terms[term] = true
+			for _, class := range ix.classes[term] {
+				terms[class] = true
+			}
+		}
+	}
+	return terms
+}
+
+// Rebuild the in-memory index from the database
+func loadInteractionIndex() error {
+	var members []DrugClassMember
+	if err := db.Find(&members).Error; err != nil {
+		return err
+	}
+	var rows []DrugInteraction
+	if err := db.Find(&rows).Error; err != nil {
+		return err
+	}
+
+	ix := &interactionIndex{
+		classes: make(map[string][]string),
+		pairs:   make(map[[2]string]DrugInteraction),
+	}
+	seen := make(map[string]bool)
+	addTerm := func(term string) {
+		if !seen[term] {
+			seen[term] = true
+			ix.vocabulary = append(ix.vocabulary, term)
+		}
+	}
+	for _, m := range members {
+		ix.classes[m.Drug] = append(ix.classes[m.Drug], m.Class)
+		addTerm(m.Drug)
+		addTerm(m.Class)
+	}
+	for _, row := range rows {
+		ix.pairs[interactionKey(row.DrugA, row.DrugB)] = row
+		addTerm(row.DrugA)
+		addTerm(row.DrugB)
+	}
+
+	interactionsMu.Lock()
+	interactions = ix
+	interactionsMu.Unlock()
+	return nil
+}
+
+// Parse a dataset from CSV. The header decides what the file holds: either
+// "drug_a,drug_b,severity,description" interactions, or "class,drug" class
+// memberships.
+func parseInteractionCSV(r io.Reader) (interactionDataset, error) {
+	var data interactionDataset
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return data, fmt.Errorf("invalid CSV: %v", err)
+	}
+	if len(records) == 0 {
+		return data, fmt.Errorf("the CSV is empty")
+	}
+
+	columns := make(map[string]int)
+	for i, name := range records[0] {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+
+	_, hasA := columns["drug_a"]
+	_, hasB := columns["drug_b"]
+	_, hasClass := columns["class"]
+	_, hasDrug := columns["drug"]
+	switch {
+	case hasA && hasB:
+		for _, record := range records[1:] {
+			data.Interactions = append(data.Interactions, DrugInteraction{
+				DrugA:       field(record, "drug_a"),
+				DrugB:       field(record, "drug_b"),
+				Severity:    field(record, "severity"),
+				Description: field(record, "description"),
+			})
+		}
+	case hasClass && hasDrug:
+		data.Classes = make(map[string][]string)
+		for _, record := range records[1:] {
+			class := field(record, "class")
+			data.Classes[class] = append(data.Classes[class], field(record, "drug"))
+		}
+	default:
+		return data, fmt.Errorf("expected a drug_a,drug_b,severity,description or a class,drug header")
+	}
+	return data, nil
+}
+
+// Import a dataset, replacing the current one or merging into it, and rebuild
+// the index. Interactions already known are updated.
+func importInteractions(data interactionDataset, replace bool) (int, int, error) {
+	var members []DrugClassMember
+	for class, drugs := range data.Classes {
+		class = normalizeDrug(class)
+		if class == "" {
+			return 0, 0, fmt.Errorf("a class has no name")
+		}
+		for _, drug := range drugs {
+			if drug = normalizeDrug(drug); drug == "" {
+				return 0, 0, fmt.Errorf("class %q has an empty drug name", class)
+			}
+			members = append(members, DrugClassMember{Class: class, Drug: drug})
+		}
+	}
+
+	rows := make([]DrugInteraction, 0, len(data.Interactions))
+	for i, row := range data.Interactions {
+		row.ID = 0
+		row.DrugA, row.DrugB = normalizeDrug(row.DrugA), normalizeDrug(row.DrugB)
+		row.Severity = strings.ToLower(strings.TrimSpace(row.Severity))
+		row.Description = strings.TrimSpace(row.Description)
+		if row.DrugA == "" || row.DrugB == "" || row.DrugA == row.DrugB {
+			return 0, 0, fmt.Errorf("interaction %d needs two different drugs", i+1)
+		}
+		if _, ok := severityRank[row.Severity]; !ok {
+			return 0, 0, fmt.Errorf("interaction %d has severity %q, expected minor, moderate, major or contraindicated", i+1, row.Severity)
+		}
+		key := interactionKey(row.DrugA, row.DrugB)
+		row.DrugA, row.DrugB = key[0], key[1]
+		rows = append(rows, row)
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if replace {
+			if err := tx.Where("1 = 1").Delete(&DrugClassMember{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("1 = 1").Delete(&DrugInteraction{}).Error; err != nil {
+				return err
+			}
+		}
+		if len(members) > 0 {
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).CreateInBatches(members, 200).Error; err != nil {
+				return err
+			}
+		}
+		if len(rows) > 0 {
+			if err := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "drug_a"}, {Name: "drug_b"}},
+				DoUpdates: clause.AssignmentColumns([]string{"severity", "description", "updated_at"}),
+			}).CreateInBatches(rows, 200).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return len(members), len(rows), loadInteractionIndex()
+}
+
+// Load the interaction dataset at startup: the starter dataset when nothing
+// has been imported yet, then INTERACTIONS_FILE (JSON, or CSV by its
+// extension) if set
+func initInteractions() {
+	var count int64
+	db.Model(&DrugInteraction{}).Count(&count)
+	if count == 0 {
+		var data interactionDataset
+		if err := json.Unmarshal(defaultInteractionData, &data); err != nil {
+			log.Printf("Failed to parse the starter interaction dataset: %v", err)
+		} else if _, _, err := importInteractions(data, false); err != nil {
+			log.Printf("Failed to load the starter interaction dataset: %v", err)
+		}
+	}
+
+	if path := os.Getenv("INTERACTIONS_FILE"); path != "" {
+		if err := importInteractionFile(path); err != nil {
+			log.Printf("Failed to import interactions from %s: %v", path, err)
+		}
+	}
+
+	if err := loadInteractionIndex(); err != nil {
+		log.Printf("Failed to load the interaction dataset: %v", err)
+	}
+}
+
+func importInteractionFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var data interactionDataset
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		if data, err = parseInteractionCSV(f); err != nil {
+			return err
+		}
+	} else if err := json.NewDecoder(f).Decode(&data); err != nil {
+		return err
+	}
+	classes, rows, err := importInteractions(data, false)
+	if err == nil {
+		log.Printf("Imported %d class memberships and %d interactions from %s", classes, rows, path)
+	}
+	return err
+}
+
+// An allergy to check prescriptions against
+type allergen struct {
+	ID        *uuid.UUID
+	Substance string
+	Severity  string
+}
+
+// Free-text allergy entries that mean there are none
+var noAllergies = map[string]bool{"none": true, "nil": true, "nka": true, "nkda": true, "no known allergies": true, "no known drug allergies": true}
+
+// A patient's allergies, the structured ones and those in the free-text
+// Allergies field
+func patientAllergens(patientID uuid.UUID) ([]allergen, error) {
+	var allergies []PatientAllergy
+	if err := db.Where("patient_id = ?", patientID).Find(&allergies).Error; err != nil {
+		return nil, err
+	}
+	var patient Patient
+	if err := db.Select("allergies").First(&patient, "id = ?", patientID).Error; err != nil {
+		return nil, err
+	}
+
+	var allergens []allergen
+	seen := make(map[string]bool)
+	for i := range allergies {
+		seen[normalizeDrug(allergies[i].Substance)] = true
+		allergens = append(allergens, allergen{&allergies[i].ID, allergies[i].Substance, allergies[i].Severity})
+	}
+	for _, item := range strings.FieldsFunc(patient.Allergies, func(r rune) bool { return strings.ContainsRune(",;\n", r) }) {
+		item = strings.TrimSpace(item)
+		if key := normalizeDrug(item); key != "" && !seen[key] && !noAllergies[key] {
+			seen[key] = true
+			allergens = append(allergens, allergen{Substance: item})
+		}
+	}
+	return allergens, nil
+}
+
+// Check a medication against a patient's allergies. The medication may be
+// the allergen itself or in its class ("penicillin" covers amoxicillin), or
+// share a class with an allergen drug, which is reported less severely.
+func (ix *interactionIndex) checkAllergies(name string, allergens []allergen) []interactionWarning {
+	terms := ix.terms(name)
+	text := " " + normalizeDrug(name) + " "
+
+	var warnings []interactionWarning
+	for _, a := range allergens {
+		substance := normalizeDrug(a.Substance)
+		variants := []string{substance, strings.TrimSuffix(substance, "s"), strings.TrimSuffix(substance, " drugs")}
+
+		warning := interactionWarning{Kind: "allergy", Drug: name, With: a.Substance, AllergyID: a.ID}
+		for _, v := range variants {
+			if v != "" && (terms[v] || strings.Contains(text, " "+v+" ")) {
+				warning.Severity = severityMajor
+				if a.Severity == allergySevere {
+					warning.Severity = severityContraindicated
+				}
+				warning.Description = "The patient is allergic to " + a.Substance
+				break
+			}
+		}
+		if warning.Severity == "" {
+			for _, class := range ix.classes[substance] {
+				if terms[class] {
+					warning.Severity = severityModerate
+					if a.Severity == allergySevere {
+						warning.Severity = severityMajor
+					}
+					warning.Description = fmt.Sprintf("Possible cross-sensitivity with %s (%s), to which the patient is allergic", a.Substance, class)
+					break
+				}
+			}
+		}
+		if warning.Severity != "" {
+			warnings = append(warnings, warning)
+		}
+	}
+	return warnings
+}
+
+// Check a medication against another, returning the most severe interaction
+// between them
+func (ix *interactionIndex) checkPair(name, other string) (DrugInteraction, bool) {
+	var found DrugInteraction
+	for a := range ix.terms(name) {
+		for b := range ix.terms(other) {
+			if row, ok := ix.pairs[interactionKey(a, b)]; ok && severityRank[row.Severity] > severityRank[found.Severity] {
+				found = row
+			}
+		}
+	}
+	return found, found.Severity != ""
+}
+
+// Check a medication for a patient against their allergies and their other
+// active medications, those without an end date in the past. exclude is the
+// medication itself when it is being updated.
+func checkMedication(name string, patientID, exclude uuid.UUID) ([]interactionWarning, error) {
+	var active []Medication
+	if err := db.Where("patient_id = ? AND id <> ?", patientID, exclude).
+		Where("end_date = '' OR end_date IS NULL OR end_date >= ?", clinicNow().Format(scheduleDateLayout)).
+		Find(&active).Error; err != nil {
+		return nil, err
+	}
+	allergens, err := patientAllergens(patientID)
+	if err != nil {
+		return nil, err
+	}
+
+	interactionsMu.RLock()
+	ix := interactions
+	interactionsMu.RUnlock()
+
+	warnings := ix.checkAllergies(name, allergens)
+	for i := range active {
+		if row, ok := ix.checkPair(name, active[i].Name); ok {
+			warnings = append(warnings, interactionWarning{
+				Kind:         "drug",
+				Severity:     row.Severity,
+				Drug:         name,
+				With:         active[i].Name,
+				MedicationID: &active[i].ID,
+				Description:  row.Description,
+			})
+		}
+	}
+	sortWarnings(warnings)
+	return warnings, nil
+}
+
+// Most severe first
+func sortWarnings(warnings []interactionWarning) {
+	sort.SliceStable(warnings, func(i, j int) bool {
+		return severityRank[warnings[i].Severity] > severityRank[warnings[j].Severity]
+	})
+}
+
+// The severity of the worst warning, "" when there are none
+func highestSeverity(warnings []interactionWarning) string {
+	highest := ""
+	for _, w := range warnings {
+		if severityRank[w.Severity] > severityRank[highest] {
+			highest = w.Severity
+		}
+	}
+	return highest
+}
+
+func needsOverride(warnings []interactionWarning) bool {
+	return severityRank[highestSeverity(warnings)] >= severityRank[overrideSeverity]
+}
+
+// Check a prescription before saving it, returning the status to respond
+// with when it is blocked. Severe warnings block it unless an override reason
+// is given. The reason is kept only when it was needed.
+func checkPrescription(m *Medication, exclude uuid.UUID) (int, error) {
+	warnings, err := checkMedication(m.Name, m.PatientID, exclude)
+	if err != nil {
+		return 500, fmt.Errorf("failed to check medication interactions")
+	}
+	m.Warnings = warnings
+	m.OverrideReason = strings.TrimSpace(m.OverrideReason)
+	if !needsOverride(warnings) {
+		m.OverrideReason = ""
+		return 0, nil
+	}
+	if m.OverrideReason == "" {
+		return 409, fmt.Errorf("the medication has %s interaction warnings, give an overrideReason to prescribe it anyway", highestSeverity(warnings))
+	}
+	return 0, nil
+}
+
+// Record a saved prescription that overrode severe warnings
+func auditOverride(c *fiber.Ctx, m *Medication) {
+	actorID := currentDoctorID(c)
+	email, _ := c.Locals("email").(string)
+	details, _ := json.Marshal(fiber.Map{
+		"medication": m.Name,
+		"reason":     m.OverrideReason,
+		"warnings":   m.Warnings,
+	})
+	recordAuditEvent(AuditEvent{
+		ActorID:      &actorID,
+		ActorEmail:   email,
+		Action:       "medication.override",
+		ResourceType: "medication",
+		ResourceID:   m.ID.String(),
+		PatientID:    &m.PatientID,
+		IP:           c.IP(),
+		Outcome:      auditSuccess,
+		Details:      string(details),
+	})
+}
+
+// Check a drug for interactions, against a patient's allergies and active
+// medications (patientId) and/or a comma-separated list of other drugs (with)
+func checkInteractions(c *fiber.Ctx) error {
+	name := strings.TrimSpace(c.Query("name"))
+	if name == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "The drug to check is required as 'name'",
+		})
+	}
+
+	warnings := []interactionWarning{}
+	var patientID uuid.UUID
+	if v := c.Query("patientId"); v != "" {
+		id, err := uuid.Parse(v)
+		if err != nil || !canAccessPatient(c, id) {
+			auditAccess(c, "read", "medication", "", id, auditNotFound)
+			return c.Status(404).JSON(fiber.Map{
+				"success": false,
+				"message": "Patient not found",
+			})
+		}
+		patientID = id
+		found, err := checkMedication(name, patientID, uuid.Nil)
+		if err != nil {
+			auditAccess(c, "read", "medication", "", patientID, auditError)
+			return c.Status(500).JSON(fiber.Map{
+				"success": false,
+				"message": "Failed to check medication interactions",
+			})
+		}
+		warnings = append(warnings, found...)
+	}
+
+	interactionsMu.RLock()
+	ix := interactions
+	interactionsMu.RUnlock()
+	for _, other := range strings.Split(c.Query("with"), ",") {
+		if other = strings.TrimSpace(other); other == "" {
+			continue
+		}
+		if row, ok := ix.checkPair(name, other); ok {
+			warnings = append(warnings, interactionWarning{
+				Kind:        "drug",
+				Severity:    row.Severity,
+				Drug:        name,
+				With:        other,
+				Description: row.Description,
+			})
+		}
+	}
+	sortWarnings(warnings)
+
+	if patientID != uuid.Nil {
+		auditAccess(c, "read", "medication", "", patientID, auditSuccess)
+	}
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Interactions checked successfully",
+		"data":    warnings,
+		"meta": fiber.Map{
+			"highestSeverity":  highestSeverity(warnings),
+			"overrideRequired": needsOverride(warnings),
+		},
+	})
+}
+
+// Import an interaction dataset as JSON, or as CSV with a text/csv content
+// type. ?replace=true drops the current dataset first.
+func importInteractionDataset(c *fiber.Ctx) error {
+	var data interactionDataset
+	var err error
+	if strings.HasPrefix(c.Get(fiber.HeaderContentType), "text/csv") {
+		data, err = parseInteractionCSV(strings.NewReader(string(c.Body())))
+	} else {
+		err = json.Unmarshal(c.Body(), &data)
+	}
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "Invalid dataset: " + err.Error(),
+		})
+	}
+
+	classes, rows, err := importInteractions(data, c.QueryBool("replace"))
+	if err != nil {
+		return c.Status(422).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to import dataset: " + err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Interaction dataset imported",
+		"data": fiber.Map{
+			"classMembers": classes,
+			"interactions": rows,
+		},
+	})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// Load a small interaction dataset for one test
+func setupTestInteractions(t *testing.T) {
+	t.Helper()
+	data := interactionDataset{
+		Classes: map[string][]string{
+			"penicillin": {"amoxicillin"},
+			"nsaid":      {"ibuprofen", "naproxen"},
+		},
+		Interactions: []DrugInteraction{
+			{DrugA: "Warfarin", DrugB: "NSAID", Severity: "major", Description: "Raises the risk of bleeding"},
+			{DrugA: "lisinopril", DrugB: "naproxen", Severity: "minor", Description: "May blunt the blood pressure lowering"},
+		},
+	}
+	if _, _, err := importInteractions(data, true); err != nil {
+		t.Fatalf("failed to import interactions: %v", err)
+	}
+	t.Cleanup(func() {
+		interactionsMu.Lock()
+		interactions = &interactionIndex{}
+		interactionsMu.Unlock()
+	})
+}
+
+func TestCheckMedication(t *testing.T) {
+	setupTestDB(t)
+	setupTestInteractions(t)
+	doctor, _ := createTestUser(t, RolePhysician, "password123")
+
+	allergic := createTestPatient(t, "Ada Lovelace", doctor)
+	db.Create(&PatientAllergy{ID: uuid.New(), PatientID: allergic.ID, Substance: "Penicillins", Severity: allergySevere})
+	db.Model(&allergic).Update("allergies", "NKDA; ibuprofen")
+
+	anticoagulated := createTestPatient(t, "Grace Hopper", doctor)
+	db.Create(&Medication{PatientID: anticoagulated.ID, Name: "Warfarin 5mg tablets"})
+	db.Create(&Medication{PatientID: anticoagulated.ID, Name: "Lisinopril", EndDate: "2020-01-01"})
+
+	tests := []struct {
+		name     string
+		drug     string
+		patient  Patient
+		want     []string // kind, severity and with of each warning, most severe first
+		override bool
+	}{
+		{"allergen's class member", "Amoxicillin 500mg capsules", allergic, []string{"allergy contraindicated Penicillins"}, true},
+		{"allergen itself", "Ibuprofen", allergic, []string{"allergy major ibuprofen"}, true},
+		{"allergen's classmate", "Naproxen", allergic, []string{"allergy moderate ibuprofen"}, false},
+		{"drug in an interacting class", "ibuprofen 400 mg", anticoagulated, []string{"drug major Warfarin 5mg tablets"}, true},
+		{"interacting drug that has ended", "Naproxen", anticoagulated, []string{"drug major Warfarin 5mg tablets"}, true},
+		{"nothing known", "Paracetamol", anticoagulated, nil, false},
+	}
+	for _, tt := range tests {
+		warnings, err := checkMedication(tt.drug, tt.patient.ID, uuid.Nil)
+		if err != nil {
+			t.Fatalf("%s: checkMedication failed: %v", tt.name, err)
+		}
+		var got []string
+		for _, w := range warnings {
+			got = append(got, w.Kind+" "+w.Severity+" "+w.With)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: warnings = %q, want %q", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: warnings = %q, want %q", tt.name, got, tt.want)
+				break
+			}
+		}
+		if needsOverride(warnings) != tt.override {
+			t.Errorf("%s: needsOverride = %v, want %v", tt.name, !tt.override, tt.override)
+		}
+	}
+}
+
+// Severe warnings block a prescription unless an override reason is given,
+// which is kept only when it was needed
+func TestCheckPrescription(t *testing.T) {
+	setupTestDB(t)
+	setupTestInteractions(t)
+	app := newTestApp()
+	doctor, token := createTestUser(t, RolePhysician, "password123")
+	patient := createTestPatient(t, "Grace Hopper", doctor)
+	db.Create(&Medication{PatientID: patient.ID, Name: "Warfarin"})
+
+	tests := []struct {
+		name       string
+		drug       string
+		reason     string
+		want       int
+		wantReason string
+	}{
+		{"major without a reason", "Ibuprofen", "", http.StatusConflict, ""},
+		{"major with a reason", "Ibuprofen", " Short course, INR monitored ", http.StatusOK, "Short course, INR monitored"},
+		{"no warnings with a reason", "Paracetamol", "Not needed", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		resp := doRequest(t, app, http.MethodPost, "/api/medications", token, map[string]interface{}{
+			"patientId":      patient.ID,
+			"name":           tt.drug,
+			"overrideReason": tt.reason,
+		})
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, resp.StatusCode, tt.want)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			var body struct {
+				Error    string               `json:"error"`
+				Warnings []interactionWarning `json:"warnings"`
+			}
+			decodeBody(t, resp, &body)
+			if want := "Cannot prescribe: the medication has major interaction warnings, give an overrideReason to prescribe it anyway"; body.Error != want {
+				t.Errorf("%s: error = %q, want %q", tt.name, body.Error, want)
+			}
+			if len(body.Warnings) != 1 || body.Warnings[0].With != "Warfarin" {
+				t.Errorf("%s: warnings = %+v, want the one with Warfarin", tt.name, body.Warnings)
+			}
+			continue
+		}
+		var medication Medication
+		decodeBody(t, resp, &medication)
+		if medication.OverrideReason != tt.wantReason {
+			t.Errorf("%s: overrideReason = %q, want %q", tt.name, medication.OverrideReason, tt.wantReason)
+		}
+	}
+
+	var overrides int64
+	db.Model(&AuditEvent{}).Where("action = ?", "medication.override").Count(&overrides)
+	if overrides != 1 {
+		t.Errorf("%d overrides audited, want 1", overrides)
+	}
+}
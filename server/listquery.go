@@ -0,0 +1,234 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Kinds of typed filter a list endpoint can accept
+const (
+	filterEquals   = iota // exact match, comma separated values match any of them
+	filterUUID            // exact match on a UUID column
+	filterContains        // case-insensitive substring match
+	filterFrom            // date/time column on or after the given value
+	filterTo              // date/time column on or before the given value
+)
+
+// Page sizes for list endpoints
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// A query string parameter that filters a list
+type listFilter struct {
+	param  string
+	column string
+	kind   int
+}
+
+// Sort fields and filters a list endpoint accepts. Only whitelisted fields
+// ever reach the SQL.
+type listSpec struct {
+	sort        map[string]string // sort parameter -> column
+	defaultSort string            // prefix with "-" for descending
+	filters     []listFilter
+}
+
+// Position after the last row of a page, handed to clients as an opaque string
+type listCursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    string `json:"id"`
+}
+
+func encodeCursor(cur listCursor) string {
+	raw, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(s string) (listCursor, error) {
+	var cur listCursor
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cur, err
+	}
+	err = json.Unmarshal(raw, &cur)
+	return cur, err
+}
+
+// Parse a filter date, accepting a date, a datetime-local value or RFC 3339.
+// dateOnly reports whether the value named a whole day.
+func parseFilterTime(value string) (t time.Time, dateOnly bool, err error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, true, nil
+	}
+	if t, err := time.Parse("2006-01-02T15:04", value); err == nil {
+		return t, false, nil
+	}
+	t, err = time.Parse(time.RFC3339, value)
+	return t.UTC(), false, err
+}
+
+// Escape LIKE wildcards so user input only matches literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// Apply the spec's filters from the query string
+func applyListFilters(c *fiber.Ctx, query *gorm.DB, spec listSpec) (*gorm.DB, error) {
+	for _, f := range spec.filters {
+		value := c.Query(f.param)
+		if value == "" {
+			continue
+		}
+
+		switch f.kind {
+		case filterEquals:
+			query = query.Where(f.column+" IN ?", strings.Split(value, ","))
+		case filterUUID:
+			id, err := uuid.Parse(value)
+			if err != nil {
+				return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid '"+f.param+"', expected a UUID")
+			}
+			query = query.Where(f.column+" = ?", id)
+		case filterContains:
+			query = query.Where("LOWER("+f.column+`) LIKE ? ESCAPE '\'`, "%"+escapeLike(strings.ToLower(value))+"%")
+		case filterFrom, filterTo:
+			t, dateOnly, err := parseFilterTime(value)
+			if err != nil {
+				return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid '"+f.param+"', expected a date or RFC 3339 timestamp")
+			}
+			// Dates and times are stored as text in several formats, datetime() normalizes them
+			switch {
+			case f.kind == filterFrom:
+				query = query.Where("datetime("+f.column+") >= datetime(?)", t.Format("2006-01-02 15:04:05"))
+			case dateOnly:
+				// A date as the upper bound includes the whole day
+				query = query.Where("datetime("+f.column+") < datetime(?)", t.AddDate(0, 0, 1).Format("2006-01-02 15:04:05"))
+			default:
+				query = query.Where("datetime("+f.column+") <= datetime(?)", t.Format("2006-01-02 15:04:05"))
+			}
+		}
+	}
+	return query, nil
+}
+
+// Filter, sort and paginate a list query from the query string, loading one
+// page into dest (a pointer to a slice of models). Pages are selected with
+// limit and offset, or with the cursor returned as nextCursor, which stays
+// stable while rows are added. Returns the metadata for the response envelope.
+func listPage(c *fiber.Ctx, query *gorm.DB, spec listSpec, dest interface{}) (fiber.Map, error) {
+	query, err := applyListFilters(c, query, spec)
+	if err != nil {
+		return nil, err
+	}
+	// Reusable from here on, so counting does not leak into the page query
+	query = query.Session(&gorm.Session{})
+
+	sortParam := c.Query("sort", spec.defaultSort)
+	desc := strings.HasPrefix(sortParam, "-")
+	column, ok := spec.sort[strings.TrimPrefix(sortParam, "-")]
+	if !ok {
+		fields := make([]string, 0, len(spec.sort))
+		for field := range spec.sort {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid sort field, expected one of: "+strings.Join(fields, ", "))
+	}
+
+	limit, _ := strconv.Atoi(c.Query("limit", strconv.Itoa(defaultPageSize)))
+	if limit < 1 || limit > maxPageSize {
+		limit = defaultPageSize
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, err
+	}
+
+	page := query
+	direction, before := " ASC", ">"
+	if desc {
+		direction, before = " DESC", "<"
+	}
+
+	offset := 0
+	cursorParam := c.Query("cursor")
+	if cursorParam != "" {
+		cur, err := decodeCursor(cursorParam)
+		if err != nil || cur.Sort != sortParam {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid cursor")
+		}
+		// Rows after the cursor, with the ID breaking ties between equal sort values
+		page = page.Where("("+column+" "+before+" ? OR ("+column+" = ? AND id "+before+" ?))", cur.Value, cur.Value, cur.ID)
+	} else {
+		offset, _ = strconv.Atoi(c.Query("offset", "0"))
+		if offset < 0 {
+			offset = 0
+		}
+		page = page.Offset(offset)
+	}
+
+	// Fetch one extra row to learn whether there is another page
+	if err := page.Order(column + direction).Order("id" + direction).Limit(limit + 1).Find(dest).Error; err != nil {
+		return nil, err
+	}
+
+	rows := reflect.ValueOf(dest).Elem()
+	hasMore := rows.Len() > limit
+	if hasMore {
+		rows.Set(rows.Slice(0, limit))
+	}
+
+	meta := fiber.Map{
+		"total":   total,
+		"limit":   limit,
+		"hasMore": hasMore,
+	}
+	if cursorParam == "" {
+		meta["offset"] = offset
+	}
+
+	if hasMore {
+		// The cursor holds the sort column exactly as stored, so it compares
+		// the same way the rows were ordered
+		last := rows.Index(rows.Len() - 1)
+		id := last.FieldByName("ID").Interface()
+		model := reflect.New(last.Type()).Interface()
+
+		var value sql.NullString
+		if err := db.Unscoped().Model(model).Select("CAST("+column+" AS TEXT)").Where("id = ?", id).Row().Scan(&value); err != nil {
+			return nil, err
+		}
+		meta["nextCursor"] = encodeCursor(listCursor{Sort: sortParam, Value: value.String, ID: id.(uuid.UUID).String()})
+	}
+
+	return meta, nil
+}
+
+// Respond to an error from listPage or a similar helper, passing fiber errors
+// such as bad requests through
+func listError(c *fiber.Ctx, err error, message string) error {
+	if fe, ok := err.(*fiber.Error); ok {
+		return c.Status(fe.Code).JSON(fiber.Map{
+			"success": false,
+			"message": fe.Message,
+		})
+	}
+	return c.Status(500).JSON(fiber.Map{
+		"success": false,
+		"message": message,
+	})
+}
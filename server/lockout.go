@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Per-account brute-force protection, complementing the IP-keyed rateLimiter()
+type lockoutPolicy struct {
+	// Failures allowed before delays start
+	freeAttempts int
+	// Delay after the first failure beyond freeAttempts, doubling each time
+	baseDelay time.Duration
+	// Upper bound on the progressive delay
+	maxDelay time.Duration
+	// Failures that trigger a lockout
+	threshold int
+	// How long a lockout lasts
+	lockDuration time.Duration
+	// Clock, replaceable in tests
+	now func() time.Time
+}
+
+var accountLockout = &lockoutPolicy{
+	freeAttempts: 3,
+	baseDelay:    2 * time.Second,
+	maxDelay:     time.Minute,
+	threshold:    10,
+	lockDuration: 15 * time.Minute,
+	now:          time.Now,
+}
+
+// Load lockout settings from environment variables if available
+func loadLockoutConfig() {
+	if v, err := strconv.Atoi(os.Getenv("LOCKOUT_THRESHOLD")); err == nil && v > 0 {
+		accountLockout.threshold = v
+	}
+	if d, err := time.ParseDuration(os.Getenv("LOCKOUT_DURATION")); err == nil && d > 0 {
+		accountLockout.lockDuration = d
+	}
+}
+
+// Normalize an email address for use as a lockout key
+func lockoutKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// Delay required after a given number of consecutive failures
+func (p *lockoutPolicy) delayAfter(failures int) time.Duration {
+	if failures <= p.freeAttempts {
+		return 0
+	}
+	delay := time.Duration(float64(p.baseDelay) * math.Pow(2, float64(failures-p.freeAttempts-1)))
+	if delay > p.maxDelay || delay <= 0 {
+		delay = p.maxDelay
+	}
+	return delay
+}
+
+// Check whether a login attempt for an email may proceed. Returns how long
+// the caller must wait and whether the account is locked.
+func (p *lockoutPolicy) check(email string) (time.Duration, bool) {
+	var attempt LoginAttempt
+	if err := db.First(&attempt, "email = ?", lockoutKey(email)).Error; err != nil {
+		return 0, false
+	}
+
+	now := p.now()
+	if attempt.LockedUntil != nil {
+		if now.Before(*attempt.LockedUntil) {
+			return attempt.LockedUntil.Sub(now), true
+		}
+		// Lockout expired, give the account a fresh start
+		db.Delete(&attempt)
+		return 0, false
+	}
+
+	if wait := attempt.LastFailedAt.Add(p.delayAfter(attempt.FailedCount)).Sub(now); wait > 0 {
+		return wait, false
+	}
+	return 0, false
+}
+
+// Record a failed attempt, returning true if it locked the account
+func (p *lockoutPolicy) recordFailure(email string) bool {
+	key := lockoutKey(email)
+	now := p.now()
+	locked := false
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var attempt LoginAttempt
+		if err := tx.FirstOrInit(&attempt, LoginAttempt{Email: key}).Error; err != nil {
+			return err
+		}
+
+		attempt.FailedCount++
+		attempt.LastFailedAt = now
+		if attempt.FailedCount >= p.threshold && attempt.LockedUntil == nil {
+			until := now.Add(p.lockDuration)
+			attempt.LockedUntil = &until
+			locked = true
+		}
+		return tx.Save(&attempt).Error
+	})
+	if err != nil {
+		log.Printf("ERROR: Failed to record login failure for %s: %v", key, err)
+	}
+
+	return locked
+}
+
+// Clear the failure history for an email after a successful login
+func (p *lockoutPolicy) recordSuccess(email string) {
+	db.Delete(&LoginAttempt{}, "email = ?", lockoutKey(email))
+}
+
+// Reject a login attempt if the account is locked or must wait. Returns
+// false if the attempt may proceed.
+func rejectLockedLogin(c *fiber.Ctx, email string) (bool, error) {
+	wait, locked := accountLockout.check(email)
+	if wait <= 0 {
+		return false, nil
+	}
+
+	seconds := int(math.Ceil(wait.Seconds()))
+	c.Set("Retry-After", strconv.Itoa(seconds))
+	if locked {
+		return true, c.Status(423).JSON(fiber.Map{
+			"success": false,
+			"message": "Account temporarily locked due to repeated failed logins",
+		})
+	}
+	return true, c.Status(429).JSON(fiber.Map{
+		"success": false,
+		"message": fmt.Sprintf("Too many failed attempts, try again in %d seconds", seconds),
+	})
+}
+
+// Record a failed login and raise an audit event if it locked the account
+func recordLoginFailure(c *fiber.Ctx, email string) {
+	if accountLockout.recordFailure(email) {
+		log.Printf("WARN: Account %s locked after %d failed logins", lockoutKey(email), accountLockout.threshold)
+		recordAuditEvent(AuditEvent{
+			ActorEmail:   lockoutKey(email),
+			Action:       "account.locked",
+			ResourceType: "account",
+			ResourceID:   lockoutKey(email),
+			IP:           c.IP(),
+			Outcome:      auditDenied,
+			Details:      fmt.Sprintf("Locked for %s after %d failed logins", accountLockout.lockDuration, accountLockout.threshold),
+		})
+	}
+}
+
+// List accounts with failed logins or an active lockout
+func getLockouts(c *fiber.Ctx) error {
+	var attempts []LoginAttempt
+	if err := db.Order("last_failed_at DESC").Find(&attempts).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to fetch lockouts",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Lockouts retrieved successfully",
+		"data":    attempts,
+	})
+}
+
+// Unlock a user account and clear its failure history
+func unlockUser(c *fiber.Ctx) error {
+	var user Doctor
+	if err := db.First(&user, "id = ?", c.Params("id")).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "User not found",
+		})
+	}
+
+	accountLockout.recordSuccess(user.Email)
+
+	adminID := currentDoctorID(c)
+	adminEmail, _ := c.Locals("email").(string)
+	recordAuditEvent(AuditEvent{
+		ActorID:      &adminID,
+		ActorEmail:   adminEmail,
+		Action:       "account.unlocked",
+		ResourceType: "account",
+		ResourceID:   user.ID.String(),
+		IP:           c.IP(),
+		Outcome:      auditSuccess,
+	})
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Account unlocked",
+	})
+}
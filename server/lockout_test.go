@@ -0,0 +1,210 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// A clock for the lockout policy that only moves when told to
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// Give the lockout policy known settings and a fake clock for one test
+func useTestLockout(t *testing.T) *fakeClock {
+	t.Helper()
+	saved := *accountLockout
+	t.Cleanup(func() { *accountLockout = saved })
+
+	clock := &fakeClock{now: time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)}
+	*accountLockout = lockoutPolicy{
+		freeAttempts: 3,
+		baseDelay:    2 * time.Second,
+		maxDelay:     time.Minute,
+		threshold:    6,
+		lockDuration: 15 * time.Minute,
+		now:          func() time.Time { return clock.now },
+	}
+	return clock
+}
+
+func attemptLogin(t *testing.T, app *fiber.App, email, password string) *http.Response {
+	t.Helper()
+	return doRequest(t, app, http.MethodPost, "/api/auth/login", "", map[string]string{"email": email, "password": password})
+}
+
+func TestLockoutDelayAfter(t *testing.T) {
+	useTestLockout(t)
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{3, 0},
+		{4, 2 * time.Second},
+		{5, 4 * time.Second},
+		{8, 32 * time.Second},
+		{9, time.Minute},
+		{100, time.Minute},
+	}
+	for _, tt := range tests {
+		if got := accountLockout.delayAfter(tt.failures); got != tt.want {
+			t.Errorf("delayAfter(%d) = %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestLoginProgressiveDelay(t *testing.T) {
+	setupTestDB(t)
+	clock := useTestLockout(t)
+	app := newTestApp()
+	doctor, _ := createTestUser(t, RolePhysician, "password123")
+
+	// The free attempts, and the one after them, are answered straight away
+	for i := 1; i <= 4; i++ {
+		if resp := attemptLogin(t, app, doctor.Email, "wrong"); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("failure %d: status = %d, want %d", i, resp.StatusCode, http.StatusUnauthorized)
+		}
+	}
+
+	// Then each attempt must wait, even with the right password
+	resp := attemptLogin(t, app, doctor.Email, "password123")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("attempt during the delay: status = %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After = %q, want %q", got, "2")
+	}
+
+	clock.advance(2 * time.Second)
+	if resp := attemptLogin(t, app, doctor.Email, "wrong"); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("attempt after the delay: status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	// The delay doubles with each further failure
+	clock.advance(3 * time.Second)
+	resp = attemptLogin(t, app, doctor.Email, "password123")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("attempt during the doubled delay: status = %d, want %d", resp.StatusCode, http.StatusTooManyRequests)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q, want %q", got, "1")
+	}
+
+	// A successful login clears the history
+	clock.advance(time.Second)
+	if resp := attemptLogin(t, app, doctor.Email, "password123"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("login after the delay: status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	var attempts int64
+	db.Model(&LoginAttempt{}).Count(&attempts)
+	if attempts != 0 {
+		t.Errorf("%d login attempts recorded after a successful login, want 0", attempts)
+	}
+}
+
+// Fail logins until the account is locked, waiting out each delay
+func lockAccount(t *testing.T, app *fiber.App, clock *fakeClock, email string) {
+	t.Helper()
+	for i := 1; i <= accountLockout.threshold; i++ {
+		if resp := attemptLogin(t, app, email, "wrong"); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("failure %d: status = %d, want %d", i, resp.StatusCode, http.StatusUnauthorized)
+		}
+		clock.advance(accountLockout.delayAfter(i))
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	setupTestDB(t)
+	clock := useTestLockout(t)
+	app := newTestApp()
+	doctor, _ := createTestUser(t, RolePhysician, "password123")
+
+	lockAccount(t, app, clock, doctor.Email)
+
+	// Locked accounts refuse even the right password
+	resp := attemptLogin(t, app, doctor.Email, "password123")
+	if resp.StatusCode != http.StatusLocked {
+		t.Fatalf("login while locked: status = %d, want %d", resp.StatusCode, http.StatusLocked)
+	}
+	// The 15 minutes less the 8 seconds waited after the last failure
+	if got, want := resp.Header.Get("Retry-After"), "892"; got != want {
+		t.Errorf("Retry-After = %q, want %q", got, want)
+	}
+
+	var events []AuditEvent
+	db.Where("action = ?", "account.locked").Find(&events)
+	if len(events) != 1 {
+		t.Fatalf("%d account.locked events, want 1", len(events))
+	}
+	if events[0].ResourceID != doctor.Email || events[0].Outcome != auditDenied {
+		t.Errorf("account.locked event for %q with outcome %q, want %q and %q", events[0].ResourceID, events[0].Outcome, doctor.Email, auditDenied)
+	}
+
+	clock.advance(14 * time.Minute)
+	if resp := attemptLogin(t, app, doctor.Email, "password123"); resp.StatusCode != http.StatusLocked {
+		t.Fatalf("login before the lockout expires: status = %d, want %d", resp.StatusCode, http.StatusLocked)
+	}
+
+	// Once the lockout expires the account starts afresh
+	clock.advance(time.Minute)
+	if resp := attemptLogin(t, app, doctor.Email, "password123"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("login after the lockout expires: status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestLockoutOfUnknownEmail(t *testing.T) {
+	setupTestDB(t)
+	clock := useTestLockout(t)
+	app := newTestApp()
+
+	// Unknown emails lock like real ones, so lockouts don't reveal accounts
+	lockAccount(t, app, clock, "nobody@example.com")
+	if resp := attemptLogin(t, app, "Nobody@Example.com", "wrong"); resp.StatusCode != http.StatusLocked {
+		t.Fatalf("login while locked: status = %d, want %d", resp.StatusCode, http.StatusLocked)
+	}
+}
+
+func TestUnlockUser(t *testing.T) {
+	setupTestDB(t)
+	clock := useTestLockout(t)
+	app := newTestApp()
+	doctor, _ := createTestUser(t, RolePhysician, "password123")
+	admin, adminToken := createTestUser(t, RoleAdmin, "password123")
+	_, physicianToken := createTestUser(t, RolePhysician, "password123")
+
+	lockAccount(t, app, clock, doctor.Email)
+
+	resp := doRequest(t, app, http.MethodGet, "/api/admin/lockouts", adminToken, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("listing lockouts: status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	path := "/api/admin/users/" + doctor.ID.String() + "/unlock"
+	if resp := doRequest(t, app, http.MethodPost, path, physicianToken, nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("unlocking as a physician: status = %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+	if resp := doRequest(t, app, http.MethodPost, path, adminToken, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("unlocking as an admin: status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	if resp := attemptLogin(t, app, doctor.Email, "password123"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("login after unlocking: status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	var unlocks []AuditEvent
+	db.Where("action = ? AND resource_id = ?", "account.unlocked", doctor.ID.String()).Find(&unlocks)
+	if len(unlocks) != 1 {
+		t.Fatalf("%d account.unlocked events, want 1", len(unlocks))
+	}
+	if unlocks[0].ActorEmail != admin.Email {
+		t.Errorf("account.unlocked actor = %q, want %q", unlocks[0].ActorEmail, admin.Email)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"mime"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// MailMessage is a plain-text email
+type MailMessage struct {
+	To      string    `json:"to"`
+	Subject string    `json:"subject"`
+	Body    string    `json:"body"`
+	SentAt  time.Time `json:"sentAt"`
+}
+
+// Mailer delivers email. Select an implementation with MAIL_DRIVER.
+type Mailer interface {
+	Send(ctx context.Context, msg MailMessage) error
+}
+
+var mailer Mailer = newMemoryMailer()
+
+// Mailer that delivers through an SMTP server
+type smtpMailer struct {
+	host     string
+	port     string
+	username string
+	password string
+	from     string
+}
+
+func (m *smtpMailer) Send(ctx context.Context, msg MailMessage) error {
+	var auth smtp.Auth
+	if m.username != "" {
+		auth = smtp.PlainAuth("", m.username, m.password, m.host)
+	}
+	body, err := formatMail(m.from, msg)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(m.host+":"+m.port, auth, m.from, []string{msg.To}, body)
+}
+
+// Mailer that keeps messages in memory, for tests and local development
+type memoryMailer struct {
+	mu       sync.Mutex
+	messages []MailMessage
+}
+
+func newMemoryMailer() *memoryMailer {
+	return &memoryMailer{}
+}
+
+func (m *memoryMailer) Send(ctx context.Context, msg MailMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msg.SentAt = time.Now()
+	m.messages = append(m.messages, msg)
+	log.Printf("INFO: Mail to %s queued in memory: %s", msg.To, msg.Subject)
+	return nil
+}
+
+// Messages returns a copy of every message sent so far
+func (m *memoryMailer) Messages() []MailMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]MailMessage(nil), m.messages...)
+}
+
+// Mailer that writes each message as an .eml file, for local development
+type fileMailer struct {
+	dir  string
+	from string
+}
+
+func (m *fileMailer) Send(ctx context.Context, msg MailMessage) error {
+	if err := os.MkdirAll(m.dir, 0o755); err != nil {
+		return err
+	}
+
+	body, err := formatMail(m.from, msg)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102-150405"), uuid.New().String()[:8])
+	return os.WriteFile(filepath.Join(m.dir, name), body, 0o644)
+}
+
+// Format a message as RFC 5322 text. Addresses with line breaks, which would
+// add headers of their own, are rejected, and the subject is encoded as an
+// RFC 2047 word when it is not plain ASCII.
+func formatMail(from string, msg MailMessage) ([]byte, error) {
+	for _, header := range [][2]string{{"From", from}, {"To", msg.To}} {
+		if strings.ContainsAny(header[1], "\r\n") {
+			return nil, fmt.Errorf("the %s address contains a line break", header[0])
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("From: " + from + "\r\n")
+	b.WriteString("To: " + msg.To + "\r\n")
+	b.WriteString("Subject: " + mime.QEncoding.Encode("UTF-8", msg.Subject) + "\r\n")
+	b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String()), nil
+}
+
+// Configure the mailer from environment variables
+func loadMailerConfig() {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "MedThing <no-reply@medthing.local>"
+	}
+
+	switch os.Getenv("MAIL_DRIVER") {
+	case "smtp":
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		mailer = &smtpMailer{
+			host:     os.Getenv("SMTP_HOST"),
+			port:     port,
+			username: os.Getenv("SMTP_USERNAME"),
+			password: os.Getenv("SMTP_PASSWORD"),
+			from:     from,
+		}
+	case "file":
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			dir = "mail"
+		}
+		mailer = &fileMailer{dir: dir, from: from}
+	default:
+		mailer = newMemoryMailer()
+	}
+}
+
+// Send an email in the background so response times don't reveal whether
+// an address has an account
+func sendMailAsync(msg MailMessage) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		if err := mailer.Send(ctx, msg); err != nil {
+			log.Printf("ERROR: Failed to send mail to %s: %v", msg.To, err)
+		}
+	}()
+}
+
+// List messages held by the in-memory mailer (development only)
+func getDevMailbox(c *fiber.Ctx) error {
+	mem, ok := mailer.(*memoryMailer)
+	if !ok {
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "In-memory mailer is not enabled",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Mailbox retrieved successfully",
+		"data":    mem.Messages(),
+	})
+}
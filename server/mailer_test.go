@@ -0,0 +1,55 @@
+package main
+
+import (
+	"mime"
+	"strings"
+	"testing"
+)
+
+func TestFormatMail(t *testing.T) {
+	from := "MedThing <no-reply@medthing.local>"
+	tests := []struct {
+		name        string
+		msg         MailMessage
+		wantSubject string
+		wantErr     string
+	}{
+		{"plain", MailMessage{To: "ada@example.com", Subject: "Reset your password", Body: "Hello"}, "Reset your password", ""},
+		{"non-ASCII subject", MailMessage{To: "ada@example.com", Subject: "Rappel: rendez-vous à 9h"}, "Rappel: rendez-vous à 9h", ""},
+		{"line break in the subject", MailMessage{To: "ada@example.com", Subject: "Hi\r\nBcc: victim@example.com"}, "Hi\r\nBcc: victim@example.com", ""},
+		{"line break in the address", MailMessage{To: "ada@example.com\r\nBcc: victim@example.com", Subject: "Hi"}, "", "the To address contains a line break"},
+		{"bare newline in the address", MailMessage{To: "ada@example.com\nBcc: victim@example.com", Subject: "Hi"}, "", "the To address contains a line break"},
+	}
+	for _, tt := range tests {
+		out, err := formatMail(from, tt.msg)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("%s: error = %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: formatMail failed: %v", tt.name, err)
+			continue
+		}
+
+		headers, _, _ := strings.Cut(string(out), "\r\n\r\n")
+		var subject string
+		for _, line := range strings.Split(headers, "\r\n") {
+			name, value, ok := strings.Cut(line, ": ")
+			if !ok || strings.ContainsAny(line, "\r\n") {
+				t.Errorf("%s: malformed header line %q", tt.name, line)
+			}
+			if name == "Bcc" {
+				t.Errorf("%s: injected header %q", tt.name, line)
+			}
+			if name == "Subject" {
+				subject = value
+			}
+		}
+		decoded, err := new(mime.WordDecoder).DecodeHeader(subject)
+		if err != nil || decoded != tt.wantSubject {
+			t.Errorf("%s: subject %q decodes to %q (%v), want %q", tt.name, subject, decoded, err, tt.wantSubject)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"os"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
@@ -23,8 +24,7 @@ func initDB() {
 		panic("failed to connect to database")
 	}
 
-	// Auto migrate all models
-	db.AutoMigrate(&Doctor{}, &Patient{}, &Appointment{}, &Medication{}, &HealthMetric{}, &Report{})
+	migrateDB()
 	
 	// Check if we need to create a default admin doctor (for testing)
 	var count int64
@@ -32,17 +32,68 @@ func initDB() {
 	if count == 0 && os.Getenv("ENV") == "development" {
 		// Create a default doctor for testing
 		hashedPassword, _ := hashPassword("admin123")
+		now := time.Now()
 		defaultDoctor := Doctor{
-			ID:             uuid.New(),
-			Email:          "admin@example.com",
-			Password:       hashedPassword,
-			Name:           "Admin Doctor",
-			Specialization: "Administration",
-			LicenseNumber:  "ADMIN-12345",
+			ID:              uuid.New(),
+			Email:           "admin@example.com",
+			Password:        hashedPassword,
+			Name:            "Admin Doctor",
+			Specialization:  "Administration",
+			LicenseNumber:   "ADMIN-12345",
+			Role:            RoleAdmin,
+			EmailVerifiedAt: &now,
 		}
 		db.Create(&defaultDoctor)
 		log.Println("Created default admin doctor: admin@example.com / admin123")
 	}
+
+	// Promote an existing account to admin, e.g. after upgrading a deployment
+	// that predates roles and has no admin yet
+	if email := os.Getenv("BOOTSTRAP_ADMIN_EMAIL"); email != "" {
+		result := db.Model(&Doctor{}).Where("email = ?", email).Update("role", RoleAdmin)
+		if result.Error != nil || result.RowsAffected == 0 {
+			log.Printf("Failed to promote %s to admin", email)
+		}
+	}
+
+	// Patients created before care teams existed are visible to nobody until
+	// they are assigned; optionally hand them all to one doctor on startup
+	if email := os.Getenv("CARE_TEAM_DEFAULT_DOCTOR"); email != "" {
+		claimed, err := claimOrphanedPatients(email)
+		if err != nil {
+			log.Printf("Failed to assign orphaned patients to %s: %v", email, err)
+		} else if claimed > 0 {
+			log.Printf("Assigned %d patients without a care team to %s", claimed, email)
+		}
+	}
+}
+
+// Migrate the schema and bring existing records up to date
+func migrateDB() {
+	// Accounts created before email verification existed are trusted as verified
+	verifyExisting := db.Migrator().HasTable(&Doctor{}) && !db.Migrator().HasColumn(&Doctor{}, "EmailVerifiedAt")
+
+	// Auto migrate all models
+	db.AutoMigrate(&Doctor{}, &RefreshToken{}, &RecoveryCode{}, &SecurityPolicy{}, &ActionToken{}, &LoginAttempt{}, &AuditEvent{}, &Patient{}, &PatientAllergy{}, &CareTeamMember{}, &Appointment{}, &AppointmentStatusChange{}, &AppointmentSeries{}, &CalendarFeed{}, &AppointmentReminder{}, &WaitlistEntry{}, &WaitlistWindow{}, &WaitlistOffer{}, &WorkingHours{}, &ScheduleBreak{}, &Holiday{}, &AppointmentType{}, &Medication{}, &MedicationAdministration{}, &PatientDevice{}, &RefillRequest{}, &DrugInteraction{}, &DrugClassMember{}, &HealthMetric{}, &Report{})
+
+	if verifyExisting {
+		db.Model(&Doctor{}).Where("email_verified_at IS NULL").Update("email_verified_at", time.Now())
+	}
+
+	// Chain any unhashed audit events and make the table append-only
+	if err := sealAuditLog(); err != nil {
+		log.Printf("Failed to seal audit log: %v", err)
+	}
+
+	initSecurityPolicy()
+
+	// Create or catch up the patient search index
+	initSearchIndex()
+	initScheduling()
+	migrateAppointmentStatuses()
+	structureExistingMedications()
+	normalizeExistingMetrics()
+	initInteractions()
 }
 
 func main() {
@@ -53,10 +104,36 @@ func main() {
 	
 	// Initialize the database
 	initDB()
+
+	// Apply account lockout and mail settings
+	loadLockoutConfig()
+	loadMailerConfig()
+	loadRetentionConfig()
+	loadCalendarConfig()
+	loadReminderConfig()
+	loadNotifierConfig()
+	loadWaitlistConfig()
+	loadAdherenceConfig()
+	loadRefillConfig()
 	
 	// Start the rate limiter cleanup routine in a goroutine
 	go cleanupRateLimiter()
 
+	// Start the expired refresh token cleanup routine in a goroutine
+	go cleanupRefreshTokens()
+
+	// Start the purge of expired archived records in a goroutine
+	go runRetentionPurge()
+
+	// Start the appointment reminder scheduler in a goroutine
+	go runReminderScheduler()
+
+	// Start the expiry of unanswered waitlist offers in a goroutine
+	go runWaitlistOffers()
+
+	// Start the refill requests for medications running out in a goroutine
+	go runRefillChecks()
+
 	// Get CORS origin from environment or use default
 	corsOrigin := os.Getenv("CORS_ORIGIN")
 	if corsOrigin == "" {
@@ -89,6 +166,21 @@ func main() {
 		AllowMethods: "GET, POST, PUT, DELETE, OPTIONS",
 	}))
 
+	setupRoutes(app)
+
+	// Get port from environment variables or use default
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8000"
+	}
+
+	// Start the server
+	log.Printf("Starting server on port %s", port)
+	log.Fatal(app.Listen(":" + port))
+}
+
+// Register all API routes
+func setupRoutes(app *fiber.App) {
 	// Health check endpoint
 	app.Get("/", func(c *fiber.Ctx) error {
 		return c.JSON(fiber.Map{
@@ -107,42 +199,100 @@ func main() {
 	auth.Post("/login", login)
 	auth.Post("/signup", signup)
 	auth.Get("/me", protected(), getCurrentUser)
-	auth.Post("/refresh", protected(), refreshToken)
+	auth.Post("/refresh", refreshToken)
+	auth.Post("/logout", logout)
+	auth.Post("/logout-all", protected(), logoutAll)
+	auth.Post("/login/2fa", loginVerify2FA)
+	auth.Post("/password/forgot", forgotPassword)
+	auth.Post("/password/reset", resetPassword)
+	auth.Post("/verify-email", verifyEmail)
+	auth.Post("/verify-email/resend", protected(), resendVerificationEmail)
+	auth.Post("/2fa/setup", protected(), setup2FA)
+	auth.Post("/2fa/confirm", protected(), confirm2FA)
+	auth.Post("/2fa/disable", protected(), disable2FA)
+	auth.Post("/2fa/recovery-codes", protected(), regenerateRecoveryCodes)
 
 	// Patients routes - protected by JWT
 	patients := api.Group("/patients")
-	patients.Use(protected()) // All patient routes require authentication
-	patients.Get("/", getAllPatients)
-	patients.Post("/", createPatient)
-	patients.Get("/:id", getPatient)
-	patients.Put("/:id", updatePatient)
-	patients.Delete("/:id", deletePatient)
+	patients.Use(protected(), requireAccountPolicy()) // All patient routes require authentication
+	patients.Get("/", requirePermission(PermPatientsRead), getAllPatients)
+	patients.Get("/search", requirePermission(PermPatientsRead), searchPatients)
+	patients.Post("/", requirePermission(PermPatientsWrite), createPatient)
+	patients.Get("/:id", requirePermission(PermPatientsRead), getPatient)
+	patients.Put("/:id", requirePermission(PermPatientsWrite), updatePatient)
+	patients.Delete("/:id", requirePermission(PermPatientsDelete), deletePatient)
+	patients.Get("/:id/care-team", requirePermission(PermPatientsRead), getCareTeam)
+	patients.Post("/:id/care-team", requirePermission(PermCareTeamManage), addCareTeamMember)
+	patients.Delete("/:id/care-team/:doctorId", requirePermission(PermCareTeamManage), removeCareTeamMember)
+	patients.Get("/:id/allergies", requirePermission(PermPatientsRead), getPatientAllergies)
+	patients.Post("/:id/allergies", requirePermission(PermPatientsWrite), createPatientAllergy)
+	patients.Delete("/:id/allergies/:allergyId", requirePermission(PermPatientsWrite), deletePatientAllergy)
+	patients.Get("/:id/devices", requirePermission(PermPatientsRead), getPatientDevices)
+	patients.Post("/:id/devices", requirePermission(PermPatientsWrite), createPatientDevice)
+	patients.Delete("/:id/devices/:deviceId", requirePermission(PermPatientsWrite), revokePatientDevice)
 
 	// Appointments routes - protected by JWT
 	appointments := api.Group("/appointments")
-	appointments.Use(protected()) // All appointment routes require authentication
-	appointments.Get("/", getAllAppointments)
-	appointments.Post("/", createAppointment)
-	appointments.Get("/:id", getAppointment)
-	appointments.Put("/:id", updateAppointment)
-	appointments.Delete("/:id", deleteAppointment)
+	appointments.Use(protected(), requireAccountPolicy()) // All appointment routes require authentication
+	appointments.Get("/", requirePermission(PermAppointmentsRead), getAllAppointments)
+	appointments.Post("/", requirePermission(PermAppointmentsWrite), createAppointment)
+	appointments.Get("/free-slots", requirePermission(PermAppointmentsRead), getFreeSlots)
+	appointments.Post("/series", requirePermission(PermAppointmentsWrite), createAppointmentSeries)
+	appointments.Get("/series/:id", requirePermission(PermAppointmentsRead), getAppointmentSeries)
+	appointments.Get("/types", requirePermission(PermAppointmentsRead), getAppointmentTypes)
+	appointments.Get("/calendar", requirePermission(PermAppointmentsRead), getAppointmentCalendar)
+	appointments.Get("/stats/status", requirePermission(PermStatsRead), getAppointmentStatusStats)
+	appointments.Get("/:id", requirePermission(PermAppointmentsRead), getAppointment)
+	appointments.Put("/:id", requirePermission(PermAppointmentsWrite), updateAppointment)
+	appointments.Delete("/:id", requirePermission(PermAppointmentsDelete), deleteAppointment)
+	appointments.Get("/:id/history", requirePermission(PermAppointmentsRead), getAppointmentHistory)
+	appointments.Get("/:id/ics", requirePermission(PermAppointmentsRead), exportAppointmentICS)
+	appointments.Get("/:id/reminders", requirePermission(PermAppointmentsRead), getAppointmentReminders)
+	appointments.Post("/:id/schedule", requirePermission(PermAppointmentsWrite), transitionAppointment(statusScheduled))
+	appointments.Post("/:id/check-in", requirePermission(PermAppointmentsWrite), transitionAppointment(statusCheckedIn))
+	appointments.Post("/:id/start", requirePermission(PermAppointmentsWrite), transitionAppointment(statusInProgress))
+	appointments.Post("/:id/complete", requirePermission(PermAppointmentsWrite), transitionAppointment(statusCompleted))
+	appointments.Post("/:id/cancel", requirePermission(PermAppointmentsWrite), transitionAppointment(statusCancelled))
+	appointments.Post("/:id/no-show", requirePermission(PermAppointmentsWrite), transitionAppointment(statusNoShow))
+	appointments.Post("/:id/reschedule", requirePermission(PermAppointmentsWrite), rescheduleAppointment)
 
 	// Medications routes - protected by JWT
 	medications := api.Group("/medications")
-	medications.Use(protected()) // All medication routes require authentication
-	medications.Get("/patient/:id", getPatientMedications)
-	medications.Post("/", createMedication)
-	medications.Put("/:id", updateMedication)
-	medications.Delete("/:id", deleteMedication)
+	medications.Use(protected(), requireAccountPolicy()) // All medication routes require authentication
+	medications.Get("/patient/:id", requirePermission(PermMedicationsRead), getPatientMedications)
+	medications.Get("/patient/:id/adherence", requirePermission(PermMedicationsRead), getPatientAdherence)
+	medications.Post("/", requirePermission(PermMedicationsWrite), createMedication)
+	medications.Put("/:id", requirePermission(PermMedicationsWrite), updateMedication)
+	medications.Delete("/:id", requirePermission(PermMedicationsDelete), deleteMedication)
+	medications.Get("/interactions", requirePermission(PermMedicationsRead), checkInteractions)
+	medications.Get("/running-out", requirePermission(PermMedicationsRead), getRunningOutMedications)
+	medications.Get("/:id/timeline", requirePermission(PermMedicationsRead), getMedicationTimeline)
+	medications.Get("/:id/administrations", requirePermission(PermMedicationsRead), getMedicationAdministrations)
+	medications.Post("/:id/administrations", requirePermission(PermMedicationsAdminister), createMedicationAdministration)
+	medications.Get("/:id/adherence", requirePermission(PermMedicationsRead), getMedicationAdherence)
+	medications.Get("/:id/refill-requests", requirePermission(PermMedicationsRead), getMedicationRefillRequests)
+	medications.Post("/:id/refill-requests", requirePermission(PermMedicationsAdminister), requestRefill)
+	medications.Put("/:id/prescription", requirePermission(PermMedicationsWrite), updatePrescription)
+
+	// Refill request routes - protected by JWT, decided by the prescriber
+	refills := api.Group("/refill-requests")
+	refills.Use(protected(), requireAccountPolicy())
+	refills.Get("/", requirePermission(PermMedicationsRead), getRefillRequests)
+	refills.Post("/:id/approve", requirePermission(PermMedicationsWrite), approveRefillRequest)
+	refills.Post("/:id/deny", requirePermission(PermMedicationsWrite), denyRefillRequest)
 
 	// Health metrics routes - protected by JWT
 	metrics := api.Group("/metrics")
-	metrics.Use(protected()) // All metric routes require authentication
-	metrics.Get("/patient/:id", getPatientMetrics)
-	metrics.Post("/", createHealthMetric)
-	metrics.Get("/trends/:patientId", getHealthTrends)
-	metrics.Get("/stats/trends", getStatsTrends)
-	metrics.Get("/stats/monthly", getMonthlyStats)
+	metrics.Use(protected(), requireAccountPolicy()) // All metric routes require authentication
+	metrics.Get("/types", requirePermission(PermMetricsRead), getMetricTypes)
+	metrics.Get("/patient/:id", requirePermission(PermMetricsRead), getPatientMetrics)
+	metrics.Post("/", requirePermission(PermMetricsWrite), createHealthMetric)
+	metrics.Post("/batch", requirePermission(PermMetricsWrite), createHealthMetricBatch)
+	metrics.Get("/vitals/:patientId", requirePermission(PermMetricsRead), getLatestVitals)
+	metrics.Get("/trends/:patientId", requirePermission(PermMetricsRead), getHealthTrends)
+	metrics.Get("/summary/:patientId", requirePermission(PermMetricsRead), getMetricSummary)
+	metrics.Get("/stats/trends", requirePermission(PermStatsRead), getStatsTrends)
+	metrics.Get("/stats/monthly", requirePermission(PermStatsRead), getMonthlyStats)
 
 	// // AI analysis routes - protected by JWT
 	// ai := api.Group("/ai")
@@ -151,18 +301,77 @@ func main() {
 
 	// Reports routes - protected by JWT
 	reports := api.Group("/reports")
-	reports.Use(protected()) // All report routes require authentication
-	reports.Get("/", getReports)
-	reports.Get("/:id", getReport)
-	reports.Post("/generate", generateMedicalReport)
+	reports.Use(protected(), requireAccountPolicy()) // All report routes require authentication
+	reports.Get("/", requirePermission(PermReportsRead), getReports)
+	reports.Get("/:id", requirePermission(PermReportsRead), getReport)
+	reports.Post("/generate", requirePermission(PermReportsGenerate), generateMedicalReport)
 
-	// Get port from environment variables or use default
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8000"
-	}
+	// Admin routes - protected by JWT and restricted to user managers
+	admin := api.Group("/admin")
+	admin.Use(protected(), requireAccountPolicy(), requirePermission(PermUsersManage))
+	admin.Get("/users", getUsers)
+	admin.Get("/roles", getRoles)
+	admin.Put("/users/:id/role", updateUserRole)
+	admin.Post("/users/:id/2fa/reset", resetUser2FA)
+	admin.Get("/lockouts", getLockouts)
+	admin.Post("/users/:id/unlock", unlockUser)
+	admin.Get("/security-policy", getSecurityPolicyHandler)
+	admin.Put("/security-policy", updateSecurityPolicy)
+	admin.Put("/appointment-types", updateDefaultAppointmentTypes)
+	admin.Post("/interactions/import", importInteractionDataset)
 
-	// Start the server
-	log.Printf("Starting server on port %s", port)
-	log.Fatal(app.Listen(":" + port))
+	// Audit log routes - protected by JWT and restricted to auditors
+	audit := api.Group("/audit")
+	audit.Use(protected(), requireAccountPolicy(), requirePermission(PermAuditRead))
+	audit.Get("/", getAuditEvents)
+	audit.Get("/export", exportAuditEvents)
+	audit.Get("/verify", verifyAuditLog)
+
+	// Schedule routes - doctors edit their own ("me"), schedule managers anyone's
+	schedules := api.Group("/schedules")
+	schedules.Use(protected(), requireAccountPolicy())
+	schedules.Get("/:doctorId", requirePermission(PermAppointmentsRead), getSchedule)
+	schedules.Put("/:doctorId/working-hours", requirePermission(PermAppointmentsWrite), updateWorkingHours)
+	schedules.Put("/:doctorId/breaks", requirePermission(PermAppointmentsWrite), updateBreaks)
+	schedules.Post("/:doctorId/holidays", requirePermission(PermAppointmentsWrite), addHoliday)
+	schedules.Delete("/:doctorId/holidays/:id", requirePermission(PermAppointmentsWrite), deleteHoliday)
+	schedules.Put("/:doctorId/appointment-types", requirePermission(PermAppointmentsWrite), updateDoctorAppointmentTypes)
+
+	// Calendar feed routes - the feed itself is public, its URL token authenticates it
+	calendar := api.Group("/calendar")
+	calendar.Get("/feed/:token", serveCalendarFeed)
+	calendar.Get("/feeds", protected(), requireAccountPolicy(), requirePermission(PermAppointmentsRead), getCalendarFeeds)
+	calendar.Post("/feeds", protected(), requireAccountPolicy(), requirePermission(PermAppointmentsRead), createCalendarFeed)
+	calendar.Delete("/feeds/:id", protected(), requireAccountPolicy(), requirePermission(PermAppointmentsRead), revokeCalendarFeed)
+
+	// Waitlist routes - protected by JWT
+	waitlist := api.Group("/waitlist")
+	waitlist.Use(protected(), requireAccountPolicy())
+	waitlist.Get("/", requirePermission(PermAppointmentsRead), getWaitlist)
+	waitlist.Post("/", requirePermission(PermAppointmentsWrite), createWaitlistEntry)
+	waitlist.Get("/offers", requirePermission(PermAppointmentsRead), getWaitlistOffers)
+	waitlist.Post("/offers/:id/accept", requirePermission(PermAppointmentsWrite), acceptWaitlistOffer)
+	waitlist.Post("/offers/:id/decline", requirePermission(PermAppointmentsWrite), declineWaitlistOffer)
+	waitlist.Get("/:id", requirePermission(PermAppointmentsRead), getWaitlistEntry)
+	waitlist.Put("/:id", requirePermission(PermAppointmentsWrite), updateWaitlistEntry)
+	waitlist.Delete("/:id", requirePermission(PermAppointmentsWrite), removeWaitlistEntry)
+
+	// Patient device routes - authenticated by the device's own token, scoped to its patient
+	device := api.Group("/device")
+	device.Use(deviceAuth())
+	device.Get("/medications", getDeviceMedications)
+	device.Post("/doses", createDeviceAdministration)
+	device.Post("/refill-requests", requestDeviceRefill)
+
+	// Trash routes - protected by JWT and restricted to users who may restore records
+	trash := api.Group("/trash")
+	trash.Use(protected(), requireAccountPolicy(), requirePermission(PermTrashManage))
+	trash.Get("/", getTrash)
+	trash.Post("/:type/:id/restore", restoreFromTrash)
+
+	// Development-only mailbox for the in-memory mailer
+	if os.Getenv("ENV") == "development" {
+		api.Get("/dev/mailbox", getDevMailbox)
+		api.Get("/dev/notifications", getDevNotifications)
+	}
 }
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestMain(m *testing.M) {
+	// Bcrypt at the production cost makes every test account slow to create
+	bcryptCost = 4
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// Point the package at a fresh, migrated database for one test
+func setupTestDB(t *testing.T) {
+	t.Helper()
+	var err error
+	db, err = gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("failed to open the test database: %v", err)
+	}
+	migrateDB()
+
+	// The IP rate limiter is shared by every request from the test client
+	limiter.mu.Lock()
+	limiter.clients = make(map[string]*clientRateLimit)
+	limiter.mu.Unlock()
+
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+}
+
+// An app with every API route, as main() serves it
+func newTestApp() *fiber.App {
+	app := fiber.New()
+	setupRoutes(app)
+	return app
+}
+
+// Create a verified account with a role and return it with an access token
+func createTestUser(t *testing.T, role, password string) (Doctor, string) {
+	t.Helper()
+	hashed, err := hashPassword(password)
+	if err != nil {
+		t.Fatalf("failed to hash password: %v", err)
+	}
+	now := time.Now()
+	id := uuid.New()
+	doctor := Doctor{
+		ID:              id,
+		Email:           role + "-" + id.String()[:8] + "@example.com",
+		Password:        hashed,
+		Name:            "Test " + role,
+		Role:            role,
+		EmailVerifiedAt: &now,
+	}
+	if err := db.Create(&doctor).Error; err != nil {
+		t.Fatalf("failed to create %s: %v", role, err)
+	}
+
+	token, err := generateToken(doctor, true)
+	if err != nil {
+		t.Fatalf("failed to generate token: %v", err)
+	}
+	return doctor, token
+}
+
+// Create a patient cared for by the given doctors
+func createTestPatient(t *testing.T, name string, doctors ...Doctor) Patient {
+	t.Helper()
+	patient := Patient{Name: name, DateOfBirth: "1980-04-12", Gender: "female"}
+	if err := db.Create(&patient).Error; err != nil {
+		t.Fatalf("failed to create patient %s: %v", name, err)
+	}
+	for _, d := range doctors {
+		if err := db.Create(&CareTeamMember{PatientID: patient.ID, DoctorID: d.ID, Role: "primary"}).Error; err != nil {
+			t.Fatalf("failed to add %s to the care team: %v", d.Email, err)
+		}
+	}
+	return patient
+}
+
+// The clinic time of the next Monday at least a week away, at the given hour
+func nextMonday(hour int) time.Time {
+	day := clinicNow().AddDate(0, 0, 7)
+	for day.Weekday() != time.Monday {
+		day = day.AddDate(0, 0, 1)
+	}
+	return time.Date(day.Year(), day.Month(), day.Day(), hour, 0, 0, 0, day.Location())
+}
+
+// Decode a JSON response body
+func decodeBody(t *testing.T, resp *http.Response, v interface{}) {
+	t.Helper()
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("failed to decode the response: %v", err)
+	}
+}
+
+// Send a JSON request to the app, with a bearer token unless it is empty
+func doRequest(t *testing.T, app *fiber.App, method, path, token string, body interface{}) *http.Response {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("failed to encode request body: %v", err)
+		}
+		reader = bytes.NewReader(payload)
+	}
+
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, path, err)
+	}
+	return resp
+}
@@ -1,15 +1,47 @@
 package main
 
-import "github.com/gofiber/fiber/v2"
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// Sorting and filtering accepted by getPatientMedications
+var medicationListSpec = listSpec{
+	sort: map[string]string{
+		"name":      "name",
+		"startDate": "start_date",
+		"endDate":   "end_date",
+		"createdAt": "created_at",
+	},
+	defaultSort: "-startDate",
+	filters: []listFilter{
+		{"name", "name", filterContains},
+		{"startFrom", "start_date", filterFrom},
+		{"startTo", "start_date", filterTo},
+	},
+}
 
 func getPatientMedications(c *fiber.Ctx) error {
-	id := c.Params("id")
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil || !canAccessPatient(c, id) {
+		auditAccess(c, "list", "medication", "", id, auditNotFound)
+		return c.Status(404).JSON(fiber.Map{"error": "Patient not found"})
+	}
+
 	var medications []Medication
-	result := db.Where("patient_id = ?", id).Find(&medications)
-	if result.Error != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch medications"})
+	meta, err := listPage(c, db.Model(&Medication{}).Where("patient_id = ?", id), medicationListSpec, &medications)
+	if err != nil {
+		auditAccess(c, "list", "medication", "", id, auditError)
+		return listError(c, err, "Failed to fetch medications")
 	}
-	return c.JSON(medications)
+
+	auditAccess(c, "list", "medication", "", id, auditSuccess)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Medications retrieved successfully",
+		"data":    medications,
+		"meta":    meta,
+	})
 }
 
 func createMedication(c *fiber.Ctx) error {
@@ -18,11 +50,32 @@ func createMedication(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
 	}
 
+	if !canAccessPatient(c, medication.PatientID) {
+		auditAccess(c, "create", "medication", "", medication.PatientID, auditNotFound)
+		return c.Status(404).JSON(fiber.Map{"error": "Patient not found"})
+	}
+
+	if err := structureDosing(medication); err != nil {
+		return c.Status(422).JSON(fiber.Map{"error": "Invalid dosing: " + err.Error()})
+	}
+	if err := preparePrescription(c, medication, true); err != nil {
+		return c.Status(422).JSON(fiber.Map{"error": "Invalid prescription: " + err.Error()})
+	}
+	if status, err := checkPrescription(medication, uuid.Nil); err != nil {
+		return c.Status(status).JSON(fiber.Map{"error": "Cannot prescribe: " + err.Error(), "warnings": medication.Warnings})
+	}
+
 	result := db.Create(&medication)
 	if result.Error != nil {
+		auditAccess(c, "create", "medication", "", medication.PatientID, auditError)
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to create medication"})
 	}
 
+	auditAccess(c, "create", "medication", medication.ID.String(), medication.PatientID, auditSuccess)
+	if medication.OverrideReason != "" {
+		auditOverride(c, medication)
+	}
+	reindexPatient(medication.PatientID)
 	return c.JSON(medication)
 }
 
@@ -33,18 +86,84 @@ func updateMedication(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
 	}
 
-	result := db.Model(&Medication{}).Where("id = ?", id).Updates(medication)
+	if medication.PatientID != uuid.Nil && !canAccessPatient(c, medication.PatientID) {
+		auditAccess(c, "update", "medication", id, medication.PatientID, auditNotFound)
+		return c.Status(404).JSON(fiber.Map{"error": "Patient not found"})
+	}
+
+	var existing Medication
+	if err := db.Scopes(scopePatientRecords(c)).First(&existing, "id = ?", id).Error; err != nil {
+		auditAccess(c, "update", "medication", id, uuid.Nil, auditNotFound)
+		return c.Status(404).JSON(fiber.Map{"error": "Medication not found"})
+	}
+
+	// Apply the changes over the stored medication. Free text that changes
+	// without its structured counterpart is parsed again, and the other way
+	// round the free text is described again from the structured fields.
+	updated := existing
+	if err := c.BodyParser(&updated); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	if medication.Dosage != "" && medication.DoseUnit == "" && medication.DoseQuantity == 0 {
+		updated.DoseQuantity, updated.DoseUnit = 0, ""
+	} else if medication.Dosage == "" && (medication.DoseUnit != "" || medication.DoseQuantity != 0) {
+		updated.Dosage = ""
+	}
+	if medication.Frequency != "" && medication.Schedule == nil {
+		updated.Schedule = nil
+	} else if medication.Frequency == "" && medication.Schedule != nil {
+		updated.Frequency = ""
+	}
+	if err := structureDosing(&updated); err != nil {
+		return c.Status(422).JSON(fiber.Map{"error": "Invalid dosing: " + err.Error()})
+	}
+
+	// Check again when the drug or the patient changes
+	recheck := updated.Name != existing.Name || updated.PatientID != existing.PatientID
+	if recheck {
+		updated.OverrideReason = medication.OverrideReason
+		if status, err := checkPrescription(&updated, existing.ID); err != nil {
+			return c.Status(status).JSON(fiber.Map{"error": "Cannot prescribe: " + err.Error(), "warnings": updated.Warnings})
+		}
+	} else {
+		updated.OverrideReason = existing.OverrideReason
+	}
+
+	result := db.Model(&existing).
+		Select("patient_id", "name", "dosage", "frequency", "dose_quantity", "dose_unit", "route", "schedule",
+			"start_date", "end_date", "notes", "override_reason").
+		Updates(&updated)
 	if result.Error != nil {
+		auditAccess(c, "update", "medication", id, existing.PatientID, auditError)
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to update medication"})
 	}
+
+	auditAccess(c, "update", "medication", id, existing.PatientID, auditSuccess)
+	if recheck && updated.OverrideReason != "" {
+		auditOverride(c, &updated)
+	}
+	reindexPatient(existing.PatientID)
+	if medication.PatientID != uuid.Nil && medication.PatientID != existing.PatientID {
+		reindexPatient(medication.PatientID)
+	}
 	return c.SendStatus(204)
 }
 
 func deleteMedication(c *fiber.Ctx) error {
 	id := c.Params("id")
-	result := db.Delete(&Medication{}, "id = ?", id)
+	var existing Medication
+	if err := db.Scopes(scopePatientRecords(c)).First(&existing, "id = ?", id).Error; err != nil {
+		auditAccess(c, "delete", "medication", id, uuid.Nil, auditNotFound)
+		return c.Status(404).JSON(fiber.Map{"error": "Medication not found"})
+	}
+
+	result := db.Delete(&existing)
 	if result.Error != nil {
+		auditAccess(c, "delete", "medication", id, existing.PatientID, auditError)
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete medication"})
 	}
+
+	auditAccess(c, "delete", "medication", id, existing.PatientID, auditSuccess)
+	reindexPatient(existing.PatientID)
 	return c.SendStatus(204) // No Content
 }
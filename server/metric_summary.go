@@ -0,0 +1,115 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// A value in one series of a patient's metrics: the values of a simple metric
+// type, or of one component of a composite one
+type metricPoint struct {
+	Type       string
+	Component  string
+	Value      float64
+	Unit       string
+	Flag       string
+	MeasuredAt string
+}
+
+// The values a metric adds to its series, one per component of a composite
+// metric
+func metricPoints(m HealthMetric) []metricPoint {
+	if len(m.Components) == 0 {
+		return []metricPoint{{Type: m.Type, Value: m.Value, Unit: m.Unit, Flag: m.Flag, MeasuredAt: m.MeasuredAt}}
+	}
+	points := make([]metricPoint, len(m.Components))
+	for i, r := range m.Components {
+		points[i] = metricPoint{Type: m.Type, Component: r.Code, Value: r.Value, Unit: r.Unit, Flag: r.Flag, MeasuredAt: m.MeasuredAt}
+	}
+	return points
+}
+
+type seriesSummary struct {
+	Type       string  `json:"type"`
+	Component  string  `json:"component,omitempty"`
+	Unit       string  `json:"unit"`
+	Count      int     `json:"count"`
+	Min        float64 `json:"min"`
+	Max        float64 `json:"max"`
+	Mean       float64 `json:"mean"`
+	Latest     float64 `json:"latest"`
+	LatestAt   string  `json:"latestAt"`
+	LatestFlag string  `json:"latestFlag,omitempty"`
+	OutOfRange int     `json:"outOfRange"` // readings flagged low, high or critical
+}
+
+// Summarise each series of a patient's metrics, composite metrics by component
+func getMetricSummary(c *fiber.Ctx) error {
+	patientID, err := uuid.Parse(c.Params("patientId"))
+	if err != nil || !canAccessPatient(c, patientID) {
+		auditAccess(c, "read", "health_summary", "", patientID, auditNotFound)
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Patient not found",
+		})
+	}
+	system, err := unitSystem(c)
+	if err != nil {
+		return listError(c, err, "")
+	}
+	query, err := applyListFilters(c, db.Where("patient_id = ?", patientID), metricListSpec)
+	if err != nil {
+		return listError(c, err, "")
+	}
+
+	var metrics []HealthMetric
+	if err := query.Order("measured_at").Find(&metrics).Error; err != nil {
+		auditAccess(c, "read", "health_summary", "", patientID, auditError)
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to fetch health metrics",
+		})
+	}
+	convertMetrics(metrics, system)
+
+	summaries := []*seriesSummary{}
+	byKey := map[string]*seriesSummary{}
+	for _, m := range metrics {
+		for _, p := range metricPoints(m) {
+			key := p.Type + "\x00" + p.Component + "\x00" + p.Unit
+			s, ok := byKey[key]
+			if !ok {
+				s = &seriesSummary{Type: p.Type, Component: p.Component, Unit: p.Unit, Min: p.Value, Max: p.Value}
+				byKey[key] = s
+				summaries = append(summaries, s)
+			}
+			s.Count++
+			s.Mean += p.Value
+			if p.Value < s.Min {
+				s.Min = p.Value
+			}
+			if p.Value > s.Max {
+				s.Max = p.Value
+			}
+			if p.MeasuredAt >= s.LatestAt {
+				s.Latest, s.LatestAt, s.LatestFlag = p.Value, p.MeasuredAt, p.Flag
+			}
+			if p.Flag != "" && p.Flag != flagNormal {
+				s.OutOfRange++
+			}
+		}
+	}
+	for _, s := range summaries {
+		s.Mean = roundTo(s.Mean/float64(s.Count), 2)
+	}
+	sort.SliceStable(summaries, func(i, j int) bool { return summaries[i].Type < summaries[j].Type })
+
+	auditAccess(c, "read", "health_summary", "", patientID, auditSuccess)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Health metric summary retrieved successfully",
+		"data":    summaries,
+	})
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// Buckets trend series can be downsampled into
+const (
+	bucketDay   = "day"
+	bucketWeek  = "week"
+	bucketMonth = "month"
+)
+
+// Largest moving average window, in points
+const maxTrendWindow = 365
+
+// A slope with a p-value below this is significant
+const trendSignificance = 0.05
+
+// A point of a trend series: a reading, or a bucket of readings summarized by
+// their mean
+type trendPoint struct {
+	At            string   `json:"at"` // when it was measured, or the first day of the bucket
+	Value         float64  `json:"value"`
+	Flag          string   `json:"flag,omitempty"`
+	Count         int      `json:"count,omitempty"`
+	Min           *float64 `json:"min,omitempty"`
+	Max           *float64 `json:"max,omitempty"`
+	Median        *float64 `json:"median,omitempty"`
+	MovingAverage *float64 `json:"movingAverage,omitempty"` // of this and the window's earlier points
+}
+
+// A least squares line through a series' readings
+type trendRegression struct {
+	SlopePerDay float64 `json:"slopePerDay"`
+	RSquared    float64 `json:"rSquared"`
+	PValue      float64 `json:"pValue"` // of there being no trend
+	Significant bool    `json:"significant"`
+	N           int     `json:"n"`
+}
+
+type trendChange struct {
+	Baseline   float64  `json:"baseline"`
+	BaselineAt string   `json:"baselineAt"`
+	Latest     float64  `json:"latest"`
+	LatestAt   string   `json:"latestAt"`
+	Change     float64  `json:"change"`
+	Percent    *float64 `json:"percent"` // nil when the baseline is 0
+}
+
+type trendSeries struct {
+	Type       string           `json:"type"`
+	Component  string           `json:"component,omitempty"`
+	Unit       string           `json:"unit"`
+	Points     []trendPoint     `json:"points"`
+	Regression *trendRegression `json:"regression,omitempty"`
+	Change     *trendChange     `json:"change,omitempty"`
+}
+
+// A reading in a series, with when it was measured
+type trendReading struct {
+	metricPoint
+	at time.Time
+}
+
+// What a trends request asks for
+type trendOptions struct {
+	bucket     string
+	window     int
+	regression bool
+	baseline   string // first, or a date
+}
+
+func parseTrendOptions(c *fiber.Ctx) (trendOptions, error) {
+	opts := trendOptions{
+		bucket:     strings.ToLower(c.Query("bucket")),
+		regression: c.Query("regression") == "true",
+		baseline:   c.Query("baseline"),
+	}
+	switch opts.bucket {
+	case "", bucketDay, bucketWeek, bucketMonth:
+	default:
+		return opts, fiber.NewError(fiber.StatusBadRequest, "bucket must be day, week or month")
+	}
+	if w := c.Query("window"); w != "" {
+		n, err := strconv.Atoi(w)
+		if err != nil || n < 2 || n > maxTrendWindow {
+			return opts, fiber.NewError(fiber.StatusBadRequest, "window must be a number of points from 2 to 365")
+		}
+		opts.window = n
+	}
+	if opts.baseline != "" && opts.baseline != "first" {
+		if _, err := time.Parse(scheduleDateLayout, opts.baseline); err != nil {
+			return opts, fiber.NewError(fiber.StatusBadRequest, "baseline must be first or a date")
+		}
+	}
+	return opts, nil
+}
+
+// The first day of the bucket a time falls in
+func bucketStart(t time.Time, bucket string) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch bucket {
+	case bucketWeek:
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7)) // back to Monday
+	case bucketMonth:
+		return day.AddDate(0, 0, 1-day.Day())
+	}
+	return day
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// Summarise readings into buckets of their min, max, mean and median
+func bucketReadings(readings []trendReading, bucket string) []trendPoint {
+	points := []trendPoint{}
+	var values []float64
+	var start time.Time
+	flush := func() {
+		if len(values) == 0 {
+			return
+		}
+		lo, hi, sum := values[0], values[0], 0.0
+		for _, v := range values {
+			lo, hi, sum = math.Min(lo, v), math.Max(hi, v), sum+v
+		}
+		med := roundTo(median(values), 2)
+		points = append(points, trendPoint{
+			At:     start.Format(scheduleDateLayout),
+			Value:  roundTo(sum/float64(len(values)), 2),
+			Count:  len(values),
+			Min:    &lo,
+			Max:    &hi,
+			Median: &med,
+		})
+		values = nil
+	}
+	for _, r := range readings {
+		if s := bucketStart(r.at, bucket); !s.Equal(start) {
+			flush()
+			start = s
+		}
+		values = append(values, r.Value)
+	}
+	flush()
+	return points
+}
+
+// Add the trailing moving average over window points to each point that has
+// enough before it
+func addMovingAverage(points []trendPoint, window int) {
+	sum := 0.0
+	for i := range points {
+		sum += points[i].Value
+		if i >= window {
+			sum -= points[i-window].Value
+		}
+		if i >= window-1 {
+			avg := roundTo(sum/float64(window), 2)
+			points[i].MovingAverage = &avg
+		}
+	}
+}
+
+// Fit a line through the readings against time in days, and test its slope
+// against there being no trend. Nil with fewer than three readings at
+// different times.
+func regress(readings []trendReading) *trendRegression {
+	n := float64(len(readings))
+	if len(readings) < 3 {
+		return nil
+	}
+	first := readings[0].at
+	var sx, sy float64
+	for _, r := range readings {
+		sx += r.at.Sub(first).Hours() / 24
+		sy += r.Value
+	}
+	mx, my := sx/n, sy/n
+	var sxx, sxy, syy float64
+	for _, r := range readings {
+		dx, dy := r.at.Sub(first).Hours()/24-mx, r.Value-my
+		sxx += dx * dx
+		sxy += dx * dy
+		syy += dy * dy
+	}
+	if sxx == 0 {
+		return nil
+	}
+
+	slope := sxy / sxx
+	result := &trendRegression{SlopePerDay: roundTo(slope, 4), N: len(readings), RSquared: 1}
+	if syy > 0 {
+		result.RSquared = roundTo(sxy*sxy/(sxx*syy), 4)
+	}
+	df := n - 2
+	sse := math.Max(syy-slope*sxy, 0)
+	if sse == 0 {
+		result.PValue = 0
+	} else {
+		t := slope / math.Sqrt(sse/df/sxx)
+		result.PValue = roundTo(incompleteBeta(df/(df+t*t), df/2, 0.5), 4)
+	}
+	result.Significant = slope != 0 && result.PValue < trendSignificance
+	return result
+}
+
+// The regularized incomplete beta function I_x(a, b), which gives the two
+// sided p-value of Student's t as I_(df/(df+t²))(df/2, 1/2)
+func incompleteBeta(x, a, b float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+	if x >= 1 {
+		return 1
+	}
+	lab, _ := math.Lgamma(a + b)
+	la, _ := math.Lgamma(a)
+	lb, _ := math.Lgamma(b)
+	front := math.Exp(lab - la - lb + a*math.Log(x) + b*math.Log(1-x))
+	if x < (a+1)/(a+b+2) {
+		return front * betaFraction(x, a, b) / a
+	}
+	return 1 - front*betaFraction(1-x, b, a)/b
+}
+
+// Evaluate the continued fraction for the incomplete beta function by Lentz's
+// method
+func betaFraction(x, a, b float64) float64 {
+	const epsilon, tiny = 1e-14, 1e-300
+	nonzero := func(v float64) float64 {
+		if math.Abs(v) < tiny {
+			return tiny
+		}
+		return v
+	}
+	c, d := 1.0, 1/nonzero(1-(a+b)*x/(a+1))
+	h := d
+	for m := 1.0; m <= 300; m++ {
+		even := m * (b - m) * x / ((a + 2*m - 1) * (a + 2*m))
+		d = 1 / nonzero(1+even*d)
+		c = nonzero(1 + even/c)
+		h *= d * c
+		odd := -(a + m) * (a + b + m) * x / ((a + 2*m) * (a + 2*m + 1))
+		d = 1 / nonzero(1+odd*d)
+		c = nonzero(1 + odd/c)
+		delta := d * c
+		h *= delta
+		if math.Abs(delta-1) < epsilon {
+			break
+		}
+	}
+	return h
+}
+
+// The change from the baseline reading to the latest: the first reading, or
+// the last on or before the baseline date, or the first after it if none
+func changeSince(readings []trendReading, baseline string) *trendChange {
+	base := readings[0]
+	if baseline != "first" {
+		date, _ := time.Parse(scheduleDateLayout, baseline)
+		for _, r := range readings {
+			if !r.at.Before(date.AddDate(0, 0, 1)) {
+				break
+			}
+			base = r
+		}
+	}
+	latest := readings[len(readings)-1]
+	change := &trendChange{
+		Baseline:   base.Value,
+		BaselineAt: base.MeasuredAt,
+		Latest:     latest.Value,
+		LatestAt:   latest.MeasuredAt,
+		Change:     roundTo(latest.Value-base.Value, 2),
+	}
+	if base.Value != 0 {
+		percent := roundTo((latest.Value-base.Value)/base.Value*100, 1)
+		change.Percent = &percent
+	}
+	return change
+}
+
+// Work out a series' points and statistics from its readings, in time order
+func buildTrendSeries(readings []trendReading, opts trendOptions) trendSeries {
+	first := readings[0]
+	series := trendSeries{Type: first.Type, Component: first.Component, Unit: first.Unit}
+	if opts.bucket != "" {
+		series.Points = bucketReadings(readings, opts.bucket)
+	} else {
+		series.Points = make([]trendPoint, len(readings))
+		for i, r := range readings {
+			series.Points[i] = trendPoint{At: r.MeasuredAt, Value: r.Value, Flag: r.Flag}
+		}
+	}
+	if opts.window > 0 {
+		addMovingAverage(series.Points, opts.window)
+	}
+	if opts.regression {
+		series.Regression = regress(readings)
+	}
+	if opts.baseline != "" {
+		series.Change = changeSince(readings, opts.baseline)
+	}
+	return series
+}
+
+// Trend series of a patient's metrics, one per type and component of
+// composite types, in canonical units unless ?units= is given. Series can be
+// downsampled with ?bucket=, smoothed with ?window=, and come with a
+// regression line with ?regression=true and the change since a baseline with
+// ?baseline=.
+func getHealthTrends(c *fiber.Ctx) error {
+	patientID, err := uuid.Parse(c.Params("patientId"))
+	if err != nil || !canAccessPatient(c, patientID) {
+		auditAccess(c, "read", "health_trends", "", patientID, auditNotFound)
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Patient not found",
+		})
+	}
+	system, err := unitSystem(c)
+	if err != nil {
+		return listError(c, err, "")
+	}
+	opts, err := parseTrendOptions(c)
+	if err != nil {
+		return listError(c, err, "")
+	}
+	query, err := applyListFilters(c, db.Where("patient_id = ?", patientID), metricListSpec)
+	if err != nil {
+		return listError(c, err, "")
+	}
+
+	var metrics []HealthMetric
+	if err := query.Order("measured_at").Order("created_at").Find(&metrics).Error; err != nil {
+		auditAccess(c, "read", "health_trends", "", patientID, auditError)
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to fetch health trends",
+		})
+	}
+	convertMetrics(metrics, system)
+
+	keys := []string{}
+	readings := map[string][]trendReading{}
+	for _, m := range metrics {
+		at, err := parseMeasuredAt(m.MeasuredAt)
+		if err != nil {
+			continue
+		}
+		for _, p := range metricPoints(m) {
+			key := p.Type + "\x00" + p.Component + "\x00" + p.Unit
+			if _, ok := readings[key]; !ok {
+				keys = append(keys, key)
+			}
+			readings[key] = append(readings[key], trendReading{p, at})
+		}
+	}
+
+	series := make([]trendSeries, 0, len(keys))
+	for _, key := range keys {
+		r := readings[key]
+		sort.SliceStable(r, func(i, j int) bool { return r[i].at.Before(r[j].at) })
+		series = append(series, buildTrendSeries(r, opts))
+	}
+	sort.SliceStable(series, func(i, j int) bool {
+		return metricTypeOrder(series[i].Type) < metricTypeOrder(series[j].Type)
+	})
+
+	auditAccess(c, "read", "health_trends", "", patientID, auditSuccess)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Health trends retrieved successfully",
+		"data":    series,
+	})
+}
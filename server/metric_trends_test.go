@@ -0,0 +1,83 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestIncompleteBeta(t *testing.T) {
+	tests := []struct {
+		name    string
+		x, a, b float64
+		want    float64
+	}{
+		{"I_x(1, 1) is x", 0.3, 1, 1, 0.3},
+		{"I_x(a, 1) is x^a", 0.6, 3, 1, math.Pow(0.6, 3)},
+		{"I_x(1, b) is 1-(1-x)^b", 0.2, 1, 4, 1 - math.Pow(0.8, 4)},
+		{"symmetric at one half", 0.5, 7.5, 7.5, 0.5},
+		{"I_x(a, b) is 1-I_(1-x)(b, a)", 0.8, 2.5, 0.5, 1 - incompleteBeta(0.2, 0.5, 2.5)},
+		{"at 0", 0, 2, 3, 0},
+		{"at 1", 1, 2, 3, 1},
+	}
+	for _, tt := range tests {
+		if got := incompleteBeta(tt.x, tt.a, tt.b); math.Abs(got-tt.want) > 1e-10 {
+			t.Errorf("%s: incompleteBeta(%g, %g, %g) = %.12f, want %.12f", tt.name, tt.x, tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+// Two sided p-values of Student's t, from t tables and closed forms
+func TestStudentPValue(t *testing.T) {
+	tests := []struct {
+		t, df float64
+		want  float64
+	}{
+		{1, 1, 0.5},
+		{12.706205, 1, 0.05},
+		{4.302653, 2, 0.05},
+		{2.776445, 4, 0.05},
+		{4.604095, 4, 0.01},
+		{2.228139, 10, 0.05},
+		{3.169273, 10, 0.01},
+		{2, 10, 0.073388},
+		{1.983972, 100, 0.05},
+		{0, 10, 1},
+	}
+	for _, tt := range tests {
+		got := incompleteBeta(tt.df/(tt.df+tt.t*tt.t), tt.df/2, 0.5)
+		if math.Abs(got-tt.want) > 1e-6 {
+			t.Errorf("p of t = %g with %g degrees of freedom = %.7f, want %.6f", tt.t, tt.df, got, tt.want)
+		}
+	}
+}
+
+func TestRegress(t *testing.T) {
+	start := time.Date(2025, 3, 1, 8, 0, 0, 0, time.UTC)
+	daily := func(values ...float64) []trendReading {
+		readings := make([]trendReading, len(values))
+		for i, v := range values {
+			readings[i] = trendReading{metricPoint: metricPoint{Value: v}, at: start.AddDate(0, 0, i)}
+		}
+		return readings
+	}
+
+	tests := []struct {
+		name     string
+		readings []trendReading
+		want     *trendRegression
+	}{
+		{"noisy rise", daily(1, 3, 2, 5, 4), &trendRegression{SlopePerDay: 0.8, RSquared: 0.64, PValue: 0.1041, Significant: false, N: 5}},
+		{"steady rise", daily(2, 2.5, 3, 3.5, 4, 4.5), &trendRegression{SlopePerDay: 0.5, RSquared: 1, PValue: 0, Significant: true, N: 6}},
+		{"steady fall", daily(90, 88.1, 86.4, 83.8, 82.2, 80.1, 78, 76.3), &trendRegression{SlopePerDay: -1.9869, RSquared: 0.9985, PValue: 0, Significant: true, N: 8}},
+		{"flat", daily(5, 5, 5), &trendRegression{SlopePerDay: 0, RSquared: 1, PValue: 0, Significant: false, N: 3}},
+		{"too few readings", daily(1, 2), nil},
+		{"all at once", []trendReading{{at: start}, {at: start}, {at: start}}, nil},
+	}
+	for _, tt := range tests {
+		got := regress(tt.readings)
+		if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+			t.Errorf("%s: regress = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Flags given to readings against their reference range
+const (
+	flagNormal   = "normal"
+	flagLow      = "low"
+	flagHigh     = "high"
+	flagCritical = "critical"
+)
+
+// The normal range of a metric for the patients it applies to. Bounds left at
+// 0 do not apply.
+type referenceRange struct {
+	Sex          string  `json:"sex,omitempty"`    // male or female, anyone when empty
+	MinAge       int     `json:"minAge,omitempty"` // in years
+	MaxAge       int     `json:"maxAge,omitempty"` // exclusive, no limit when 0
+	Low          float64 `json:"low,omitempty"`
+	High         float64 `json:"high,omitempty"`
+	CriticalLow  float64 `json:"criticalLow,omitempty"`
+	CriticalHigh float64 `json:"criticalHigh,omitempty"`
+}
+
+// A kind of health metric. Values outside Min and Max cannot be real readings
+// and are rejected. Composite metrics, such as blood pressure, are made up of
+// components which are measured like metrics of their own.
+type metricType struct {
+	Code       string           `json:"code"`
+	Name       string           `json:"name"`
+	Unit       string           `json:"unit,omitempty"`  // canonical unit, which ranges are given in
+	Units      []metricUnit     `json:"units,omitempty"` // units readings may be recorded in, the canonical one first
+	Min        float64          `json:"min,omitempty"`
+	Max        float64          `json:"max,omitempty"`
+	Ranges     []referenceRange `json:"ranges,omitempty"` // the first that applies is used
+	Components []metricType     `json:"components,omitempty"`
+	Optional   bool             `json:"optional,omitempty"`   // for components, which are otherwise required
+	StaleHours int              `json:"staleHours,omitempty"` // how long a reading stays current
+
+	// Checks across the components of a composite metric, by component code
+	check func(values map[string]float64) error
+}
+
+// A component of a composite metric as recorded
+type metricComponent struct {
+	Code           string          `json:"code"`
+	Value          float64         `json:"value"`
+	Unit           string          `json:"unit"`
+	CanonicalValue float64         `json:"canonicalValue"`
+	CanonicalUnit  string          `json:"canonicalUnit"`
+	Flag           string          `json:"flag,omitempty"`
+	ReferenceRange *referenceRange `json:"referenceRange,omitempty"`
+}
+
+var (
+	cholesterolUnits = []metricUnit{{Unit: "mg/dL", System: unitsUS, Scale: 1}, {Unit: "mmol/L", System: unitsMetric, Scale: 0.0258598}}
+	cellCountUnits   = []metricUnit{{Unit: "10^9/L", Scale: 1}}
+
+	hemoglobinType = metricType{Code: "hemoglobin", Name: "Hemoglobin", StaleHours: 2160, Unit: "g/dL", Units: []metricUnit{{Unit: "g/dL", Scale: 1}, {Unit: "g/L", Scale: 10}}, Min: 2, Max: 25, Ranges: []referenceRange{
+		{Sex: "male", MinAge: 18, Low: 13.5, High: 17.5, CriticalLow: 7, CriticalHigh: 20},
+		{Sex: "female", MinAge: 18, Low: 12, High: 15.5, CriticalLow: 7, CriticalHigh: 20},
+		{Low: 11, High: 16, CriticalLow: 7, CriticalHigh: 20},
+	}}
+)
+
+// Registered metric types. Adult ranges come first, as they are used when the
+// patient's age is unknown.
+var metricTypes = []metricType{
+	{Code: "weight", Name: "Weight", StaleHours: 720, Unit: "kg", Units: []metricUnit{{Unit: "kg", System: unitsMetric, Scale: 1}, {Unit: "lb", System: unitsUS, Scale: 2.2046226218}}, Min: 0.2, Max: 650},
+	{Code: "height", Name: "Height", StaleHours: 8760, Unit: "cm", Units: []metricUnit{{Unit: "cm", System: unitsMetric, Scale: 1}, {Unit: "in", System: unitsUS, Scale: 0.3937007874}}, Min: 20, Max: 275},
+	{Code: "bmi", Name: "Body mass index", StaleHours: 720, Unit: "kg/m2", Units: []metricUnit{{Unit: "kg/m2", Scale: 1}}, Min: 5, Max: 150, Ranges: []referenceRange{
+		{MinAge: 18, Low: 18.5, High: 24.9, CriticalLow: 15},
+	}},
+	{Code: "temperature", Name: "Body temperature", StaleHours: 24, Unit: "°C", Units: []metricUnit{{Unit: "°C", System: unitsMetric, Scale: 1}, {Unit: "°F", System: unitsUS, Scale: 1.8, Offset: 32}}, Min: 25, Max: 45, Ranges: []referenceRange{
+		{Low: 36.1, High: 37.2, CriticalLow: 35, CriticalHigh: 40},
+	}},
+	{Code: "heart_rate", Name: "Heart rate", StaleHours: 24, Unit: "bpm", Units: []metricUnit{{Unit: "bpm", Scale: 1}}, Min: 20, Max: 300, Ranges: []referenceRange{
+		{MinAge: 18, Low: 60, High: 100, CriticalLow: 40, CriticalHigh: 130},
+		{MinAge: 6, MaxAge: 18, Low: 70, High: 110, CriticalLow: 50, CriticalHigh: 150},
+		{MinAge: 1, MaxAge: 6, Low: 80, High: 130, CriticalLow: 60, CriticalHigh: 180},
+		{MaxAge: 1, Low: 100, High: 160, CriticalLow: 80, CriticalHigh: 200},
+	}},
+	{Code: "respiratory_rate", Name: "Respiratory rate", StaleHours: 24, Unit: "breaths/min", Units: []metricUnit{{Unit: "breaths/min", Scale: 1}}, Min: 2, Max: 80, Ranges: []referenceRange{
+		{MinAge: 18, Low: 12, High: 20, CriticalLow: 8, CriticalHigh: 30},
+		{MinAge: 6, MaxAge: 18, Low: 14, High: 24, CriticalLow: 10, CriticalHigh: 40},
+		{MaxAge: 6, Low: 20, High: 40, CriticalLow: 15, CriticalHigh: 60},
+	}},
+	{Code: "oxygen_saturation", Name: "Oxygen saturation", StaleHours: 24, Unit: "%", Units: []metricUnit{{Unit: "%", Scale: 1}}, Min: 50, Max: 100, Ranges: []referenceRange{
+		{Low: 95, CriticalLow: 90},
+	}},
+	{Code: "blood_pressure", Name: "Blood pressure", StaleHours: 24, Components: []metricType{
+		{Code: "systolic", Name: "Systolic pressure", Unit: "mmHg", Units: []metricUnit{{Unit: "mmHg", Scale: 1}}, Min: 40, Max: 300, Ranges: []referenceRange{
+			{MinAge: 18, Low: 90, High: 129, CriticalLow: 70, CriticalHigh: 180},
+		}},
+		{Code: "diastolic", Name: "Diastolic pressure", Unit: "mmHg", Units: []metricUnit{{Unit: "mmHg", Scale: 1}}, Min: 20, Max: 200, Ranges: []referenceRange{
+			{MinAge: 18, Low: 60, High: 79, CriticalLow: 40, CriticalHigh: 120},
+		}},
+	}, check: func(values map[string]float64) error {
+		if values["diastolic"] >= values["systolic"] {
+			return fmt.Errorf("the diastolic pressure must be lower than the systolic pressure")
+		}
+		return nil
+	}},
+	{Code: "blood_sugar", Name: "Blood glucose", StaleHours: 24, Unit: "mg/dL", Units: []metricUnit{{Unit: "mg/dL", System: unitsUS, Scale: 1}, {Unit: "mmol/L", System: unitsMetric, Scale: 0.0555062}}, Min: 10, Max: 1500, Ranges: []referenceRange{
+		{Low: 70, High: 140, CriticalLow: 54, CriticalHigh: 400},
+	}},
+	{Code: "cholesterol_total", Name: "Total cholesterol", StaleHours: 8760, Unit: "mg/dL", Units: cholesterolUnits, Min: 50, Max: 1000, Ranges: []referenceRange{
+		{High: 199},
+	}},
+	hemoglobinType,
+	{Code: "pain_score", Name: "Pain score", StaleHours: 12, Unit: "score", Units: []metricUnit{{Unit: "score", Scale: 1}}, Min: 0, Max: 10},
+	{Code: "lipid_panel", Name: "Lipid panel", StaleHours: 8760, Components: []metricType{
+		{Code: "total_cholesterol", Name: "Total cholesterol", Unit: "mg/dL", Units: cholesterolUnits, Min: 50, Max: 1000, Optional: true, Ranges: []referenceRange{
+			{High: 199},
+		}},
+		{Code: "ldl", Name: "LDL cholesterol", Unit: "mg/dL", Units: cholesterolUnits, Min: 10, Max: 1000, Optional: true, Ranges: []referenceRange{
+			{High: 99},
+		}},
+		{Code: "hdl", Name: "HDL cholesterol", Unit: "mg/dL", Units: cholesterolUnits, Min: 5, Max: 200, Optional: true, Ranges: []referenceRange{
+			{Sex: "female", Low: 50},
+			{Low: 40},
+		}},
+		{Code: "triglycerides", Name: "Triglycerides", Unit: "mg/dL", Units: []metricUnit{{Unit: "mg/dL", System: unitsUS, Scale: 1}, {Unit: "mmol/L", System: unitsMetric, Scale: 0.0112901}}, Min: 10, Max: 5000, Optional: true, Ranges: []referenceRange{
+			{High: 149, CriticalHigh: 1000},
+		}},
+	}},
+	{Code: "cbc", Name: "Complete blood count", StaleHours: 2160, Components: []metricType{
+		{Code: "wbc", Name: "White blood cells", Unit: "10^9/L", Units: cellCountUnits, Min: 0.1, Max: 500, Optional: true, Ranges: []referenceRange{
+			{Low: 4, High: 11, CriticalLow: 2, CriticalHigh: 30},
+		}},
+		withOptional(hemoglobinType),
+		{Code: "hematocrit", Name: "Hematocrit", Unit: "%", Units: []metricUnit{{Unit: "%", Scale: 1}}, Min: 5, Max: 80, Optional: true, Ranges: []referenceRange{
+			{Sex: "male", MinAge: 18, Low: 41, High: 53, CriticalLow: 20, CriticalHigh: 60},
+			{Sex: "female", MinAge: 18, Low: 36, High: 46, CriticalLow: 20, CriticalHigh: 60},
+			{Low: 33, High: 48, CriticalLow: 20, CriticalHigh: 60},
+		}},
+		{Code: "platelets", Name: "Platelets", Unit: "10^9/L", Units: cellCountUnits, Min: 1, Max: 3000, Optional: true, Ranges: []referenceRange{
+			{Low: 150, High: 400, CriticalLow: 50, CriticalHigh: 1000},
+		}},
+	}},
+}
+
+// Other names metric types are recorded under
+var metricTypeAliases = map[string]string{
+	"body_weight":     "weight",
+	"body_mass_index": "bmi",
+	"temp":            "temperature", "body_temperature": "temperature",
+	"pulse": "heart_rate", "heartrate": "heart_rate", "hr": "heart_rate",
+	"respiration_rate": "respiratory_rate", "rr": "respiratory_rate",
+	"spo2": "oxygen_saturation", "o2_saturation": "oxygen_saturation", "sao2": "oxygen_saturation",
+	"bp":      "blood_pressure",
+	"glucose": "blood_sugar", "blood_glucose": "blood_sugar",
+	"cholesterol": "cholesterol_total", "total_cholesterol": "cholesterol_total",
+	"lipids": "lipid_panel", "lipid_profile": "lipid_panel",
+	"complete_blood_count": "cbc", "full_blood_count": "cbc", "fbc": "cbc",
+	"haemoglobin": "hemoglobin", "hb": "hemoglobin", "hgb": "hemoglobin",
+	"pain": "pain_score",
+}
+
+// Look up a metric type by its code or another name for it, in any case
+func findMetricType(name string) (metricType, bool) {
+	code := strings.ToLower(strings.TrimSpace(name))
+	code = strings.NewReplacer(" ", "_", "-", "_").Replace(code)
+	if alias, ok := metricTypeAliases[code]; ok {
+		code = alias
+	}
+	for _, t := range metricTypes {
+		if t.Code == code {
+			return t, true
+		}
+	}
+	return metricType{}, false
+}
+
+// The reference range for a patient of the given sex and age, or nil. When the
+// age is unknown (-1) any range can apply.
+func (t metricType) reference(sex string, age int) *referenceRange {
+	sex = strings.ToLower(strings.TrimSpace(sex))
+	for i, r := range t.Ranges {
+		if r.Sex != "" && r.Sex != sex {
+			continue
+		}
+		if age >= 0 && (age < r.MinAge || (r.MaxAge > 0 && age >= r.MaxAge)) {
+			continue
+		}
+		return &t.Ranges[i]
+	}
+	return nil
+}
+
+func (r referenceRange) flag(value float64) string {
+	switch {
+	case r.CriticalLow != 0 && value < r.CriticalLow, r.CriticalHigh != 0 && value > r.CriticalHigh:
+		return flagCritical
+	case r.Low != 0 && value < r.Low:
+		return flagLow
+	case r.High != 0 && value > r.High:
+		return flagHigh
+	}
+	return flagNormal
+}
+
+// Parse when a metric was measured, as a clinic local time. Times with an
+// offset, such as device readings in UTC, are converted to clinic time.
+func parseMeasuredAt(s string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02T15:04:05", appointmentTimeLayout, "2006-01-02 15:04:05", "2006-01-02 15:04", scheduleDateLayout} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, fmt.Errorf("measuredAt must be a date and time like 2006-01-02T15:04")
+	}
+	local := t.In(time.Local)
+	return time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), local.Minute(), local.Second(), 0, time.UTC), nil
+}
+
+// A patient's age in whole years on a date, or -1 when their date of birth is
+// not known
+func ageOn(dateOfBirth string, on time.Time) int {
+	born, err := time.Parse(scheduleDateLayout, dateOfBirth)
+	if err != nil || born.After(on) {
+		return -1
+	}
+	age := on.Year() - born.Year()
+	if on.Month() < born.Month() || (on.Month() == born.Month() && on.Day() < born.Day()) {
+		age--
+	}
+	return age
+}
+
+// A metric type as an optional component of a composite metric
+func withOptional(t metricType) metricType {
+	t.Optional = true
+	return t
+}
+
+func (t metricType) component(code string) (metricType, bool) {
+	code = strings.NewReplacer(" ", "_", "-", "_").Replace(strings.ToLower(strings.TrimSpace(code)))
+	for _, c := range t.Components {
+		if c.Code == code {
+			return c, true
+		}
+	}
+	return metricType{}, false
+}
+
+func (t metricType) componentCodes() []string {
+	codes := make([]string, len(t.Components))
+	for i, c := range t.Components {
+		codes[i] = c.Code
+	}
+	return codes
+}
+
+// Measure a value recorded in one of a simple metric type's units: work out its
+// canonical value, check it is possible and flag it against the reference
+// range for a patient of the given sex and age
+func (t metricType) measure(value float64, unitName, sex string, age int) (metricComponent, error) {
+	unit, ok := t.unit(unitName)
+	if !ok {
+		return metricComponent{}, fmt.Errorf("unit %q cannot be used for %s, use %s", unitName, t.Code, strings.Join(t.unitNames(), ", "))
+	}
+	r := metricComponent{
+		Code:           t.Code,
+		Value:          value,
+		Unit:           unit.Unit,
+		CanonicalValue: roundTo(unit.toCanonical(value), 4),
+		CanonicalUnit:  t.Unit,
+	}
+	if math.IsNaN(value) || r.CanonicalValue < t.Min || r.CanonicalValue > t.Max {
+		return metricComponent{}, fmt.Errorf("%s of %g %s is not possible, it must be between %g and %g", t.Code, value, r.Unit,
+			roundTo(unit.fromCanonical(t.Min), 2), roundTo(unit.fromCanonical(t.Max), 2))
+	}
+	if r.ReferenceRange = t.reference(sex, age); r.ReferenceRange != nil {
+		r.Flag = r.ReferenceRange.flag(r.CanonicalValue)
+	}
+	return r, nil
+}
+
+// How far out of range a flag is
+var flagRank = map[string]int{flagNormal: 1, flagLow: 2, flagHigh: 2, flagCritical: 3}
+
+// Check a metric against the registry, normalize its type, unit and time, work
+// out its canonical value and flag it against the patient's reference range.
+// Composite metrics are flagged by their furthest out of range component, and
+// take their value from their first.
+func prepareHealthMetric(m *HealthMetric, patient Patient) error {
+	t, ok := findMetricType(m.Type)
+	if !ok {
+		return fmt.Errorf("unknown metric type %q", m.Type)
+	}
+	m.Type = t.Code
+
+	measured := clinicNow()
+	if m.MeasuredAt != "" {
+		var err error
+		if measured, err = parseMeasuredAt(m.MeasuredAt); err != nil {
+			return err
+		}
+	}
+	m.MeasuredAt = measured.Format(appointmentTimeLayout)
+	age := ageOn(patient.DateOfBirth, measured)
+
+	if len(t.Components) == 0 {
+		if len(m.Components) > 0 {
+			return fmt.Errorf("%s has no components", t.Code)
+		}
+		r, err := t.measure(m.Value, m.Unit, patient.Gender, age)
+		if err != nil {
+			return err
+		}
+		m.Unit, m.CanonicalValue, m.CanonicalUnit = r.Unit, r.CanonicalValue, r.CanonicalUnit
+		m.Flag, m.ReferenceRange = r.Flag, r.ReferenceRange
+		return nil
+	}
+
+	if len(m.Components) == 0 {
+		return fmt.Errorf("%s is recorded as its components: %s", t.Code, strings.Join(t.componentCodes(), ", "))
+	}
+	recorded := map[string]metricComponent{}
+	values := map[string]float64{}
+	for _, given := range m.Components {
+		ct, ok := t.component(given.Code)
+		if !ok {
+			return fmt.Errorf("unknown component %q of %s, use %s", given.Code, t.Code, strings.Join(t.componentCodes(), ", "))
+		}
+		if _, ok := recorded[ct.Code]; ok {
+			return fmt.Errorf("component %s of %s is given more than once", ct.Code, t.Code)
+		}
+		unit := given.Unit
+		if unit == "" {
+			unit = m.Unit
+		}
+		r, err := ct.measure(given.Value, unit, patient.Gender, age)
+		if err != nil {
+			return err
+		}
+		recorded[ct.Code] = r
+		values[ct.Code] = r.CanonicalValue
+	}
+	components := []metricComponent{}
+	for _, ct := range t.Components {
+		r, ok := recorded[ct.Code]
+		if !ok {
+			if !ct.Optional {
+				return fmt.Errorf("%s needs its %s", t.Code, ct.Code)
+			}
+			continue
+		}
+		components = append(components, r)
+	}
+	if t.check != nil {
+		if err := t.check(values); err != nil {
+			return err
+		}
+	}
+
+	m.Components = components
+	m.Value, m.Unit = components[0].Value, components[0].Unit
+	m.CanonicalValue, m.CanonicalUnit = components[0].CanonicalValue, components[0].CanonicalUnit
+	m.Flag, m.ReferenceRange = "", nil
+	for _, r := range components {
+		if flagRank[r.Flag] > flagRank[m.Flag] {
+			m.Flag = r.Flag
+		}
+	}
+	return nil
+}
+
+// Before blood pressure had components, the diastolic pressure was often noted
+// after the systolic value, as in "/80 after exercise"
+var diastolicNote = regexp.MustCompile(`(?i)^\s*/\s*(\d+(?:\.\d+)?)\s*(?:mm\s*hg)?[\s,;.-]*`)
+
+// Split a blood pressure recorded the old way into its components, if the
+// diastolic pressure is in its notes
+func splitBloodPressure(m *HealthMetric) bool {
+	match := diastolicNote.FindStringSubmatch(m.Notes)
+	if match == nil {
+		return false
+	}
+	diastolic, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return false
+	}
+	m.Components = []metricComponent{
+		{Code: "systolic", Value: m.Value, Unit: m.Unit},
+		{Code: "diastolic", Value: diastolic, Unit: m.Unit},
+	}
+	m.Notes = strings.TrimSpace(m.Notes[len(match[0]):])
+	return true
+}
+
+// Bring metrics recorded before the registry or without a canonical value in
+// line with it, where their type and unit are known, and split blood pressures
+// recorded as a single value
+func normalizeExistingMetrics() {
+	var metrics []HealthMetric
+	if err := db.Unscoped().Preload("Patient", func(tx *gorm.DB) *gorm.DB { return tx.Unscoped() }).
+		Where("canonical_unit = '' OR canonical_unit IS NULL OR (type = ? AND components IS NULL)", "blood_pressure").
+		Find(&metrics).Error; err != nil {
+		log.Printf("Failed to load health metrics to normalize: %v", err)
+		return
+	}
+
+	normalized := 0
+	for _, m := range metrics {
+		if m.MeasuredAt == "" {
+			m.MeasuredAt = m.CreatedAt.Format(appointmentTimeLayout)
+		}
+		if t, ok := findMetricType(m.Type); ok && len(t.Components) > 0 && len(m.Components) == 0 {
+			if t.Code != "blood_pressure" || !splitBloodPressure(&m) {
+				// Left as recorded, under the type's own name
+				if m.Type != t.Code {
+					db.Unscoped().Model(&m).Update("type", t.Code)
+				}
+				log.Printf("Health metric %s left as recorded: its %s components are unknown", m.ID, t.Code)
+				continue
+			}
+		}
+		if err := prepareHealthMetric(&m, m.Patient); err != nil {
+			log.Printf("Health metric %s left as recorded: %v", m.ID, err)
+			continue
+		}
+		if err := db.Unscoped().Model(&m).Select("type", "value", "unit", "canonical_value", "canonical_unit", "components", "measured_at", "flag", "notes").
+			Updates(&m).Error; err != nil {
+			log.Printf("Failed to normalize health metric %s: %v", m.ID, err)
+			continue
+		}
+		normalized++
+	}
+	if normalized > 0 {
+		log.Printf("Normalized %d health metrics", normalized)
+	}
+}
+
+// List the registered metric types
+func getMetricTypes(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Metric types retrieved successfully",
+		"data":    metricTypes,
+	})
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMeasuredAt(t *testing.T) {
+	defer func(local *time.Location) { time.Local = local }(time.Local)
+	time.Local = time.FixedZone("clinic", -4*60*60)
+
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"2025-03-10T14:30", "2025-03-10T14:30:00"},
+		{"2025-03-10 14:30:15", "2025-03-10T14:30:15"},
+		{"2025-03-10", "2025-03-10T00:00:00"},
+		{"2025-03-10T14:30:15Z", "2025-03-10T10:30:15"},
+		{"2025-03-10T14:30:00-04:00", "2025-03-10T14:30:00"},
+		{"2025-03-10T02:00:00+01:00", "2025-03-09T21:00:00"},
+	}
+	for _, tt := range tests {
+		got, err := parseMeasuredAt(tt.in)
+		if err != nil {
+			t.Errorf("parseMeasuredAt(%q) failed: %v", tt.in, err)
+			continue
+		}
+		if got.Format("2006-01-02T15:04:05") != tt.want {
+			t.Errorf("parseMeasuredAt(%q) = %s, want %s", tt.in, got.Format("2006-01-02T15:04:05"), tt.want)
+		}
+	}
+
+	if _, err := parseMeasuredAt("yesterday"); err == nil {
+		t.Error("parseMeasuredAt(\"yesterday\") did not fail")
+	}
+}
+
+// Metrics recorded before the registry are normalized where their type and
+// unit are known, and the others are logged and left out of sorting by value
+func TestNormalizeExistingMetrics(t *testing.T) {
+	setupTestDB(t)
+	app := newTestApp()
+	doctor, token := createTestUser(t, RolePhysician, "password123")
+	patient := createTestPatient(t, "Ada Lovelace", doctor)
+
+	legacy := []HealthMetric{
+		{PatientID: patient.ID, Type: "Weight", Value: 154, Unit: "lbs", MeasuredAt: "2024-05-01T09:00"},
+		{PatientID: patient.ID, Type: "weight", Value: 11, Unit: "stone", MeasuredAt: "2024-05-02T09:00"},
+		{PatientID: patient.ID, Type: "blood_pressure", Value: 120, Unit: "mmHg", MeasuredAt: "2024-05-03T09:00", Notes: "/80 after exercise"},
+		{PatientID: patient.ID, Type: "blood_pressure", Value: 130, Unit: "mmHg", MeasuredAt: "2024-05-04T09:00"},
+	}
+	for i := range legacy {
+		if err := db.Create(&legacy[i]).Error; err != nil {
+			t.Fatalf("failed to create a metric: %v", err)
+		}
+	}
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	normalizeExistingMetrics()
+	log.SetOutput(io.Discard)
+
+	var got []HealthMetric
+	db.Order("measured_at").Find(&got)
+	if m := got[0]; m.Type != "weight" || m.CanonicalUnit != "kg" || roundTo(m.CanonicalValue, 2) != 69.85 || m.Value != 154 || m.Unit != "lb" {
+		t.Errorf("weight in lbs normalized to %+v, want 154 lb kept as 69.85 kg", m)
+	}
+	if m := got[1]; m.CanonicalUnit != "" {
+		t.Errorf("weight in stone normalized to %v %s, want it left as recorded", m.CanonicalValue, m.CanonicalUnit)
+	}
+	if m := got[2]; len(m.Components) != 2 || m.Components[1].Value != 80 || m.Notes != "after exercise" {
+		t.Errorf("blood pressure with a diastolic note = %+v, want it split into 120/80", m)
+	}
+	if m := got[3]; len(m.Components) != 0 || m.CanonicalUnit != "" {
+		t.Errorf("blood pressure without a diastolic note = %+v, want it left as recorded", m)
+	}
+	for _, m := range []HealthMetric{got[1], got[3]} {
+		if !strings.Contains(logged.String(), "Health metric "+m.ID.String()+" left as recorded: ") {
+			t.Errorf("skipping metric %s was not logged:\n%s", m.ID, logged.String())
+		}
+	}
+
+	resp := doRequest(t, app, http.MethodGet, "/api/metrics/patient/"+patient.ID.String()+"?sort=value", token, nil)
+	var body struct {
+		Data []HealthMetric `json:"data"`
+	}
+	decodeBody(t, resp, &body)
+	if len(body.Data) != 2 || body.Data[0].ID != got[0].ID || body.Data[1].ID != got[2].ID {
+		t.Errorf("sorted by value: %d metrics, want the weight and the split blood pressure", len(body.Data))
+	}
+}
+
+func TestPrepareCompositeMetric(t *testing.T) {
+	patient := Patient{Gender: "female", DateOfBirth: "1980-04-12"}
+	bp := func(systolic, diastolic float64) []metricComponent {
+		return []metricComponent{{Code: "systolic", Value: systolic}, {Code: "diastolic", Value: diastolic}}
+	}
+
+	tests := []struct {
+		name       string
+		metric     HealthMetric
+		want       string // component code, value, unit, canonical value and flag of each component
+		wantFlag   string
+		wantValue  string // the metric's value, unit and canonical value
+		wantErrHas string
+	}{
+		{
+			name:      "blood pressure",
+			metric:    HealthMetric{Type: "BP", Unit: "mmHg", Components: bp(135, 85)},
+			want:      "systolic 135 mmHg 135 high, diastolic 85 mmHg 85 high",
+			wantFlag:  flagHigh,
+			wantValue: "135 mmHg 135",
+		},
+		{
+			name:      "components in registry order, furthest out of range flag",
+			metric:    HealthMetric{Type: "blood_pressure", Components: []metricComponent{{Code: "Diastolic", Value: 75, Unit: "mmHg"}, {Code: "SYSTOLIC", Value: 185, Unit: "mmHg"}}},
+			want:      "systolic 185 mmHg 185 critical, diastolic 75 mmHg 75 normal",
+			wantFlag:  flagCritical,
+			wantValue: "185 mmHg 185",
+		},
+		{
+			name:      "optional components in their own units",
+			metric:    HealthMetric{Type: "lipids", Unit: "mmol/L", Components: []metricComponent{{Code: "hdl", Value: 1}, {Code: "ldl", Value: 3}, {Code: "triglycerides", Value: 120, Unit: "mg/dL"}}},
+			want:      "ldl 3 mmol/L 116.0102 high, hdl 1 mmol/L 38.6701 low, triglycerides 120 mg/dL 120 normal",
+			wantFlag:  flagHigh,
+			wantValue: "3 mmol/L 116.0102",
+		},
+		{
+			name:       "diastolic above systolic",
+			metric:     HealthMetric{Type: "blood_pressure", Unit: "mmHg", Components: bp(80, 90)},
+			wantErrHas: "the diastolic pressure must be lower than the systolic pressure",
+		},
+		{
+			name:       "required component missing",
+			metric:     HealthMetric{Type: "blood_pressure", Unit: "mmHg", Components: bp(120, 80)[:1]},
+			wantErrHas: "blood_pressure needs its diastolic",
+		},
+		{
+			name:       "single value for a composite type",
+			metric:     HealthMetric{Type: "blood_pressure", Value: 120, Unit: "mmHg"},
+			wantErrHas: "blood_pressure is recorded as its components: systolic, diastolic",
+		},
+		{
+			name:       "component given twice",
+			metric:     HealthMetric{Type: "blood_pressure", Unit: "mmHg", Components: append(bp(120, 80), metricComponent{Code: "systolic", Value: 125})},
+			wantErrHas: "component systolic of blood_pressure is given more than once",
+		},
+		{
+			name:       "unknown component",
+			metric:     HealthMetric{Type: "blood_pressure", Unit: "mmHg", Components: append(bp(120, 80), metricComponent{Code: "pulse", Value: 70})},
+			wantErrHas: `unknown component "pulse" of blood_pressure`,
+		},
+		{
+			name:       "impossible component",
+			metric:     HealthMetric{Type: "blood_pressure", Unit: "mmHg", Components: bp(400, 80)},
+			wantErrHas: "systolic of 400 mmHg is not possible",
+		},
+		{
+			name:       "wrong unit for a component",
+			metric:     HealthMetric{Type: "cbc", Components: []metricComponent{{Code: "platelets", Value: 250, Unit: "mg/dL"}}},
+			wantErrHas: `unit "mg/dL" cannot be used for platelets`,
+		},
+		{
+			name:       "components of a simple type",
+			metric:     HealthMetric{Type: "weight", Value: 70, Unit: "kg", Components: []metricComponent{{Code: "weight", Value: 70}}},
+			wantErrHas: "weight has no components",
+		},
+	}
+	for _, tt := range tests {
+		m := tt.metric
+		m.MeasuredAt = "2025-03-10T09:00"
+		err := prepareHealthMetric(&m, patient)
+		if tt.wantErrHas != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErrHas) {
+				t.Errorf("%s: error = %v, want one containing %q", tt.name, err, tt.wantErrHas)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: prepareHealthMetric failed: %v", tt.name, err)
+			continue
+		}
+		var got []string
+		for _, r := range m.Components {
+			got = append(got, fmt.Sprintf("%s %g %s %g %s", r.Code, r.Value, r.Unit, r.CanonicalValue, r.Flag))
+		}
+		if strings.Join(got, ", ") != tt.want {
+			t.Errorf("%s: components = %q, want %q", tt.name, strings.Join(got, ", "), tt.want)
+		}
+		if m.Flag != tt.wantFlag || m.ReferenceRange != nil {
+			t.Errorf("%s: flag = %q with range %v, want %q and no range of its own", tt.name, m.Flag, m.ReferenceRange, tt.wantFlag)
+		}
+		if value := fmt.Sprintf("%g %s %g", m.Value, m.Unit, m.CanonicalValue); value != tt.wantValue {
+			t.Errorf("%s: value = %q, want %q", tt.name, value, tt.wantValue)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"math"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Unit systems values can be returned in
+const (
+	unitsMetric = "metric"
+	unitsUS     = "us"
+)
+
+// A unit a metric can be recorded in. A value in the unit is Scale times the
+// value in the type's canonical unit, plus Offset.
+type metricUnit struct {
+	Unit   string  `json:"unit"`
+	System string  `json:"system,omitempty"` // metric or us, both when empty
+	Scale  float64 `json:"scale"`
+	Offset float64 `json:"offset,omitempty"`
+}
+
+func (u metricUnit) toCanonical(value float64) float64 {
+	return (value - u.Offset) / u.Scale
+}
+
+func (u metricUnit) fromCanonical(value float64) float64 {
+	return value*u.Scale + u.Offset
+}
+
+// Units, keyed by accepted spellings
+var metricUnits = map[string]string{
+	"kg": "kg", "kgs": "kg", "kilogram": "kg", "kilograms": "kg",
+	"lb": "lb", "lbs": "lb", "pound": "lb", "pounds": "lb",
+	"cm": "cm", "centimetre": "cm", "centimeter": "cm", "centimetres": "cm", "centimeters": "cm",
+	"in": "in", "inch": "in", "inches": "in",
+	"kg/m2": "kg/m2", "kg/m²": "kg/m2", "kg/m^2": "kg/m2",
+	"°c": "°C", "c": "°C", "degc": "°C", "celsius": "°C",
+	"°f": "°F", "f": "°F", "degf": "°F", "fahrenheit": "°F",
+	"bpm": "bpm", "beats/min": "bpm", "/min": "bpm",
+	"breaths/min": "breaths/min", "br/min": "breaths/min",
+	"%": "%", "percent": "%",
+	"mmhg":   "mmHg",
+	"mg/dl":  "mg/dL",
+	"mmol/l": "mmol/L", "mmol": "mmol/L",
+	"g/dl":  "g/dL",
+	"g/l":   "g/L",
+	"score": "score", "/10": "score",
+	"10^9/l": "10^9/L", "x10^9/l": "10^9/L", "×10^9/l": "10^9/L", "10e9/l": "10^9/L",
+	"k/ul": "10^9/L", "k/µl": "10^9/L", "10^3/ul": "10^9/L", "x10^3/ul": "10^9/L",
+}
+
+// The unit a metric type is recorded in, by any accepted spelling. An empty
+// unit is the canonical one.
+func (t metricType) unit(name string) (metricUnit, bool) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return t.Units[0], true
+	}
+	unit, ok := metricUnits[strings.ToLower(name)]
+	if !ok {
+		return metricUnit{}, false
+	}
+	for _, u := range t.Units {
+		if u.Unit == unit {
+			return u, true
+		}
+	}
+	return metricUnit{}, false
+}
+
+// The unit to show a metric type in for a unit system, the canonical one when
+// none is given
+func (t metricType) unitIn(system string) metricUnit {
+	if system == "" {
+		return t.Units[0]
+	}
+	for _, u := range t.Units {
+		if u.System == "" || u.System == system {
+			return u
+		}
+	}
+	return t.Units[0]
+}
+
+func (t metricType) unitNames() []string {
+	names := make([]string, len(t.Units))
+	for i, u := range t.Units {
+		names[i] = u.Unit
+	}
+	return names
+}
+
+func roundTo(value float64, places int) float64 {
+	p := math.Pow(10, float64(places))
+	return math.Round(value*p) / p
+}
+
+// The unit system asked for with ?units=, if any
+func unitSystem(c *fiber.Ctx) (string, error) {
+	switch system := strings.ToLower(c.Query("units")); system {
+	case "", unitsMetric, unitsUS:
+		return system, nil
+	}
+	return "", fiber.NewError(fiber.StatusBadRequest, "units must be metric or us")
+}
+
+// Show metrics in a unit system, or in canonical units when it is empty,
+// converting from their canonical values. Metrics of unknown types are left as
+// recorded.
+func convertMetrics(metrics []HealthMetric, system string) {
+	for i, m := range metrics {
+		t, ok := findMetricType(m.Type)
+		if !ok {
+			continue
+		}
+		if len(t.Components) == 0 {
+			if m.CanonicalUnit == t.Unit {
+				metrics[i].Value, metrics[i].Unit = t.convert(m.CanonicalValue, system)
+			}
+			continue
+		}
+		components := make([]metricComponent, len(m.Components))
+		for j, r := range m.Components {
+			if ct, ok := t.component(r.Code); ok && r.CanonicalUnit == ct.Unit {
+				r.Value, r.Unit = ct.convert(r.CanonicalValue, system)
+			}
+			components[j] = r
+		}
+		metrics[i].Components = components
+		if len(components) > 0 {
+			metrics[i].Value, metrics[i].Unit = components[0].Value, components[0].Unit
+		}
+	}
+}
+
+// A canonical value of a simple metric type in a unit system
+func (t metricType) convert(value float64, system string) (float64, string) {
+	u := t.unitIn(system)
+	return roundTo(u.fromCanonical(value), 2), u.Unit
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// Every unit converts to the canonical unit and back without drifting
+func TestMetricUnitRoundTrip(t *testing.T) {
+	var types []metricType
+	for _, mt := range metricTypes {
+		types = append(types, mt)
+		types = append(types, mt.Components...)
+	}
+	for _, mt := range types {
+		if len(mt.Units) == 0 {
+			continue
+		}
+		if mt.Units[0].Unit != mt.Unit || mt.Units[0].Scale != 1 || mt.Units[0].Offset != 0 {
+			t.Errorf("%s: first unit %+v, want the canonical %s", mt.Code, mt.Units[0], mt.Unit)
+		}
+		for _, u := range mt.Units {
+			for _, v := range []float64{mt.Min, (mt.Min + mt.Max) / 2, mt.Max} {
+				if got := u.toCanonical(u.fromCanonical(v)); math.Abs(got-v) > 1e-9*math.Max(1, math.Abs(v)) {
+					t.Errorf("%s: %v %s to %s and back = %v", mt.Code, v, mt.Unit, u.Unit, got)
+				}
+			}
+		}
+	}
+}
+
+func TestMetricUnitConversions(t *testing.T) {
+	tests := []struct {
+		metric string
+		value  float64
+		unit   string
+		want   float64 // in the canonical unit
+	}{
+		{"weight", 154.32, "lbs", 70},
+		{"height", 70, "inches", 177.8},
+		{"temperature", 98.6, "°F", 37},
+		{"temperature", 100, "Fahrenheit", 37.78},
+		{"temperature", 37, "", 37},
+		{"blood_sugar", 5.5, "mmol/L", 99.09},
+		{"cholesterol_total", 5.2, "mmol", 201.08},
+		{"hemoglobin", 135, "g/L", 13.5},
+	}
+	for _, tt := range tests {
+		mt, ok := findMetricType(tt.metric)
+		if !ok {
+			t.Fatalf("metric type %s is not registered", tt.metric)
+		}
+		u, ok := mt.unit(tt.unit)
+		if !ok {
+			t.Errorf("%s: unit %q not accepted", tt.metric, tt.unit)
+			continue
+		}
+		if got := roundTo(u.toCanonical(tt.value), 2); got != tt.want {
+			t.Errorf("%s: %v %s = %v %s, want %v", tt.metric, tt.value, tt.unit, got, mt.Unit, tt.want)
+		}
+	}
+
+	weight, _ := findMetricType("weight")
+	if _, ok := weight.unit("°C"); ok {
+		t.Error("weight accepts °C")
+	}
+	if v, unit := weight.convert(70, unitsUS); v != 154.32 || unit != "lb" {
+		t.Errorf("70 kg in US units = %v %s, want 154.32 lb", v, unit)
+	}
+	heartRate, _ := findMetricType("heart_rate")
+	if v, unit := heartRate.convert(72, unitsUS); v != 72 || unit != "bpm" {
+		t.Errorf("72 bpm in US units = %v %s, want 72 bpm", v, unit)
+	}
+}
@@ -2,19 +2,64 @@ package main
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
 )
 
+// Sorting and filtering accepted by getPatientMetrics
+var metricListSpec = listSpec{
+	sort: map[string]string{
+		"measuredAt": "measured_at",
+		"type":       "type",
+		"value":      "canonical_value",
+		"createdAt":  "created_at",
+	},
+	defaultSort: "-measuredAt",
+	filters: []listFilter{
+		{"type", "type", filterEquals},
+		{"from", "measured_at", filterFrom},
+		{"to", "measured_at", filterTo},
+	},
+}
+
 func getPatientMetrics(c *fiber.Ctx) error {
-	id := c.Params("id")
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil || !canAccessPatient(c, id) {
+		auditAccess(c, "list", "health_metric", "", id, auditNotFound)
+		return c.Status(404).JSON(fiber.Map{"error": "Patient not found"})
+	}
+
+	system, err := unitSystem(c)
+	if err != nil {
+		return listError(c, err, "")
+	}
+
+	query := db.Model(&HealthMetric{}).Where("patient_id = ?", id)
+	// Metrics that could not be normalized have no canonical value to sort by
+	if strings.TrimPrefix(c.Query("sort"), "-") == "value" {
+		query = query.Where("canonical_unit <> '' AND canonical_unit IS NOT NULL")
+	}
+
 	var metrics []HealthMetric
-	result := db.Where("patient_id = ?", id).Find(&metrics)
-	if result.Error != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch health metrics"})
+	meta, err := listPage(c, query, metricListSpec, &metrics)
+	if err != nil {
+		auditAccess(c, "list", "health_metric", "", id, auditError)
+		return listError(c, err, "Failed to fetch health metrics")
 	}
-	return c.JSON(metrics)
+	if system != "" {
+		convertMetrics(metrics, system)
+	}
+
+	auditAccess(c, "list", "health_metric", "", id, auditSuccess)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Health metrics retrieved successfully",
+		"data":    metrics,
+		"meta":    meta,
+	})
 }
 
 func createHealthMetric(c *fiber.Ctx) error {
@@ -23,28 +68,28 @@ func createHealthMetric(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
 	}
 
-	result := db.Create(&metric)
-	if result.Error != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to create health metric"})
+	if !canAccessPatient(c, metric.PatientID) {
+		auditAccess(c, "create", "health_metric", "", metric.PatientID, auditNotFound)
+		return c.Status(404).JSON(fiber.Map{"error": "Patient not found"})
 	}
-	return c.JSON(metric)
-}
 
-func getHealthTrends(c *fiber.Ctx) error {
-	patientId := c.Params("patientId")
-	var metrics []HealthMetric
-	result := db.Where("patient_id = ?", patientId).Find(&metrics)
-	if result.Error != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch health trends"})
+	var patient Patient
+	if err := db.First(&patient, "id = ?", metric.PatientID).Error; err != nil {
+		auditAccess(c, "create", "health_metric", "", metric.PatientID, auditError)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to create health metric"})
+	}
+	if err := prepareHealthMetric(metric, patient); err != nil {
+		return c.Status(422).JSON(fiber.Map{"error": "Invalid metric: " + err.Error()})
 	}
 
-	// group by type and calculate trends
-	trends := make(map[string][]HealthMetric)
-	for _, metric := range metrics {
-		trends[metric.Type] = append(trends[metric.Type], metric)
+	result := db.Create(&metric)
+	if result.Error != nil {
+		auditAccess(c, "create", "health_metric", "", metric.PatientID, auditError)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to create health metric"})
 	}
 
-	return c.JSON(trends)
+	auditAccess(c, "create", "health_metric", metric.ID.String(), metric.PatientID, auditSuccess)
+	return c.JSON(metric)
 }
 
 func getStatsTrends(c *fiber.Ctx) error {
@@ -55,19 +100,19 @@ func getStatsTrends(c *fiber.Ctx) error {
 
 	// Get patient count for current month
 	var currentMonthPatients int64
-	db.Model(&Patient{}).Where("strftime('%Y-%m', created_at) = ?", currentMonth).Count(&currentMonthPatients)
+	db.Model(&Patient{}).Scopes(scopePatients(c)).Where("strftime('%Y-%m', created_at) = ?", currentMonth).Count(&currentMonthPatients)
 
 	// Get patient count for previous month
 	var previousMonthPatients int64
-	db.Model(&Patient{}).Where("strftime('%Y-%m', created_at) = ?", lastMonth).Count(&previousMonthPatients)
+	db.Model(&Patient{}).Scopes(scopePatients(c)).Where("strftime('%Y-%m', created_at) = ?", lastMonth).Count(&previousMonthPatients)
 
 	// Get appointment count for current month
 	var currentMonthAppointments int64
-	db.Model(&Appointment{}).Where("strftime('%Y-%m', created_at) = ?", currentMonth).Count(&currentMonthAppointments)
+	db.Model(&Appointment{}).Scopes(scopePatientRecords(c)).Where("strftime('%Y-%m', created_at) = ?", currentMonth).Count(&currentMonthAppointments)
 
 	// Get appointment count for previous month
 	var previousMonthAppointments int64
-	db.Model(&Appointment{}).Where("strftime('%Y-%m', created_at) = ?", lastMonth).Count(&previousMonthAppointments)
+	db.Model(&Appointment{}).Scopes(scopePatientRecords(c)).Where("strftime('%Y-%m', created_at) = ?", lastMonth).Count(&previousMonthAppointments)
 
 	// Calculate trends
 	patientTrend := calculateTrendPercentage(previousMonthPatients, currentMonthPatients)
@@ -75,11 +120,11 @@ func getStatsTrends(c *fiber.Ctx) error {
 
 	// Get upcoming appointments (future dates)
 	var upcomingAppointments int64
-	db.Model(&Appointment{}).Where("datetime(date_time) > datetime('now')").Count(&upcomingAppointments)
+	db.Model(&Appointment{}).Scopes(scopePatientRecords(c)).Where("datetime(date_time) > datetime('now')").Count(&upcomingAppointments)
 	
 	// Compare with last month's upcoming appointments count at the same time
 	var previousUpcomingAppointments int64
-	db.Model(&Appointment{}).Where("datetime(date_time) > datetime(?)", now.AddDate(0, -1, 0).Format("2006-01-02 15:04:05")).
+	db.Model(&Appointment{}).Scopes(scopePatientRecords(c)).Where("datetime(date_time) > datetime(?)", now.AddDate(0, -1, 0).Format("2006-01-02 15:04:05")).
 		Where("datetime(date_time) < datetime(?)", now.AddDate(0, 0, 0).Format("2006-01-02 15:04:05")).
 		Count(&previousUpcomingAppointments)
 
@@ -134,12 +179,12 @@ func getMonthlyStats(c *fiber.Ctx) error {
 		
 		// Count patients created in this month
 		var patientCount int64
-		db.Model(&Patient{}).Where("strftime('%Y-%m', created_at) = ?", monthKey).Count(&patientCount)
+		db.Model(&Patient{}).Scopes(scopePatients(c)).Where("strftime('%Y-%m', created_at) = ?", monthKey).Count(&patientCount)
 		patientCounts[monthKey] = int(patientCount)
 		
 		// Count appointments created in this month
 		var appointmentCount int64
-		db.Model(&Appointment{}).Where("strftime('%Y-%m', created_at) = ?", monthKey).Count(&appointmentCount)
+		db.Model(&Appointment{}).Scopes(scopePatientRecords(c)).Where("strftime('%Y-%m', created_at) = ?", monthKey).Count(&appointmentCount)
 		appointmentCounts[monthKey] = int(appointmentCount)
 	}
 	
@@ -118,6 +118,14 @@ func protected() fiber.Handler {
 			})
 		}
 
+		// Challenge tokens from the first login step are not access tokens
+		if purpose, _ := claims["purpose"].(string); purpose != "" {
+			return c.Status(401).JSON(fiber.Map{
+				"success": false,
+				"message": "Invalid token",
+			})
+		}
+
 		// Validate expiration
 		if exp, ok := claims["exp"].(float64); !ok || float64(time.Now().Unix()) > exp {
 			return c.Status(401).JSON(fiber.Map{
@@ -134,8 +142,28 @@ func protected() fiber.Handler {
 			})
 		}
 
-		// Set doctor ID to context locals for route handlers to use
+		// Tokens issued before roles existed carry no role claim
+		role, _ := claims["role"].(string)
+		if role == "" {
+			var doctor Doctor
+			if err := db.Select("role").First(&doctor, "id = ?", doctorID).Error; err == nil {
+				role = doctor.Role
+			}
+		}
+
+		// Set doctor ID, email, role, MFA and verification status to context locals for route handlers to use
+		mfa, _ := claims["mfa"].(bool)
+		// Tokens without the claim predate verification, when all accounts were marked verified
+		emailVerified, ok := claims["emailVerified"].(bool)
+		if !ok {
+			emailVerified = true
+		}
+		email, _ := claims["email"].(string)
 		c.Locals("doctorId", doctorID)
+		c.Locals("email", email)
+		c.Locals("role", role)
+		c.Locals("mfa", mfa)
+		c.Locals("emailVerified", emailVerified)
 		return c.Next()
 	}
 }
@@ -4,81 +4,426 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"gorm.io/gorm"
 )
 
 type Doctor struct {
-	ID             uuid.UUID `gorm:"primaryKey;type:varchar(36)" json:"id"`
-	Email          string    `gorm:"unique;not null" json:"email"`
-	Password       string    `gorm:"not null" json:"-"`
-	Name           string    `json:"name"`
-	Specialization string    `json:"specialization"`
-	LicenseNumber  string    `json:"licenseNumber"`
-	CreatedAt      time.Time `json:"createdAt"`
-	UpdatedAt      time.Time `json:"updatedAt"`
+	ID              uuid.UUID  `gorm:"primaryKey;type:varchar(36)" json:"id"`
+	Email           string     `gorm:"unique;not null" json:"email"`
+	Password        string     `gorm:"not null" json:"-"`
+	Name            string     `json:"name"`
+	Specialization  string     `json:"specialization"`
+	LicenseNumber   string     `json:"licenseNumber"`
+	Role            string     `gorm:"not null;default:physician" json:"role"` // admin, physician, nurse, receptionist
+	TOTPEnabled     bool       `json:"totpEnabled"`
+	TOTPSecret      string     `json:"-"` // base32 secret, set once enrolment is confirmed
+	TOTPPending     string     `json:"-"` // base32 secret awaiting confirmation
+	TOTPLastStep    int64      `json:"-"` // last accepted time step, prevents code replay
+	EmailVerifiedAt *time.Time `json:"emailVerifiedAt"`
+	CreatedAt       time.Time  `json:"createdAt"`
+	UpdatedAt       time.Time  `json:"updatedAt"`
+}
+
+// RefreshToken is an opaque, single-use token for obtaining new access tokens.
+// Tokens rotated from the same login share a FamilyID so the whole chain can
+// be revoked at once.
+type RefreshToken struct {
+	ID        uuid.UUID  `gorm:"primaryKey;type:varchar(36)" json:"id"`
+	DoctorID  uuid.UUID  `gorm:"type:varchar(36);index" json:"doctorId"`
+	FamilyID  uuid.UUID  `gorm:"type:varchar(36);index" json:"familyId"`
+	TokenHash string     `gorm:"uniqueIndex;not null" json:"-"` // SHA-256 of the token, never the token itself
+	ExpiresAt time.Time  `json:"expiresAt"`
+	MFA       bool       `json:"mfa"`       // session was verified with a second factor
+	UsedAt    *time.Time `json:"usedAt"`    // set once the token has been rotated
+	RevokedAt *time.Time `json:"revokedAt"` // set on logout or reuse detection
+	IP        string     `json:"ip"`
+	UserAgent string     `json:"userAgent"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+// RecoveryCode is a one-time code for signing in without the authenticator app
+type RecoveryCode struct {
+	ID        uuid.UUID  `gorm:"primaryKey;type:varchar(36)" json:"id"`
+	DoctorID  uuid.UUID  `gorm:"type:varchar(36);index" json:"doctorId"`
+	CodeHash  string     `gorm:"not null" json:"-"` // bcrypt hash of the code
+	UsedAt    *time.Time `json:"usedAt"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+// SecurityPolicy holds deployment-wide security settings, stored as a single row
+type SecurityPolicy struct {
+	ID         uint      `gorm:"primaryKey" json:"-"`
+	Require2FA bool      `json:"require2fa"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// ActionToken records an emailed password reset or verification token so it
+// can only be used once. The token itself is a signed JWT carrying this ID.
+type ActionToken struct {
+	ID        uuid.UUID  `gorm:"primaryKey;type:varchar(36)" json:"id"`
+	DoctorID  uuid.UUID  `gorm:"type:varchar(36);index" json:"doctorId"`
+	Purpose   string     `json:"purpose"` // "password_reset", "email_verification"
+	ExpiresAt time.Time  `json:"expiresAt"`
+	UsedAt    *time.Time `json:"usedAt"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+// LoginAttempt tracks consecutive failed logins for an email address
+type LoginAttempt struct {
+	Email        string     `gorm:"primaryKey" json:"email"` // lowercased
+	FailedCount  int        `json:"failedCount"`
+	LastFailedAt time.Time  `json:"lastFailedAt"`
+	LockedUntil  *time.Time `json:"lockedUntil"`
+	UpdatedAt    time.Time  `json:"updatedAt"`
+}
+
+// AuditEvent records a security-relevant action or an access to patient
+// data. Events are append-only and hash-chained: each Hash covers the event's
+// fields and the previous event's Hash, so editing or removing a row breaks
+// the chain from that point on.
+type AuditEvent struct {
+	ID           uint       `gorm:"primaryKey" json:"id"`
+	Timestamp    time.Time  `gorm:"index" json:"timestamp"`
+	ActorID      *uuid.UUID `gorm:"type:varchar(36);index" json:"actorId"`
+	ActorEmail   string     `json:"actorEmail"`
+	Action       string     `gorm:"index" json:"action"` // e.g., "read", "update", "account.locked"
+	ResourceType string     `json:"resourceType"`        // e.g., "patient", "medication", "account"
+	ResourceID   string     `json:"resourceId"`
+	PatientID    *uuid.UUID `gorm:"type:varchar(36);index" json:"patientId"`
+	IP           string     `json:"ip"`
+	Outcome      string     `json:"outcome"` // "success", "not_found", "denied", "error"
+	Details      string     `json:"details"`
+	PrevHash     string     `json:"prevHash"`
+	Hash         string     `gorm:"not null;default:''" json:"hash"`
 }
 
 type Patient struct {
-	ID          uuid.UUID `gorm:"primaryKey;type:varchar(36)" json:"id"`
-	Name        string    `json:"name"`
-	DateOfBirth string `json:"dateOfBirth"`
-	Gender      string    `json:"gender"`
-	Contact     string    `json:"contact"`
-	Address     string    `json:"address"`
-	BloodGroup  string    `json:"bloodGroup"`
-	Allergies   string    `json:"allergies"`
-	CreatedAt   time.Time `json:"createdAt"`
-	UpdatedAt   time.Time `json:"updatedAt"`
+	ID          uuid.UUID      `gorm:"primaryKey;type:varchar(36)" json:"id"`
+	Name        string         `json:"name"`
+	DateOfBirth string         `json:"dateOfBirth"`
+	Gender      string         `json:"gender"`
+	Contact     string         `json:"contact"`
+	Address     string         `json:"address"`
+	BloodGroup  string         `json:"bloodGroup"`
+	Allergies   string         `json:"allergies"`
+	CreatedAt   time.Time      `json:"createdAt"`
+	UpdatedAt   time.Time      `json:"updatedAt"`
+	DeletedAt   gorm.DeletedAt `gorm:"index" json:"deletedAt"`
+}
+
+// PatientAllergy is a structured allergy, checked when prescribing. The
+// free-text Patient.Allergies is checked as well.
+type PatientAllergy struct {
+	ID        uuid.UUID      `gorm:"primaryKey;type:varchar(36)" json:"id"`
+	PatientID uuid.UUID      `gorm:"type:varchar(36);index" json:"patientId"`
+	Substance string         `json:"substance"` // a drug, a drug class such as "penicillin", or anything else
+	Reaction  string         `json:"reaction"`
+	Severity  string         `json:"severity"` // mild, moderate, severe, or empty if unknown
+	Notes     string         `json:"notes"`
+	CreatedAt time.Time      `json:"createdAt"`
+	UpdatedAt time.Time      `json:"updatedAt"`
+	DeletedAt gorm.DeletedAt `gorm:"index" json:"deletedAt"`
+}
+
+// CareTeamMember links a doctor to a patient they are allowed to see
+type CareTeamMember struct {
+	PatientID uuid.UUID `gorm:"primaryKey;type:varchar(36)" json:"patientId"`
+	DoctorID  uuid.UUID `gorm:"primaryKey;type:varchar(36);index" json:"doctorId"`
+	Doctor    Doctor    `json:"doctor"`
+	Role      string    `json:"role"` // e.g., "primary", "consulting"
+	CreatedAt time.Time `json:"createdAt"`
 }
 
 type Appointment struct {
+	ID                 uuid.UUID      `gorm:"primaryKey;type:varchar(36)" json:"id"`
+	PatientID          uuid.UUID      `json:"patientId"`
+	Patient            Patient        `json:"patient"`
+	DoctorID           uuid.UUID      `gorm:"type:varchar(36);index" json:"doctorId"`
+	DateTime           string         `json:"dateTime"` // clinic local time, "2006-01-02T15:04"
+	EndTime            string         `json:"endTime"`
+	Duration           int            `json:"duration"` // minutes, from the appointment type
+	SeriesID           *uuid.UUID     `gorm:"type:varchar(36);index" json:"seriesId"`
+	RecurrenceID       string         `json:"recurrenceId"` // start the series gave this occurrence
+	Type               string         `json:"type"`
+	Notes              string         `json:"notes"`
+	Status             string         `json:"status"` // see appointmentTransitions
+	CancellationReason string         `json:"cancellationReason"`
+	RescheduledFrom    *uuid.UUID     `gorm:"type:varchar(36)" json:"rescheduledFrom"` // appointment this one replaced
+	CreatedAt          time.Time      `json:"createdAt"`
+	UpdatedAt          time.Time      `json:"updatedAt"`
+	DeletedAt          gorm.DeletedAt `gorm:"index" json:"deletedAt"`
+}
+
+// AppointmentStatusChange records a transition in an appointment's lifecycle
+type AppointmentStatusChange struct {
+	ID            uint       `gorm:"primaryKey" json:"id"`
+	AppointmentID uuid.UUID  `gorm:"type:varchar(36);index" json:"appointmentId"`
+	FromStatus    string     `json:"fromStatus"` // empty when the appointment was created
+	ToStatus      string     `json:"toStatus"`
+	Reason        string     `json:"reason"`
+	ChangedBy     *uuid.UUID `gorm:"type:varchar(36)" json:"changedBy"`
+	ChangedAt     time.Time  `gorm:"index" json:"changedAt"`
+}
+
+// AppointmentSeries is a recurring appointment. Its occurrences are stored as
+// ordinary appointments linked by SeriesID, generated from the RRULE.
+type AppointmentSeries struct {
 	ID        uuid.UUID `gorm:"primaryKey;type:varchar(36)" json:"id"`
-	PatientID uuid.UUID `json:"patientId"`
-	Patient   Patient   `json:"patient"`
-	DateTime  string `json:"dateTime"`
+	PatientID uuid.UUID `gorm:"type:varchar(36);index" json:"patientId"`
+	DoctorID  uuid.UUID `gorm:"type:varchar(36);index" json:"doctorId"`
+	DateTime  string    `json:"dateTime"` // start of the first occurrence
+	RRule     string    `json:"rrule"`    // e.g. "FREQ=WEEKLY;BYDAY=MO,TH;COUNT=12"
+	ExDates   string    `json:"exDates"`  // comma separated dates left out, e.g. "2025-12-25,2026-01-01"
 	Type      string    `json:"type"`
 	Notes     string    `json:"notes"`
-	Status    string    `json:"status"`
 	CreatedAt time.Time `json:"createdAt"`
 	UpdatedAt time.Time `json:"updatedAt"`
 }
 
+// CalendarFeed is a doctor's subscription URL for their appointments. The
+// token in the URL is the only credential, so it is stored hashed and can be
+// revoked.
+type CalendarFeed struct {
+	ID         uuid.UUID  `gorm:"primaryKey;type:varchar(36)" json:"id"`
+	DoctorID   uuid.UUID  `gorm:"type:varchar(36);index" json:"doctorId"`
+	TokenHash  string     `gorm:"uniqueIndex;not null" json:"-"` // SHA-256 of the token
+	Label      string     `json:"label"`                         // e.g. "Phone"
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	RevokedAt  *time.Time `json:"revokedAt"`
+	CreatedAt  time.Time  `json:"createdAt"`
+}
+
+// AppointmentReminder is a notification to send a patient before an
+// appointment, one per offset and channel. Rows are created ahead of time by
+// the reminder scheduler, so they survive restarts.
+type AppointmentReminder struct {
+	ID              uuid.UUID  `gorm:"primaryKey;type:varchar(36)" json:"id"`
+	AppointmentID   uuid.UUID  `gorm:"type:varchar(36);uniqueIndex:idx_reminder_key" json:"appointmentId"`
+	AppointmentTime string     `gorm:"uniqueIndex:idx_reminder_key" json:"appointmentTime"` // the dateTime the reminder was planned for
+	Channel         string     `gorm:"uniqueIndex:idx_reminder_key" json:"channel"`         // email, sms or webhook
+	OffsetMinutes   int        `gorm:"uniqueIndex:idx_reminder_key" json:"offsetMinutes"`   // before the appointment
+	Recipient       string     `json:"recipient"`                                           // email address or phone number, empty for webhooks
+	DueAt           time.Time  `gorm:"index" json:"dueAt"`
+	Status          string     `gorm:"index;not null;default:pending" json:"status"` // pending, sending, sent, failed, suppressed or expired
+	Attempts        int        `json:"attempts"`
+	NextAttemptAt   time.Time  `json:"nextAttemptAt"`
+	Reason          string     `json:"reason"` // why the last attempt failed or the reminder was suppressed
+	SentAt          *time.Time `json:"sentAt"`
+	CreatedAt       time.Time  `json:"createdAt"`
+	UpdatedAt       time.Time  `json:"updatedAt"`
+}
+
+// WaitlistEntry queues a patient for an earlier appointment with a doctor,
+// to be offered slots that free up
+type WaitlistEntry struct {
+	ID        uuid.UUID        `gorm:"primaryKey;type:varchar(36)" json:"id"`
+	PatientID uuid.UUID        `gorm:"type:varchar(36);index" json:"patientId"`
+	Patient   Patient          `json:"patient"`
+	DoctorID  uuid.UUID        `gorm:"type:varchar(36);index" json:"doctorId"`
+	Type      string           `json:"type"`
+	Priority  int              `json:"priority"`                                                      // higher is offered first
+	NotBefore string           `json:"notBefore"`                                                     // optional first day, "2006-01-02"
+	NotAfter  string           `json:"notAfter"`                                                      // optional last day
+	Windows   []WaitlistWindow `gorm:"foreignKey:EntryID;constraint:OnDelete:CASCADE" json:"windows"` // preferred times, any time if empty
+	Notes     string           `json:"notes"`
+	Status    string           `gorm:"index;not null;default:waiting" json:"status"` // waiting, offered, booked or removed
+	CreatedBy uuid.UUID        `gorm:"type:varchar(36)" json:"createdBy"`
+	CreatedAt time.Time        `json:"createdAt"`
+	UpdatedAt time.Time        `json:"updatedAt"`
+	DeletedAt gorm.DeletedAt   `gorm:"index" json:"deletedAt"`
+}
+
+// WaitlistWindow is a weekly time at which a waitlisted patient can come
+type WaitlistWindow struct {
+	ID      uint      `gorm:"primaryKey" json:"-"`
+	EntryID uuid.UUID `gorm:"type:varchar(36);index" json:"-"`
+	Weekday int       `json:"weekday"` // 0 is Sunday
+	Start   string    `json:"start"`   // "09:00"
+	End     string    `json:"end"`
+}
+
+// WaitlistOffer holds a freed slot for a waitlisted patient until it is
+// accepted, declined or expires
+type WaitlistOffer struct {
+	ID                  uuid.UUID  `gorm:"primaryKey;type:varchar(36)" json:"id"`
+	EntryID             uuid.UUID  `gorm:"type:varchar(36);index" json:"entryId"`
+	PatientID           uuid.UUID  `gorm:"type:varchar(36);index" json:"patientId"`
+	DoctorID            uuid.UUID  `gorm:"type:varchar(36);index" json:"doctorId"`
+	DateTime            string     `json:"dateTime"` // clinic local time, like appointments
+	EndTime             string     `json:"endTime"`
+	Type                string     `json:"type"`
+	Status              string     `gorm:"index;not null;default:pending" json:"status"` // pending, accepted, declined, expired or withdrawn
+	ExpiresAt           time.Time  `gorm:"index" json:"expiresAt"`
+	SourceAppointmentID *uuid.UUID `gorm:"type:varchar(36)" json:"sourceAppointmentId"` // the appointment that freed the slot
+	AppointmentID       *uuid.UUID `gorm:"type:varchar(36)" json:"appointmentId"`       // booked on acceptance
+	RespondedAt         *time.Time `json:"respondedAt"`
+	CreatedAt           time.Time  `json:"createdAt"`
+}
+
+// WorkingHours is a weekly block of time in which a doctor takes appointments
+type WorkingHours struct {
+	ID       uint      `gorm:"primaryKey" json:"id"`
+	DoctorID uuid.UUID `gorm:"type:varchar(36);index;not null" json:"doctorId"`
+	Weekday  int       `json:"weekday"` // 0 = Sunday
+	Start    string    `json:"start"`   // "09:00"
+	End      string    `json:"end"`     // "17:00"
+}
+
+// ScheduleBreak is a weekly block within working hours that cannot be booked, e.g. lunch
+type ScheduleBreak struct {
+	ID       uint      `gorm:"primaryKey" json:"id"`
+	DoctorID uuid.UUID `gorm:"type:varchar(36);index;not null" json:"doctorId"`
+	Weekday  int       `json:"weekday"`
+	Start    string    `json:"start"`
+	End      string    `json:"end"`
+}
+
+// Holiday is a run of whole days a doctor is away
+type Holiday struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	DoctorID  uuid.UUID `gorm:"type:varchar(36);index;not null" json:"doctorId"`
+	StartDate string    `json:"startDate"` // "2006-01-02"
+	EndDate   string    `json:"endDate"`   // inclusive
+	Reason    string    `json:"reason"`
+}
+
+// AppointmentType sets how long an appointment of a type lasts. Types without
+// a doctor are the clinic defaults; a doctor's own types override them by name.
+type AppointmentType struct {
+	ID       uint       `gorm:"primaryKey" json:"id"`
+	DoctorID *uuid.UUID `gorm:"type:varchar(36);index" json:"doctorId"`
+	Name     string     `gorm:"not null" json:"name"`
+	Duration int        `json:"duration"` // minutes
+}
+
 type Medication struct {
-	ID        uuid.UUID `gorm:"primaryKey;type:varchar(36)" json:"id"`
-	PatientID uuid.UUID `json:"patientId"`
-	Patient   Patient   `json:"patient"`
-	Name      string    `json:"name"`
-	Dosage    string    `json:"dosage"`
-	Frequency string    `json:"frequency"`
-	StartDate string `json:"startDate"`
-	EndDate   string `json:"endDate"`
-	Notes     string    `json:"notes"`
-	CreatedAt time.Time `json:"createdAt"`
-	UpdatedAt time.Time `json:"updatedAt"`
+	ID               uuid.UUID            `gorm:"primaryKey;type:varchar(36)" json:"id"`
+	PatientID        uuid.UUID            `json:"patientId"`
+	Patient          Patient              `json:"patient"`
+	Name             string               `json:"name"`
+	Dosage           string               `json:"dosage"`
+	Frequency        string               `json:"frequency"`
+	DoseQuantity     float64              `json:"doseQuantity"`
+	DoseUnit         string               `json:"doseUnit"`
+	Route            string               `json:"route"`
+	Schedule         *DosingSchedule      `gorm:"serializer:json" json:"schedule"`
+	StartDate        string               `json:"startDate"`
+	EndDate          string               `json:"endDate"`
+	Notes            string               `json:"notes"`
+	OverrideReason   string               `json:"overrideReason"` // why it was prescribed despite severe interaction warnings
+	PrescriberID     *uuid.UUID           `gorm:"type:varchar(36);index" json:"prescriberId"`
+	Quantity         float64              `json:"quantity"` // dispensed per fill, in the dose unit
+	RefillsAllowed   int                  `json:"refillsAllowed"`
+	RefillsRemaining int                  `json:"refillsRemaining"`
+	LastFilledAt     string               `json:"lastFilledAt"` // "2006-01-02", the supply is counted from here
+	Warnings         []interactionWarning `gorm:"-" json:"warnings,omitempty"`
+	CreatedAt        time.Time            `json:"createdAt"`
+	UpdatedAt        time.Time            `json:"updatedAt"`
+	DeletedAt        gorm.DeletedAt       `gorm:"index" json:"deletedAt"`
+}
+
+// MedicationAdministration records whether a dose was taken, one per dose.
+// Times are clinic local "2006-01-02T15:04" strings like appointment times.
+type MedicationAdministration struct {
+	ID           uuid.UUID      `gorm:"primaryKey;type:varchar(36)" json:"id"`
+	MedicationID uuid.UUID      `gorm:"type:varchar(36);uniqueIndex:idx_administration_dose" json:"medicationId"`
+	PatientID    uuid.UUID      `gorm:"type:varchar(36);index" json:"patientId"`
+	ScheduledAt  string         `gorm:"uniqueIndex:idx_administration_dose" json:"scheduledAt"` // the dose in the timeline, or when an as-needed dose was taken
+	Status       string         `gorm:"index" json:"status"`                                    // taken, late or skipped
+	TakenAt      string         `json:"takenAt"`                                                // empty when skipped
+	DoseQuantity float64        `json:"doseQuantity"`
+	Reason       string         `json:"reason"` // why the dose was skipped
+	Notes        string         `json:"notes"`
+	Source       string         `json:"source"` // staff or device
+	RecordedBy   *uuid.UUID     `gorm:"type:varchar(36)" json:"recordedBy"`
+	DeviceID     *uuid.UUID     `gorm:"type:varchar(36)" json:"deviceId"`
+	CreatedAt    time.Time      `json:"createdAt"`
+	UpdatedAt    time.Time      `json:"updatedAt"`
+	DeletedAt    gorm.DeletedAt `gorm:"index" json:"deletedAt"`
+}
+
+// PatientDevice is a patient's phone app or smart pill dispenser, allowed to
+// record the patient's doses with its token
+type PatientDevice struct {
+	ID         uuid.UUID  `gorm:"primaryKey;type:varchar(36)" json:"id"`
+	PatientID  uuid.UUID  `gorm:"type:varchar(36);index" json:"patientId"`
+	TokenHash  string     `gorm:"uniqueIndex;not null" json:"-"` // SHA-256 of the token
+	Label      string     `json:"label"`                         // e.g. "Pill dispenser"
+	CreatedBy  uuid.UUID  `gorm:"type:varchar(36)" json:"createdBy"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	RevokedAt  *time.Time `json:"revokedAt"`
+	CreatedAt  time.Time  `json:"createdAt"`
+}
+
+// RefillRequest asks a medication's prescriber for a refill, or for a renewal
+// once no refills remain
+type RefillRequest struct {
+	ID           uuid.UUID      `gorm:"primaryKey;type:varchar(36)" json:"id"`
+	MedicationID uuid.UUID      `gorm:"type:varchar(36);index" json:"medicationId"`
+	PatientID    uuid.UUID      `gorm:"type:varchar(36);index" json:"patientId"`
+	PrescriberID *uuid.UUID     `gorm:"type:varchar(36);index" json:"prescriberId"`
+	Kind         string         `json:"kind"`                                         // refill or renewal
+	Status       string         `gorm:"index;not null;default:pending" json:"status"` // pending, approved or denied
+	Source       string         `json:"source"`                                       // staff, device or auto
+	RequestedBy  *uuid.UUID     `gorm:"type:varchar(36)" json:"requestedBy"`
+	DeviceID     *uuid.UUID     `gorm:"type:varchar(36)" json:"deviceId"`
+	Notes        string         `json:"notes"`
+	RunsOutOn    string         `json:"runsOutOn"` // estimated day the supply runs out, "2006-01-02"
+	DecidedBy    *uuid.UUID     `gorm:"type:varchar(36)" json:"decidedBy"`
+	DecidedAt    *time.Time     `json:"decidedAt"`
+	DecisionNote string         `json:"decisionNote"`
+	CreatedAt    time.Time      `json:"createdAt"`
+	UpdatedAt    time.Time      `json:"updatedAt"`
+	DeletedAt    gorm.DeletedAt `gorm:"index" json:"deletedAt"`
+}
+
+// DrugInteraction is an interaction between two drugs or drug classes, stored
+// with the names in alphabetical order
+type DrugInteraction struct {
+	ID          uint      `gorm:"primaryKey" json:"-"`
+	DrugA       string    `gorm:"uniqueIndex:idx_interaction_pair" json:"drugA"`
+	DrugB       string    `gorm:"uniqueIndex:idx_interaction_pair" json:"drugB"`
+	Severity    string    `json:"severity"` // minor, moderate, major or contraindicated
+	Description string    `json:"description"`
+	UpdatedAt   time.Time `json:"-"`
+}
+
+// DrugClassMember puts a drug in a class, such as amoxicillin in penicillin
+type DrugClassMember struct {
+	Class string `gorm:"primaryKey"`
+	Drug  string `gorm:"primaryKey;index"`
 }
 
 type HealthMetric struct {
-	ID         uuid.UUID `gorm:"primaryKey;type:varchar(36)" json:"id"`
-	PatientID  uuid.UUID `json:"patientId"`
-	Patient    Patient   `json:"patient"`
-	Type       string    `json:"type"` // e.g., "blood_pressure", "blood_sugar", "weight"
-	Value      float64   `json:"value"`
-	Unit       string    `json:"unit"`
-	MeasuredAt string `json:"measuredAt"`
-	Notes      string    `json:"notes"`
-	CreatedAt  time.Time `json:"createdAt"`
-	UpdatedAt  time.Time `json:"updatedAt"`
+	ID             uuid.UUID         `gorm:"primaryKey;type:varchar(36)" json:"id"`
+	PatientID      uuid.UUID         `json:"patientId"`
+	Patient        Patient           `json:"patient"`
+	Type           string            `json:"type"`  // a registered metric type, see metricTypes
+	Value          float64           `json:"value"` // as recorded
+	Unit           string            `json:"unit"`
+	CanonicalValue float64           `json:"canonicalValue"` // in the type's canonical unit
+	CanonicalUnit  string            `json:"canonicalUnit"`
+	Components     []metricComponent `gorm:"serializer:json" json:"components,omitempty"` // of composite metrics, such as blood pressure
+	MeasuredAt     string            `json:"measuredAt"`
+	Flag           string            `json:"flag,omitempty"` // against the reference range: normal, low, high or critical
+	ReferenceRange *referenceRange   `gorm:"-" json:"referenceRange,omitempty"`
+	Notes          string            `json:"notes"`
+	CreatedAt      time.Time         `json:"createdAt"`
+	UpdatedAt      time.Time         `json:"updatedAt"`
+	DeletedAt      gorm.DeletedAt    `gorm:"index" json:"deletedAt"`
 }
 
 // Report structure for storing AI-generated medical reports
 type Report struct {
-	ID           uuid.UUID `gorm:"primaryKey;type:varchar(36)" json:"id"`
-	PatientID    uuid.UUID `json:"patientId"`
-	PatientName  string    `json:"patientName"`
-	ReportType   string    `json:"reportType"`
-	Summary      string    `json:"summary"`
-	Content      string    `json:"content"` // JSON string containing sections and recommendations
-	GeneratedAt  time.Time `json:"generatedAt"`
-	Status       string    `json:"status"` // "processing", "completed", "failed"
-	CreatedAt    time.Time `json:"createdAt"`
-	UpdatedAt    time.Time `json:"updatedAt"`
+	ID          uuid.UUID      `gorm:"primaryKey;type:varchar(36)" json:"id"`
+	PatientID   uuid.UUID      `json:"patientId"`
+	PatientName string         `json:"patientName"`
+	ReportType  string         `json:"reportType"`
+	Summary     string         `json:"summary"`
+	Content     string         `json:"content"` // JSON string containing sections and recommendations
+	GeneratedAt time.Time      `json:"generatedAt"`
+	Status      string         `json:"status"` // "processing", "completed", "failed"
+	CreatedAt   time.Time      `json:"createdAt"`
+	UpdatedAt   time.Time      `json:"updatedAt"`
+	DeletedAt   gorm.DeletedAt `gorm:"index" json:"deletedAt"`
 }
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// Notification channels
+const (
+	channelEmail   = "email"
+	channelSMS     = "sms"
+	channelWebhook = "webhook"
+)
+
+// Notification is a message for a patient, or for the clinic's own systems
+// in the case of webhooks
+type Notification struct {
+	Channel       string    `json:"channel"`
+	To            string    `json:"to"`
+	Subject       string    `json:"subject"`
+	Body          string    `json:"body"`
+	Event         string    `json:"event"` // e.g. "appointment.reminder"
+	AppointmentID uuid.UUID `json:"appointmentId"`
+	PatientID     uuid.UUID `json:"patientId"`
+	DateTime      string    `json:"dateTime"`
+	SentAt        time.Time `json:"sentAt"`
+}
+
+// Notifier delivers notifications over one channel. Configure the channels
+// with REMINDER_CHANNELS and the SMS gateway and webhook settings, or set
+// NOTIFIER_DRIVER=fake to keep every notification in memory.
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// Notifiers by channel, only enabled channels are present
+var notifiers = map[string]Notifier{}
+
+var notifierClient = &http.Client{Timeout: 30 * time.Second}
+
+// Notifier that sends email through the configured mailer
+type emailNotifier struct{}
+
+func (emailNotifier) Notify(ctx context.Context, n Notification) error {
+	return mailer.Send(ctx, MailMessage{To: n.To, Subject: n.Subject, Body: n.Body})
+}
+
+// Notifier that posts text messages to an HTTP SMS gateway as
+// {"from", "to", "body"} JSON, with the token as a bearer credential
+type smsNotifier struct {
+	url   string
+	token string
+	from  string
+}
+
+func (s *smsNotifier) Notify(ctx context.Context, n Notification) error {
+	payload, _ := json.Marshal(fiber.Map{"from": s.from, "to": n.To, "body": n.Body})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	return doNotifierRequest(req)
+}
+
+// Notifier that posts events to the clinic's own systems. The body is signed
+// with HMAC-SHA256 in X-MedThing-Signature when a secret is set. Only IDs and
+// times are sent, no names or contact details.
+type webhookNotifier struct {
+	url    string
+	secret string
+}
+
+func (w *webhookNotifier) Notify(ctx context.Context, n Notification) error {
+	payload, _ := json.Marshal(fiber.Map{
+		"event":         n.Event,
+		"appointmentId": n.AppointmentID,
+		"patientId":     n.PatientID,
+		"dateTime":      n.DateTime,
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.secret != "" {
+		mac := hmac.New(sha256.New, []byte(w.secret))
+		mac.Write(payload)
+		req.Header.Set("X-MedThing-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	return doNotifierRequest(req)
+}
+
+// Send a request, failing on any non-2xx response
+func doNotifierRequest(req *http.Request) error {
+	resp, err := notifierClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 200))
+		return fmt.Errorf("%s responded %d: %s", req.URL.Host, resp.StatusCode, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// Notifier that keeps notifications in memory, for tests and local
+// development
+type fakeNotifier struct {
+	mu            sync.Mutex
+	notifications []Notification
+}
+
+func newFakeNotifier() *fakeNotifier {
+	return &fakeNotifier{}
+}
+
+func (f *fakeNotifier) Notify(ctx context.Context, n Notification) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n.SentAt = time.Now()
+	f.notifications = append(f.notifications, n)
+	log.Printf("INFO: %s notification to %s kept in memory: %s", n.Channel, n.To, n.Event)
+	return nil
+}
+
+// Notifications returns a copy of every notification sent so far
+func (f *fakeNotifier) Notifications() []Notification {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]Notification(nil), f.notifications...)
+}
+
+// Configure the notifiers for the channels in REMINDER_CHANNELS, called from
+// main once the environment is loaded
+func loadNotifierConfig() {
+	notifiers = map[string]Notifier{}
+	fake := os.Getenv("NOTIFIER_DRIVER") == "fake"
+	var shared *fakeNotifier
+	if fake {
+		shared = newFakeNotifier()
+	}
+
+	for _, channel := range reminderChannels {
+		if fake {
+			notifiers[channel] = shared
+			continue
+		}
+
+		switch channel {
+		case channelEmail:
+			notifiers[channel] = emailNotifier{}
+		case channelSMS:
+			url := os.Getenv("SMS_GATEWAY_URL")
+			if url == "" {
+				log.Println("WARN: SMS reminders are enabled but SMS_GATEWAY_URL is not set, SMS reminders are disabled")
+				continue
+			}
+			notifiers[channel] = &smsNotifier{
+				url:   url,
+				token: os.Getenv("SMS_GATEWAY_TOKEN"),
+				from:  os.Getenv("SMS_FROM"),
+			}
+		case channelWebhook:
+			url := os.Getenv("REMINDER_WEBHOOK_URL")
+			if url == "" {
+				log.Println("WARN: Webhook reminders are enabled but REMINDER_WEBHOOK_URL is not set, webhook reminders are disabled")
+				continue
+			}
+			notifiers[channel] = &webhookNotifier{url: url, secret: os.Getenv("REMINDER_WEBHOOK_SECRET")}
+		}
+	}
+}
+
+// List notifications held by the fake notifier (development only)
+func getDevNotifications(c *fiber.Ctx) error {
+	for _, n := range notifiers {
+		if fake, ok := n.(*fakeNotifier); ok {
+			return c.JSON(fiber.Map{
+				"success": true,
+				"message": "Notifications retrieved successfully",
+				"data":    fake.Notifications(),
+			})
+		}
+	}
+
+	return c.Status(404).JSON(fiber.Map{
+		"success": false,
+		"message": "Fake notifier is not enabled",
+	})
+}
@@ -1,14 +1,51 @@
 package main
 
-import "github.com/gofiber/fiber/v2"
+import (
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Sorting and filtering accepted by getAllPatients
+var patientListSpec = listSpec{
+	sort: map[string]string{
+		"name":        "name",
+		"dateOfBirth": "date_of_birth",
+		"createdAt":   "created_at",
+		"updatedAt":   "updated_at",
+	},
+	defaultSort: "name",
+	filters: []listFilter{
+		{"q", "name", filterContains},
+		{"gender", "gender", filterEquals},
+		{"bloodGroup", "blood_group", filterEquals},
+		{"createdFrom", "created_at", filterFrom},
+		{"createdTo", "created_at", filterTo},
+	},
+}
 
 func getAllPatients(c *fiber.Ctx) error {
 	var patients []Patient
-	result := db.Find(&patients) // empty condition
-	if result.Error != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch patients"})
+	query := db.Model(&Patient{}).Scopes(scopePatients(c)) // caller's care teams only
+	meta, err := listPage(c, query, patientListSpec, &patients)
+	if err != nil {
+		return listError(c, err, "Failed to fetch patients")
 	}
-	return c.JSON(patients)
+
+	patientIDs := make([]uuid.UUID, len(patients))
+	for i, patient := range patients {
+		patientIDs[i] = patient.ID
+	}
+	auditList(c, "patient", patientIDs)
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Patients retrieved successfully",
+		"data":    patients,
+		"meta":    meta,
+	})
 }
 
 func createPatient(c *fiber.Ctx) error {
@@ -19,22 +56,38 @@ func createPatient(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
 	}
 
-	result := db.Create(&patient)
-	if result.Error != nil {
+	// the creating doctor becomes the patient's primary care team member
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&patient).Error; err != nil {
+			return err
+		}
+		return tx.Create(&CareTeamMember{
+			PatientID: patient.ID,
+			DoctorID:  currentDoctorID(c),
+			Role:      "primary",
+			CreatedAt: time.Now(),
+		}).Error
+	})
+	if err != nil {
+		auditAccess(c, "create", "patient", "", uuid.Nil, auditError)
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to create patient"})
 	}
 
+	auditAccess(c, "create", "patient", patient.ID.String(), patient.ID, auditSuccess)
+	reindexPatient(patient.ID)
 	return c.JSON(patient)
 }
 
 func getPatient(c *fiber.Ctx) error {
 	id := c.Params("id")
 	var patient Patient
-	result := db.First(&patient, "id = ?", id)
+	result := db.Scopes(scopePatients(c)).First(&patient, "id = ?", id)
 	if result.Error != nil {
+		auditAccess(c, "read", "patient", id, uuid.Nil, auditNotFound)
 		return c.Status(404).JSON(fiber.Map{"error": "Patient not found"})
 	}
 
+	auditAccess(c, "read", "patient", id, patient.ID, auditSuccess)
 	return c.JSON(patient)
 }
 
@@ -44,19 +97,40 @@ func updatePatient(c *fiber.Ctx) error {
 	if err := c.BodyParser(patient); err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
 	}
-	result := db.Model(&Patient{}).Where("id = ?", id).Updates(patient)
+	patientID, _ := uuid.Parse(id)
+	result := db.Model(&Patient{}).Scopes(scopePatients(c)).Where("id = ?", id).Updates(patient)
 	if result.Error != nil {
+		auditAccess(c, "update", "patient", id, patientID, auditError)
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to update patient"})
 	}
+	if result.RowsAffected == 0 {
+		auditAccess(c, "update", "patient", id, uuid.Nil, auditNotFound)
+		return c.Status(404).JSON(fiber.Map{"error": "Patient not found"})
+	}
 
+	auditAccess(c, "update", "patient", id, patientID, auditSuccess)
+	reindexPatient(patientID)
 	return c.JSON(patient)
 }
 
+// Archives the patient and their records, see archivePatient()
 func deletePatient(c *fiber.Ctx) error {
 	id := c.Params("id")
-	result := db.Delete(&Patient{}, "id = ?", id)
-	if result.Error != nil {
+	var patient Patient
+	if err := db.Scopes(scopePatients(c)).First(&patient, "id = ?", id).Error; err != nil {
+		auditAccess(c, "delete", "patient", id, uuid.Nil, auditNotFound)
+		return c.Status(404).JSON(fiber.Map{"error": "Patient not found"})
+	}
+
+	// the care team is kept so the patient can still be restored
+	err := db.Transaction(func(tx *gorm.DB) error {
+		return archivePatient(tx, patient.ID)
+	})
+	if err != nil {
+		auditAccess(c, "delete", "patient", id, patient.ID, auditError)
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete patient"})
 	}
+
+	auditAccess(c, "delete", "patient", id, patient.ID, auditSuccess)
 	return c.SendStatus(204) // No Content
 }
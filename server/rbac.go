@@ -0,0 +1,226 @@
+package main
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// Roles a user account can hold
+const (
+	RoleAdmin        = "admin"
+	RolePhysician    = "physician"
+	RoleNurse        = "nurse"
+	RoleReceptionist = "receptionist"
+)
+
+// Permissions checked by requirePermission()
+const (
+	PermPatientsRead          = "patients:read"
+	PermPatientsWrite         = "patients:write"
+	PermPatientsDelete        = "patients:delete"
+	PermPatientsAll           = "patients:all" // bypasses care team scoping
+	PermCareTeamManage        = "careteam:manage"
+	PermAppointmentsRead      = "appointments:read"
+	PermAppointmentsWrite     = "appointments:write"
+	PermAppointmentsDelete    = "appointments:delete"
+	PermMedicationsRead       = "medications:read"
+	PermMedicationsWrite      = "medications:write"
+	PermMedicationsDelete     = "medications:delete"
+	PermMedicationsAdminister = "medications:administer" // record doses as taken or skipped
+	PermMetricsRead           = "metrics:read"
+	PermMetricsWrite          = "metrics:write"
+	PermReportsRead           = "reports:read"
+	PermReportsGenerate       = "reports:generate"
+	PermStatsRead             = "stats:read"
+	PermUsersManage           = "users:manage"
+	PermAuditRead             = "audit:read"
+	PermTrashManage           = "trash:manage"
+	PermScheduleManage        = "schedule:manage" // edit any doctor's schedule
+)
+
+// Permission matrix for every role
+var rolePermissions = map[string][]string{
+	RoleAdmin: {
+		PermPatientsRead, PermPatientsWrite, PermPatientsDelete, PermPatientsAll, PermCareTeamManage,
+		PermAppointmentsRead, PermAppointmentsWrite, PermAppointmentsDelete,
+		PermMedicationsRead, PermMedicationsWrite, PermMedicationsDelete, PermMedicationsAdminister,
+		PermMetricsRead, PermMetricsWrite,
+		PermReportsRead, PermReportsGenerate,
+		PermStatsRead, PermUsersManage, PermAuditRead, PermTrashManage,
+		PermScheduleManage,
+	},
+	RolePhysician: {
+		PermPatientsRead, PermPatientsWrite, PermCareTeamManage,
+		PermAppointmentsRead, PermAppointmentsWrite,
+		PermMedicationsRead, PermMedicationsWrite, PermMedicationsAdminister,
+		PermMetricsRead, PermMetricsWrite,
+		PermReportsRead, PermReportsGenerate,
+		PermStatsRead,
+	},
+	RoleNurse: {
+		PermPatientsRead, PermPatientsWrite,
+		PermAppointmentsRead, PermAppointmentsWrite,
+		PermMedicationsRead, PermMedicationsAdminister,
+		PermMetricsRead, PermMetricsWrite,
+		PermReportsRead,
+		PermStatsRead,
+	},
+	RoleReceptionist: {
+		PermPatientsRead, PermPatientsWrite,
+		PermAppointmentsRead, PermAppointmentsWrite,
+		PermStatsRead,
+	},
+}
+
+// Check whether a role exists in the permission matrix
+func isValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// Check whether a role grants a permission
+func roleHasPermission(role, permission string) bool {
+	for _, p := range rolePermissions[role] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether the authenticated caller has a permission
+func hasPermission(c *fiber.Ctx, permission string) bool {
+	role, _ := c.Locals("role").(string)
+	return roleHasPermission(role, permission)
+}
+
+// Check whether a role sees patients, so appointments can be booked with it
+func seesPatients(role string) bool {
+	return role == RolePhysician || role == RoleAdmin
+}
+
+// The doctor to book with when none is given: the caller if they see
+// patients, none otherwise
+func defaultDoctorID(c *fiber.Ctx) uuid.UUID {
+	role, _ := c.Locals("role").(string)
+	if !seesPatients(role) {
+		return uuid.Nil
+	}
+	return currentDoctorID(c)
+}
+
+// Permission middleware, must run after protected()
+func requirePermission(permission string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !hasPermission(c, permission) {
+			actorID := currentDoctorID(c)
+			email, _ := c.Locals("email").(string)
+			recordAuditEvent(AuditEvent{
+				ActorID:      &actorID,
+				ActorEmail:   email,
+				Action:       "permission.denied",
+				ResourceType: permission,
+				ResourceID:   c.Method() + " " + c.Path(),
+				IP:           c.IP(),
+				Outcome:      auditDenied,
+			})
+			return c.Status(403).JSON(fiber.Map{
+				"success": false,
+				"message": "You do not have permission to perform this action",
+			})
+		}
+		return c.Next()
+	}
+}
+
+// List all user accounts with their roles
+func getUsers(c *fiber.Ctx) error {
+	var users []Doctor
+	if err := db.Order("name").Find(&users).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to fetch users",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Users retrieved successfully",
+		"data":    users,
+	})
+}
+
+// List the available roles and the permissions each one grants
+func getRoles(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Roles retrieved successfully",
+		"data":    rolePermissions,
+	})
+}
+
+// Assign a role to a user account
+func updateUserRole(c *fiber.Ctx) error {
+	req := new(struct {
+		Role string `json:"role"`
+	})
+	if err := c.BodyParser(req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "Invalid request body",
+		})
+	}
+
+	if !isValidRole(req.Role) {
+		return c.Status(422).JSON(fiber.Map{
+			"success": false,
+			"message": "Unknown role",
+		})
+	}
+
+	var user Doctor
+	if err := db.First(&user, "id = ?", c.Params("id")).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "User not found",
+		})
+	}
+
+	// Refuse to demote the last remaining admin
+	if user.Role == RoleAdmin && req.Role != RoleAdmin {
+		var admins int64
+		db.Model(&Doctor{}).Where("role = ?", RoleAdmin).Count(&admins)
+		if admins <= 1 {
+			return c.Status(409).JSON(fiber.Map{
+				"success": false,
+				"message": "Cannot remove the last admin",
+			})
+		}
+	}
+
+	previousRole := user.Role
+	if err := db.Model(&user).Update("role", req.Role).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to update role",
+		})
+	}
+
+	adminID := currentDoctorID(c)
+	recordAuditEvent(AuditEvent{
+		ActorID:      &adminID,
+		Action:       "account.role_changed",
+		ResourceType: "account",
+		ResourceID:   user.ID.String(),
+		IP:           c.IP(),
+		Outcome:      auditSuccess,
+		Details:      previousRole + " -> " + req.Role,
+	})
+
+	// The new role applies from the user's next token
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Role updated",
+		"data":    user,
+	})
+}
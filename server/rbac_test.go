@@ -0,0 +1,222 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestRoleHasPermission(t *testing.T) {
+	tests := []struct {
+		role       string
+		permission string
+		want       bool
+	}{
+		{RoleReceptionist, PermAppointmentsRead, true},
+		{RoleReceptionist, PermAppointmentsWrite, true},
+		{RoleReceptionist, PermAppointmentsDelete, false},
+		{RoleReceptionist, PermMedicationsRead, false},
+		{RoleReceptionist, PermMetricsRead, false},
+		{RoleReceptionist, PermReportsRead, false},
+		{RoleReceptionist, PermReportsGenerate, false},
+		{RoleNurse, PermMedicationsRead, true},
+		{RoleNurse, PermMedicationsAdminister, true},
+		{RoleNurse, PermMedicationsWrite, false},
+		{RoleNurse, PermReportsGenerate, false},
+		{RolePhysician, PermMedicationsWrite, true},
+		{RolePhysician, PermReportsGenerate, true},
+		{RolePhysician, PermPatientsAll, false},
+		{RolePhysician, PermUsersManage, false},
+		{RoleAdmin, PermUsersManage, true},
+		{RoleAdmin, PermAuditRead, true},
+		{RoleAdmin, PermTrashManage, true},
+		{"", PermPatientsRead, false},
+		{"superuser", PermPatientsRead, false},
+	}
+
+	for _, tt := range tests {
+		if got := roleHasPermission(tt.role, tt.permission); got != tt.want {
+			t.Errorf("roleHasPermission(%q, %q) = %v, want %v", tt.role, tt.permission, got, tt.want)
+		}
+	}
+}
+
+// Only admins may delete, whatever the record
+func TestOnlyAdminsHoldDeletePermissions(t *testing.T) {
+	deletes := []string{PermPatientsDelete, PermAppointmentsDelete, PermMedicationsDelete}
+	for role := range rolePermissions {
+		for _, permission := range deletes {
+			if got, want := roleHasPermission(role, permission), role == RoleAdmin; got != want {
+				t.Errorf("roleHasPermission(%q, %q) = %v, want %v", role, permission, got, want)
+			}
+		}
+	}
+}
+
+func TestRoutePermissions(t *testing.T) {
+	setupTestDB(t)
+	app := newTestApp()
+
+	tokens := map[string]string{}
+	for _, role := range []string{RoleAdmin, RolePhysician, RoleNurse, RoleReceptionist} {
+		_, tokens[role] = createTestUser(t, role, "password123")
+	}
+
+	id := uuid.New().String()
+	tests := []struct {
+		role    string
+		method  string
+		path    string
+		allowed bool
+	}{
+		// Receptionists manage appointments but see no clinical data
+		{RoleReceptionist, http.MethodGet, "/api/appointments", true},
+		{RoleReceptionist, http.MethodPost, "/api/appointments", true},
+		{RoleReceptionist, http.MethodPut, "/api/appointments/" + id, true},
+		{RoleReceptionist, http.MethodPost, "/api/appointments/" + id + "/check-in", true},
+		{RoleReceptionist, http.MethodGet, "/api/patients", true},
+		{RoleReceptionist, http.MethodGet, "/api/medications/patient/" + id, false},
+		{RoleReceptionist, http.MethodPost, "/api/medications", false},
+		{RoleReceptionist, http.MethodPost, "/api/medications/" + id + "/refill-requests", false},
+		{RoleReceptionist, http.MethodGet, "/api/metrics/patient/" + id, false},
+		{RoleReceptionist, http.MethodGet, "/api/reports", false},
+		{RoleReceptionist, http.MethodPost, "/api/reports/generate", false},
+
+		// Nurses record doses but do not prescribe or generate reports
+		{RoleNurse, http.MethodGet, "/api/medications/patient/" + id, true},
+		{RoleNurse, http.MethodPost, "/api/medications/" + id + "/administrations", true},
+		{RoleNurse, http.MethodPost, "/api/medications/" + id + "/refill-requests", true},
+		{RoleNurse, http.MethodPost, "/api/refill-requests/" + id + "/approve", false},
+		{RoleNurse, http.MethodPost, "/api/medications", false},
+		{RoleNurse, http.MethodPost, "/api/metrics", true},
+		{RoleNurse, http.MethodGet, "/api/reports", true},
+		{RoleNurse, http.MethodPost, "/api/reports/generate", false},
+
+		// Physicians prescribe and generate reports
+		{RolePhysician, http.MethodPost, "/api/medications", true},
+		{RolePhysician, http.MethodPost, "/api/reports/generate", true},
+		{RolePhysician, http.MethodPost, "/api/patients/" + id + "/care-team", true},
+
+		// Only admins delete records
+		{RoleAdmin, http.MethodDelete, "/api/patients/" + id, true},
+		{RolePhysician, http.MethodDelete, "/api/patients/" + id, false},
+		{RoleNurse, http.MethodDelete, "/api/patients/" + id, false},
+		{RoleReceptionist, http.MethodDelete, "/api/patients/" + id, false},
+		{RoleAdmin, http.MethodDelete, "/api/appointments/" + id, true},
+		{RolePhysician, http.MethodDelete, "/api/appointments/" + id, false},
+		{RoleNurse, http.MethodDelete, "/api/appointments/" + id, false},
+		{RoleReceptionist, http.MethodDelete, "/api/appointments/" + id, false},
+		{RoleAdmin, http.MethodDelete, "/api/medications/" + id, true},
+		{RolePhysician, http.MethodDelete, "/api/medications/" + id, false},
+		{RoleNurse, http.MethodDelete, "/api/medications/" + id, false},
+		{RoleReceptionist, http.MethodDelete, "/api/medications/" + id, false},
+
+		// Administration is for admins alone
+		{RoleAdmin, http.MethodGet, "/api/admin/users", true},
+		{RolePhysician, http.MethodGet, "/api/admin/users", false},
+		{RoleNurse, http.MethodPut, "/api/admin/users/" + id + "/role", false},
+		{RoleAdmin, http.MethodGet, "/api/audit", true},
+		{RolePhysician, http.MethodGet, "/api/audit", false},
+		{RoleAdmin, http.MethodGet, "/api/trash", true},
+		{RoleReceptionist, http.MethodGet, "/api/trash", false},
+	}
+
+	for _, tt := range tests {
+		resp := doRequest(t, app, tt.method, tt.path, tokens[tt.role], map[string]string{})
+		if denied := resp.StatusCode == http.StatusForbidden; denied == tt.allowed {
+			t.Errorf("%s %s as %s: status %d, want allowed = %v", tt.method, tt.path, tt.role, resp.StatusCode, tt.allowed)
+		}
+	}
+}
+
+func TestRoutePermissionsRequireAuthentication(t *testing.T) {
+	setupTestDB(t)
+	app := newTestApp()
+
+	resp := doRequest(t, app, http.MethodGet, "/api/appointments", "", nil)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
+
+func TestUpdateUserRole(t *testing.T) {
+	setupTestDB(t)
+	app := newTestApp()
+
+	admin, adminToken := createTestUser(t, RoleAdmin, "password123")
+	nurse, _ := createTestUser(t, RoleNurse, "password123")
+
+	// The only admin cannot be demoted, not even by themselves
+	resp := doRequest(t, app, http.MethodPut, "/api/admin/users/"+admin.ID.String()+"/role", adminToken, map[string]string{"role": RolePhysician})
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("demoting the last admin: status = %d, want %d", resp.StatusCode, http.StatusConflict)
+	}
+
+	resp = doRequest(t, app, http.MethodPut, "/api/admin/users/"+nurse.ID.String()+"/role", adminToken, map[string]string{"role": "superuser"})
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("assigning an unknown role: status = %d, want %d", resp.StatusCode, http.StatusUnprocessableEntity)
+	}
+
+	// Once there is a second admin, the first may step down
+	resp = doRequest(t, app, http.MethodPut, "/api/admin/users/"+nurse.ID.String()+"/role", adminToken, map[string]string{"role": RoleAdmin})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("promoting a nurse: status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	resp = doRequest(t, app, http.MethodPut, "/api/admin/users/"+admin.ID.String()+"/role", adminToken, map[string]string{"role": RolePhysician})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("demoting one of two admins: status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	var updated Doctor
+	db.First(&updated, "id = ?", admin.ID)
+	if updated.Role != RolePhysician {
+		t.Errorf("role = %q, want %q", updated.Role, RolePhysician)
+	}
+
+	var changes int64
+	db.Model(&AuditEvent{}).Where("action = ?", "account.role_changed").Count(&changes)
+	if changes != 2 {
+		t.Errorf("%d account.role_changed events, want 2", changes)
+	}
+}
+
+// Staff who don't see patients book with a physician they name, never themselves
+func TestBookingNeedsPhysician(t *testing.T) {
+	setupTestDB(t)
+	app := newTestApp()
+	physician, _ := createTestUser(t, RolePhysician, "password123")
+	nurse, _ := createTestUser(t, RoleNurse, "password123")
+	receptionist, receptionistToken := createTestUser(t, RoleReceptionist, "password123")
+	patient := createTestPatient(t, "Ada Lovelace", physician, receptionist)
+
+	tests := []struct {
+		name     string
+		path     string
+		doctorID uuid.UUID
+		want     int
+	}{
+		{"appointment without doctorId", "/api/appointments", uuid.Nil, http.StatusUnprocessableEntity},
+		{"appointment with a nurse", "/api/appointments", nurse.ID, http.StatusUnprocessableEntity},
+		{"series without doctorId", "/api/appointments/series", uuid.Nil, http.StatusUnprocessableEntity},
+		{"series with a nurse", "/api/appointments/series", nurse.ID, http.StatusUnprocessableEntity},
+		{"waitlist without doctorId", "/api/waitlist", uuid.Nil, http.StatusUnprocessableEntity},
+		{"waitlist with a nurse", "/api/waitlist", nurse.ID, http.StatusUnprocessableEntity},
+		{"appointment with a physician", "/api/appointments", physician.ID, http.StatusOK},
+	}
+	for _, tt := range tests {
+		body := map[string]interface{}{
+			"patientId": patient.ID,
+			"dateTime":  nextMonday(9).Format(appointmentTimeLayout),
+			"rrule":     "FREQ=WEEKLY;COUNT=2",
+			"type":      "Consultation",
+		}
+		if tt.doctorID != uuid.Nil {
+			body["doctorId"] = tt.doctorID
+		}
+		resp := doRequest(t, app, http.MethodPost, tt.path, receptionistToken, body)
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, resp.StatusCode, tt.want)
+		}
+	}
+}
@@ -0,0 +1,681 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Kinds of refill request
+const (
+	refillKindRefill  = "refill"  // a refill of the prescription, while refills remain
+	refillKindRenewal = "renewal" // a new prescription, once no refills remain
+)
+
+// Refill request statuses
+const (
+	refillPending  = "pending"
+	refillApproved = "approved"
+	refillDenied   = "denied"
+)
+
+// Who raised a refill request; staff and device are shared with administrations
+const sourceAuto = "auto"
+
+// Prescriptions are flagged this many days before their supply runs out
+var refillLeadDays = 7
+
+// How often supplies are checked
+const refillCheckInterval = time.Hour
+
+// Apply REFILL_LEAD_DAYS, called from main once the environment is loaded
+func loadRefillConfig() {
+	if v, err := strconv.Atoi(os.Getenv("REFILL_LEAD_DAYS")); err == nil && v >= 0 {
+		refillLeadDays = v
+	}
+}
+
+// Sorting and filtering accepted by getRefillRequests and getMedicationRefillRequests
+var refillListSpec = listSpec{
+	sort: map[string]string{
+		"createdAt": "created_at",
+		"runsOutOn": "runs_out_on",
+	},
+	defaultSort: "-createdAt",
+	filters: []listFilter{
+		{"status", "status", filterEquals},
+		{"kind", "kind", filterEquals},
+		{"source", "source", filterEquals},
+		{"patientId", "patient_id", filterUUID},
+		{"prescriberId", "prescriber_id", filterUUID},
+	},
+}
+
+// Validate the prescription fields of a medication and fill in defaults: the
+// caller as prescriber, every refill remaining, and the supply counted from
+// the start date or today
+func preparePrescription(c *fiber.Ctx, m *Medication, created bool) error {
+	if m.PrescriberID == nil || *m.PrescriberID == uuid.Nil {
+		if !created {
+			return nil
+		}
+		id := currentDoctorID(c)
+		m.PrescriberID = &id
+	} else {
+		var count int64
+		db.Model(&Doctor{}).Where("id = ?", *m.PrescriberID).Count(&count)
+		if count == 0 {
+			return fmt.Errorf("prescriber not found")
+		}
+	}
+	if m.Quantity < 0 || m.RefillsAllowed < 0 || m.RefillsRemaining < 0 {
+		return fmt.Errorf("quantity and refills cannot be negative")
+	}
+	if created && m.RefillsRemaining == 0 {
+		m.RefillsRemaining = m.RefillsAllowed
+	}
+	if m.RefillsRemaining > m.RefillsAllowed {
+		return fmt.Errorf("refillsRemaining cannot be more than refillsAllowed")
+	}
+	if m.LastFilledAt != "" {
+		if _, err := time.Parse(scheduleDateLayout, m.LastFilledAt); err != nil {
+			return fmt.Errorf("lastFilledAt %q must be a date like 2006-01-02", m.LastFilledAt)
+		}
+	} else if m.Quantity > 0 {
+		m.LastFilledAt = clinicNow().Format(scheduleDateLayout)
+		if m.StartDate != "" {
+			m.LastFilledAt = m.StartDate[:len(scheduleDateLayout)]
+		}
+	}
+	return nil
+}
+
+// Estimate the day a medication's supply runs out: the day of the first dose
+// the quantity dispensed at the last fill does not cover. Supplies lasting
+// past the end date, or more than a year, never run out.
+func supplyRunsOut(m Medication) (time.Time, bool) {
+	if m.Quantity <= 0 || m.Schedule == nil || m.Schedule.Kind == schedulePRN {
+		return time.Time{}, false
+	}
+	from, err := time.Parse(scheduleDateLayout, m.LastFilledAt)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	supply := m.Quantity
+	for _, dose := range expandDoses(m, from, from.AddDate(1, 0, 0)) {
+		// Without a dose quantity each dose counts as one unit
+		quantity := dose.DoseQuantity
+		if quantity == 0 {
+			quantity = 1
+		}
+		if supply -= quantity; supply < 0 {
+			t, _ := time.Parse(appointmentTimeLayout, dose.DateTime)
+			return t.Truncate(24 * time.Hour), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// The kind of request a medication needs next
+func refillKind(m Medication) string {
+	if m.RefillsRemaining > 0 {
+		return refillKindRefill
+	}
+	return refillKindRenewal
+}
+
+// Whether a medication has a request awaiting a decision
+func hasPendingRefill(medicationID uuid.UUID) bool {
+	var count int64
+	db.Model(&RefillRequest{}).Where("medication_id = ? AND status = ?", medicationID, refillPending).Count(&count)
+	return count > 0
+}
+
+// Create a pending request and tell the prescriber
+func createRefillRequest(m Medication, r *RefillRequest) error {
+	r.ID = uuid.New()
+	r.MedicationID = m.ID
+	r.PatientID = m.PatientID
+	r.PrescriberID = m.PrescriberID
+	r.Kind = refillKind(m)
+	r.Status = refillPending
+	if runsOut, ok := supplyRunsOut(m); ok {
+		r.RunsOutOn = runsOut.Format(scheduleDateLayout)
+	}
+	if err := db.Create(r).Error; err != nil {
+		return err
+	}
+	notifyPrescriber(m, *r)
+	return nil
+}
+
+// Email the prescriber about a new request. Only the medication is named, the
+// patient is left to the app.
+func notifyPrescriber(m Medication, r RefillRequest) {
+	if m.PrescriberID == nil {
+		return
+	}
+	var prescriber Doctor
+	if err := db.First(&prescriber, "id = ?", *m.PrescriberID).Error; err != nil {
+		return
+	}
+	body := fmt.Sprintf("A %s of %s awaits your decision in MedThing (request %s).", r.Kind, m.Name, r.ID)
+	if r.RunsOutOn != "" {
+		body += fmt.Sprintf(" The patient's supply is expected to run out on %s.", r.RunsOutOn)
+	}
+	sendMailAsync(MailMessage{
+		To:      prescriber.Email,
+		Subject: "Prescription " + r.Kind + " request",
+		Body:    body,
+	})
+}
+
+// Raise requests for prescriptions whose supply runs out within
+// refillLeadDays, once per fill
+func detectRunningOut() error {
+	var medications []Medication
+	if err := db.Where("quantity > 0 AND schedule IS NOT NULL AND last_filled_at <> ''").Find(&medications).Error; err != nil {
+		return err
+	}
+
+	today := clinicNow().Truncate(24 * time.Hour)
+	horizon := today.AddDate(0, 0, refillLeadDays)
+	for _, m := range medications {
+		runsOut, ok := supplyRunsOut(m)
+		if !ok || runsOut.After(horizon) {
+			continue
+		}
+		if end, err := parseMedicationDate(m.EndDate); err == nil && end.Before(runsOut) {
+			continue
+		}
+		// One request per fill: nothing if one was raised since the last fill
+		var count int64
+		if err := db.Model(&RefillRequest{}).
+			Where("medication_id = ? AND created_at >= ?", m.ID, m.LastFilledAt).
+			Count(&count).Error; err != nil || count > 0 {
+			continue
+		}
+
+		request := RefillRequest{Source: sourceAuto, Notes: "Supply running out"}
+		if err := createRefillRequest(m, &request); err != nil {
+			log.Printf("ERROR: Failed to request a refill of medication %s: %v", m.ID, err)
+			continue
+		}
+		details, _ := json.Marshal(fiber.Map{"medicationId": m.ID, "runsOutOn": request.RunsOutOn})
+		recordAuditEvent(AuditEvent{
+			Action:       "refill.detect",
+			ResourceType: "refill_request",
+			ResourceID:   request.ID.String(),
+			PatientID:    &m.PatientID,
+			Outcome:      auditSuccess,
+			Details:      string(details),
+		})
+	}
+	return nil
+}
+
+func runRefillChecks() {
+	for {
+		if err := detectRunningOut(); err != nil {
+			log.Printf("ERROR: Failed to check prescription supplies: %v", err)
+		}
+		time.Sleep(refillCheckInterval)
+	}
+}
+
+// List the caller's medications whose supply runs out within ?days= (default
+// REFILL_LEAD_DAYS)
+func getRunningOutMedications(c *fiber.Ctx) error {
+	days := c.QueryInt("days", refillLeadDays)
+	if days < 0 || days > maxTimelineDays {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("'days' must be between 0 and %d", maxTimelineDays),
+		})
+	}
+
+	var medications []Medication
+	if err := db.Scopes(scopePatientRecords(c)).
+		Where("quantity > 0 AND schedule IS NOT NULL AND last_filled_at <> ''").
+		Find(&medications).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to fetch medications",
+		})
+	}
+
+	horizon := clinicNow().Truncate(24*time.Hour).AddDate(0, 0, days)
+	data := []fiber.Map{}
+	var patientIDs []uuid.UUID
+	for _, m := range medications {
+		runsOut, ok := supplyRunsOut(m)
+		if !ok || runsOut.After(horizon) {
+			continue
+		}
+		if end, err := parseMedicationDate(m.EndDate); err == nil && end.Before(runsOut) {
+			continue
+		}
+		data = append(data, fiber.Map{
+			"medicationId":     m.ID,
+			"patientId":        m.PatientID,
+			"name":             m.Name,
+			"prescriberId":     m.PrescriberID,
+			"runsOutOn":        runsOut.Format(scheduleDateLayout),
+			"refillsRemaining": m.RefillsRemaining,
+			"needs":            refillKind(m),
+			"pendingRequest":   hasPendingRefill(m.ID),
+		})
+		patientIDs = append(patientIDs, m.PatientID)
+	}
+
+	auditList(c, "medication", patientIDs)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Medications running out retrieved successfully",
+		"data":    data,
+		"meta":    fiber.Map{"days": days},
+	})
+}
+
+// Ask the prescriber for a refill, or a renewal once no refills remain
+func requestRefill(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var medication Medication
+	if err := db.Scopes(scopePatientRecords(c)).First(&medication, "id = ?", id).Error; err != nil {
+		auditAccess(c, "create", "refill_request", "", uuid.Nil, auditNotFound)
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Medication not found",
+		})
+	}
+	req := new(struct {
+		Notes string `json:"notes"`
+	})
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(req); err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"success": false,
+				"message": "Invalid request body",
+			})
+		}
+	}
+	if hasPendingRefill(medication.ID) {
+		return c.Status(409).JSON(fiber.Map{
+			"success": false,
+			"message": "A refill request for this medication is already pending",
+		})
+	}
+
+	requestedBy := currentDoctorID(c)
+	request := RefillRequest{Source: sourceStaff, RequestedBy: &requestedBy, Notes: req.Notes}
+	if err := createRefillRequest(medication, &request); err != nil {
+		auditAccess(c, "create", "refill_request", "", medication.PatientID, auditError)
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to create refill request",
+		})
+	}
+
+	auditAccess(c, "create", "refill_request", request.ID.String(), medication.PatientID, auditSuccess)
+	return c.Status(201).JSON(fiber.Map{
+		"success": true,
+		"message": "Refill request created successfully",
+		"data":    request,
+	})
+}
+
+// Ask for a refill from a patient's device
+func requestDeviceRefill(c *fiber.Ctx) error {
+	device := c.Locals("device").(PatientDevice)
+	req := new(struct {
+		MedicationID uuid.UUID `json:"medicationId"`
+		Notes        string    `json:"notes"`
+	})
+	if err := c.BodyParser(req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "Invalid request body",
+		})
+	}
+
+	var medication Medication
+	if err := db.First(&medication, "id = ? AND patient_id = ?", req.MedicationID, device.PatientID).Error; err != nil {
+		auditDevice(c, "device.refill", "", auditNotFound)
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Medication not found",
+		})
+	}
+	if hasPendingRefill(medication.ID) {
+		return c.Status(409).JSON(fiber.Map{
+			"success": false,
+			"message": "A refill request for this medication is already pending",
+		})
+	}
+
+	request := RefillRequest{Source: sourceDevice, DeviceID: &device.ID, Notes: req.Notes}
+	if err := createRefillRequest(medication, &request); err != nil {
+		auditDevice(c, "device.refill", "", auditError)
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to create refill request",
+		})
+	}
+
+	auditDevice(c, "device.refill", request.ID.String(), auditSuccess)
+	return c.Status(201).JSON(fiber.Map{
+		"success": true,
+		"message": "Refill request created successfully",
+		"data": fiber.Map{
+			"id":           request.ID,
+			"medicationId": request.MedicationID,
+			"kind":         request.Kind,
+			"status":       request.Status,
+		},
+	})
+}
+
+// List refill requests, ?mine=true for those awaiting the caller as prescriber
+func getRefillRequests(c *fiber.Ctx) error {
+	query := db.Model(&RefillRequest{}).Scopes(scopePatientRecords(c))
+	if c.QueryBool("mine") {
+		query = query.Where("prescriber_id = ?", currentDoctorID(c))
+	}
+
+	var requests []RefillRequest
+	meta, err := listPage(c, query, refillListSpec, &requests)
+	if err != nil {
+		return listError(c, err, "Failed to fetch refill requests")
+	}
+
+	patientIDs := make([]uuid.UUID, len(requests))
+	for i, r := range requests {
+		patientIDs[i] = r.PatientID
+	}
+	auditList(c, "refill_request", patientIDs)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Refill requests retrieved successfully",
+		"data":    requests,
+		"meta":    meta,
+	})
+}
+
+// List a medication's refill requests
+func getMedicationRefillRequests(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var medication Medication
+	if err := db.Scopes(scopePatientRecords(c)).First(&medication, "id = ?", id).Error; err != nil {
+		auditAccess(c, "list", "refill_request", "", uuid.Nil, auditNotFound)
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Medication not found",
+		})
+	}
+
+	var requests []RefillRequest
+	meta, err := listPage(c, db.Model(&RefillRequest{}).Where("medication_id = ?", medication.ID), refillListSpec, &requests)
+	if err != nil {
+		auditAccess(c, "list", "refill_request", "", medication.PatientID, auditError)
+		return listError(c, err, "Failed to fetch refill requests")
+	}
+
+	auditAccess(c, "list", "refill_request", "", medication.PatientID, auditSuccess)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Refill requests retrieved successfully",
+		"data":    requests,
+		"meta":    meta,
+	})
+}
+
+// A decision on a refill request. Renewals may set the new prescription's
+// refills, quantity and end date.
+type refillDecision struct {
+	Note     string   `json:"note"`
+	Refills  *int     `json:"refills"`
+	Quantity *float64 `json:"quantity"`
+	EndDate  *string  `json:"endDate"`
+}
+
+// Reasons a decision on a refill request is turned down, as responses
+var (
+	errRefillNotFound = fiber.NewError(fiber.StatusNotFound, "Refill request not found")
+	errNotPrescriber  = fiber.NewError(fiber.StatusForbidden, "Only the prescriber can decide on this request")
+	errRefillDecided  = fiber.NewError(fiber.StatusConflict, "The refill request has just been decided by someone else")
+)
+
+// Load a pending request for a decision by the caller, who must be the
+// prescriber. Requests for medications without a prescriber can be decided by
+// anyone allowed to prescribe, who becomes the prescriber.
+func findPendingRefill(c *fiber.Ctx, tx *gorm.DB) (RefillRequest, Medication, error) {
+	var request RefillRequest
+	var medication Medication
+	if err := tx.Scopes(scopePatientRecords(c)).First(&request, "id = ?", c.Params("id")).Error; err != nil {
+		return request, medication, errRefillNotFound
+	}
+	if request.Status != refillPending {
+		return request, medication, fiber.NewError(fiber.StatusConflict, "The refill request has already been "+request.Status)
+	}
+	if err := tx.First(&medication, "id = ?", request.MedicationID).Error; err != nil {
+		return request, medication, fiber.NewError(fiber.StatusNotFound, "Medication not found")
+	}
+	if medication.PrescriberID != nil && *medication.PrescriberID != currentDoctorID(c) {
+		return request, medication, errNotPrescriber
+	}
+	return request, medication, nil
+}
+
+// Respond to a decision that failed, auditing it as turned down when it was
+func refillDecisionFailed(c *fiber.Ctx, action string, request RefillRequest, err error) error {
+	var decisionErr *fiber.Error
+	if !errors.As(err, &decisionErr) {
+		auditAccess(c, action, "refill_request", c.Params("id"), request.PatientID, auditError)
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to " + action + " refill request",
+		})
+	}
+
+	outcome := auditError
+	switch decisionErr.Code {
+	case fiber.StatusForbidden:
+		outcome = auditDenied
+	case fiber.StatusNotFound:
+		outcome = auditNotFound
+	}
+	auditAccess(c, action, "refill_request", c.Params("id"), request.PatientID, outcome)
+	return c.Status(decisionErr.Code).JSON(fiber.Map{
+		"success": false,
+		"message": decisionErr.Message,
+	})
+}
+
+// Approve a refill request. A refill uses up one of the refills remaining; a
+// renewal starts a new prescription with the caller as prescriber. Either way
+// the supply is counted again from today.
+func approveRefillRequest(c *fiber.Ctx) error {
+	decision := new(refillDecision)
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(decision); err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"success": false,
+				"message": "Invalid request body",
+			})
+		}
+	}
+
+	var request RefillRequest
+	var medication Medication
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if request, medication, err = findPendingRefill(c, tx); err != nil {
+			return err
+		}
+
+		prescriberID := currentDoctorID(c)
+		today := clinicNow().Format(scheduleDateLayout)
+		updates := map[string]interface{}{"last_filled_at": today, "prescriber_id": prescriberID}
+		if request.Kind == refillKindRefill {
+			if medication.RefillsRemaining <= 0 {
+				return fiber.NewError(fiber.StatusConflict, "No refills remain, the prescription needs renewal")
+			}
+			updates["refills_remaining"] = medication.RefillsRemaining - 1
+		} else {
+			refills := medication.RefillsAllowed
+			if decision.Refills != nil {
+				refills = *decision.Refills
+			}
+			if refills < 0 || (decision.Quantity != nil && *decision.Quantity < 0) {
+				return fiber.NewError(fiber.StatusUnprocessableEntity, "The refills and quantity cannot be negative")
+			}
+			updates["refills_allowed"], updates["refills_remaining"] = refills, refills
+			if decision.Quantity != nil {
+				updates["quantity"] = *decision.Quantity
+			}
+			if decision.EndDate != nil {
+				if _, err := parseMedicationDate(*decision.EndDate); *decision.EndDate != "" && err != nil {
+					return fiber.NewError(fiber.StatusUnprocessableEntity, "Invalid endDate, expected YYYY-MM-DD")
+				}
+				updates["end_date"] = *decision.EndDate
+			}
+		}
+		if err := tx.Model(&medication).Updates(updates).Error; err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		request.Status = refillApproved
+		request.DecidedBy = &prescriberID
+		request.DecidedAt = &now
+		request.DecisionNote = decision.Note
+		result := tx.Model(&request).Where("status = ?", refillPending).
+			Select("status", "decided_by", "decided_at", "decision_note").Updates(&request)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errRefillDecided
+		}
+		return nil
+	})
+	if err != nil {
+		return refillDecisionFailed(c, "approve", request, err)
+	}
+
+	auditAccess(c, "approve", "refill_request", request.ID.String(), request.PatientID, auditSuccess)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Refill request approved",
+		"data": fiber.Map{
+			"request":    request,
+			"medication": medication,
+		},
+	})
+}
+
+// Deny a refill request, giving the reason as note
+func denyRefillRequest(c *fiber.Ctx) error {
+	decision := new(refillDecision)
+	if err := c.BodyParser(decision); err != nil || decision.Note == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "A note explaining the denial is required",
+		})
+	}
+
+	request, _, err := findPendingRefill(c, db)
+	if err != nil {
+		return refillDecisionFailed(c, "deny", request, err)
+	}
+
+	prescriberID := currentDoctorID(c)
+	now := time.Now().UTC()
+	request.Status = refillDenied
+	request.DecidedBy = &prescriberID
+	request.DecidedAt = &now
+	request.DecisionNote = decision.Note
+	result := db.Model(&request).Where("status = ?", refillPending).
+		Select("status", "decided_by", "decided_at", "decision_note").Updates(&request)
+	if result.Error == nil && result.RowsAffected == 0 {
+		result.Error = errRefillDecided
+	}
+	if result.Error != nil {
+		return refillDecisionFailed(c, "deny", request, result.Error)
+	}
+
+	auditAccess(c, "deny", "refill_request", request.ID.String(), request.PatientID, auditSuccess)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Refill request denied",
+		"data":    request,
+	})
+}
+
+// Change a medication's prescription: its prescriber, the quantity per fill,
+// the refills allowed and remaining, and the last fill. Only the prescriber
+// can, or anyone allowed to prescribe when it has none, who becomes the
+// prescriber. Other edits of a medication leave the prescription as it is.
+func updatePrescription(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var medication Medication
+	if err := db.Scopes(scopePatientRecords(c)).First(&medication, "id = ?", id).Error; err != nil {
+		auditAccess(c, "update", "prescription", id, uuid.Nil, auditNotFound)
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Medication not found",
+		})
+	}
+	if medication.PrescriberID != nil && *medication.PrescriberID != currentDoctorID(c) {
+		auditAccess(c, "update", "prescription", id, medication.PatientID, auditDenied)
+		return c.Status(403).JSON(fiber.Map{
+			"success": false,
+			"message": "Only the prescriber can change the prescription",
+		})
+	}
+
+	updated := medication
+	if err := c.BodyParser(&updated); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "Invalid request body",
+		})
+	}
+	if updated.PrescriberID == nil || *updated.PrescriberID == uuid.Nil {
+		prescriberID := currentDoctorID(c)
+		updated.PrescriberID = &prescriberID
+	}
+	if err := preparePrescription(c, &updated, false); err != nil {
+		return c.Status(422).JSON(fiber.Map{
+			"success": false,
+			"message": "Invalid prescription: " + err.Error(),
+		})
+	}
+
+	result := db.Model(&medication).
+		Select("prescriber_id", "quantity", "refills_allowed", "refills_remaining", "last_filled_at").
+		Updates(&updated)
+	if result.Error != nil {
+		auditAccess(c, "update", "prescription", id, medication.PatientID, auditError)
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to update prescription",
+		})
+	}
+
+	auditAccess(c, "update", "prescription", id, medication.PatientID, auditSuccess)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Prescription updated",
+		"data":    updated,
+	})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+func TestDecideRefillRequest(t *testing.T) {
+	setupTestDB(t)
+	app := newTestApp()
+	prescriber, prescriberToken := createTestUser(t, RolePhysician, "password123")
+	other, otherToken := createTestUser(t, RolePhysician, "password123")
+	patient := createTestPatient(t, "Maria Lopez", prescriber, other)
+
+	medication := Medication{PatientID: patient.ID, Name: "Metformin", PrescriberID: &prescriber.ID, Quantity: 60, RefillsAllowed: 2, RefillsRemaining: 1}
+	if err := db.Create(&medication).Error; err != nil {
+		t.Fatalf("failed to create the medication: %v", err)
+	}
+	request := RefillRequest{ID: uuid.New(), MedicationID: medication.ID, PatientID: patient.ID, PrescriberID: &prescriber.ID, Kind: refillKindRefill, Status: refillPending}
+	if err := db.Create(&request).Error; err != nil {
+		t.Fatalf("failed to create the refill request: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		token       string
+		action      string
+		want        int
+		wantMessage string
+	}{
+		{"another doctor", otherToken, "approve", http.StatusForbidden, "Only the prescriber can decide on this request"},
+		{"the prescriber", prescriberToken, "approve", http.StatusOK, "Refill request approved"},
+		{"decided already", prescriberToken, "deny", http.StatusConflict, "The refill request has already been approved"},
+	}
+	for _, tt := range tests {
+		resp := doRequest(t, app, http.MethodPost, "/api/refill-requests/"+request.ID.String()+"/"+tt.action, tt.token, map[string]string{"note": "Checked"})
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, resp.StatusCode, tt.want)
+		}
+		var body struct {
+			Message string `json:"message"`
+		}
+		decodeBody(t, resp, &body)
+		if body.Message != tt.wantMessage {
+			t.Errorf("%s: message = %q, want %q", tt.name, body.Message, tt.wantMessage)
+		}
+	}
+
+	db.First(&medication, "id = ?", medication.ID)
+	if medication.RefillsRemaining != 0 {
+		t.Errorf("refillsRemaining = %d, want 0", medication.RefillsRemaining)
+	}
+}
+
+// An approval that finds the request decided meanwhile is rolled back
+func TestApproveRefillRequestDecidedMeanwhile(t *testing.T) {
+	setupTestDB(t)
+	app := newTestApp()
+	prescriber, token := createTestUser(t, RolePhysician, "password123")
+	patient := createTestPatient(t, "Maria Lopez", prescriber)
+
+	medication := Medication{PatientID: patient.ID, Name: "Metformin", PrescriberID: &prescriber.ID, Quantity: 60, RefillsAllowed: 2, RefillsRemaining: 1}
+	db.Create(&medication)
+	request := RefillRequest{ID: uuid.New(), MedicationID: medication.ID, PatientID: patient.ID, PrescriberID: &prescriber.ID, Kind: refillKindRefill, Status: refillPending}
+	db.Create(&request)
+
+	// Deny the request in the approval's transaction, after it was found pending
+	db.Callback().Update().Before("gorm:update").Register("test:deny_meanwhile", func(tx *gorm.DB) {
+		if tx.Statement.Table == "refill_requests" {
+			tx.Session(&gorm.Session{NewDB: true}).Exec("UPDATE refill_requests SET status = ? WHERE id = ?", refillDenied, request.ID)
+		}
+	})
+	defer db.Callback().Update().Remove("test:deny_meanwhile")
+
+	resp := doRequest(t, app, http.MethodPost, "/api/refill-requests/"+request.ID.String()+"/approve", token, nil)
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusConflict)
+	}
+
+	db.First(&medication, "id = ?", medication.ID)
+	if medication.RefillsRemaining != 1 {
+		t.Errorf("refillsRemaining = %d, want 1, the approval should be rolled back", medication.RefillsRemaining)
+	}
+}
+
+// Only the prescriber changes refills and the prescriber, not a plain edit
+func TestUpdatePrescription(t *testing.T) {
+	setupTestDB(t)
+	app := newTestApp()
+	prescriber, prescriberToken := createTestUser(t, RolePhysician, "password123")
+	other, otherToken := createTestUser(t, RolePhysician, "password123")
+	patient := createTestPatient(t, "Maria Lopez", prescriber, other)
+
+	medication := Medication{PatientID: patient.ID, Name: "Metformin", PrescriberID: &prescriber.ID, Quantity: 60, RefillsAllowed: 2, RefillsRemaining: 0}
+	db.Create(&medication)
+	path := "/api/medications/" + medication.ID.String()
+	topUp := map[string]interface{}{"refillsRemaining": 2, "prescriberId": other.ID}
+
+	tests := []struct {
+		name   string
+		token  string
+		method string
+		path   string
+		want   int
+	}{
+		{"edit by another doctor", otherToken, http.MethodPut, path, http.StatusNoContent},
+		{"prescription by another doctor", otherToken, http.MethodPut, path + "/prescription", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		resp := doRequest(t, app, tt.method, tt.path, tt.token, topUp)
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, resp.StatusCode, tt.want)
+		}
+	}
+	db.First(&medication, "id = ?", medication.ID)
+	if medication.RefillsRemaining != 0 || *medication.PrescriberID != prescriber.ID {
+		t.Fatalf("refillsRemaining = %d and prescriber %v, want them unchanged", medication.RefillsRemaining, *medication.PrescriberID)
+	}
+
+	resp := doRequest(t, app, http.MethodPut, path+"/prescription", prescriberToken, topUp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("prescription by the prescriber: status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	db.First(&medication, "id = ?", medication.ID)
+	if medication.RefillsRemaining != 2 || *medication.PrescriberID != other.ID {
+		t.Errorf("refillsRemaining = %d and prescriber %v, want 2 and %v", medication.RefillsRemaining, *medication.PrescriberID, other.ID)
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/mail"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm/clause"
+)
+
+// Reminders are planned as rows in appointment_reminders well before they are
+// due and sent by a polling loop, so reminders survive a restart.
+// Whether the appointment still stands is checked again just before sending.
+
+// Reminder statuses
+const (
+	reminderPending    = "pending"
+	reminderSending    = "sending"
+	reminderSent       = "sent"
+	reminderFailed     = "failed"
+	reminderSuppressed = "suppressed" // the appointment was cancelled, moved or removed
+	reminderExpired    = "expired"    // the appointment started before the reminder could be sent
+)
+
+// Attempts per reminder, retried after reminderRetryDelay times the attempts so far
+const (
+	maxReminderAttempts = 3
+	reminderRetryDelay  = 5 * time.Minute
+)
+
+// Only upcoming appointments get reminders
+var remindedStatuses = []string{statusRequested, statusScheduled}
+
+// Reminder settings, see loadReminderConfig()
+var (
+	reminderOffsets      = []time.Duration{24 * time.Hour, 2 * time.Hour}
+	reminderChannels     = []string{channelEmail}
+	reminderPollInterval = time.Minute
+)
+
+var phonePattern = regexp.MustCompile(`^\+?[0-9 ()./-]{7,20}$`)
+
+// Apply REMINDER_OFFSETS, REMINDER_CHANNELS and REMINDER_POLL_INTERVAL, called
+// from main before loadNotifierConfig()
+func loadReminderConfig() {
+	if v := os.Getenv("REMINDER_OFFSETS"); v != "" {
+		var offsets []time.Duration
+		for _, s := range strings.Split(v, ",") {
+			d, err := time.ParseDuration(strings.TrimSpace(s))
+			if err != nil || d <= 0 {
+				log.Printf("WARN: Invalid REMINDER_OFFSETS entry %q, expected e.g. 24h or 90m", s)
+				continue
+			}
+			offsets = append(offsets, d)
+		}
+		reminderOffsets = offsets
+	}
+
+	if v := os.Getenv("REMINDER_CHANNELS"); v != "" {
+		reminderChannels = nil
+		for _, s := range strings.Split(v, ",") {
+			switch channel := strings.TrimSpace(s); channel {
+			case channelEmail, channelSMS, channelWebhook:
+				reminderChannels = append(reminderChannels, channel)
+			case "none":
+			default:
+				log.Printf("WARN: Unknown REMINDER_CHANNELS entry %q, expected email, sms or webhook", s)
+			}
+		}
+	}
+
+	if d, err := time.ParseDuration(os.Getenv("REMINDER_POLL_INTERVAL")); err == nil && d > 0 {
+		reminderPollInterval = d
+	}
+}
+
+// Where a channel reaches a patient, empty if it cannot
+func reminderRecipient(channel string, patient Patient) string {
+	contact := strings.TrimSpace(patient.Contact)
+	switch channel {
+	case channelEmail:
+		if addr, err := mail.ParseAddress(contact); err == nil {
+			return addr.Address
+		}
+	case channelSMS:
+		if phonePattern.MatchString(contact) {
+			digits := strings.Map(func(r rune) rune {
+				if r >= '0' && r <= '9' {
+					return r
+				}
+				return -1
+			}, contact)
+			if len(digits) < 7 {
+				return ""
+			}
+			if strings.HasPrefix(contact, "+") {
+				return "+" + digits
+			}
+			return digits
+		}
+	}
+	return ""
+}
+
+// Create the reminders of upcoming appointments, and suppress those of
+// appointments that no longer stand
+func planReminders() error {
+	// Reminders for a time the appointment no longer has
+	if err := db.Model(&AppointmentReminder{}).
+		Where("status = ? AND appointment_id IN (?)", reminderPending,
+			db.Model(&Appointment{}).Select("id").
+				Where("status IN ? AND date_time <> appointment_reminders.appointment_time", remindedStatuses)).
+		Updates(map[string]interface{}{"status": reminderSuppressed, "reason": "Appointment was moved"}).Error; err != nil {
+		return err
+	}
+	// Reminders for appointments that were cancelled, archived or deleted
+	if err := db.Model(&AppointmentReminder{}).
+		Where("status = ? AND appointment_id NOT IN (?)", reminderPending,
+			db.Model(&Appointment{}).Select("id").Where("status IN ?", remindedStatuses)).
+		Updates(map[string]interface{}{"status": reminderSuppressed, "reason": "Appointment is no longer scheduled"}).Error; err != nil {
+		return err
+	}
+
+	if len(reminderOffsets) == 0 || len(notifiers) == 0 {
+		return nil
+	}
+	var horizon time.Duration
+	for _, offset := range reminderOffsets {
+		horizon = max(horizon, offset)
+	}
+
+	// Plan a day ahead of the earliest reminder, so a short outage doesn't miss any
+	now := clinicNow()
+	var appointments []Appointment
+	if err := db.Preload("Patient").
+		Where("status IN ? AND datetime(date_time) > datetime(?) AND datetime(date_time) <= datetime(?)", remindedStatuses,
+			now.Format(sqliteTimeLayout), now.Add(horizon+24*time.Hour).Format(sqliteTimeLayout)).
+		Find(&appointments).Error; err != nil {
+		return err
+	}
+
+	var reminders []AppointmentReminder
+	for _, a := range appointments {
+		start, err := appointmentInstant(a.DateTime)
+		if err != nil {
+			continue
+		}
+		for _, offset := range reminderOffsets {
+			due := start.Add(-offset)
+			// Booked too late for this reminder
+			if due.Before(a.CreatedAt) {
+				continue
+			}
+			for channel := range notifiers {
+				recipient := reminderRecipient(channel, a.Patient)
+				if recipient == "" && channel != channelWebhook {
+					continue
+				}
+				reminders = append(reminders, AppointmentReminder{
+					ID:              uuid.New(),
+					AppointmentID:   a.ID,
+					AppointmentTime: a.DateTime,
+					Channel:         channel,
+					OffsetMinutes:   int(offset / time.Minute),
+					Recipient:       recipient,
+					DueAt:           due.UTC(),
+					Status:          reminderPending,
+					NextAttemptAt:   due.UTC(),
+				})
+			}
+		}
+	}
+	if len(reminders) == 0 {
+		return nil
+	}
+	// Reminders planned on an earlier run are left as they are, except ones
+	// suppressed when the appointment was moved away, which are due again now
+	// that it is back at that time
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "appointment_id"}, {Name: "appointment_time"}, {Name: "channel"}, {Name: "offset_minutes"}},
+		DoUpdates: clause.AssignmentColumns([]string{"recipient", "due_at", "status", "attempts", "next_attempt_at", "reason", "updated_at"}),
+		Where: clause.Where{Exprs: []clause.Expression{
+			clause.Eq{Column: clause.Column{Table: "appointment_reminders", Name: "status"}, Value: reminderSuppressed},
+		}},
+	}).CreateInBatches(&reminders, 100).Error
+}
+
+// Send the reminders that are due
+func sendDueReminders() error {
+	var due []AppointmentReminder
+	if err := db.Where("status = ? AND next_attempt_at <= ?", reminderPending, time.Now().UTC()).
+		Order("due_at").Limit(100).Find(&due).Error; err != nil {
+		return err
+	}
+
+	for _, reminder := range due {
+		// Claim the reminder, so it is never sent twice
+		claim := db.Model(&AppointmentReminder{}).
+			Where("id = ? AND status = ?", reminder.ID, reminderPending).
+			Update("status", reminderSending)
+		if claim.Error != nil {
+			return claim.Error
+		}
+		if claim.RowsAffected == 1 {
+			sendReminder(reminder)
+		}
+	}
+	return nil
+}
+
+// Send one claimed reminder and record the outcome
+func sendReminder(reminder AppointmentReminder) {
+	finish := func(status, reason string) {
+		updates := map[string]interface{}{"status": status, "reason": reason, "attempts": reminder.Attempts}
+		if status == reminderSent {
+			updates["sent_at"] = time.Now().UTC()
+		}
+		if status == reminderPending {
+			updates["next_attempt_at"] = time.Now().UTC().Add(time.Duration(reminder.Attempts) * reminderRetryDelay)
+		}
+		if err := db.Model(&AppointmentReminder{}).Where("id = ?", reminder.ID).Updates(updates).Error; err != nil {
+			log.Printf("ERROR: Failed to update reminder %s: %v", reminder.ID, err)
+		}
+	}
+
+	var appointment Appointment
+	if err := db.Preload("Patient").First(&appointment, "id = ?", reminder.AppointmentID).Error; err != nil {
+		finish(reminderSuppressed, "Appointment is no longer scheduled")
+		return
+	}
+	if appointment.Status != statusRequested && appointment.Status != statusScheduled {
+		finish(reminderSuppressed, "Appointment is no longer scheduled")
+		return
+	}
+	if appointment.DateTime != reminder.AppointmentTime {
+		finish(reminderSuppressed, "Appointment was moved")
+		return
+	}
+	start, err := appointmentInstant(appointment.DateTime)
+	if err != nil || !start.After(time.Now()) {
+		finish(reminderExpired, "Appointment started before the reminder was sent")
+		return
+	}
+	notifier := notifiers[reminder.Channel]
+	if notifier == nil {
+		finish(reminderFailed, "Channel "+reminder.Channel+" is not configured")
+		return
+	}
+
+	var doctor Doctor
+	db.First(&doctor, "id = ?", appointment.DoctorID)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	reminder.Attempts++
+	err = notifier.Notify(ctx, reminderNotification(reminder, appointment, doctor))
+
+	outcome := auditSuccess
+	switch {
+	case err == nil:
+		finish(reminderSent, "")
+	case reminder.Attempts < maxReminderAttempts:
+		outcome = auditError
+		finish(reminderPending, err.Error())
+	default:
+		outcome = auditError
+		finish(reminderFailed, err.Error())
+	}
+	if err != nil {
+		log.Printf("ERROR: Failed to send %s reminder %s (attempt %d): %v", reminder.Channel, reminder.ID, reminder.Attempts, err)
+	}
+
+	// Reminders disclose appointments outside the clinic
+	details, _ := json.Marshal(fiber.Map{
+		"reminderId":    reminder.ID,
+		"channel":       reminder.Channel,
+		"offsetMinutes": reminder.OffsetMinutes,
+		"attempt":       reminder.Attempts,
+	})
+	recordAuditEvent(AuditEvent{
+		Action:       "reminder.send",
+		ResourceType: "appointment",
+		ResourceID:   appointment.ID.String(),
+		PatientID:    &appointment.PatientID,
+		Outcome:      outcome,
+		Details:      string(details),
+	})
+}
+
+// Compose the reminder for its channel
+func reminderNotification(reminder AppointmentReminder, appointment Appointment, doctor Doctor) Notification {
+	n := Notification{
+		Channel:       reminder.Channel,
+		To:            reminder.Recipient,
+		Event:         "appointment.reminder",
+		AppointmentID: appointment.ID,
+		PatientID:     appointment.PatientID,
+		DateTime:      appointment.DateTime,
+	}
+
+	what := "appointment"
+	if appointment.Type != "" {
+		what = strings.ToLower(appointment.Type) + " appointment"
+	}
+	with := ""
+	if doctor.Name != "" {
+		with = " with " + doctor.Name
+	}
+	start, _ := parseAppointmentTime(appointment.DateTime)
+
+	switch reminder.Channel {
+	case channelWebhook:
+		// Webhooks carry IDs and times only
+	case channelSMS:
+		// Text messages stay short and leave out the patient's name
+		n.Body = fmt.Sprintf("Reminder: your %s%s is on %s at %s. Please contact the clinic if you cannot attend.",
+			what, with, start.Format("Mon 2 Jan"), start.Format("15:04"))
+	default:
+		n.Subject = "Reminder of your appointment on " + start.Format("Monday 2 January")
+		n.Body = fmt.Sprintf("Hello %s,\n\nThis is a reminder of your %s%s on %s at %s.\n\nIf you cannot attend, please contact the clinic to cancel or reschedule.\n",
+			appointment.Patient.Name, what, with, start.Format("Monday 2 January 2006"), start.Format("15:04"))
+	}
+	return n
+}
+
+// Plan and send reminders every REMINDER_POLL_INTERVAL
+func runReminderScheduler() {
+	// Reminders claimed when the server stopped were never confirmed sent
+	if err := db.Model(&AppointmentReminder{}).Where("status = ?", reminderSending).
+		Update("status", reminderPending).Error; err != nil {
+		log.Printf("ERROR: Failed to recover interrupted reminders: %v", err)
+	}
+
+	for {
+		if err := planReminders(); err != nil {
+			log.Printf("ERROR: Failed to plan reminders: %v", err)
+		}
+		if err := sendDueReminders(); err != nil {
+			log.Printf("ERROR: Failed to send reminders: %v", err)
+		}
+		time.Sleep(reminderPollInterval)
+	}
+}
+
+// List an appointment's reminders with their delivery status
+func getAppointmentReminders(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var appointment Appointment
+	if err := db.Scopes(scopePatientRecords(c)).First(&appointment, "id = ?", id).Error; err != nil {
+		auditAccess(c, "read", "appointment", id, uuid.Nil, auditNotFound)
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Appointment not found",
+		})
+	}
+
+	var reminders []AppointmentReminder
+	if err := db.Where("appointment_id = ?", appointment.ID).Order("due_at, channel").Find(&reminders).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to fetch reminders",
+		})
+	}
+
+	auditAccess(c, "read", "appointment", id, appointment.PatientID, auditSuccess)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Reminders retrieved successfully",
+		"data":    reminders,
+	})
+}
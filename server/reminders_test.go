@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Reminders follow their appointment as it is moved, moved back and cancelled
+func TestPlanRemindersSuppression(t *testing.T) {
+	setupTestDB(t)
+	defer func(offsets []time.Duration, n map[string]Notifier) { reminderOffsets, notifiers = offsets, n }(reminderOffsets, notifiers)
+	reminderOffsets = []time.Duration{24 * time.Hour, 2 * time.Hour}
+	notifiers = map[string]Notifier{channelWebhook: newFakeNotifier()}
+
+	doctor, _ := createTestUser(t, RolePhysician, "password123")
+	patient := createTestPatient(t, "Ada Lovelace", doctor)
+	at := func(d time.Duration) string {
+		return clinicNow().Add(d).Truncate(time.Minute).Format(appointmentTimeLayout)
+	}
+	original, moved := at(30*time.Hour), at(32*time.Hour)
+	appointment := Appointment{ID: uuid.New(), PatientID: patient.ID, DoctorID: doctor.ID, DateTime: original, Type: "Consultation", Status: statusScheduled}
+	if err := db.Create(&appointment).Error; err != nil {
+		t.Fatalf("failed to create the appointment: %v", err)
+	}
+	// Booked just now, too late for a reminder a day and a half before
+	late := Appointment{ID: uuid.New(), PatientID: patient.ID, DoctorID: doctor.ID, DateTime: at(3 * time.Hour), Type: "Consultation", Status: statusScheduled}
+	db.Create(&late)
+
+	// Reminder statuses by the appointment time they were planned for
+	statuses := func(a Appointment) map[string]map[string]int {
+		var reminders []AppointmentReminder
+		db.Where("appointment_id = ?", a.ID).Find(&reminders)
+		byTime := map[string]map[string]int{}
+		for _, r := range reminders {
+			if byTime[r.AppointmentTime] == nil {
+				byTime[r.AppointmentTime] = map[string]int{}
+			}
+			byTime[r.AppointmentTime][r.Status]++
+		}
+		return byTime
+	}
+	plan := func(step string) {
+		if err := planReminders(); err != nil {
+			t.Fatalf("%s: planReminders failed: %v", step, err)
+		}
+	}
+	check := func(step, dateTime, status string, want int) {
+		t.Helper()
+		if got := statuses(appointment)[dateTime][status]; got != want {
+			t.Errorf("%s: %d %s reminders for %s, want %d", step, got, status, dateTime, want)
+		}
+	}
+
+	plan("planned")
+	check("planned", original, reminderPending, 2)
+	if got := statuses(late)[late.DateTime]; got[reminderPending] != 1 || len(got) != 1 {
+		t.Errorf("late booking: reminders %v, want the 2 hour one alone", got)
+	}
+	plan("planned again")
+	check("planned again", original, reminderPending, 2)
+
+	// The day-before reminder went out before the appointment was moved
+	db.Model(&AppointmentReminder{}).Where("appointment_id = ? AND offset_minutes = ?", appointment.ID, 24*60).Update("status", reminderSent)
+
+	db.Model(&appointment).Update("date_time", moved)
+	plan("moved")
+	check("moved", original, reminderSuppressed, 1)
+	check("moved", original, reminderSent, 1)
+	check("moved", moved, reminderPending, 2)
+
+	db.Model(&appointment).Update("date_time", original)
+	plan("moved back")
+	check("moved back", original, reminderPending, 1)
+	check("moved back", original, reminderSent, 1)
+	check("moved back", moved, reminderSuppressed, 2)
+	var restored AppointmentReminder
+	db.Where("appointment_id = ? AND appointment_time = ? AND status = ?", appointment.ID, original, reminderPending).First(&restored)
+	if restored.Reason != "" || restored.Attempts != 0 {
+		t.Errorf("moved back: reminder kept reason %q and %d attempts", restored.Reason, restored.Attempts)
+	}
+
+	db.Model(&appointment).Update("status", statusCancelled)
+	plan("cancelled")
+	check("cancelled", original, reminderPending, 0)
+	check("cancelled", original, reminderSuppressed, 1)
+	check("cancelled", original, reminderSent, 1)
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Recurrence rules are the RRULE property of iCalendar (RFC 5545), limited to
+// the parts needed for regular follow-up care: FREQ, INTERVAL, COUNT, UNTIL,
+// BYDAY, BYMONTHDAY, BYMONTH and WKST=MO. Times are clinic local times like
+// appointment times.
+
+// Longest run of periods searched for occurrences, so rules that rarely or
+// never match (e.g. the 31st of February) cannot loop forever
+const maxRulePeriods = 5000
+
+var ruleWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+// A BYDAY entry, e.g. "TU", "1MO" (first Monday) or "-1FR" (last Friday)
+type ruleWeekday struct {
+	n   int // 0 for every such weekday in the period
+	day time.Weekday
+}
+
+func (w ruleWeekday) String() string {
+	for name, day := range ruleWeekdays {
+		if day == w.day {
+			if w.n == 0 {
+				return name
+			}
+			return strconv.Itoa(w.n) + name
+		}
+	}
+	return ""
+}
+
+// A parsed RRULE
+type recurrenceRule struct {
+	freq       string // DAILY, WEEKLY, MONTHLY or YEARLY
+	interval   int
+	count      int
+	until      time.Time // inclusive, zero if the rule ends by count
+	byDay      []ruleWeekday
+	byMonthDay []int
+	byMonth    []int
+}
+
+// Parse an RRULE value, with or without the "RRULE:" prefix. Rules must end,
+// by COUNT or UNTIL.
+func parseRRule(s string) (recurrenceRule, error) {
+	r := recurrenceRule{interval: 1}
+	s = strings.TrimPrefix(strings.TrimSpace(s), "RRULE:")
+	if s == "" {
+		return r, fmt.Errorf("rrule is required")
+	}
+
+	for _, part := range strings.Split(s, ";") {
+		name, value, ok := strings.Cut(part, "=")
+		if !ok || value == "" {
+			return r, fmt.Errorf("invalid rule part %q", part)
+		}
+		value = strings.ToUpper(value)
+
+		var err error
+		switch strings.ToUpper(name) {
+		case "FREQ":
+			switch value {
+			case "DAILY", "WEEKLY", "MONTHLY", "YEARLY":
+				r.freq = value
+			default:
+				err = fmt.Errorf("unsupported FREQ %q, expected DAILY, WEEKLY, MONTHLY or YEARLY", value)
+			}
+		case "INTERVAL":
+			r.interval, err = strconv.Atoi(value)
+			if err != nil || r.interval < 1 {
+				err = fmt.Errorf("INTERVAL must be a positive number")
+			}
+		case "COUNT":
+			r.count, err = strconv.Atoi(value)
+			if err != nil || r.count < 1 {
+				err = fmt.Errorf("COUNT must be a positive number")
+			}
+		case "UNTIL":
+			r.until, err = parseRuleUntil(value)
+		case "BYDAY":
+			for _, v := range strings.Split(value, ",") {
+				day, ok := ruleWeekdays[v[max(len(v)-2, 0):]]
+				if !ok {
+					return r, fmt.Errorf("invalid BYDAY %q", v)
+				}
+				n := 0
+				if prefix := v[:len(v)-2]; prefix != "" {
+					n, err = strconv.Atoi(prefix)
+					if err != nil || n == 0 || n < -5 || n > 5 {
+						return r, fmt.Errorf("invalid BYDAY %q", v)
+					}
+				}
+				r.byDay = append(r.byDay, ruleWeekday{n, day})
+			}
+		case "BYMONTHDAY":
+			r.byMonthDay, err = parseRuleInts(value, -31, 31)
+		case "BYMONTH":
+			r.byMonth, err = parseRuleInts(value, 1, 12)
+		case "WKST":
+			if value != "MO" {
+				err = fmt.Errorf("only WKST=MO is supported")
+			}
+		default:
+			err = fmt.Errorf("unsupported rule part %s", name)
+		}
+		if err != nil {
+			return r, err
+		}
+	}
+
+	switch {
+	case r.freq == "":
+		return r, fmt.Errorf("FREQ is required")
+	case r.count == 0 && r.until.IsZero():
+		return r, fmt.Errorf("the rule must end, add COUNT or UNTIL")
+	case r.count > 0 && !r.until.IsZero():
+		return r, fmt.Errorf("COUNT and UNTIL cannot both be given")
+	case r.freq == "WEEKLY" && len(r.byMonthDay) > 0:
+		return r, fmt.Errorf("BYMONTHDAY cannot be used with FREQ=WEEKLY")
+	case r.freq == "YEARLY" && len(r.byDay) > 0 && len(r.byMonth) == 0:
+		return r, fmt.Errorf("BYDAY with FREQ=YEARLY needs BYMONTH")
+	}
+	if r.freq == "DAILY" || r.freq == "WEEKLY" || len(r.byMonthDay) > 0 {
+		for _, w := range r.byDay {
+			if w.n != 0 {
+				return r, fmt.Errorf("numbered BYDAY values need FREQ=MONTHLY or YEARLY without BYMONTHDAY")
+			}
+		}
+	}
+	return r, nil
+}
+
+// Parse a comma separated list of non-zero numbers within a range
+func parseRuleInts(value string, lo, hi int) ([]int, error) {
+	var values []int
+	for _, v := range strings.Split(value, ",") {
+		n, err := strconv.Atoi(v)
+		if err != nil || n == 0 || n < lo || n > hi {
+			return nil, fmt.Errorf("invalid value %q, expected %d to %d", v, lo, hi)
+		}
+		values = append(values, n)
+	}
+	return values, nil
+}
+
+// Parse UNTIL as a date (the whole day), a local time or a UTC time
+func parseRuleUntil(value string) (time.Time, error) {
+	if t, err := time.Parse("20060102", value); err == nil {
+		return t.Add(24*time.Hour - time.Second), nil
+	}
+	if t, err := time.Parse("20060102T150405", value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("20060102T150405Z", value)
+	if err != nil {
+		return t, fmt.Errorf("invalid UNTIL %q, expected e.g. 20250630 or 20250630T170000", value)
+	}
+	local := t.In(time.Local)
+	return time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), local.Minute(), local.Second(), 0, time.UTC), nil
+}
+
+// Format the rule as an RRULE value
+func (r recurrenceRule) String() string {
+	parts := []string{"FREQ=" + r.freq}
+	if r.interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.interval))
+	}
+	if r.count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(r.count))
+	} else {
+		parts = append(parts, "UNTIL="+r.until.Format("20060102T150405"))
+	}
+	if len(r.byDay) > 0 {
+		days := make([]string, len(r.byDay))
+		for i, w := range r.byDay {
+			days[i] = w.String()
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	join := func(values []int) string {
+		s := make([]string, len(values))
+		for i, v := range values {
+			s[i] = strconv.Itoa(v)
+		}
+		return strings.Join(s, ",")
+	}
+	if len(r.byMonthDay) > 0 {
+		parts = append(parts, "BYMONTHDAY="+join(r.byMonthDay))
+	}
+	if len(r.byMonth) > 0 {
+		parts = append(parts, "BYMONTH="+join(r.byMonth))
+	}
+	return strings.Join(parts, ";")
+}
+
+// Expand the rule into the start times of its occurrences. The first must be
+// start itself. Fails if there would be more than limit occurrences.
+func (r recurrenceRule) expand(start time.Time, limit int) ([]time.Time, error) {
+	var occurrences []time.Time
+periods:
+	for period := 0; period < maxRulePeriods; period++ {
+		for _, t := range r.candidates(start, period) {
+			if t.Before(start) {
+				continue
+			}
+			if !r.until.IsZero() && t.After(r.until) {
+				break periods
+			}
+			if len(occurrences) == 0 && !t.Equal(start) {
+				return nil, fmt.Errorf("dateTime must be the first occurrence of the rule")
+			}
+			occurrences = append(occurrences, t)
+			if len(occurrences) > limit {
+				return nil, fmt.Errorf("the rule has more than %d occurrences", limit)
+			}
+			if r.count > 0 && len(occurrences) == r.count {
+				return occurrences, nil
+			}
+		}
+	}
+	if len(occurrences) == 0 {
+		return nil, fmt.Errorf("dateTime must be the first occurrence of the rule")
+	}
+	return occurrences, nil
+}
+
+// Occurrences in the nth period after the one containing start, in order
+func (r recurrenceRule) candidates(start time.Time, period int) []time.Time {
+	at := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, start.Hour(), start.Minute(), 0, 0, time.UTC)
+	}
+	step := period * r.interval
+
+	var days []time.Time
+	switch r.freq {
+	case "DAILY":
+		day := start.AddDate(0, 0, step)
+		if r.matchesWeekday(day) && r.matchesMonthDay(day) {
+			days = append(days, day)
+		}
+	case "WEEKLY":
+		// Weeks start on Monday
+		monday := start.AddDate(0, 0, -((int(start.Weekday())+6)%7)+7*step)
+		weekdays := r.byDay
+		if len(weekdays) == 0 {
+			weekdays = []ruleWeekday{{0, start.Weekday()}}
+		}
+		for _, w := range weekdays {
+			days = append(days, monday.AddDate(0, 0, (int(w.day)+6)%7))
+		}
+	case "MONTHLY":
+		first := at(start.Year(), start.Month(), 1).AddDate(0, step, 0)
+		days = r.monthDays(first, start.Day())
+	case "YEARLY":
+		months := r.byMonth
+		if len(months) == 0 {
+			months = []int{int(start.Month())}
+		}
+		for _, m := range months {
+			days = append(days, r.monthDays(at(start.Year()+step, time.Month(m), 1), start.Day())...)
+		}
+	}
+
+	var matched []time.Time
+	for _, day := range days {
+		if len(r.byMonth) == 0 || containsInt(r.byMonth, int(day.Month())) {
+			matched = append(matched, day)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].Before(matched[j]) })
+
+	// A day selected twice, as by BYMONTHDAY=31,-1, is one occurrence
+	var unique []time.Time
+	for _, day := range matched {
+		if len(unique) == 0 || !day.Equal(unique[len(unique)-1]) {
+			unique = append(unique, day)
+		}
+	}
+	return unique
+}
+
+// Days of the month starting at first selected by BYMONTHDAY or BYDAY, or
+// the given day of the month when neither is set
+func (r recurrenceRule) monthDays(first time.Time, defaultDay int) []time.Time {
+	daysInMonth := first.AddDate(0, 1, -1).Day()
+	var days []time.Time
+
+	switch {
+	case len(r.byMonthDay) > 0:
+		for _, d := range r.byMonthDay {
+			if d < 0 {
+				d += daysInMonth + 1
+			}
+			if d >= 1 && d <= daysInMonth {
+				day := first.AddDate(0, 0, d-1)
+				if r.matchesWeekday(day) {
+					days = append(days, day)
+				}
+			}
+		}
+	case len(r.byDay) > 0:
+		for _, w := range r.byDay {
+			var matching []time.Time
+			for d := first; d.Month() == first.Month(); d = d.AddDate(0, 0, 1) {
+				if d.Weekday() == w.day {
+					matching = append(matching, d)
+				}
+			}
+			switch {
+			case w.n == 0:
+				days = append(days, matching...)
+			case w.n > 0 && w.n <= len(matching):
+				days = append(days, matching[w.n-1])
+			case w.n < 0 && -w.n <= len(matching):
+				days = append(days, matching[len(matching)+w.n])
+			}
+		}
+	case defaultDay <= daysInMonth:
+		// Months without the day are skipped, as RFC 5545 requires
+		days = append(days, first.AddDate(0, 0, defaultDay-1))
+	}
+	return days
+}
+
+func (r recurrenceRule) matchesWeekday(day time.Time) bool {
+	if len(r.byDay) == 0 {
+		return true
+	}
+	for _, w := range r.byDay {
+		if w.day == day.Weekday() {
+			return true
+		}
+	}
+	return false
+}
+
+func (r recurrenceRule) matchesMonthDay(day time.Time) bool {
+	if len(r.byMonthDay) == 0 {
+		return true
+	}
+	daysInMonth := time.Date(day.Year(), day.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	for _, d := range r.byMonthDay {
+		if d == day.Day() || d+daysInMonth+1 == day.Day() {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(values []int, v int) bool {
+	for _, x := range values {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
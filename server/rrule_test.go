@@ -0,0 +1,146 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRuleExpand(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    string
+		start   string
+		limit   int
+		want    []string
+		wantErr string
+	}{
+		{
+			name:  "BYMONTHDAY=31 skips shorter months",
+			rule:  "FREQ=MONTHLY;BYMONTHDAY=31;COUNT=4",
+			start: "2025-01-31T09:00",
+			want:  []string{"2025-01-31T09:00", "2025-03-31T09:00", "2025-05-31T09:00", "2025-07-31T09:00"},
+		},
+		{
+			name:  "BYMONTHDAY=-1 is the last day of every month",
+			rule:  "FREQ=MONTHLY;BYMONTHDAY=-1;COUNT=3",
+			start: "2024-01-31T09:00",
+			want:  []string{"2024-01-31T09:00", "2024-02-29T09:00", "2024-03-31T09:00"},
+		},
+		{
+			name:  "BYMONTHDAY=31,-1 selects a long month's last day once",
+			rule:  "FREQ=MONTHLY;BYMONTHDAY=31,-1;COUNT=4",
+			start: "2025-01-31T09:00",
+			want:  []string{"2025-01-31T09:00", "2025-02-28T09:00", "2025-03-31T09:00", "2025-04-30T09:00"},
+		},
+		{
+			name:  "day of the month missing from some months",
+			rule:  "FREQ=MONTHLY;COUNT=3",
+			start: "2025-01-30T09:00",
+			want:  []string{"2025-01-30T09:00", "2025-03-30T09:00", "2025-04-30T09:00"},
+		},
+		{
+			name:  "UNTIL is inclusive",
+			rule:  "FREQ=WEEKLY;UNTIL=20250120T090000",
+			start: "2025-01-06T09:00",
+			want:  []string{"2025-01-06T09:00", "2025-01-13T09:00", "2025-01-20T09:00"},
+		},
+		{
+			name:  "UNTIL as a date covers the whole day",
+			rule:  "FREQ=DAILY;INTERVAL=2;UNTIL=20250110",
+			start: "2025-01-06T17:00",
+			want:  []string{"2025-01-06T17:00", "2025-01-08T17:00", "2025-01-10T17:00"},
+		},
+		{
+			name:  "BYDAY counts every weekday toward COUNT",
+			rule:  "FREQ=WEEKLY;BYDAY=MO,TH;COUNT=3",
+			start: "2025-01-06T09:00",
+			want:  []string{"2025-01-06T09:00", "2025-01-09T09:00", "2025-01-13T09:00"},
+		},
+		{
+			name:    "start not an occurrence",
+			rule:    "FREQ=MONTHLY;BYMONTHDAY=-1;COUNT=3",
+			start:   "2025-01-30T09:00",
+			wantErr: "dateTime must be the first occurrence of the rule",
+		},
+		{
+			name:    "more occurrences than the limit",
+			rule:    "FREQ=DAILY;COUNT=11",
+			start:   "2025-01-06T09:00",
+			limit:   10,
+			wantErr: "the rule has more than 10 occurrences",
+		},
+	}
+	for _, tt := range tests {
+		rule, err := parseRRule(tt.rule)
+		if err != nil {
+			t.Fatalf("%s: parseRRule(%q) failed: %v", tt.name, tt.rule, err)
+		}
+		start, _ := parseAppointmentTime(tt.start)
+		limit := tt.limit
+		if limit == 0 {
+			limit = maxSeriesOccurrences
+		}
+
+		starts, err := rule.expand(start, limit)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("%s: error = %v, want %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expand failed: %v", tt.name, err)
+			continue
+		}
+		got := make([]string, len(starts))
+		for i, s := range starts {
+			got[i] = s.Format(appointmentTimeLayout)
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("%s: occurrences = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestExpandSeriesExDates(t *testing.T) {
+	series := AppointmentSeries{
+		DateTime: "2025-01-06T09:00",
+		RRule:    "FREQ=WEEKLY;COUNT=4",
+		Type:     "Consultation",
+	}
+
+	tests := []struct {
+		exDates string
+		want    []string
+		wantErr string
+	}{
+		{"", []string{"2025-01-06T09:00", "2025-01-13T09:00", "2025-01-20T09:00", "2025-01-27T09:00"}, ""},
+		{"2025-01-13,2025-01-27", []string{"2025-01-06T09:00", "2025-01-20T09:00"}, ""},
+		{"2025-01-14", []string{"2025-01-06T09:00", "2025-01-13T09:00", "2025-01-20T09:00", "2025-01-27T09:00"}, ""},
+		{"2025-01-06,2025-01-13,2025-01-20,2025-01-27", nil, "every occurrence of the rule is an exception date"},
+	}
+	for _, tt := range tests {
+		series.ExDates = tt.exDates
+		occurrences, err := expandSeries(series, statusScheduled)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("exDates %q: error = %v, want %q", tt.exDates, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("exDates %q: expandSeries failed: %v", tt.exDates, err)
+			continue
+		}
+		var got []string
+		for _, o := range occurrences {
+			if o.RecurrenceID != o.DateTime {
+				t.Errorf("exDates %q: recurrenceId %s, want %s", tt.exDates, o.RecurrenceID, o.DateTime)
+			}
+			got = append(got, o.DateTime)
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("exDates %q: occurrences = %v, want %v", tt.exDates, got, tt.want)
+		}
+	}
+}
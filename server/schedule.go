@@ -0,0 +1,884 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Appointment times are clinic local wall-clock times without a zone, as sent
+// by datetime-local inputs. They are handled as time.Time values in UTC so
+// that no zone conversion ever shifts them.
+const (
+	appointmentTimeLayout = "2006-01-02T15:04"
+	scheduleDateLayout    = "2006-01-02"
+	clockLayout           = "15:04"
+	sqliteTimeLayout      = "2006-01-02 15:04:05"
+)
+
+// Limits for the free slots search
+const (
+	defaultSlotStep  = 15 // minutes
+	maxSlotRangeDays = 31
+)
+
+// Weekly hours used for doctors who have not configured any: Monday to
+// Friday, 9 to 5
+var defaultWorkingHours = func() []WorkingHours {
+	var hours []WorkingHours
+	for day := time.Monday; day <= time.Friday; day++ {
+		hours = append(hours, WorkingHours{Weekday: int(day), Start: "09:00", End: "17:00"})
+	}
+	return hours
+}()
+
+// Appointment types created on first start, matching the frontend's choices
+var defaultAppointmentTypes = []AppointmentType{
+	{Name: "Consultation", Duration: 30},
+	{Name: "Follow-up", Duration: 15},
+	{Name: "Check-up", Duration: 30},
+	{Name: "Emergency", Duration: 30},
+	{Name: "Procedure", Duration: 60},
+	{Name: "Surgery", Duration: 120},
+	{Name: "Other", Duration: 30},
+}
+
+// Statuses of appointments that no longer occupy their slot
+var nonBlockingStatuses = []string{statusCancelled, statusNoShow, statusRescheduled}
+
+// Serializes the conflict check and the write of a booking, so two requests
+// cannot both take the last free slot
+var bookingMu sync.Mutex
+
+// Create the default appointment types if there are none, and give existing
+// appointments an end time. Called from initDB.
+func initScheduling() {
+	var count int64
+	db.Model(&AppointmentType{}).Where("doctor_id IS NULL").Count(&count)
+	if count == 0 {
+		types := make([]AppointmentType, len(defaultAppointmentTypes))
+		copy(types, defaultAppointmentTypes)
+		db.Create(&types)
+	}
+
+	// Appointments booked before durations existed are assumed to take 30 minutes
+	result := db.Exec(`UPDATE appointments SET duration = 30,
+		end_time = strftime('%Y-%m-%dT%H:%M', datetime(date_time, '+30 minutes'))
+		WHERE (end_time IS NULL OR end_time = '') AND datetime(date_time) IS NOT NULL`)
+	if result.Error != nil {
+		log.Printf("Failed to set end times of existing appointments: %v", result.Error)
+	} else if result.RowsAffected > 0 {
+		log.Printf("Set end times of %d existing appointments", result.RowsAffected)
+	}
+}
+
+// Parse an appointment time. RFC 3339 timestamps are converted to the
+// server's local time first.
+func parseAppointmentTime(s string) (time.Time, error) {
+	for _, layout := range []string{appointmentTimeLayout, "2006-01-02T15:04:05", "2006-01-02 15:04"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, err
+	}
+	local := t.In(time.Local)
+	return time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), local.Minute(), 0, 0, time.UTC), nil
+}
+
+// Current clinic wall-clock time, in the same form as parsed appointment times
+func clinicNow() time.Time {
+	now := time.Now()
+	return time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), now.Second(), 0, time.UTC)
+}
+
+// Parse a "15:04" time of day into minutes since midnight. "24:00" is allowed
+// as the end of the day.
+func parseClock(s string) (int, error) {
+	if s == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse(clockLayout, s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// A span of time, start inclusive and end exclusive
+type interval struct {
+	start, end time.Time
+}
+
+func (i interval) overlaps(o interval) bool {
+	return i.start.Before(o.end) && o.start.Before(i.end)
+}
+
+func (i interval) contains(o interval) bool {
+	return !o.start.Before(i.start) && !o.end.After(i.end)
+}
+
+// A doctor's weekly schedule and time off
+type doctorSchedule struct {
+	hours    []WorkingHours
+	breaks   []ScheduleBreak
+	holidays []Holiday
+}
+
+// Load a doctor's schedule, with the default working hours if they have none
+func loadSchedule(doctorID uuid.UUID) (doctorSchedule, error) {
+	var s doctorSchedule
+	if err := db.Where("doctor_id = ?", doctorID).Find(&s.hours).Error; err != nil {
+		return s, err
+	}
+	if len(s.hours) == 0 {
+		s.hours = defaultWorkingHours
+	}
+	if err := db.Where("doctor_id = ?", doctorID).Find(&s.breaks).Error; err != nil {
+		return s, err
+	}
+	err := db.Where("doctor_id = ?", doctorID).Find(&s.holidays).Error
+	return s, err
+}
+
+// Whether a day falls within one of the doctor's holidays
+func (s doctorSchedule) onHoliday(day time.Time) *Holiday {
+	date := day.Format(scheduleDateLayout)
+	for i, h := range s.holidays {
+		if date >= h.StartDate && date <= h.EndDate {
+			return &s.holidays[i]
+		}
+	}
+	return nil
+}
+
+// Bookable windows on a day: working hours with breaks cut out, nothing on holidays
+func (s doctorSchedule) windows(day time.Time) []interval {
+	if s.onHoliday(day) != nil {
+		return nil
+	}
+	midnight := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, time.UTC)
+	at := func(clock string) time.Time {
+		minutes, _ := parseClock(clock)
+		return midnight.Add(time.Duration(minutes) * time.Minute)
+	}
+
+	var windows []interval
+	for _, h := range s.hours {
+		if h.Weekday == int(day.Weekday()) {
+			windows = append(windows, interval{at(h.Start), at(h.End)})
+		}
+	}
+
+	for _, b := range s.breaks {
+		if b.Weekday != int(day.Weekday()) {
+			continue
+		}
+		cut := interval{at(b.Start), at(b.End)}
+		var remaining []interval
+		for _, w := range windows {
+			if !w.overlaps(cut) {
+				remaining = append(remaining, w)
+				continue
+			}
+			if w.start.Before(cut.start) {
+				remaining = append(remaining, interval{w.start, cut.start})
+			}
+			if cut.end.Before(w.end) {
+				remaining = append(remaining, interval{cut.end, w.end})
+			}
+		}
+		windows = remaining
+	}
+
+	sort.Slice(windows, func(i, j int) bool { return windows[i].start.Before(windows[j].start) })
+	return windows
+}
+
+// Appointment types available for a doctor: the clinic defaults, overridden
+// by name with the doctor's own
+func appointmentTypesFor(doctorID uuid.UUID) ([]AppointmentType, error) {
+	var types []AppointmentType
+	if err := db.Where("doctor_id IS NULL OR doctor_id = ?", doctorID).Order("name").Find(&types).Error; err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]AppointmentType)
+	for _, t := range types {
+		if existing, ok := byName[strings.ToLower(t.Name)]; ok && existing.DoctorID != nil {
+			continue
+		}
+		byName[strings.ToLower(t.Name)] = t
+	}
+
+	effective := make([]AppointmentType, 0, len(byName))
+	for _, t := range types {
+		if byName[strings.ToLower(t.Name)].ID == t.ID {
+			effective = append(effective, t)
+		}
+	}
+	return effective, nil
+}
+
+// Appointments of a doctor that occupy time overlapping the span, other than
+// the excluded ones
+func busyAppointments(tx *gorm.DB, doctorID uuid.UUID, span interval, exclude []uuid.UUID) ([]Appointment, error) {
+	var appointments []Appointment
+	exclude = append([]uuid.UUID{uuid.Nil}, exclude...) // never an empty IN list
+	err := tx.Where("doctor_id = ? AND id NOT IN ? AND status NOT IN ?", doctorID, exclude, nonBlockingStatuses).
+		Where("datetime(date_time) < datetime(?) AND datetime(end_time) > datetime(?)",
+			span.end.Format(sqliteTimeLayout), span.start.Format(sqliteTimeLayout)).
+		Order("date_time").
+		Find(&appointments).Error
+	return appointments, err
+}
+
+// A booking that cannot be made, with the status to respond with
+type bookingError struct {
+	status   int
+	message  string
+	conflict *Appointment
+}
+
+func (e *bookingError) Error() string { return e.message }
+
+// Respond to a rejected booking in the appointment handlers' format
+func bookingErrorResponse(c *fiber.Ctx, err error) error {
+	be, ok := err.(*bookingError)
+	if !ok {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to check availability"})
+	}
+	response := fiber.Map{"error": be.message}
+	if be.conflict != nil {
+		response["conflict"] = conflictDetails(c, be.conflict)
+	}
+	return c.Status(be.status).JSON(response)
+}
+
+// The parts of a conflicting appointment shown to the caller. Which patient
+// it is for is only shown to callers who may see that patient.
+func conflictDetails(c *fiber.Ctx, a *Appointment) fiber.Map {
+	details := fiber.Map{
+		"doctorId": a.DoctorID,
+		"dateTime": a.DateTime,
+		"endTime":  a.EndTime,
+	}
+	if canAccessPatient(c, a.PatientID) {
+		details["id"] = a.ID
+		details["patientId"] = a.PatientID
+	}
+	return details
+}
+
+// Validate an appointment's time, type and doctor and check it against the
+// doctor's schedule and existing bookings. Appointments being moved at the
+// same time are not treated as conflicts. Normalizes DateTime and fills in
+// Duration and EndTime. Callers must hold bookingMu until the appointment is
+// saved.
+func checkBooking(a *Appointment, moving ...uuid.UUID) error {
+	start, err := parseAppointmentTime(a.DateTime)
+	if err != nil {
+		return &bookingError{status: 422, message: "Invalid dateTime, expected YYYY-MM-DDTHH:MM"}
+	}
+
+	if a.DoctorID == uuid.Nil {
+		return &bookingError{status: 422, message: "doctorId is required"}
+	}
+	var doctor Doctor
+	if err := db.First(&doctor, "id = ?", a.DoctorID).Error; err != nil {
+		return &bookingError{status: 422, message: "Doctor not found"}
+	}
+	if !seesPatients(doctor.Role) {
+		return &bookingError{status: 422, message: "Appointments can only be booked with a physician"}
+	}
+
+	types, err := appointmentTypesFor(a.DoctorID)
+	if err != nil {
+		return err
+	}
+	a.Duration = 0
+	names := make([]string, len(types))
+	for i, t := range types {
+		names[i] = t.Name
+		if strings.EqualFold(t.Name, a.Type) {
+			a.Type, a.Duration = t.Name, t.Duration
+		}
+	}
+	if a.Duration == 0 {
+		return &bookingError{status: 422, message: "Unknown appointment type, expected one of: " + strings.Join(names, ", ")}
+	}
+
+	span := interval{start, start.Add(time.Duration(a.Duration) * time.Minute)}
+	a.DateTime = span.start.Format(appointmentTimeLayout)
+	a.EndTime = span.end.Format(appointmentTimeLayout)
+
+	// Cancelled and similar appointments do not need a free slot
+	for _, status := range nonBlockingStatuses {
+		if a.Status == status {
+			return nil
+		}
+	}
+
+	schedule, err := loadSchedule(a.DoctorID)
+	if err != nil {
+		return err
+	}
+	if h := schedule.onHoliday(start); h != nil {
+		return &bookingError{status: 422, message: "The doctor is away on " + start.Format(scheduleDateLayout)}
+	}
+	inHours := false
+	for _, w := range schedule.windows(start) {
+		if w.contains(span) {
+			inHours = true
+			break
+		}
+	}
+	if !inHours {
+		return &bookingError{status: 422, message: "The appointment is outside the doctor's working hours"}
+	}
+
+	exclude := append([]uuid.UUID{a.ID}, moving...)
+	busy, err := busyAppointments(db, a.DoctorID, span, exclude)
+	if err != nil {
+		return err
+	}
+	if len(busy) > 0 {
+		return &bookingError{status: 409, message: "The doctor already has an appointment at this time", conflict: &busy[0]}
+	}
+	// Slots offered to a waitlisted patient are held for them alone
+	held, err := heldOffers(a.DoctorID, span, a.PatientID)
+	if err != nil {
+		return err
+	}
+	if len(held) > 0 {
+		return &bookingError{status: 409, message: "The slot is held for a waitlisted patient until " +
+			held[0].ExpiresAt.In(time.Local).Format("15:04")}
+	}
+
+	// Nor can a patient be in two appointments at once
+	var clash Appointment
+	err = db.Where("patient_id = ? AND id NOT IN ? AND status NOT IN ?", a.PatientID, exclude, nonBlockingStatuses).
+		Where("datetime(date_time) < datetime(?) AND datetime(end_time) > datetime(?)",
+			span.end.Format(sqliteTimeLayout), span.start.Format(sqliteTimeLayout)).
+		Take(&clash).Error
+	if err == nil {
+		return &bookingError{status: 409, message: "The patient already has an appointment at this time", conflict: &clash}
+	}
+	return nil
+}
+
+// Find the free slots of a doctor over a range of days
+func getFreeSlots(c *fiber.Ctx) error {
+	doctorID := currentDoctorID(c)
+	if id := c.Query("doctorId"); id != "" {
+		parsed, err := uuid.Parse(id)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"success": false,
+				"message": "Invalid doctorId",
+			})
+		}
+		doctorID = parsed
+	}
+
+	today := clinicNow().Truncate(24 * time.Hour)
+	from, to := today, today
+	if v := c.Query("from"); v != "" {
+		t, err := time.Parse(scheduleDateLayout, v)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"success": false,
+				"message": "Invalid 'from' date, expected YYYY-MM-DD",
+			})
+		}
+		from, to = t, t
+	}
+	if v := c.Query("to"); v != "" {
+		t, err := time.Parse(scheduleDateLayout, v)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"success": false,
+				"message": "Invalid 'to' date, expected YYYY-MM-DD",
+			})
+		}
+		to = t
+	}
+	if to.Before(from) || to.Sub(from) > maxSlotRangeDays*24*time.Hour {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("The range must run forwards and span at most %d days", maxSlotRangeDays),
+		})
+	}
+
+	types, err := appointmentTypesFor(doctorID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to load appointment types",
+		})
+	}
+	duration := 0
+	for _, t := range types {
+		if strings.EqualFold(t.Name, c.Query("type")) {
+			duration = t.Duration
+		}
+	}
+	if duration == 0 {
+		duration, _ = strconv.Atoi(c.Query("duration"))
+	}
+	if duration <= 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "A known appointment type or a duration in minutes is required",
+		})
+	}
+
+	step, _ := strconv.Atoi(c.Query("step", strconv.Itoa(defaultSlotStep)))
+	if step < 5 {
+		step = defaultSlotStep
+	}
+
+	schedule, err := loadSchedule(doctorID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to load schedule",
+		})
+	}
+
+	rangeSpan := interval{from, to.AddDate(0, 0, 1)}
+	busy, err := busyAppointments(db, doctorID, rangeSpan, nil)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to load appointments",
+		})
+	}
+	held, err := heldOffers(doctorID, rangeSpan, uuid.Nil)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to load appointments",
+		})
+	}
+	busySpans := make([]interval, 0, len(busy)+len(held))
+	for _, a := range busy {
+		start, err1 := parseAppointmentTime(a.DateTime)
+		end, err2 := parseAppointmentTime(a.EndTime)
+		if err1 == nil && err2 == nil {
+			busySpans = append(busySpans, interval{start, end})
+		}
+	}
+	for _, o := range held {
+		start, err1 := parseAppointmentTime(o.DateTime)
+		end, err2 := parseAppointmentTime(o.EndTime)
+		if err1 == nil && err2 == nil {
+			busySpans = append(busySpans, interval{start, end})
+		}
+	}
+
+	now := clinicNow()
+	length := time.Duration(duration) * time.Minute
+	slots := []fiber.Map{}
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		for _, w := range schedule.windows(day) {
+			for start := w.start; !start.Add(length).After(w.end); start = start.Add(time.Duration(step) * time.Minute) {
+				slot := interval{start, start.Add(length)}
+				if slot.start.Before(now) {
+					continue
+				}
+				free := true
+				for _, b := range busySpans {
+					if slot.overlaps(b) {
+						free = false
+						break
+					}
+				}
+				if free {
+					slots = append(slots, fiber.Map{
+						"start": slot.start.Format(appointmentTimeLayout),
+						"end":   slot.end.Format(appointmentTimeLayout),
+					})
+				}
+			}
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Free slots retrieved successfully",
+		"data":    slots,
+		"meta": fiber.Map{
+			"doctorId": doctorID,
+			"from":     from.Format(scheduleDateLayout),
+			"to":       to.Format(scheduleDateLayout),
+			"duration": duration,
+			"step":     step,
+		},
+	})
+}
+
+// Parse the doctor whose schedule a route manages, enforcing that only the
+// doctor themselves or a schedule manager may change it
+func scheduleDoctor(c *fiber.Ctx, write bool) (uuid.UUID, error) {
+	doctorID := currentDoctorID(c)
+	if id := c.Params("doctorId"); id != "me" {
+		parsed, err := uuid.Parse(id)
+		if err != nil || db.First(&Doctor{}, "id = ?", parsed).Error != nil {
+			return uuid.Nil, fiber.NewError(fiber.StatusNotFound, "Doctor not found")
+		}
+		doctorID = parsed
+	}
+	if write && doctorID != currentDoctorID(c) && !hasPermission(c, PermScheduleManage) {
+		return uuid.Nil, fiber.NewError(fiber.StatusForbidden, "You can only change your own schedule")
+	}
+	return doctorID, nil
+}
+
+// Get a doctor's working hours, breaks, holidays and appointment types
+func getSchedule(c *fiber.Ctx) error {
+	doctorID, err := scheduleDoctor(c, false)
+	if err != nil {
+		return listError(c, err, "Failed to load schedule")
+	}
+
+	var hours []WorkingHours
+	var breaks []ScheduleBreak
+	var holidays []Holiday
+	db.Where("doctor_id = ?", doctorID).Order("weekday, start").Find(&hours)
+	db.Where("doctor_id = ?", doctorID).Order("weekday, start").Find(&breaks)
+	db.Where("doctor_id = ?", doctorID).Order("start_date").Find(&holidays)
+	types, _ := appointmentTypesFor(doctorID)
+
+	defaults := len(hours) == 0
+	if defaults {
+		hours = defaultWorkingHours
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Schedule retrieved successfully",
+		"data": fiber.Map{
+			"doctorId":            doctorID,
+			"workingHours":        hours,
+			"defaultWorkingHours": defaults,
+			"breaks":              breaks,
+			"holidays":            holidays,
+			"appointmentTypes":    types,
+		},
+	})
+}
+
+// Validate a weekly block of time
+func validateWeeklyBlock(weekday int, start, end string) error {
+	if weekday < 0 || weekday > 6 {
+		return fmt.Errorf("weekday must be 0 (Sunday) to 6 (Saturday)")
+	}
+	from, err := parseClock(start)
+	if err != nil {
+		return err
+	}
+	to, err := parseClock(end)
+	if err != nil {
+		return err
+	}
+	if to <= from {
+		return fmt.Errorf("%s-%s ends before it starts", start, end)
+	}
+	return nil
+}
+
+// Replace a doctor's weekly working hours
+func updateWorkingHours(c *fiber.Ctx) error {
+	doctorID, err := scheduleDoctor(c, true)
+	if err != nil {
+		return listError(c, err, "Failed to update working hours")
+	}
+
+	var hours []WorkingHours
+	if err := c.BodyParser(&hours); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "Invalid request body, expected a list of working hours",
+		})
+	}
+	for i := range hours {
+		if err := validateWeeklyBlock(hours[i].Weekday, hours[i].Start, hours[i].End); err != nil {
+			return c.Status(422).JSON(fiber.Map{
+				"success": false,
+				"message": "Invalid working hours: " + err.Error(),
+			})
+		}
+		hours[i].ID = 0
+		hours[i].DoctorID = doctorID
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("doctor_id = ?", doctorID).Delete(&WorkingHours{}).Error; err != nil {
+			return err
+		}
+		if len(hours) == 0 {
+			return nil
+		}
+		return tx.Create(&hours).Error
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to update working hours",
+		})
+	}
+
+	// Existing appointments are kept even if they now fall outside working hours
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Working hours updated",
+		"data":    hours,
+	})
+}
+
+// Replace a doctor's weekly breaks
+func updateBreaks(c *fiber.Ctx) error {
+	doctorID, err := scheduleDoctor(c, true)
+	if err != nil {
+		return listError(c, err, "Failed to update breaks")
+	}
+
+	var breaks []ScheduleBreak
+	if err := c.BodyParser(&breaks); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "Invalid request body, expected a list of breaks",
+		})
+	}
+	for i := range breaks {
+		if err := validateWeeklyBlock(breaks[i].Weekday, breaks[i].Start, breaks[i].End); err != nil {
+			return c.Status(422).JSON(fiber.Map{
+				"success": false,
+				"message": "Invalid break: " + err.Error(),
+			})
+		}
+		breaks[i].ID = 0
+		breaks[i].DoctorID = doctorID
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("doctor_id = ?", doctorID).Delete(&ScheduleBreak{}).Error; err != nil {
+			return err
+		}
+		if len(breaks) == 0 {
+			return nil
+		}
+		return tx.Create(&breaks).Error
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to update breaks",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Breaks updated",
+		"data":    breaks,
+	})
+}
+
+// Add a holiday to a doctor's schedule
+func addHoliday(c *fiber.Ctx) error {
+	doctorID, err := scheduleDoctor(c, true)
+	if err != nil {
+		return listError(c, err, "Failed to add holiday")
+	}
+
+	holiday := new(Holiday)
+	if err := c.BodyParser(holiday); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "Invalid request body",
+		})
+	}
+	if holiday.EndDate == "" {
+		holiday.EndDate = holiday.StartDate
+	}
+	start, err1 := time.Parse(scheduleDateLayout, holiday.StartDate)
+	end, err2 := time.Parse(scheduleDateLayout, holiday.EndDate)
+	if err1 != nil || err2 != nil || end.Before(start) {
+		return c.Status(422).JSON(fiber.Map{
+			"success": false,
+			"message": "startDate and endDate must be YYYY-MM-DD dates, in order",
+		})
+	}
+
+	holiday.ID = 0
+	holiday.DoctorID = doctorID
+	if err := db.Create(holiday).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to add holiday",
+		})
+	}
+
+	// Point out bookings that now clash, they are not cancelled automatically
+	var affected []Appointment
+	db.Where("doctor_id = ? AND status NOT IN ?", doctorID, nonBlockingStatuses).
+		Where("date(date_time) BETWEEN ? AND ?", holiday.StartDate, holiday.EndDate).
+		Find(&affected)
+
+	return c.Status(201).JSON(fiber.Map{
+		"success": true,
+		"message": "Holiday added",
+		"data":    holiday,
+		"meta": fiber.Map{
+			"affectedAppointments": len(affected),
+		},
+	})
+}
+
+// Remove a holiday from a doctor's schedule
+func deleteHoliday(c *fiber.Ctx) error {
+	doctorID, err := scheduleDoctor(c, true)
+	if err != nil {
+		return listError(c, err, "Failed to delete holiday")
+	}
+
+	result := db.Where("id = ? AND doctor_id = ?", c.Params("id"), doctorID).Delete(&Holiday{})
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to delete holiday",
+		})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Holiday not found",
+		})
+	}
+	return c.SendStatus(204)
+}
+
+// Validate and normalize a list of appointment types
+func parseAppointmentTypes(c *fiber.Ctx, doctorID *uuid.UUID) ([]AppointmentType, error) {
+	var types []AppointmentType
+	if err := c.BodyParser(&types); err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid request body, expected a list of appointment types")
+	}
+	seen := make(map[string]bool)
+	for i := range types {
+		types[i].Name = strings.TrimSpace(types[i].Name)
+		key := strings.ToLower(types[i].Name)
+		if key == "" || seen[key] {
+			return nil, fiber.NewError(fiber.StatusUnprocessableEntity, "Appointment type names must be unique and not empty")
+		}
+		if types[i].Duration < 5 || types[i].Duration > 24*60 {
+			return nil, fiber.NewError(fiber.StatusUnprocessableEntity, "Duration of "+types[i].Name+" must be between 5 minutes and a day")
+		}
+		seen[key] = true
+		types[i].ID = 0
+		types[i].DoctorID = doctorID
+	}
+	return types, nil
+}
+
+// Replace the set of appointment types owned by doctorID, or the clinic
+// defaults when it is nil
+func replaceAppointmentTypes(doctorID *uuid.UUID, types []AppointmentType) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		query := tx.Where("doctor_id IS NULL")
+		if doctorID != nil {
+			query = tx.Where("doctor_id = ?", *doctorID)
+		}
+		if err := query.Delete(&AppointmentType{}).Error; err != nil {
+			return err
+		}
+		if len(types) == 0 {
+			return nil
+		}
+		return tx.Create(&types).Error
+	})
+}
+
+// Replace a doctor's own appointment types, which override the clinic defaults
+func updateDoctorAppointmentTypes(c *fiber.Ctx) error {
+	doctorID, err := scheduleDoctor(c, true)
+	if err != nil {
+		return listError(c, err, "Failed to update appointment types")
+	}
+
+	types, err := parseAppointmentTypes(c, &doctorID)
+	if err != nil {
+		return listError(c, err, "Failed to update appointment types")
+	}
+	if err := replaceAppointmentTypes(&doctorID, types); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to update appointment types",
+		})
+	}
+
+	effective, _ := appointmentTypesFor(doctorID)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Appointment types updated",
+		"data":    effective,
+	})
+}
+
+// List the appointment types that can be booked with a doctor
+func getAppointmentTypes(c *fiber.Ctx) error {
+	doctorID := currentDoctorID(c)
+	if id := c.Query("doctorId"); id != "" {
+		parsed, err := uuid.Parse(id)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"success": false,
+				"message": "Invalid doctorId",
+			})
+		}
+		doctorID = parsed
+	}
+
+	types, err := appointmentTypesFor(doctorID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to fetch appointment types",
+		})
+	}
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Appointment types retrieved successfully",
+		"data":    types,
+	})
+}
+
+// Replace the clinic's default appointment types
+func updateDefaultAppointmentTypes(c *fiber.Ctx) error {
+	types, err := parseAppointmentTypes(c, nil)
+	if err != nil {
+		return listError(c, err, "Failed to update appointment types")
+	}
+	if err := replaceAppointmentTypes(nil, types); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to update appointment types",
+		})
+	}
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Default appointment types updated",
+		"data":    types,
+	})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestConflictDetailsHidePatientsOutsideCareTeam(t *testing.T) {
+	setupTestDB(t)
+	app := newTestApp()
+	doctor, doctorToken := createTestUser(t, RolePhysician, "password123")
+	colleague, colleagueToken := createTestUser(t, RolePhysician, "password123")
+	booked := createTestPatient(t, "Ada Lovelace", doctor)
+	other := createTestPatient(t, "Grace Hopper", doctor, colleague)
+
+	start := nextMonday(10).Format(appointmentTimeLayout)
+	resp := doRequest(t, app, http.MethodPost, "/api/appointments", doctorToken, fiber.Map{"patientId": booked.ID, "dateTime": start, "type": "Consultation"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("booking: status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	var appointment Appointment
+	decodeBody(t, resp, &appointment)
+
+	tests := []struct {
+		name        string
+		token       string
+		showPatient bool
+	}{
+		{"caller on the care team", doctorToken, true},
+		{"caller outside the care team", colleagueToken, false},
+	}
+	for _, tt := range tests {
+		resp := doRequest(t, app, http.MethodPost, "/api/appointments", tt.token, fiber.Map{"patientId": other.ID, "doctorId": doctor.ID, "dateTime": start, "type": "Consultation"})
+		if resp.StatusCode != http.StatusConflict {
+			t.Fatalf("%s: status = %d, want %d", tt.name, resp.StatusCode, http.StatusConflict)
+		}
+		var body struct {
+			Conflict map[string]interface{} `json:"conflict"`
+		}
+		decodeBody(t, resp, &body)
+
+		if body.Conflict["dateTime"] != start || body.Conflict["doctorId"] != doctor.ID.String() {
+			t.Errorf("%s: conflict = %v, want the doctor and time", tt.name, body.Conflict)
+		}
+		_, hasID := body.Conflict["id"]
+		patientID, hasPatient := body.Conflict["patientId"]
+		if hasID != tt.showPatient || hasPatient != tt.showPatient {
+			t.Errorf("%s: conflict = %v, want id and patientId shown = %v", tt.name, body.Conflict, tt.showPatient)
+		}
+		if tt.showPatient && (patientID != booked.ID.String() || body.Conflict["id"] != appointment.ID.String()) {
+			t.Errorf("%s: conflict = %v, want appointment %s of patient %s", tt.name, body.Conflict, appointment.ID, booked.ID)
+		}
+	}
+}
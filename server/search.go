@@ -0,0 +1,550 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Patients are searched through an FTS5 table with one row per patient,
+// holding their details plus the names of their medications and the summaries
+// of their reports. FTS5 needs the binary built with -tags sqlite_fts5;
+// without it search falls back to LIKE queries.
+var searchFTS bool
+
+// The search index. name_tails holds the words of the name without their
+// first letters, for fuzzy search only.
+const searchIndexSchema = `CREATE VIRTUAL TABLE IF NOT EXISTS patient_search USING fts5(
+	patient_id UNINDEXED, name, contact, address, allergies, medications, reports, name_tails,
+	tokenize = 'unicode61 remove_diacritics 2', prefix = '2 3')`
+
+// Page sizes for patient search
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 50
+
+	// Most patients a fuzzy search compares the query with
+	maxFuzzyCandidates = 1000
+)
+
+// Markers placed around matches by SQLite, swapped for <mark> after escaping
+const (
+	markStart = "\x02"
+	markEnd   = "\x03"
+)
+
+// A patient matching a search, with why it matched
+type SearchResult struct {
+	Patient         Patient `json:"patient"`
+	MatchType       string  `json:"matchType"` // "id", "text" or "fuzzy"
+	Score           float64 `json:"score"`     // lower is better
+	HighlightedName string  `json:"highlightedName"`
+	Snippet         string  `json:"snippet"`
+}
+
+// Create the search index if FTS5 is available, and rebuild it if it is out
+// of step with the patients table. Called from initDB.
+func initSearchIndex() {
+	err := db.Exec(searchIndexSchema).Error
+	if err != nil {
+		log.Printf("WARN: Full-text search unavailable (%v), build with -tags sqlite_fts5; falling back to LIKE search", err)
+		return
+	}
+
+	// Indexes created before name tails were indexed are created afresh
+	if db.Exec("SELECT name_tails FROM patient_search LIMIT 0").Error != nil {
+		db.Exec("DROP TABLE patient_search")
+		if err := db.Exec(searchIndexSchema).Error; err != nil {
+			log.Printf("ERROR: Failed to recreate the search index, falling back to LIKE search: %v", err)
+			return
+		}
+	}
+	searchFTS = true
+
+	var indexed, patients int64
+	db.Raw("SELECT count(*) FROM patient_search").Scan(&indexed)
+	db.Unscoped().Model(&Patient{}).Count(&patients)
+	if indexed != patients {
+		rebuildSearchIndex()
+	}
+}
+
+// Re-index every patient
+func rebuildSearchIndex() {
+	var ids []uuid.UUID
+	db.Unscoped().Model(&Patient{}).Pluck("id", &ids)
+
+	db.Exec("DELETE FROM patient_search")
+	for _, id := range ids {
+		reindexPatient(id)
+	}
+	log.Printf("Rebuilt search index for %d patients", len(ids))
+}
+
+// Refresh a patient's row in the search index. Call after changing the
+// patient, their medications or their reports. Failures are logged only, a
+// stale index should never fail the request that changed the data.
+func reindexPatient(patientID uuid.UUID) {
+	if !searchFTS {
+		return
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("DELETE FROM patient_search WHERE patient_id = ?", patientID.String()).Error; err != nil {
+			return err
+		}
+
+		var patient Patient
+		if err := tx.Unscoped().First(&patient, "id = ?", patientID).Error; err != nil {
+			return nil // purged, nothing to index
+		}
+
+		var medications, reports []string
+		tx.Model(&Medication{}).Where("patient_id = ?", patientID).Pluck("name", &medications)
+		tx.Model(&Report{}).Where("patient_id = ? AND status = ?", patientID, "completed").Pluck("summary", &reports)
+
+		return tx.Exec(`INSERT INTO patient_search (patient_id, name, contact, address, allergies, medications, reports, name_tails)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			patient.ID.String(), patient.Name, patient.Contact, patient.Address, patient.Allergies,
+			strings.Join(medications, "\n"), strings.Join(reports, "\n"), nameTails(patient.Name)).Error
+	})
+	if err != nil {
+		log.Printf("ERROR: Failed to index patient %s for search: %v", patientID, err)
+	}
+}
+
+// Remove purged patients from the search index
+func dropFromSearchIndex(patientIDs []uuid.UUID) {
+	if !searchFTS || len(patientIDs) == 0 {
+		return
+	}
+	ids := make([]string, len(patientIDs))
+	for i, id := range patientIDs {
+		ids[i] = id.String()
+	}
+	db.Exec("DELETE FROM patient_search WHERE patient_id IN ?", ids)
+}
+
+// Split a search box query into lowercase words
+func searchTokens(q string) []string {
+	return strings.FieldsFunc(strings.ToLower(q), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// FTS5 prefix query for a token, quoted so it is never parsed as FTS5 syntax
+func ftsPrefix(token string) string {
+	return `"` + strings.ReplaceAll(token, `"`, `""`) + `"*`
+}
+
+// FTS5 query matching every token as a prefix, in any column but the hidden ones
+func ftsQuery(tokens, hidden []string) string {
+	terms := make([]string, len(tokens))
+	for i, t := range tokens {
+		terms[i] = ftsPrefix(t)
+	}
+	return "- {" + strings.Join(hidden, " ") + "} : (" + strings.Join(terms, " AND ") + ")"
+}
+
+// Index columns the caller may not search: name_tails, which is for fuzzy
+// search only, and medications and reports unless the caller may read them
+func hiddenSearchColumns(c *fiber.Ctx) []string {
+	hidden := []string{"name_tails"}
+	if !hasPermission(c, PermMedicationsRead) {
+		hidden = append(hidden, "medications")
+	}
+	if !hasPermission(c, PermReportsRead) {
+		hidden = append(hidden, "reports")
+	}
+	return hidden
+}
+
+// The words of a name without their first letters, e.g. "atherine" for
+// Katherine, so names misspelt from the first letter on can be shortlisted
+func nameTails(name string) string {
+	var tails []string
+	for _, w := range searchTokens(name) {
+		if r := []rune(w); len(r) > 1 {
+			tails = append(tails, string(r[1:]))
+		}
+	}
+	return strings.Join(tails, " ")
+}
+
+// HTML-escape text containing match markers, then turn the markers into <mark>
+func renderMarks(s string) string {
+	s = html.EscapeString(s)
+	return strings.NewReplacer(markStart, "<mark>", markEnd, "</mark>").Replace(s)
+}
+
+// Mark the words of text that start with any of the tokens
+func markPrefixes(text string, tokens []string) string {
+	var b strings.Builder
+	start := -1
+	flush := func(end int) {
+		word := text[start:end]
+		lower := strings.ToLower(word)
+		for _, t := range tokens {
+			if strings.HasPrefix(lower, t) {
+				word = markStart + word + markEnd
+				break
+			}
+		}
+		b.WriteString(word)
+		start = -1
+	}
+	for i, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			flush(i)
+		}
+		b.WriteRune(r)
+	}
+	if start >= 0 {
+		flush(len(text))
+	}
+	return b.String()
+}
+
+// American Soundex code of a word, e.g. "Robert" and "Rupert" are both R163
+func soundex(word string) string {
+	codes := map[rune]byte{
+		'b': '1', 'f': '1', 'p': '1', 'v': '1',
+		'c': '2', 'g': '2', 'j': '2', 'k': '2', 'q': '2', 's': '2', 'x': '2', 'z': '2',
+		'd': '3', 't': '3',
+		'l': '4',
+		'm': '5', 'n': '5',
+		'r': '6',
+	}
+
+	var out []byte
+	var last byte
+	for i, r := range strings.ToLower(word) {
+		if r < 'a' || r > 'z' {
+			continue
+		}
+		code := codes[r]
+		if len(out) == 0 {
+			out = append(out, byte(unicode.ToUpper(r)))
+			last = code
+			continue
+		}
+		if code != 0 && code != last {
+			out = append(out, code)
+			if len(out) == 4 {
+				break
+			}
+		}
+		// H and W do not separate letters with the same code, vowels do
+		if r != 'h' && r != 'w' || i == 0 {
+			last = code
+		}
+	}
+	if len(out) == 0 {
+		return ""
+	}
+	for len(out) < 4 {
+		out = append(out, '0')
+	}
+	return string(out)
+}
+
+// Edit distance counting insertions, deletions, substitutions and swaps of
+// adjacent letters, the usual typing mistakes
+func editDistance(a, b string) int {
+	s, t := []rune(a), []rune(b)
+	d := make([][]int, len(s)+1)
+	for i := range d {
+		d[i] = make([]int, len(t)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && s[i-1] == t[j-2] && s[i-2] == t[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(s)][len(t)]
+}
+
+// How far a query token is from a word in a name, or -1 if too far to be a
+// misspelling. The token is compared with the start of the word as well, so
+// half-typed names still match.
+func fuzzyDistance(token, word string) int {
+	n := len([]rune(token))
+	if n < 3 {
+		return -1
+	}
+	if strings.HasPrefix(word, token) {
+		return 0
+	}
+
+	allowed := 1
+	if n >= 8 {
+		allowed = 2
+	}
+	best := -1
+	if n >= 4 {
+		best = editDistance(token, word)
+		if prefix := []rune(word); len(prefix) > n {
+			if d := editDistance(token, string(prefix[:n])); d < best {
+				best = d
+			}
+		}
+		if best > allowed {
+			best = -1
+		}
+	}
+	if best < 0 && soundex(token) == soundex(word) {
+		best = allowed
+	}
+	return best
+}
+
+// Find patients whose names are close to the query, for misspellings the
+// text search misses
+func fuzzySearch(c *fiber.Ctx, tokens []string, exclude map[uuid.UUID]bool, limit int) ([]SearchResult, error) {
+	// Tokens shorter than three letters are never close enough
+	for _, t := range tokens {
+		if len([]rune(t)) < 3 {
+			return nil, nil
+		}
+	}
+
+	// Only names with, for every token, a word starting with the same letter,
+	// as sounding alike needs, or one letter added, removed or changed at the
+	// start are compared
+	query := db.Scopes(scopePatients(c)).Select("patients.id", "patients.name")
+	for _, t := range tokens {
+		r := []rune(t)
+		first, second, head := string(r[:1]), string(r[1:3]), string(r[:2])
+		if searchFTS {
+			match := fmt.Sprintf("name : %s OR name : %s OR name_tails : %s OR name_tails : %s",
+				ftsPrefix(first), ftsPrefix(second), ftsPrefix(head), ftsPrefix(second))
+			query = query.Where("patients.id IN (?)",
+				db.Table("patient_search").Select("patient_id").Where("patient_search MATCH ?", match))
+		} else {
+			// Without the index, a word start is anything after a space, hyphen or apostrophe
+			query = query.Where(`(' ' || REPLACE(REPLACE(LOWER(patients.name), '-', ' '), '''', ' ') LIKE ? ESCAPE '\'
+				OR LOWER(patients.name) LIKE ? ESCAPE '\' OR LOWER(patients.name) LIKE ? ESCAPE '\')`,
+				"% "+escapeLike(first)+"%", "%"+escapeLike(head)+"%", "%"+escapeLike(second)+"%")
+		}
+	}
+
+	var candidates []Patient
+	if err := query.Order("patients.name").Limit(maxFuzzyCandidates).Find(&candidates).Error; err != nil {
+		return nil, err
+	}
+
+	var results []SearchResult
+	for _, p := range candidates {
+		if exclude[p.ID] {
+			continue
+		}
+		words := searchTokens(p.Name)
+
+		// Every token has to be close to some word of the name
+		total := 0
+		for _, t := range tokens {
+			best := -1
+			for _, w := range words {
+				if d := fuzzyDistance(t, w); d >= 0 && (best < 0 || d < best) {
+					best = d
+				}
+			}
+			if best < 0 {
+				total = -1
+				break
+			}
+			total += best
+		}
+		if total < 0 {
+			continue
+		}
+		results = append(results, SearchResult{Patient: p, MatchType: "fuzzy", Score: float64(total)})
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score < results[j].Score
+		}
+		return results[i].Patient.Name < results[j].Patient.Name
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	// Load the full records for the matches
+	for i := range results {
+		db.First(&results[i].Patient, "id = ?", results[i].Patient.ID)
+		results[i].HighlightedName = html.EscapeString(results[i].Patient.Name)
+	}
+	return results, nil
+}
+
+// Search the index for patients matching every token as a prefix
+func textSearch(c *fiber.Ctx, tokens []string, exclude map[uuid.UUID]bool, limit int) ([]SearchResult, error) {
+	var rows []struct {
+		Patient         `gorm:"embedded"`
+		SearchRank      float64
+		HighlightedName string
+		Snippet         string
+	}
+
+	query := db.Model(&Patient{}).Scopes(scopePatients(c))
+	if searchFTS {
+		// Name matches weigh most, then medications, then contact details and
+		// reports. Hidden columns neither match nor give the snippet.
+		err := query.
+			Select(`patients.*,
+				bm25(patient_search, 0, 10.0, 2.0, 1.0, 2.0, 4.0, 1.0, 0) AS search_rank,
+				highlight(patient_search, 1, ?, ?) AS highlighted_name,
+				snippet(patient_search, -1, ?, ?, '…', 12) AS snippet`, markStart, markEnd, markStart, markEnd).
+			Joins("JOIN patient_search ON patient_search.patient_id = patients.id").
+			Where("patient_search MATCH ?", ftsQuery(tokens, hiddenSearchColumns(c))).
+			Order("search_rank").Limit(limit + len(exclude)).
+			Scan(&rows).Error
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		medications, reports := hasPermission(c, PermMedicationsRead), hasPermission(c, PermReportsRead)
+		for _, t := range tokens {
+			like := "%" + escapeLike(t) + "%"
+			match := db.Where(`LOWER(name) LIKE ? ESCAPE '\'`, like).Or(`LOWER(contact) LIKE ? ESCAPE '\'`, like).
+				Or(`LOWER(address) LIKE ? ESCAPE '\'`, like).Or(`LOWER(allergies) LIKE ? ESCAPE '\'`, like)
+			if medications {
+				match = match.Or("patients.id IN (?)",
+					db.Model(&Medication{}).Select("patient_id").Where(`LOWER(name) LIKE ? ESCAPE '\'`, like))
+			}
+			if reports {
+				match = match.Or("patients.id IN (?)",
+					db.Model(&Report{}).Select("patient_id").Where(`status = ? AND LOWER(summary) LIKE ? ESCAPE '\'`, "completed", like))
+			}
+			query = query.Where(match)
+		}
+		if err := query.Order("name").Limit(limit + len(exclude)).Scan(&rows).Error; err != nil {
+			return nil, err
+		}
+		for i := range rows {
+			rows[i].HighlightedName = markPrefixes(rows[i].Name, tokens)
+			for _, field := range []string{rows[i].Contact, rows[i].Address, rows[i].Allergies} {
+				if marked := markPrefixes(field, tokens); strings.Contains(marked, markStart) {
+					rows[i].Snippet = marked
+					break
+				}
+			}
+		}
+	}
+
+	var results []SearchResult
+	for _, row := range rows {
+		if exclude[row.ID] || len(results) == limit {
+			continue
+		}
+		results = append(results, SearchResult{
+			Patient:         row.Patient,
+			MatchType:       "text",
+			Score:           row.SearchRank,
+			HighlightedName: renderMarks(row.HighlightedName),
+			Snippet:         renderMarks(row.Snippet),
+		})
+	}
+	return results, nil
+}
+
+// Search the caller's patients by ID, name, contact details, allergies,
+// medications or report summaries, as typed into a search box
+func searchPatients(c *fiber.Ctx) error {
+	q := strings.TrimSpace(c.Query("q"))
+	tokens := searchTokens(q)
+	if len(tokens) == 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "Search query is required",
+		})
+	}
+
+	limit, _ := strconv.Atoi(c.Query("limit", strconv.Itoa(defaultSearchLimit)))
+	if limit < 1 || limit > maxSearchLimit {
+		limit = defaultSearchLimit
+	}
+
+	results := []SearchResult{}
+	found := make(map[uuid.UUID]bool)
+
+	// A pasted patient ID, or the start of one
+	if len(q) >= 8 && strings.Trim(strings.ToLower(q), "0123456789abcdef-") == "" {
+		var patients []Patient
+		db.Scopes(scopePatients(c)).Where("patients.id LIKE ?", strings.ToLower(q)+"%").Limit(limit).Find(&patients)
+		for _, p := range patients {
+			results = append(results, SearchResult{Patient: p, MatchType: "id", HighlightedName: html.EscapeString(p.Name)})
+			found[p.ID] = true
+		}
+	}
+
+	if len(results) < limit {
+		matches, err := textSearch(c, tokens, found, limit-len(results))
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"success": false,
+				"message": "Failed to search patients",
+			})
+		}
+		for _, m := range matches {
+			results = append(results, m)
+			found[m.Patient.ID] = true
+		}
+	}
+
+	// Only fall back to guessing at misspellings when the text search comes up short
+	if len(results) < limit {
+		matches, err := fuzzySearch(c, tokens, found, limit-len(results))
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"success": false,
+				"message": "Failed to search patients",
+			})
+		}
+		results = append(results, matches...)
+	}
+
+	patientIDs := make([]uuid.UUID, len(results))
+	for i, r := range results {
+		patientIDs[i] = r.Patient.ID
+	}
+	auditList(c, "patient_search", patientIDs)
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Search results retrieved successfully",
+		"data":    results,
+		"meta": fiber.Map{
+			"query":    q,
+			"count":    len(results),
+			"fullText": searchFTS,
+		},
+	})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSearchPatients(t *testing.T) {
+	setupTestDB(t)
+	app := newTestApp()
+	_, token := createTestUser(t, RoleAdmin, "password123")
+
+	patients := map[string]*Patient{}
+	for _, name := range []string{"Catherine Smith", "Jonathan Smyth", "Robert Jones", "Zoe O'Brien-Adams"} {
+		p := Patient{Name: name}
+		if err := db.Create(&p).Error; err != nil {
+			t.Fatalf("failed to create %s: %v", name, err)
+		}
+		reindexPatient(p.ID)
+		patients[name] = &p
+	}
+	db.Create(&Report{PatientID: patients["Robert Jones"].ID, Summary: "Hypertension follow-up", Status: "completed"})
+	reindexPatient(patients["Robert Jones"].ID)
+
+	tests := []struct {
+		q    string
+		want []string // in order
+	}{
+		{"cat smi", []string{"Catherine Smith"}},
+		{"jo smi", []string{}},
+		{"jon smy", []string{"Jonathan Smyth"}},
+		{"hypertens", []string{"Robert Jones"}},
+		{"Katherine", []string{"Catherine Smith"}},
+		{"atherine", []string{"Catherine Smith"}},
+		{"Smyth", []string{"Jonathan Smyth", "Catherine Smith"}},
+		{"Rupert", []string{"Robert Jones"}},
+		{"adams", []string{"Zoe O'Brien-Adams"}},
+		{"brian", []string{"Zoe O'Brien-Adams"}},
+		{"xy", []string{}},
+	}
+	for _, tt := range tests {
+		resp := doRequest(t, app, http.MethodGet, "/api/patients/search?q="+url.QueryEscape(tt.q), token, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("search %q: status = %d, want %d", tt.q, resp.StatusCode, http.StatusOK)
+		}
+		var body struct {
+			Data []SearchResult `json:"data"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("search %q: failed to decode the response: %v", tt.q, err)
+		}
+
+		got := make([]string, len(body.Data))
+		for i, r := range body.Data {
+			got[i] = r.Patient.Name
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("search %q = %q, want %q", tt.q, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("search %q = %q, want %q", tt.q, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestSearchIndexUpgrade(t *testing.T) {
+	setupTestDB(t)
+	if !searchFTS {
+		t.Skip("needs -tags sqlite_fts5")
+	}
+
+	// An index from before name tails were indexed
+	db.Exec("DROP TABLE patient_search")
+	db.Exec(`CREATE VIRTUAL TABLE patient_search USING fts5(
+		patient_id UNINDEXED, name, contact, address, allergies, medications, reports)`)
+	p := Patient{Name: "Catherine Smith"}
+	db.Create(&p)
+
+	initSearchIndex()
+	var tails string
+	db.Raw("SELECT name_tails FROM patient_search WHERE patient_id = ?", p.ID.String()).Scan(&tails)
+	if tails != "atherine mith" {
+		t.Errorf("name_tails = %q, want %q", tails, "atherine mith")
+	}
+}
+
+// Medication names and report summaries are searched only for callers who may read them
+func TestSearchHidesClinicalRecords(t *testing.T) {
+	setupTestDB(t)
+	app := newTestApp()
+	receptionist, receptionistToken := createTestUser(t, RoleReceptionist, "password123")
+	nurse, nurseToken := createTestUser(t, RoleNurse, "password123")
+
+	patient := createTestPatient(t, "Robert Jones", receptionist, nurse)
+	db.Model(&patient).Update("address", "12 Warfield Road")
+	db.Create(&Medication{PatientID: patient.ID, Name: "Warfarin"})
+	db.Create(&Report{PatientID: patient.ID, Summary: "HIV follow-up", Status: "completed"})
+	reindexPatient(patient.ID)
+
+	tests := []struct {
+		token       string
+		role        string
+		q           string
+		want        int
+		wantSnippet string
+	}{
+		{receptionistToken, RoleReceptionist, "warfarin", 0, ""},
+		{receptionistToken, RoleReceptionist, "hiv", 0, ""},
+		{receptionistToken, RoleReceptionist, "warf", 1, "12 <mark>Warfield</mark> Road"},
+		{nurseToken, RoleNurse, "warfarin", 1, ""},
+		{nurseToken, RoleNurse, "hiv", 1, ""},
+	}
+	for _, tt := range tests {
+		resp := doRequest(t, app, http.MethodGet, "/api/patients/search?q="+url.QueryEscape(tt.q), tt.token, nil)
+		var body struct {
+			Data []SearchResult `json:"data"`
+		}
+		decodeBody(t, resp, &body)
+		if len(body.Data) != tt.want {
+			t.Errorf("search %q as %s: %d results, want %d", tt.q, tt.role, len(body.Data), tt.want)
+			continue
+		}
+		if tt.wantSnippet != "" && !strings.Contains(body.Data[0].Snippet, tt.wantSnippet) {
+			t.Errorf("search %q as %s: snippet = %q, want it to show %q", tt.q, tt.role, body.Data[0].Snippet, tt.wantSnippet)
+		}
+	}
+}
@@ -0,0 +1,636 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Most occurrences a single series may generate
+const maxSeriesOccurrences = 200
+
+// Which occurrences of a series an update or deletion applies to
+const (
+	scopeThis      = "this"      // only the given occurrence
+	scopeFollowing = "following" // the given occurrence and those after it
+	scopeAll       = "all"       // every occurrence
+)
+
+// Parse the scope query parameter of appointment updates and deletions
+func seriesScope(c *fiber.Ctx) (string, bool) {
+	scope := c.Query("scope", scopeThis)
+	return scope, scope == scopeThis || scope == scopeFollowing || scope == scopeAll
+}
+
+// Normalize a comma separated list of exception dates
+func normalizeExDates(s string) (string, error) {
+	var dates []string
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if _, err := time.Parse(scheduleDateLayout, v); err != nil {
+			return "", fmt.Errorf("invalid exception date %q, expected YYYY-MM-DD", v)
+		}
+		dates = append(dates, v)
+	}
+	return strings.Join(dates, ","), nil
+}
+
+// Generate the occurrences of a series, leaving out its exception dates
+func expandSeries(series AppointmentSeries, status string) ([]Appointment, error) {
+	rule, err := parseRRule(series.RRule)
+	if err != nil {
+		return nil, err
+	}
+	start, err := parseAppointmentTime(series.DateTime)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dateTime, expected YYYY-MM-DDTHH:MM")
+	}
+	starts, err := rule.expand(start, maxSeriesOccurrences)
+	if err != nil {
+		return nil, err
+	}
+
+	var occurrences []Appointment
+	for _, t := range starts {
+		if strings.Contains(","+series.ExDates+",", ","+t.Format(scheduleDateLayout)+",") {
+			continue
+		}
+		seriesID := series.ID
+		occurrences = append(occurrences, Appointment{
+			PatientID:    series.PatientID,
+			DoctorID:     series.DoctorID,
+			DateTime:     t.Format(appointmentTimeLayout),
+			Type:         series.Type,
+			Notes:        series.Notes,
+			Status:       status,
+			SeriesID:     &seriesID,
+			RecurrenceID: t.Format(appointmentTimeLayout),
+		})
+	}
+	if len(occurrences) == 0 {
+		return nil, fmt.Errorf("every occurrence of the rule is an exception date")
+	}
+	return occurrences, nil
+}
+
+// Check every occurrence against the schedule and existing bookings, as
+// checkBooking does for single appointments. Returns the occurrences that
+// cannot be booked.
+func checkOccurrences(c *fiber.Ctx, occurrences []Appointment, moving []uuid.UUID) ([]fiber.Map, int, error) {
+	var conflicts []fiber.Map
+	status := 422
+	for i := range occurrences {
+		err := checkBooking(&occurrences[i], moving...)
+		if err == nil {
+			continue
+		}
+		be, ok := err.(*bookingError)
+		if !ok {
+			return nil, 0, err
+		}
+		conflict := fiber.Map{
+			"dateTime": occurrences[i].DateTime,
+			"message":  be.message,
+		}
+		if be.conflict != nil {
+			conflict["conflict"] = conflictDetails(c, be.conflict)
+		}
+		if be.status == 409 {
+			status = 409
+		}
+		conflicts = append(conflicts, conflict)
+	}
+	return conflicts, status, nil
+}
+
+// Respond with the occurrences of a series that cannot be booked
+func seriesConflictResponse(c *fiber.Ctx, status int, conflicts []fiber.Map) error {
+	return c.Status(status).JSON(fiber.Map{
+		"success":   false,
+		"message":   fmt.Sprintf("%d occurrences of the series cannot be booked", len(conflicts)),
+		"conflicts": conflicts,
+	})
+}
+
+// Occurrences of a series that an update or deletion applies to. Occurrences
+// that have already started are history and never change with the series, and
+// rescheduled ones have been replaced.
+func seriesTargets(seriesID uuid.UUID, from string) ([]Appointment, error) {
+	query := db.Where("series_id = ? AND status <> ?", seriesID, statusRescheduled).
+		Where("datetime(date_time) >= datetime(?)", clinicNow().Format(sqliteTimeLayout))
+	if from != "" {
+		query = query.Where("datetime(date_time) >= datetime(?)", from)
+	}
+	var targets []Appointment
+	err := query.Order("date_time").Find(&targets).Error
+	return targets, err
+}
+
+// End a series' rule just before the occurrence that originally started at before
+func truncateSeries(tx *gorm.DB, series *AppointmentSeries, before time.Time) error {
+	rule, err := parseRRule(series.RRule)
+	if err != nil {
+		return err
+	}
+	rule.count = 0
+	rule.until = before.Add(-time.Minute)
+	series.RRule = rule.String()
+	return tx.Save(series).Error
+}
+
+// Create a recurring appointment and all of its occurrences
+func createAppointmentSeries(c *fiber.Ctx) error {
+	series := new(AppointmentSeries)
+	if err := c.BodyParser(series); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "Invalid request body",
+		})
+	}
+
+	if !canAccessPatient(c, series.PatientID) {
+		auditAccess(c, "create", "appointment_series", "", series.PatientID, auditNotFound)
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Patient not found",
+		})
+	}
+	if series.DoctorID == uuid.Nil {
+		series.DoctorID = defaultDoctorID(c)
+	}
+
+	exDates, err := normalizeExDates(series.ExDates)
+	if err != nil {
+		return c.Status(422).JSON(fiber.Map{
+			"success": false,
+			"message": err.Error(),
+		})
+	}
+	series.ID = uuid.New()
+	series.ExDates = exDates
+
+	bookingMu.Lock()
+	defer bookingMu.Unlock()
+
+	occurrences, err := expandSeries(*series, statusScheduled)
+	if err != nil {
+		return c.Status(422).JSON(fiber.Map{
+			"success": false,
+			"message": "Invalid recurrence: " + err.Error(),
+		})
+	}
+	conflicts, status, err := checkOccurrences(c, occurrences, nil)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to check availability",
+		})
+	}
+	if len(conflicts) > 0 {
+		auditAccess(c, "create", "appointment_series", "", series.PatientID, auditDenied)
+		return seriesConflictResponse(c, status, conflicts)
+	}
+
+	// As normalized by checkBooking
+	rule, _ := parseRRule(series.RRule)
+	series.RRule = rule.String()
+	series.DateTime = occurrences[0].RecurrenceID
+	series.Type = occurrences[0].Type
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(series).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&occurrences).Error; err != nil {
+			return err
+		}
+		for _, o := range occurrences {
+			if err := recordStatusChange(tx, c, o.ID, "", o.Status, ""); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		auditAccess(c, "create", "appointment_series", "", series.PatientID, auditError)
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to create appointment series",
+		})
+	}
+
+	auditAccess(c, "create", "appointment_series", series.ID.String(), series.PatientID, auditSuccess)
+	return c.Status(201).JSON(fiber.Map{
+		"success": true,
+		"message": fmt.Sprintf("Appointment series created with %d occurrences", len(occurrences)),
+		"data": fiber.Map{
+			"series":      series,
+			"occurrences": occurrences,
+		},
+	})
+}
+
+// Get a series with its occurrences
+func getAppointmentSeries(c *fiber.Ctx) error {
+	id := c.Params("id")
+	var series AppointmentSeries
+	if err := db.Scopes(scopePatientRecords(c)).First(&series, "id = ?", id).Error; err != nil {
+		auditAccess(c, "read", "appointment_series", id, uuid.Nil, auditNotFound)
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Appointment series not found",
+		})
+	}
+
+	var occurrences []Appointment
+	if err := db.Where("series_id = ?", series.ID).Order("date_time").Find(&occurrences).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to fetch occurrences",
+		})
+	}
+
+	auditAccess(c, "read", "appointment_series", id, series.PatientID, auditSuccess)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Appointment series retrieved successfully",
+		"data": fiber.Map{
+			"series":      series,
+			"occurrences": occurrences,
+		},
+	})
+}
+
+// Update an occurrence and the following ones, or all upcoming occurrences,
+// of the series existing belongs to. A changed dateTime moves every affected
+// occurrence by the same amount; a changed rrule replaces them with the new
+// rule's occurrences starting from the first of them. Editing the following
+// occurrences splits them off into a new series.
+func updateSeriesOccurrences(c *fiber.Ctx, existing Appointment, scope string) error {
+	id := existing.ID.String()
+	req := new(struct {
+		PatientID uuid.UUID `json:"patientId"`
+		DoctorID  uuid.UUID `json:"doctorId"`
+		DateTime  string    `json:"dateTime"`
+		Type      string    `json:"type"`
+		Notes     string    `json:"notes"`
+		Status    string    `json:"status"`
+		RRule     string    `json:"rrule"`
+
+		CancellationReason string `json:"cancellationReason"`
+	})
+	if err := c.BodyParser(req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	if req.PatientID != uuid.Nil && req.PatientID != existing.PatientID {
+		return c.Status(422).JSON(fiber.Map{"error": "A series cannot be moved to another patient"})
+	}
+	req.Status = normalizeStatus(req.Status)
+	switch {
+	case req.Status == statusRescheduled:
+		return c.Status(422).JSON(fiber.Map{"error": "Occurrences are rescheduled one at a time"})
+	case req.Status == statusCancelled && strings.TrimSpace(req.CancellationReason) == "":
+		return c.Status(422).JSON(fiber.Map{"error": "A cancellationReason is required to cancel appointments"})
+	}
+
+	bookingMu.Lock()
+	defer bookingMu.Unlock()
+
+	var series AppointmentSeries
+	if err := db.First(&series, "id = ?", existing.SeriesID).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Appointment series not found"})
+	}
+
+	from := ""
+	if scope == scopeFollowing {
+		from = existing.DateTime
+	}
+	targets, err := seriesTargets(series.ID, from)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update appointment series"})
+	}
+	if len(targets) == 0 {
+		return c.Status(422).JSON(fiber.Map{"error": "The series has no upcoming occurrences to change"})
+	}
+	moving := make([]uuid.UUID, len(targets))
+	for i, t := range targets {
+		moving[i] = t.ID
+	}
+
+	var offset time.Duration
+	if req.DateTime != "" {
+		newStart, err := parseAppointmentTime(req.DateTime)
+		if err != nil {
+			return c.Status(422).JSON(fiber.Map{"error": "Invalid dateTime, expected YYYY-MM-DDTHH:MM"})
+		}
+		oldStart, _ := parseAppointmentTime(existing.DateTime)
+		offset = newStart.Sub(oldStart)
+	}
+	shift := func(s string) string {
+		t, err := parseAppointmentTime(s)
+		if err != nil {
+			return s
+		}
+		return t.Add(offset).Format(appointmentTimeLayout)
+	}
+	firstRecurrence, err := parseAppointmentTime(targets[0].RecurrenceID)
+	if err != nil {
+		firstRecurrence, _ = parseAppointmentTime(targets[0].DateTime)
+	}
+
+	// The series the targets belong to afterwards
+	updated := series
+	if req.DoctorID != uuid.Nil {
+		updated.DoctorID = req.DoctorID
+	}
+	if req.Type != "" {
+		updated.Type = req.Type
+	}
+	if req.Notes != "" {
+		updated.Notes = req.Notes
+	}
+
+	// Split the following occurrences off unless nothing precedes them
+	split := false
+	if scope == scopeFollowing {
+		var earlier int64
+		db.Model(&Appointment{}).Where("series_id = ? AND datetime(date_time) < datetime(?)", series.ID, targets[0].DateTime).Count(&earlier)
+		split = earlier > 0
+	}
+	if split {
+		updated.ID = uuid.New()
+		updated.CreatedAt = time.Time{}
+	}
+
+	rule, err := parseRRule(series.RRule)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "The series has an invalid rule"})
+	}
+	ruleChanged := false
+	if req.RRule != "" {
+		newRule, err := parseRRule(req.RRule)
+		if err != nil {
+			return c.Status(422).JSON(fiber.Map{"error": "Invalid recurrence: " + err.Error()})
+		}
+		ruleChanged = newRule.String() != rule.String()
+		rule = newRule
+	}
+
+	var occurrences []Appointment
+	var kept, replaced []Appointment            // targets kept and replaced when the rule changes
+	statusChanges := make(map[uuid.UUID]string) // occurrence -> previous status
+	if ruleChanged {
+		// Replace the targets with the new rule's occurrences, except cancelled
+		// and no-show ones, which are kept and not generated again
+		for _, t := range targets {
+			if t.Status != statusCancelled && t.Status != statusNoShow {
+				replaced = append(replaced, t)
+				continue
+			}
+			kept = append(kept, t)
+			recurrence := t.RecurrenceID
+			if recurrence == "" {
+				recurrence = t.DateTime
+			}
+			if date := shift(recurrence); len(date) >= len(scheduleDateLayout) {
+				updated.ExDates += "," + date[:len(scheduleDateLayout)]
+			}
+		}
+		updated.ExDates, _ = normalizeExDates(updated.ExDates)
+		updated.RRule = rule.String()
+		updated.DateTime = shift(targets[0].DateTime)
+		status := req.Status
+		if status == "" {
+			status = statusScheduled
+		}
+		if err := checkInitialStatus(status); err != nil {
+			return c.Status(422).JSON(fiber.Map{"error": err.(*fiber.Error).Message})
+		}
+		occurrences, err = expandSeries(updated, status)
+		if err != nil {
+			return c.Status(422).JSON(fiber.Map{"error": "Invalid recurrence: " + err.Error()})
+		}
+	} else {
+		if split && rule.count > 0 {
+			// The new series keeps the occurrences the old one had left
+			start, _ := parseAppointmentTime(series.DateTime)
+			starts, _ := rule.expand(start, maxSeriesOccurrences)
+			remaining := 0
+			for _, t := range starts {
+				if !t.Before(firstRecurrence) {
+					remaining++
+				}
+			}
+			rule.count = remaining
+		}
+		if !rule.until.IsZero() {
+			rule.until = rule.until.Add(offset)
+		}
+		updated.RRule = rule.String()
+		if split {
+			updated.DateTime = shift(firstRecurrence.Format(appointmentTimeLayout))
+		} else {
+			updated.DateTime = shift(series.DateTime)
+		}
+
+		// Targets keep the occurrences as they were, for the slots they free
+		occurrences = make([]Appointment, len(targets))
+		copy(occurrences, targets)
+		for i := range occurrences {
+			o := &occurrences[i]
+			if req.Status != "" && req.Status != o.Status {
+				if err := checkTransition(o.Status, req.Status); err != nil {
+					return c.Status(422).JSON(fiber.Map{"error": o.DateTime + ": " + err.(*fiber.Error).Message})
+				}
+				statusChanges[o.ID] = o.Status
+				o.Status = req.Status
+				o.CancellationReason = req.CancellationReason
+			}
+			o.DateTime = shift(o.DateTime)
+			o.RecurrenceID = shift(o.RecurrenceID)
+			o.DoctorID = updated.DoctorID
+			if req.Type != "" {
+				o.Type = req.Type
+			}
+			if req.Notes != "" {
+				o.Notes = req.Notes
+			}
+			o.SeriesID = &updated.ID
+		}
+	}
+
+	conflicts, status, err := checkOccurrences(c, occurrences, moving)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to check availability"})
+	}
+	if len(conflicts) > 0 {
+		auditAccess(c, "update", "appointment_series", series.ID.String(), series.PatientID, auditDenied)
+		return seriesConflictResponse(c, status, conflicts)
+	}
+	updated.Type = occurrences[0].Type
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if split {
+			if err := truncateSeries(tx, &series, firstRecurrence); err != nil {
+				return err
+			}
+		}
+		if err := tx.Save(&updated).Error; err != nil {
+			return err
+		}
+		if ruleChanged {
+			if len(replaced) > 0 {
+				if err := tx.Delete(&replaced).Error; err != nil {
+					return err
+				}
+			}
+			for _, k := range kept {
+				if err := tx.Model(&Appointment{}).Where("id = ?", k.ID).Update("series_id", updated.ID).Error; err != nil {
+					return err
+				}
+			}
+			if err := tx.Create(&occurrences).Error; err != nil {
+				return err
+			}
+			for _, o := range occurrences {
+				if err := recordStatusChange(tx, c, o.ID, "", o.Status, ""); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		for _, o := range occurrences {
+			// The status endpoints do not take bookingMu, so a status may have
+			// changed since it was read
+			from, statusChanged := statusChanges[o.ID]
+			update := tx.Model(&Appointment{}).Where("id = ?", o.ID)
+			if statusChanged {
+				update = update.Where("status = ?", from)
+			}
+			result := update.Updates(map[string]interface{}{
+				"series_id":           o.SeriesID,
+				"recurrence_id":       o.RecurrenceID,
+				"doctor_id":           o.DoctorID,
+				"date_time":           o.DateTime,
+				"end_time":            o.EndTime,
+				"duration":            o.Duration,
+				"type":                o.Type,
+				"notes":               o.Notes,
+				"status":              o.Status,
+				"cancellation_reason": o.CancellationReason,
+			})
+			if result.Error != nil {
+				return result.Error
+			}
+			if !statusChanged {
+				continue
+			}
+			if result.RowsAffected == 0 {
+				return errStatusChanged
+			}
+			if err := recordStatusChange(tx, c, o.ID, from, o.Status, o.CancellationReason); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == errStatusChanged {
+		return c.Status(409).JSON(fiber.Map{"error": errStatusChanged.Message})
+	}
+	if err != nil {
+		auditAccess(c, "update", "appointment_series", series.ID.String(), series.PatientID, auditError)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update appointment series"})
+	}
+
+	auditAccess(c, "update", "appointment", id, existing.PatientID, auditSuccess)
+	auditAccess(c, "update", "appointment_series", updated.ID.String(), series.PatientID, auditSuccess)
+	for _, r := range replaced {
+		releaseSlot(r)
+	}
+	if !ruleChanged {
+		// A cancelled or moved occurrence frees its slot for the waitlist
+		for i, o := range occurrences {
+			if t := targets[i]; o.Status == statusCancelled || o.DoctorID != t.DoctorID || o.DateTime != t.DateTime {
+				releaseSlot(t)
+			}
+		}
+	}
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": fmt.Sprintf("%d occurrences updated", len(occurrences)),
+		"data": fiber.Map{
+			"series":      updated,
+			"occurrences": occurrences,
+		},
+	})
+}
+
+// Archive an occurrence and the following ones, or all upcoming occurrences,
+// and end the series' rule before them
+func deleteSeriesOccurrences(c *fiber.Ctx, existing Appointment, scope string) error {
+	id := existing.ID.String()
+
+	bookingMu.Lock()
+	defer bookingMu.Unlock()
+
+	var series AppointmentSeries
+	if err := db.First(&series, "id = ?", existing.SeriesID).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Appointment series not found"})
+	}
+
+	from := ""
+	if scope == scopeFollowing {
+		from = existing.DateTime
+	}
+	targets, err := seriesTargets(series.ID, from)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete appointments"})
+	}
+	if len(targets) == 0 {
+		return c.Status(422).JSON(fiber.Map{"error": "The series has no upcoming occurrences to delete"})
+	}
+	firstRecurrence, err := parseAppointmentTime(targets[0].RecurrenceID)
+	if err != nil {
+		firstRecurrence, _ = parseAppointmentTime(targets[0].DateTime)
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&targets).Error; err != nil {
+			return err
+		}
+		return truncateSeries(tx, &series, firstRecurrence)
+	})
+	if err != nil {
+		auditAccess(c, "delete", "appointment_series", series.ID.String(), series.PatientID, auditError)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete appointments"})
+	}
+
+	auditAccess(c, "delete", "appointment", id, existing.PatientID, auditSuccess)
+	auditAccess(c, "delete", "appointment_series", series.ID.String(), series.PatientID, auditSuccess)
+	for _, target := range targets {
+		releaseSlot(target)
+	}
+	return c.SendStatus(204)
+}
+
+// Record a deleted occurrence as an exception date of its series, so it is not
+// generated again if the series' rule changes
+func addSeriesException(tx *gorm.DB, occurrence Appointment) error {
+	var series AppointmentSeries
+	if err := tx.First(&series, "id = ?", occurrence.SeriesID).Error; err != nil {
+		return err
+	}
+	date := occurrence.RecurrenceID
+	if len(date) >= len(scheduleDateLayout) {
+		date = date[:len(scheduleDateLayout)]
+	}
+	exDates, _ := normalizeExDates(series.ExDates + "," + date)
+	return tx.Model(&series).Update("ex_dates", exDates).Error
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+type seriesResponse struct {
+	Data struct {
+		Series      AppointmentSeries `json:"series"`
+		Occurrences []Appointment     `json:"occurrences"`
+	} `json:"data"`
+}
+
+func TestRuleChangeKeepsCancelledOccurrences(t *testing.T) {
+	setupTestDB(t)
+	app := newTestApp()
+	doctor, token := createTestUser(t, RolePhysician, "password123")
+	patient := createTestPatient(t, "Ada Lovelace", doctor)
+
+	resp := doRequest(t, app, http.MethodPost, "/api/appointments/series", token, fiber.Map{
+		"patientId": patient.ID,
+		"dateTime":  nextMonday(10).Format(appointmentTimeLayout),
+		"rrule":     "FREQ=WEEKLY;COUNT=4",
+		"type":      "Consultation",
+	})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("creating the series: status = %d, want %d", resp.StatusCode, http.StatusCreated)
+	}
+	var created seriesResponse
+	decodeBody(t, resp, &created)
+	occurrences := created.Data.Occurrences
+	if len(occurrences) != 4 {
+		t.Fatalf("%d occurrences created, want 4", len(occurrences))
+	}
+
+	cancelled := occurrences[1]
+	resp = doRequest(t, app, http.MethodPost, "/api/appointments/"+cancelled.ID.String()+"/cancel", token, fiber.Map{"reason": "Patient away"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("cancelling: status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	resp = doRequest(t, app, http.MethodPut, "/api/appointments/"+occurrences[0].ID.String()+"?scope=all", token, fiber.Map{"rrule": "FREQ=WEEKLY;COUNT=5"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("changing the rule: status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	resp = doRequest(t, app, http.MethodGet, "/api/appointments/series/"+created.Data.Series.ID.String(), token, nil)
+	var got seriesResponse
+	decodeBody(t, resp, &got)
+
+	byDate := map[string][]Appointment{}
+	for _, o := range got.Data.Occurrences {
+		byDate[o.DateTime] = append(byDate[o.DateTime], o)
+	}
+	if len(got.Data.Occurrences) != 5 || len(byDate) != 5 {
+		t.Fatalf("%d occurrences on %d dates after the rule change, want 5 on 5", len(got.Data.Occurrences), len(byDate))
+	}
+	kept := byDate[cancelled.DateTime]
+	if len(kept) != 1 || kept[0].ID != cancelled.ID || kept[0].Status != statusCancelled {
+		t.Errorf("occurrences at %s = %+v, want the cancelled one alone", cancelled.DateTime, kept)
+	}
+	for _, o := range got.Data.Occurrences {
+		if o.ID != cancelled.ID && o.Status != statusScheduled {
+			t.Errorf("occurrence at %s is %s, want %s", o.DateTime, o.Status, statusScheduled)
+		}
+	}
+	if want := cancelled.DateTime[:len(scheduleDateLayout)]; got.Data.Series.ExDates != want {
+		t.Errorf("exDates = %q, want %q", got.Data.Series.ExDates, want)
+	}
+}
+
+// Slots freed by editing a series are offered to the waitlist
+func TestSeriesEditOffersFreedSlots(t *testing.T) {
+	tests := []struct {
+		name   string
+		update fiber.Map
+	}{
+		{"cancelled", fiber.Map{"status": statusCancelled, "cancellationReason": "Doctor away"}},
+		{"moved", fiber.Map{"dateTime": nextMonday(14).Format(appointmentTimeLayout)}},
+	}
+	for _, tt := range tests {
+		setupTestDB(t)
+		app := newTestApp()
+		doctor, token := createTestUser(t, RolePhysician, "password123")
+		patient := createTestPatient(t, "Ada Lovelace", doctor)
+
+		resp := doRequest(t, app, http.MethodPost, "/api/appointments/series", token, fiber.Map{
+			"patientId": patient.ID,
+			"dateTime":  nextMonday(10).Format(appointmentTimeLayout),
+			"rrule":     "FREQ=WEEKLY;COUNT=2",
+			"type":      "Consultation",
+		})
+		var created seriesResponse
+		decodeBody(t, resp, &created)
+		if len(created.Data.Occurrences) != 2 {
+			t.Fatalf("%s: %d occurrences created, want 2", tt.name, len(created.Data.Occurrences))
+		}
+		for _, name := range []string{"Grace Hopper", "Alan Turing"} {
+			waiting := createTestPatient(t, name, doctor)
+			db.Create(&WaitlistEntry{ID: uuid.New(), PatientID: waiting.ID, DoctorID: doctor.ID, Type: "Consultation", Status: entryWaiting})
+		}
+
+		first := created.Data.Occurrences[0]
+		resp = doRequest(t, app, http.MethodPut, "/api/appointments/"+first.ID.String()+"?scope=all", token, tt.update)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status = %d, want %d", tt.name, resp.StatusCode, http.StatusOK)
+		}
+
+		// Slots are offered in the background
+		var offers []WaitlistOffer
+		for deadline := time.Now().Add(5 * time.Second); len(offers) < 2 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			db.Order("date_time").Find(&offers)
+		}
+		if len(offers) != 2 {
+			t.Fatalf("%s: %d slots offered, want 2", tt.name, len(offers))
+		}
+		for i, o := range offers {
+			if want := created.Data.Occurrences[i]; o.DateTime != want.DateTime || *o.SourceAppointmentID != want.ID {
+				t.Errorf("%s: offer %d is for %s from %v, want the slot of %s at %s", tt.name, i, o.DateTime, *o.SourceAppointmentID, want.ID, want.DateTime)
+			}
+		}
+	}
+}
+
+// Editing the following occurrences splits them off into a new series that
+// ends where the old one did, and ends the old one before them
+func TestSeriesSplit(t *testing.T) {
+	first := nextMonday(9)
+	weeks := func(start time.Time, n ...int) []string {
+		var times []string
+		for _, w := range n {
+			times = append(times, start.AddDate(0, 0, 7*w).Format(appointmentTimeLayout))
+		}
+		return times
+	}
+	// Occurrences of a stored series, as its rule gives them
+	expanded := func(t *testing.T, series AppointmentSeries) []string {
+		rule, err := parseRRule(series.RRule)
+		if err != nil {
+			t.Fatalf("series rule %q: %v", series.RRule, err)
+		}
+		start, _ := parseAppointmentTime(series.DateTime)
+		starts, err := rule.expand(start, maxSeriesOccurrences)
+		if err != nil {
+			t.Fatalf("series rule %q from %s: %v", series.RRule, series.DateTime, err)
+		}
+		var times []string
+		for _, s := range starts {
+			times = append(times, s.Format(appointmentTimeLayout))
+		}
+		return times
+	}
+
+	tests := []struct {
+		name     string
+		rrule    string
+		wantRule string
+	}{
+		{"ending by COUNT", "FREQ=WEEKLY;COUNT=4", "FREQ=WEEKLY;COUNT=2"},
+		{"ending by UNTIL", "FREQ=WEEKLY;UNTIL=" + first.AddDate(0, 0, 21).Format("20060102T150405"),
+			"FREQ=WEEKLY;UNTIL=" + first.AddDate(0, 0, 21).Add(time.Hour).Format("20060102T150405")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+			app := newTestApp()
+			doctor, token := createTestUser(t, RolePhysician, "password123")
+			patient := createTestPatient(t, "Ada Lovelace", doctor)
+
+			resp := doRequest(t, app, http.MethodPost, "/api/appointments/series", token, fiber.Map{
+				"patientId": patient.ID,
+				"dateTime":  first.Format(appointmentTimeLayout),
+				"rrule":     tt.rrule,
+				"type":      "Consultation",
+			})
+			var created seriesResponse
+			decodeBody(t, resp, &created)
+			if len(created.Data.Occurrences) != 4 {
+				t.Fatalf("%d occurrences created, want 4", len(created.Data.Occurrences))
+			}
+
+			// Move the third occurrence and the following one an hour later
+			third := created.Data.Occurrences[2]
+			resp = doRequest(t, app, http.MethodPut, "/api/appointments/"+third.ID.String()+"?scope=following", token, fiber.Map{
+				"dateTime": first.AddDate(0, 0, 14).Add(time.Hour).Format(appointmentTimeLayout),
+			})
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("splitting: status = %d, want %d", resp.StatusCode, http.StatusOK)
+			}
+			var split seriesResponse
+			decodeBody(t, resp, &split)
+			following := split.Data.Series
+			if following.ID == created.Data.Series.ID {
+				t.Fatal("the following occurrences were not split off into a new series")
+			}
+			if following.RRule != tt.wantRule {
+				t.Errorf("new series rule = %q, want %q", following.RRule, tt.wantRule)
+			}
+			if got, want := expanded(t, following), weeks(first.Add(time.Hour), 2, 3); strings.Join(got, " ") != strings.Join(want, " ") {
+				t.Errorf("new series occurrences = %v, want %v", got, want)
+			}
+
+			resp = doRequest(t, app, http.MethodGet, "/api/appointments/series/"+created.Data.Series.ID.String(), token, nil)
+			var original seriesResponse
+			decodeBody(t, resp, &original)
+			if got, want := expanded(t, original.Data.Series), weeks(first, 0, 1); strings.Join(got, " ") != strings.Join(want, " ") {
+				t.Errorf("original series occurrences = %v, want %v", got, want)
+			}
+			var kept []string
+			for _, o := range original.Data.Occurrences {
+				kept = append(kept, o.DateTime)
+			}
+			if want := weeks(first, 0, 1); strings.Join(kept, " ") != strings.Join(want, " ") {
+				t.Errorf("original series keeps %v, want %v", kept, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// Token lifetimes. Access tokens are short-lived JWTs that cannot be revoked,
+// refresh tokens are stored server-side and can be.
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+var (
+	errRefreshTokenInvalid = errors.New("invalid or expired refresh token")
+	errRefreshTokenReused  = errors.New("refresh token reuse detected")
+)
+
+// Generate a random URL-safe token
+func generateOpaqueToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Hash an opaque token for storage. Tokens are high-entropy so a fast hash is
+// sufficient, unlike passwords.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Store a new refresh token in the given family and return its plaintext value
+func createRefreshToken(c *fiber.Ctx, doctorID, familyID uuid.UUID, mfa bool) (string, error) {
+	token, err := generateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	record := RefreshToken{
+		ID:        uuid.New(),
+		DoctorID:  doctorID,
+		FamilyID:  familyID,
+		TokenHash: hashToken(token),
+		ExpiresAt: time.Now().Add(refreshTokenTTL),
+		MFA:       mfa,
+		IP:        c.IP(),
+		UserAgent: c.Get("User-Agent"),
+		CreatedAt: time.Now(),
+	}
+	if err := db.Create(&record).Error; err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// Issue an access token and a refresh token starting a new token family
+func issueTokens(c *fiber.Ctx, doctor Doctor, mfa bool) (string, string, error) {
+	accessToken, err := generateToken(doctor, mfa)
+	if err != nil {
+		return "", "", err
+	}
+
+	refreshToken, err := createRefreshToken(c, doctor.ID, uuid.New(), mfa)
+	if err != nil {
+		return "", "", err
+	}
+
+	return accessToken, refreshToken, nil
+}
+
+// Exchange a refresh token for a new one in the same family. Presenting a
+// token that was already rotated or revoked revokes the whole family, since
+// it means the token was copied.
+func rotateRefreshToken(c *fiber.Ctx, token string) (RefreshToken, string, error) {
+	var record RefreshToken
+	if err := db.Where("token_hash = ?", hashToken(token)).First(&record).Error; err != nil {
+		return record, "", errRefreshTokenInvalid
+	}
+
+	if record.UsedAt != nil || record.RevokedAt != nil {
+		if err := revokeTokenFamily(record.FamilyID); err != nil {
+			log.Printf("ERROR: Failed to revoke token family %s after reuse: %v", record.FamilyID, err)
+		}
+		return record, "", errRefreshTokenReused
+	}
+
+	if time.Now().After(record.ExpiresAt) {
+		return record, "", errRefreshTokenInvalid
+	}
+
+	// Mark the token used, guarding against a concurrent rotation of the same token
+	result := db.Model(&RefreshToken{}).
+		Where("id = ? AND used_at IS NULL AND revoked_at IS NULL", record.ID).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return record, "", result.Error
+	}
+	if result.RowsAffected == 0 {
+		revokeTokenFamily(record.FamilyID)
+		return record, "", errRefreshTokenReused
+	}
+
+	newToken, err := createRefreshToken(c, record.DoctorID, record.FamilyID, record.MFA)
+	if err != nil {
+		return record, "", err
+	}
+
+	return record, newToken, nil
+}
+
+// Revoke every token in a family
+func revokeTokenFamily(familyID uuid.UUID) error {
+	return db.Model(&RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL", familyID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// Revoke every refresh token belonging to a doctor
+func revokeAllTokens(doctorID uuid.UUID) error {
+	return db.Model(&RefreshToken{}).
+		Where("doctor_id = ? AND revoked_at IS NULL", doctorID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// Cleanup routine for expired refresh tokens
+func cleanupRefreshTokens() {
+	for {
+		time.Sleep(time.Hour)
+
+		if err := db.Where("expires_at < ?", time.Now()).Delete(&RefreshToken{}).Error; err != nil {
+			log.Printf("ERROR: Failed to clean up expired refresh tokens: %v", err)
+		}
+	}
+}
@@ -0,0 +1,628 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// TOTP parameters (RFC 6238 defaults, supported by every authenticator app)
+const (
+	totpDigits = 6
+	totpPeriod = 30
+	totpSkew   = 1 // accept one step either side for clock drift
+
+	recoveryCodeCount    = 10
+	recoveryCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+	mfaChallengeTTL      = 5 * time.Minute
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Generate a random 160-bit TOTP secret, base32 encoded
+func generateTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// Compute the HOTP value (RFC 4226) for a counter
+func hotp(key []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, value%uint32(math.Pow10(totpDigits)))
+}
+
+// Validate a TOTP code against a secret, returning the matching time step
+func validateTOTP(secret, code string, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	step := now.Unix() / totpPeriod
+	for i := -totpSkew; i <= totpSkew; i++ {
+		candidate := step + int64(i)
+		if hmac.Equal([]byte(hotp(key, uint64(candidate))), []byte(code)) {
+			return candidate, true
+		}
+	}
+	return 0, false
+}
+
+// Verify a code for an enrolled doctor, recording the time step so the same
+// code cannot be used twice
+func verifyDoctorTOTP(doctor *Doctor, code string) bool {
+	step, ok := validateTOTP(doctor.TOTPSecret, code, time.Now())
+	if !ok || step <= doctor.TOTPLastStep {
+		return false
+	}
+
+	result := db.Model(&Doctor{}).
+		Where("id = ? AND totp_last_step < ?", doctor.ID, step).
+		Update("totp_last_step", step)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false
+	}
+
+	doctor.TOTPLastStep = step
+	return true
+}
+
+// Build the otpauth:// URI that authenticator apps scan as a QR code
+func totpProvisioningURI(secret, accountName string) string {
+	issuer := os.Getenv("TOTP_ISSUER")
+	if issuer == "" {
+		issuer = "MedThing"
+	}
+
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(totpDigits))
+	params.Set("period", fmt.Sprint(totpPeriod))
+
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+accountName) + "?" + params.Encode()
+}
+
+// Normalize a recovery code as typed by the user
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+// Replace a doctor's recovery codes, returning the new plaintext codes. Codes
+// are stored as bcrypt hashes like passwords, at the default cost since ten
+// are generated at once.
+func generateRecoveryCodes(tx *gorm.DB, doctorID uuid.UUID) ([]string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	records := make([]RecoveryCode, 0, recoveryCodeCount)
+
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		for j := range b {
+			b[j] = recoveryCodeAlphabet[int(b[j])%len(recoveryCodeAlphabet)]
+		}
+		code := string(b)
+
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+
+		codes = append(codes, code[:5]+"-"+code[5:])
+		records = append(records, RecoveryCode{
+			ID:        uuid.New(),
+			DoctorID:  doctorID,
+			CodeHash:  string(hash),
+			CreatedAt: time.Now(),
+		})
+	}
+
+	if err := tx.Where("doctor_id = ?", doctorID).Delete(&RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Create(&records).Error; err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// Consume one of a doctor's unused recovery codes
+func useRecoveryCode(doctorID uuid.UUID, code string) bool {
+	code = normalizeRecoveryCode(code)
+
+	var records []RecoveryCode
+	db.Where("doctor_id = ? AND used_at IS NULL", doctorID).Find(&records)
+
+	for _, record := range records {
+		if !checkPasswordHash(code, record.CodeHash) {
+			continue
+		}
+		result := db.Model(&RecoveryCode{}).
+			Where("id = ? AND used_at IS NULL", record.ID).
+			Update("used_at", time.Now())
+		return result.Error == nil && result.RowsAffected == 1
+	}
+	return false
+}
+
+// Generate a short-lived token proving the password step of login succeeded
+func generateMFAChallenge(doctor Doctor) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"id":      doctor.ID,
+		"purpose": "mfa_challenge",
+		"exp":     time.Now().Add(mfaChallengeTTL).Unix(),
+	})
+	return token.SignedString(jwtSecret)
+}
+
+// Parse an MFA challenge token, returning the doctor ID it was issued for
+func parseMFAChallenge(tokenString string) (uuid.UUID, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fiber.NewError(fiber.StatusUnauthorized, "Invalid token")
+		}
+		return jwtSecret, nil
+	})
+	if err != nil || !token.Valid {
+		return uuid.Nil, fiber.NewError(fiber.StatusUnauthorized, "Invalid or expired token")
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["purpose"] != "mfa_challenge" {
+		return uuid.Nil, fiber.NewError(fiber.StatusUnauthorized, "Invalid token")
+	}
+
+	id, _ := claims["id"].(string)
+	return uuid.Parse(id)
+}
+
+// Create the default security policy row if there is none yet
+func initSecurityPolicy() {
+	if err := db.FirstOrCreate(&SecurityPolicy{}, SecurityPolicy{ID: 1}).Error; err != nil {
+		log.Printf("Failed to create the default security policy: %v", err)
+	}
+}
+
+// Load the security policy, created on startup by initSecurityPolicy()
+func getSecurityPolicy() SecurityPolicy {
+	var policy SecurityPolicy
+	db.Limit(1).Find(&policy, "id = ?", 1)
+	policy.ID = 1 // saved back to the single row even if it went missing
+	return policy
+}
+
+// Account policy middleware, must run after protected(). Rejects accounts
+// with an unverified email, and sessions that did not pass two-factor
+// authentication when the policy requires it.
+func requireAccountPolicy() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if rejected, err := rejectUnverifiedEmail(c); rejected {
+			return err
+		}
+
+		mfa, _ := c.Locals("mfa").(bool)
+		if !mfa && getSecurityPolicy().Require2FA {
+			return c.Status(403).JSON(fiber.Map{
+				"success": false,
+				"message": "Two-factor authentication is required, enrol at /api/auth/2fa/setup",
+			})
+		}
+		return c.Next()
+	}
+}
+
+// Second login step, exchanges an MFA challenge and a TOTP or recovery code for tokens
+func loginVerify2FA(c *fiber.Ctx) error {
+	req := new(struct {
+		MFAToken     string `json:"mfaToken"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recoveryCode"`
+	})
+	if err := c.BodyParser(req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "Invalid request format",
+		})
+	}
+
+	if req.MFAToken == "" || (req.Code == "" && req.RecoveryCode == "") {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "MFA token and a code or recovery code are required",
+		})
+	}
+
+	doctorID, err := parseMFAChallenge(req.MFAToken)
+	if err != nil {
+		return c.Status(401).JSON(fiber.Map{
+			"success": false,
+			"message": "Invalid or expired MFA token, please log in again",
+		})
+	}
+
+	var doctor Doctor
+	if err := db.First(&doctor, "id = ?", doctorID).Error; err != nil || !doctor.TOTPEnabled {
+		return c.Status(401).JSON(fiber.Map{
+			"success": false,
+			"message": "Invalid or expired MFA token, please log in again",
+		})
+	}
+
+	// Failed codes count towards the same lockout as failed passwords
+	if blocked, err := rejectLockedLogin(c, doctor.Email); blocked {
+		return err
+	}
+
+	verified := false
+	if req.Code != "" {
+		verified = verifyDoctorTOTP(&doctor, req.Code)
+	} else {
+		verified = useRecoveryCode(doctor.ID, req.RecoveryCode)
+	}
+	if !verified {
+		recordLoginFailure(c, doctor.Email)
+		return c.Status(401).JSON(fiber.Map{
+			"success": false,
+			"message": "Invalid authentication code",
+		})
+	}
+
+	accountLockout.recordSuccess(doctor.Email)
+
+	token, refreshToken, err := issueTokens(c, doctor, true)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Authentication failed, please try again",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Login successful",
+		"data": fiber.Map{
+			"token":        token,
+			"refreshToken": refreshToken,
+			"expiresIn":    int(accessTokenTTL.Seconds()),
+			"user":         doctor,
+		},
+	})
+}
+
+// Start TOTP enrolment, returning a new secret and its provisioning URI
+func setup2FA(c *fiber.Ctx) error {
+	var doctor Doctor
+	if err := db.First(&doctor, "id = ?", currentDoctorID(c)).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "User not found",
+		})
+	}
+
+	if doctor.TOTPEnabled {
+		return c.Status(409).JSON(fiber.Map{
+			"success": false,
+			"message": "Two-factor authentication is already enabled",
+		})
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to start two-factor enrolment",
+		})
+	}
+
+	if err := db.Model(&doctor).Update("totp_pending", secret).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to start two-factor enrolment",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Scan the provisioning URI and confirm with a code",
+		"data": fiber.Map{
+			"secret":          secret,
+			"provisioningUri": totpProvisioningURI(secret, doctor.Email),
+		},
+	})
+}
+
+// Confirm TOTP enrolment with a code from the authenticator app
+func confirm2FA(c *fiber.Ctx) error {
+	req := new(struct {
+		Code string `json:"code"`
+	})
+	if err := c.BodyParser(req); err != nil || req.Code == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "Code is required",
+		})
+	}
+
+	var doctor Doctor
+	if err := db.First(&doctor, "id = ?", currentDoctorID(c)).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "User not found",
+		})
+	}
+
+	if doctor.TOTPPending == "" {
+		return c.Status(409).JSON(fiber.Map{
+			"success": false,
+			"message": "No two-factor enrolment in progress",
+		})
+	}
+
+	step, ok := validateTOTP(doctor.TOTPPending, req.Code, time.Now())
+	if !ok {
+		return c.Status(401).JSON(fiber.Map{
+			"success": false,
+			"message": "Invalid authentication code",
+		})
+	}
+
+	var codes []string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&doctor).Updates(map[string]interface{}{
+			"totp_enabled":   true,
+			"totp_secret":    doctor.TOTPPending,
+			"totp_pending":   "",
+			"totp_last_step": step,
+		}).Error; err != nil {
+			return err
+		}
+
+		var err error
+		codes, err = generateRecoveryCodes(tx, doctor.ID)
+		return err
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to enable two-factor authentication",
+		})
+	}
+
+	// The code just proved possession of the second factor, so upgrade the session
+	token, refreshToken, err := issueTokens(c, doctor, true)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Two-factor authentication enabled but authentication failed",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Two-factor authentication enabled, store the recovery codes somewhere safe",
+		"data": fiber.Map{
+			"recoveryCodes": codes,
+			"token":         token,
+			"refreshToken":  refreshToken,
+			"expiresIn":     int(accessTokenTTL.Seconds()),
+		},
+	})
+}
+
+// Disable TOTP for the current user, requiring the password and a current code
+func disable2FA(c *fiber.Ctx) error {
+	req := new(struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	})
+	if err := c.BodyParser(req); err != nil || req.Password == "" || req.Code == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "Password and code are required",
+		})
+	}
+
+	if getSecurityPolicy().Require2FA {
+		return c.Status(409).JSON(fiber.Map{
+			"success": false,
+			"message": "Two-factor authentication is mandatory and cannot be disabled",
+		})
+	}
+
+	var doctor Doctor
+	if err := db.First(&doctor, "id = ?", currentDoctorID(c)).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "User not found",
+		})
+	}
+
+	if !doctor.TOTPEnabled {
+		return c.Status(409).JSON(fiber.Map{
+			"success": false,
+			"message": "Two-factor authentication is not enabled",
+		})
+	}
+
+	if !checkPasswordHash(req.Password, doctor.Password) || !verifyDoctorTOTP(&doctor, req.Code) {
+		return c.Status(401).JSON(fiber.Map{
+			"success": false,
+			"message": "Invalid password or authentication code",
+		})
+	}
+
+	if err := clear2FA(db, doctor.ID); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to disable two-factor authentication",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Two-factor authentication disabled",
+	})
+}
+
+// Replace the current user's recovery codes, requiring a current code
+func regenerateRecoveryCodes(c *fiber.Ctx) error {
+	req := new(struct {
+		Code string `json:"code"`
+	})
+	if err := c.BodyParser(req); err != nil || req.Code == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "Code is required",
+		})
+	}
+
+	var doctor Doctor
+	if err := db.First(&doctor, "id = ?", currentDoctorID(c)).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "User not found",
+		})
+	}
+
+	if !doctor.TOTPEnabled || !verifyDoctorTOTP(&doctor, req.Code) {
+		return c.Status(401).JSON(fiber.Map{
+			"success": false,
+			"message": "Invalid authentication code",
+		})
+	}
+
+	codes, err := generateRecoveryCodes(db, doctor.ID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to generate recovery codes",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Recovery codes regenerated",
+		"data": fiber.Map{
+			"recoveryCodes": codes,
+		},
+	})
+}
+
+// Remove a doctor's TOTP secret and recovery codes
+func clear2FA(tx *gorm.DB, doctorID uuid.UUID) error {
+	return tx.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&Doctor{}).Where("id = ?", doctorID).Updates(map[string]interface{}{
+			"totp_enabled":   false,
+			"totp_secret":    "",
+			"totp_pending":   "",
+			"totp_last_step": 0,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Where("doctor_id = ?", doctorID).Delete(&RecoveryCode{}).Error
+	})
+}
+
+// Get the security policy
+func getSecurityPolicyHandler(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Security policy retrieved successfully",
+		"data":    getSecurityPolicy(),
+	})
+}
+
+// Update the security policy
+func updateSecurityPolicy(c *fiber.Ctx) error {
+	req := new(struct {
+		Require2FA *bool `json:"require2fa"`
+	})
+	if err := c.BodyParser(req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "Invalid request body",
+		})
+	}
+
+	policy := getSecurityPolicy()
+	if req.Require2FA != nil {
+		policy.Require2FA = *req.Require2FA
+	}
+
+	if err := db.Save(&policy).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to update security policy",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Security policy updated",
+		"data":    policy,
+	})
+}
+
+// Reset a user's two-factor authentication, e.g. after a lost device
+func resetUser2FA(c *fiber.Ctx) error {
+	var user Doctor
+	if err := db.First(&user, "id = ?", c.Params("id")).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "User not found",
+		})
+	}
+
+	if err := clear2FA(db, user.ID); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to reset two-factor authentication",
+		})
+	}
+
+	// Sessions verified with the old factor should not outlive it
+	revokeAllTokens(user.ID)
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Two-factor authentication reset",
+	})
+}
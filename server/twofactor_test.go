@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Test values from RFC 4226 appendix D
+func TestHOTP(t *testing.T) {
+	key := []byte("12345678901234567890")
+	want := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for counter, code := range want {
+		if got := hotp(key, uint64(counter)); got != code {
+			t.Errorf("hotp(counter %d) = %s, want %s", counter, got, code)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(59, 0) // step 1
+
+	tests := []struct {
+		code string
+		step int64
+		ok   bool
+	}{
+		{"755224", 0, true}, // one step behind
+		{"287082", 1, true},
+		{"359152", 2, true}, // one step ahead
+		{"969429", 0, false},
+		{"28708", 0, false},
+		{"287 082", 1, true},
+	}
+	for _, tt := range tests {
+		step, ok := validateTOTP(secret, tt.code, now)
+		if ok != tt.ok || step != tt.step {
+			t.Errorf("validateTOTP(%q) = %d, %v, want %d, %v", tt.code, step, ok, tt.step, tt.ok)
+		}
+	}
+}
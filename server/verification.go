@@ -0,0 +1,348 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Purposes and lifetimes of emailed action tokens
+const (
+	purposePasswordReset     = "password_reset"
+	purposeEmailVerification = "email_verification"
+
+	passwordResetTTL     = time.Hour
+	emailVerificationTTL = 48 * time.Hour
+
+	minPasswordLength = 8
+)
+
+// Create a signed, single-use token for an emailed action
+func generateActionToken(doctorID uuid.UUID, purpose string, ttl time.Duration) (string, error) {
+	record := ActionToken{
+		ID:        uuid.New(),
+		DoctorID:  doctorID,
+		Purpose:   purpose,
+		ExpiresAt: time.Now().Add(ttl),
+		CreatedAt: time.Now(),
+	}
+	if err := db.Create(&record).Error; err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"jti":     record.ID,
+		"id":      doctorID,
+		"purpose": purpose,
+		"exp":     record.ExpiresAt.Unix(),
+	})
+	return token.SignedString(jwtSecret)
+}
+
+// Returned for emailed action tokens that cannot be used
+var errInvalidActionToken = fiber.NewError(fiber.StatusBadRequest, "Invalid or expired link")
+
+// Verify an action token's signature and purpose, returning its ID
+func parseActionToken(tokenString, purpose string) (string, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errInvalidActionToken
+		}
+		return jwtSecret, nil
+	})
+	if err != nil || !token.Valid {
+		return "", errInvalidActionToken
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["purpose"] != purpose {
+		return "", errInvalidActionToken
+	}
+	jti, _ := claims["jti"].(string)
+	return jti, nil
+}
+
+// Check that an action token is valid and unused, without using it
+func checkActionToken(tokenString, purpose string) error {
+	jti, err := parseActionToken(tokenString, purpose)
+	if err != nil {
+		return err
+	}
+
+	var count int64
+	db.Model(&ActionToken{}).
+		Where("id = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?", jti, purpose, time.Now()).
+		Count(&count)
+	if count == 0 {
+		return errInvalidActionToken
+	}
+	return nil
+}
+
+// Verify an action token's signature, purpose and expiry, and mark it used.
+// Returns the doctor ID the token was issued for.
+func consumeActionToken(tx *gorm.DB, tokenString, purpose string) (uuid.UUID, error) {
+	jti, err := parseActionToken(tokenString, purpose)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	result := tx.Model(&ActionToken{}).
+		Where("id = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?", jti, purpose, time.Now()).
+		Update("used_at", time.Now())
+	if result.Error != nil || result.RowsAffected == 0 {
+		return uuid.Nil, errInvalidActionToken
+	}
+
+	var record ActionToken
+	if err := tx.First(&record, "id = ?", jti).Error; err != nil {
+		return uuid.Nil, errInvalidActionToken
+	}
+	return record.DoctorID, nil
+}
+
+// Build a link to the frontend page that handles an emailed token
+func actionLink(path, token string) string {
+	base := os.Getenv("APP_URL")
+	if base == "" {
+		base = "http://localhost:3000"
+	}
+	return base + path + "?token=" + url.QueryEscape(token)
+}
+
+// Email a verification link to a doctor
+func sendVerificationEmail(doctor Doctor) error {
+	token, err := generateActionToken(doctor.ID, purposeEmailVerification, emailVerificationTTL)
+	if err != nil {
+		return err
+	}
+
+	sendMailAsync(MailMessage{
+		To:      doctor.Email,
+		Subject: "Verify your MedThing email address",
+		Body: fmt.Sprintf("Hello %s,\n\nPlease confirm your email address by opening the link below:\n\n%s\n\nThe link expires in %d hours.\n",
+			doctor.Name, actionLink("/auth/verify-email", token), int(emailVerificationTTL.Hours())),
+	})
+	return nil
+}
+
+// Account policy check for unverified email addresses, see requireAccountPolicy()
+func rejectUnverifiedEmail(c *fiber.Ctx) (bool, error) {
+	if verified, _ := c.Locals("emailVerified").(bool); verified {
+		return false, nil
+	}
+	return true, c.Status(403).JSON(fiber.Map{
+		"success": false,
+		"message": "Please verify your email address to continue",
+	})
+}
+
+// Request a password reset email. Always succeeds so it cannot be used to
+// discover which addresses have accounts.
+func forgotPassword(c *fiber.Ctx) error {
+	req := new(struct {
+		Email string `json:"email"`
+	})
+	if err := c.BodyParser(req); err != nil || req.Email == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "Email is required",
+		})
+	}
+
+	var doctor Doctor
+	if err := db.Where("email = ?", req.Email).First(&doctor).Error; err == nil {
+		if token, err := generateActionToken(doctor.ID, purposePasswordReset, passwordResetTTL); err == nil {
+			sendMailAsync(MailMessage{
+				To:      doctor.Email,
+				Subject: "Reset your MedThing password",
+				Body: fmt.Sprintf("Hello %s,\n\nA password reset was requested for your account. Open the link below to choose a new password:\n\n%s\n\nThe link expires in %d minutes. If you did not request this, you can ignore this email.\n",
+					doctor.Name, actionLink("/auth/reset-password", token), int(passwordResetTTL.Minutes())),
+			})
+		}
+
+		recordAuditEvent(AuditEvent{
+			ActorEmail:   doctor.Email,
+			Action:       "password.reset_requested",
+			ResourceType: "account",
+			ResourceID:   doctor.ID.String(),
+			IP:           c.IP(),
+			Outcome:      auditSuccess,
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "If an account exists for that email, a reset link has been sent",
+	})
+}
+
+// Set a new password using a reset token
+func resetPassword(c *fiber.Ctx) error {
+	req := new(struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	})
+	if err := c.BodyParser(req); err != nil || req.Token == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "Token and password are required",
+		})
+	}
+
+	if len(req.Password) < minPasswordLength {
+		return c.Status(422).JSON(fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("Password must be at least %d characters", minPasswordLength),
+		})
+	}
+
+	// Check the link before paying for a password hash, it is used up below
+	if err := checkActionToken(req.Token, purposePasswordReset); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "Invalid or expired link",
+		})
+	}
+
+	hashedPassword, err := hashPassword(req.Password)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to reset password",
+		})
+	}
+
+	var doctor Doctor
+	err = db.Transaction(func(tx *gorm.DB) error {
+		doctorID, err := consumeActionToken(tx, req.Token, purposePasswordReset)
+		if err != nil {
+			return err
+		}
+		if err := tx.First(&doctor, "id = ?", doctorID).Error; err != nil {
+			return err
+		}
+
+		// Receiving the email proves ownership of the address as well
+		updates := map[string]interface{}{"password": hashedPassword}
+		if doctor.EmailVerifiedAt == nil {
+			updates["email_verified_at"] = time.Now()
+		}
+		if err := tx.Model(&doctor).Updates(updates).Error; err != nil {
+			return err
+		}
+
+		// Any other outstanding reset links die with this one
+		return tx.Model(&ActionToken{}).
+			Where("doctor_id = ? AND purpose = ? AND used_at IS NULL", doctor.ID, purposePasswordReset).
+			Update("used_at", time.Now()).Error
+	})
+	if fe, ok := err.(*fiber.Error); ok {
+		return c.Status(fe.Code).JSON(fiber.Map{
+			"success": false,
+			"message": fe.Message,
+		})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to reset password",
+		})
+	}
+
+	// Sign out every existing session and lift any lockout
+	revokeAllTokens(doctor.ID)
+	accountLockout.recordSuccess(doctor.Email)
+
+	recordAuditEvent(AuditEvent{
+		ActorID:      &doctor.ID,
+		ActorEmail:   doctor.Email,
+		Action:       "password.reset",
+		ResourceType: "account",
+		ResourceID:   doctor.ID.String(),
+		IP:           c.IP(),
+		Outcome:      auditSuccess,
+	})
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Password reset, please log in with your new password",
+	})
+}
+
+// Confirm an email address using a verification token
+func verifyEmail(c *fiber.Ctx) error {
+	req := new(struct {
+		Token string `json:"token"`
+	})
+	if err := c.BodyParser(req); err != nil || req.Token == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "Token is required",
+		})
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		doctorID, err := consumeActionToken(tx, req.Token, purposeEmailVerification)
+		if err != nil {
+			return err
+		}
+		return tx.Model(&Doctor{}).
+			Where("id = ? AND email_verified_at IS NULL", doctorID).
+			Update("email_verified_at", time.Now()).Error
+	})
+	if fe, ok := err.(*fiber.Error); ok {
+		return c.Status(fe.Code).JSON(fiber.Map{
+			"success": false,
+			"message": fe.Message,
+		})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to verify email",
+		})
+	}
+
+	// Existing access tokens still say unverified until refreshed
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Email verified, refresh your token to continue",
+	})
+}
+
+// Send a new verification email to the current user
+func resendVerificationEmail(c *fiber.Ctx) error {
+	var doctor Doctor
+	if err := db.First(&doctor, "id = ?", currentDoctorID(c)).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "User not found",
+		})
+	}
+
+	if doctor.EmailVerifiedAt != nil {
+		return c.Status(409).JSON(fiber.Map{
+			"success": false,
+			"message": "Email already verified",
+		})
+	}
+
+	if err := sendVerificationEmail(doctor); err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to send verification email",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Verification email sent",
+	})
+}
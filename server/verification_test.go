@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestResetPassword(t *testing.T) {
+	setupTestDB(t)
+	app := newTestApp()
+	doctor, _ := createTestUser(t, RolePhysician, "password123")
+
+	token, err := generateActionToken(doctor.ID, purposePasswordReset, passwordResetTTL)
+	if err != nil {
+		t.Fatalf("failed to generate a reset token: %v", err)
+	}
+	verification, err := generateActionToken(doctor.ID, purposeEmailVerification, emailVerificationTTL)
+	if err != nil {
+		t.Fatalf("failed to generate a verification token: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"forged token", "not-a-token", http.StatusBadRequest},
+		{"token for another purpose", verification, http.StatusBadRequest},
+		{"reset token", token, http.StatusOK},
+		{"used reset token", token, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		resp := doRequest(t, app, http.MethodPost, "/api/auth/password/reset", "", map[string]string{"token": tt.token, "password": "new-password"})
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, resp.StatusCode, tt.want)
+		}
+	}
+
+	var updated Doctor
+	db.First(&updated, "id = ?", doctor.ID)
+	if !checkPasswordHash("new-password", updated.Password) {
+		t.Error("the password was not changed")
+	}
+}
+
+func TestCheckActionTokenDoesNotUseIt(t *testing.T) {
+	setupTestDB(t)
+	doctor, _ := createTestUser(t, RolePhysician, "password123")
+
+	token, err := generateActionToken(doctor.ID, purposePasswordReset, passwordResetTTL)
+	if err != nil {
+		t.Fatalf("failed to generate a reset token: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := checkActionToken(token, purposePasswordReset); err != nil {
+			t.Fatalf("check %d: %v", i+1, err)
+		}
+	}
+
+	db.Model(&ActionToken{}).Where("doctor_id = ?", doctor.ID).Update("expires_at", time.Now().Add(-time.Minute))
+	if err := checkActionToken(token, purposePasswordReset); err == nil {
+		t.Error("an expired token passed the check")
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Most metrics accepted in one batch
+const maxMetricBatch = 1000
+
+// The latest reading of a metric type
+type vitalSign struct {
+	Type            string       `json:"type"`
+	Name            string       `json:"name"`
+	Metric          HealthMetric `json:"metric"`
+	AgeHours        float64      `json:"ageHours"` // since it was measured
+	StaleAfterHours int          `json:"staleAfterHours,omitempty"`
+	Stale           bool         `json:"stale"`
+}
+
+// The position of a metric type in the registry, unknown types last
+func metricTypeOrder(code string) int {
+	for i, t := range metricTypes {
+		if t.Code == code {
+			return i
+		}
+	}
+	return len(metricTypes)
+}
+
+// Get the latest reading of each metric type recorded for a patient, and
+// whether it is too old to rely on
+func getLatestVitals(c *fiber.Ctx) error {
+	patientID, err := uuid.Parse(c.Params("patientId"))
+	if err != nil || !canAccessPatient(c, patientID) {
+		auditAccess(c, "read", "vital_signs", "", patientID, auditNotFound)
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Patient not found",
+		})
+	}
+	system, err := unitSystem(c)
+	if err != nil {
+		return listError(c, err, "")
+	}
+
+	var metrics []HealthMetric
+	if err := db.Where("patient_id = ?", patientID).
+		Where(`measured_at = (SELECT MAX(latest.measured_at) FROM health_metrics latest
+			WHERE latest.patient_id = health_metrics.patient_id AND latest.type = health_metrics.type AND latest.deleted_at IS NULL)`).
+		Order("created_at DESC").Find(&metrics).Error; err != nil {
+		auditAccess(c, "read", "vital_signs", "", patientID, auditError)
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to fetch vital signs",
+		})
+	}
+	if system != "" {
+		convertMetrics(metrics, system)
+	}
+
+	now := clinicNow()
+	vitals := []vitalSign{}
+	seen := map[string]bool{}
+	for _, m := range metrics {
+		// Of readings measured at the same time, the last recorded
+		if seen[m.Type] {
+			continue
+		}
+		seen[m.Type] = true
+
+		v := vitalSign{Type: m.Type, Name: m.Type, Metric: m}
+		if measured, err := parseMeasuredAt(m.MeasuredAt); err == nil {
+			v.AgeHours = roundTo(now.Sub(measured).Hours(), 1)
+		}
+		if t, ok := findMetricType(m.Type); ok {
+			v.Name = t.Name
+			v.StaleAfterHours = t.StaleHours
+			v.Stale = t.StaleHours > 0 && v.AgeHours > float64(t.StaleHours)
+		}
+		vitals = append(vitals, v)
+	}
+	sort.SliceStable(vitals, func(i, j int) bool {
+		return metricTypeOrder(vitals[i].Type) < metricTypeOrder(vitals[j].Type)
+	})
+
+	auditAccess(c, "read", "vital_signs", "", patientID, auditSuccess)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Vital signs retrieved successfully",
+		"data":    vitals,
+	})
+}
+
+// The outcome of one metric of a batch
+type batchResult struct {
+	Index  int        `json:"index"`
+	Status string     `json:"status"` // created, invalid, or valid when the batch was not saved
+	ID     *uuid.UUID `json:"id,omitempty"`
+	Flag   string     `json:"flag,omitempty"`
+	Error  string     `json:"error,omitempty"`
+}
+
+// Record many metrics, for any of the caller's patients, in one transaction.
+// Unless ?partial=true, one invalid metric fails the whole batch.
+func createHealthMetricBatch(c *fiber.Ctx) error {
+	req := new(struct {
+		Metrics []HealthMetric `json:"metrics"`
+	})
+	if err := c.BodyParser(req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "Invalid request body",
+		})
+	}
+	if len(req.Metrics) == 0 {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "metrics is required",
+		})
+	}
+	if len(req.Metrics) > maxMetricBatch {
+		return c.Status(413).JSON(fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("A batch can have at most %d metrics", maxMetricBatch),
+		})
+	}
+	partial := c.Query("partial") == "true"
+
+	// Patients are checked once each, nil when not found or not the caller's
+	patients := map[uuid.UUID]*Patient{}
+	results := make([]batchResult, len(req.Metrics))
+	valid := []HealthMetric{}
+	positions := []int{}
+	for i := range req.Metrics {
+		m := req.Metrics[i]
+		results[i] = batchResult{Index: i, Status: "invalid"}
+
+		patient, checked := patients[m.PatientID]
+		if !checked {
+			patient = nil
+			var p Patient
+			if canAccessPatient(c, m.PatientID) && db.First(&p, "id = ?", m.PatientID).Error == nil {
+				patient = &p
+			} else {
+				auditAccess(c, "create", "health_metric", "", m.PatientID, auditNotFound)
+			}
+			patients[m.PatientID] = patient
+		}
+		if patient == nil {
+			results[i].Error = "Patient not found"
+			continue
+		}
+		if err := prepareHealthMetric(&m, *patient); err != nil {
+			results[i].Error = "Invalid metric: " + err.Error()
+			continue
+		}
+		m.ID = uuid.Nil
+		results[i].Status = "valid"
+		results[i].Flag = m.Flag
+		valid = append(valid, m)
+		positions = append(positions, i)
+	}
+
+	invalid := len(req.Metrics) - len(valid)
+	if len(valid) == 0 || (invalid > 0 && !partial) {
+		return c.Status(422).JSON(fiber.Map{
+			"success": false,
+			"message": fmt.Sprintf("%d of %d metrics are invalid, none were recorded", invalid, len(req.Metrics)),
+			"data":    results,
+		})
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		return tx.CreateInBatches(&valid, 100).Error
+	})
+	if err != nil {
+		for id, patient := range patients {
+			if patient != nil {
+				auditAccess(c, "create", "health_metric", "", id, auditError)
+			}
+		}
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to record health metrics",
+		})
+	}
+	for j, m := range valid {
+		id := m.ID
+		results[positions[j]].Status = "created"
+		results[positions[j]].ID = &id
+		auditAccess(c, "create", "health_metric", m.ID.String(), m.PatientID, auditSuccess)
+	}
+
+	return c.Status(201).JSON(fiber.Map{
+		"success": true,
+		"message": fmt.Sprintf("%d health metrics recorded", len(valid)),
+		"data":    results,
+		"meta": fiber.Map{
+			"created": len(valid),
+			"invalid": invalid,
+		},
+	})
+}
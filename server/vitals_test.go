@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+type batchResponse struct {
+	Message string        `json:"message"`
+	Data    []batchResult `json:"data"`
+	Meta    struct {
+		Created int `json:"created"`
+		Invalid int `json:"invalid"`
+	} `json:"meta"`
+}
+
+// A batch is recorded whole or not at all, unless partial=true records its
+// valid metrics and reports the others
+func TestCreateHealthMetricBatch(t *testing.T) {
+	setupTestDB(t)
+	app := newTestApp()
+	doctor, token := createTestUser(t, RolePhysician, "password123")
+	other, _ := createTestUser(t, RolePhysician, "password123")
+	patient := createTestPatient(t, "Ada Lovelace", doctor)
+	stranger := createTestPatient(t, "Grace Hopper", other)
+
+	metrics := []map[string]interface{}{
+		{"patientId": patient.ID, "type": "weight", "value": 154, "unit": "lb", "measuredAt": "2025-03-10T09:00"},
+		{"patientId": patient.ID, "type": "mood", "value": 3},
+		{"patientId": stranger.ID, "type": "weight", "value": 70, "unit": "kg"},
+		{"patientId": patient.ID, "type": "bp", "components": []map[string]interface{}{{"code": "systolic", "value": 150}, {"code": "diastolic", "value": 95}}, "unit": "mmHg"},
+	}
+	wantErrors := []string{"", `Invalid metric: unknown metric type "mood"`, "Patient not found", ""}
+	count := func() int64 {
+		var n int64
+		db.Model(&HealthMetric{}).Count(&n)
+		return n
+	}
+
+	tests := []struct {
+		name         string
+		query        string
+		metrics      []map[string]interface{}
+		want         int
+		wantStatuses []string
+		wantCreated  int64
+	}{
+		{"all or nothing", "", metrics, http.StatusUnprocessableEntity, []string{"valid", "invalid", "invalid", "valid"}, 0},
+		{"nothing valid", "?partial=true", metrics[1:3], http.StatusUnprocessableEntity, []string{"invalid", "invalid"}, 0},
+		{"partial", "?partial=true", metrics, http.StatusCreated, []string{"created", "invalid", "invalid", "created"}, 2},
+	}
+	for _, tt := range tests {
+		before := count()
+		resp := doRequest(t, app, http.MethodPost, "/api/metrics/batch"+tt.query, token, map[string]interface{}{"metrics": tt.metrics})
+		if resp.StatusCode != tt.want {
+			t.Fatalf("%s: status = %d, want %d", tt.name, resp.StatusCode, tt.want)
+		}
+		var body batchResponse
+		decodeBody(t, resp, &body)
+		if len(body.Data) != len(tt.wantStatuses) {
+			t.Fatalf("%s: %d results, want %d", tt.name, len(body.Data), len(tt.wantStatuses))
+		}
+		for i, r := range body.Data {
+			if r.Index != i || r.Status != tt.wantStatuses[i] {
+				t.Errorf("%s: result %d is %d %s, want %d %s", tt.name, i, r.Index, r.Status, i, tt.wantStatuses[i])
+			}
+			if (r.Status == "created") != (r.ID != nil) {
+				t.Errorf("%s: result %d is %s with id %v", tt.name, i, r.Status, r.ID)
+			}
+		}
+		if created := count() - before; created != tt.wantCreated {
+			t.Errorf("%s: %d metrics recorded, want %d", tt.name, created, tt.wantCreated)
+		}
+	}
+
+	// What a partial batch reports about each metric, and what it records
+	resp := doRequest(t, app, http.MethodPost, "/api/metrics/batch?partial=true", token, map[string]interface{}{"metrics": metrics})
+	var body batchResponse
+	decodeBody(t, resp, &body)
+	if body.Meta.Created != 2 || body.Meta.Invalid != 2 {
+		t.Errorf("meta = %+v, want 2 created and 2 invalid", body.Meta)
+	}
+	for i, r := range body.Data {
+		if r.Error != wantErrors[i] {
+			t.Errorf("result %d error = %q, want %q", i, r.Error, wantErrors[i])
+		}
+	}
+	if r := body.Data[3]; r.Flag != flagHigh {
+		t.Errorf("blood pressure flag = %q, want %q", r.Flag, flagHigh)
+	}
+	var weight HealthMetric
+	if err := db.First(&weight, "id = ?", body.Data[0].ID).Error; err != nil {
+		t.Fatalf("created weight %v not found: %v", body.Data[0].ID, err)
+	}
+	if weight.PatientID != patient.ID || weight.CanonicalUnit != "kg" || roundTo(weight.CanonicalValue, 2) != 69.85 {
+		t.Errorf("weight stored as %+v, want 69.85 kg for %s", weight, patient.ID)
+	}
+	var strangers int64
+	db.Model(&HealthMetric{}).Where("patient_id = ?", stranger.ID).Count(&strangers)
+	if strangers != 0 {
+		t.Errorf("%d metrics recorded for another doctor's patient", strangers)
+	}
+}
+
+func TestCreateHealthMetricBatchLimits(t *testing.T) {
+	setupTestDB(t)
+	app := newTestApp()
+	_, token := createTestUser(t, RolePhysician, "password123")
+
+	tooMany := make([]map[string]interface{}, maxMetricBatch+1)
+	for i := range tooMany {
+		tooMany[i] = map[string]interface{}{"patientId": uuid.New(), "type": "weight", "value": 70}
+	}
+	tests := []struct {
+		name    string
+		metrics []map[string]interface{}
+		want    int
+	}{
+		{"empty", nil, http.StatusBadRequest},
+		{"too many", tooMany, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		resp := doRequest(t, app, http.MethodPost, "/api/metrics/batch", token, map[string]interface{}{"metrics": tt.metrics})
+		if resp.StatusCode != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, resp.StatusCode, tt.want)
+		}
+	}
+}
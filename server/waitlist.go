@@ -0,0 +1,726 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// When a booked slot frees up it is offered to the waitlisted patients of the
+// doctor, highest priority first and then first come, first served. The slot
+// is held for the patient offered it until they accept, decline or the hold
+// expires, after which it moves on to the next patient.
+
+// Waitlist entry statuses
+const (
+	entryWaiting = "waiting"
+	entryOffered = "offered"
+	entryBooked  = "booked"
+	entryRemoved = "removed"
+)
+
+// Waitlist offer statuses
+const (
+	offerPending   = "pending"
+	offerAccepted  = "accepted"
+	offerDeclined  = "declined"
+	offerExpired   = "expired"
+	offerWithdrawn = "withdrawn" // the entry was removed while the offer was open
+)
+
+// How long an offered slot is held, see loadWaitlistConfig()
+var waitlistHold = 2 * time.Hour
+
+var waitlistListSpec = listSpec{
+	sort: map[string]string{
+		"priority":  "priority",
+		"createdAt": "created_at",
+	},
+	defaultSort: "-priority",
+	filters: []listFilter{
+		{"patientId", "patient_id", filterUUID},
+		{"doctorId", "doctor_id", filterUUID},
+		{"status", "status", filterEquals},
+		{"type", "type", filterEquals},
+	},
+}
+
+var waitlistOfferListSpec = listSpec{
+	sort: map[string]string{
+		"createdAt": "created_at",
+		"expiresAt": "expires_at",
+		"dateTime":  "date_time",
+	},
+	defaultSort: "-createdAt",
+	filters: []listFilter{
+		{"entryId", "entry_id", filterUUID},
+		{"patientId", "patient_id", filterUUID},
+		{"doctorId", "doctor_id", filterUUID},
+		{"status", "status", filterEquals},
+	},
+}
+
+// Apply WAITLIST_HOLD, called from main once the environment is loaded
+func loadWaitlistConfig() {
+	if d, err := time.ParseDuration(os.Getenv("WAITLIST_HOLD")); err == nil && d > 0 {
+		waitlistHold = d
+	}
+}
+
+// Whether an appointment at the given span suits the entry's dates and
+// preferred times
+func (e WaitlistEntry) accepts(span interval) bool {
+	day := span.start.Format(scheduleDateLayout)
+	if (e.NotBefore != "" && day < e.NotBefore) || (e.NotAfter != "" && day > e.NotAfter) {
+		return false
+	}
+	if len(e.Windows) == 0 {
+		return true
+	}
+
+	midnight := span.start.Truncate(24 * time.Hour)
+	for _, w := range e.Windows {
+		if time.Weekday(w.Weekday) != span.start.Weekday() {
+			continue
+		}
+		from, err1 := parseClock(w.Start)
+		to, err2 := parseClock(w.End)
+		window := interval{midnight.Add(time.Duration(from) * time.Minute), midnight.Add(time.Duration(to) * time.Minute)}
+		if err1 == nil && err2 == nil && window.contains(span) {
+			return true
+		}
+	}
+	return false
+}
+
+// Open offers holding time of a doctor that overlaps the span, other than
+// those made to the given patient
+func heldOffers(doctorID uuid.UUID, span interval, patientID uuid.UUID) ([]WaitlistOffer, error) {
+	var offers []WaitlistOffer
+	err := db.Where("doctor_id = ? AND status = ? AND expires_at > ? AND patient_id <> ?",
+		doctorID, offerPending, time.Now().UTC(), patientID).
+		Where("datetime(date_time) < datetime(?) AND datetime(end_time) > datetime(?)",
+			span.end.Format(sqliteTimeLayout), span.start.Format(sqliteTimeLayout)).
+		Find(&offers).Error
+	return offers, err
+}
+
+// Offer the slot an appointment gave up to the waitlist, in the background.
+// Only upcoming appointments free a slot.
+func releaseSlot(a Appointment) {
+	if a.Status != statusRequested && a.Status != statusScheduled {
+		return
+	}
+	go func() {
+		if err := offerSlot(a.DoctorID, a.DateTime, &a.ID); err != nil {
+			log.Printf("ERROR: Failed to offer the slot of appointment %s to the waitlist: %v", a.ID, err)
+		}
+	}()
+}
+
+// Offer a doctor's slot starting at dateTime to the first waitlisted patient
+// it suits and who has not been offered it before
+func offerSlot(doctorID uuid.UUID, dateTime string, source *uuid.UUID) error {
+	start, err := parseAppointmentTime(dateTime)
+	if err != nil || !start.After(clinicNow()) {
+		return nil
+	}
+
+	bookingMu.Lock()
+	defer bookingMu.Unlock()
+
+	var entries []WaitlistEntry
+	if err := db.Preload("Windows").Preload("Patient").
+		Where("doctor_id = ? AND status = ?", doctorID, entryWaiting).
+		Order("priority DESC, created_at").
+		Find(&entries).Error; err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		candidate := Appointment{
+			PatientID: entry.PatientID,
+			DoctorID:  doctorID,
+			DateTime:  dateTime,
+			Type:      entry.Type,
+			Status:    statusScheduled,
+		}
+		if err := checkBooking(&candidate); err != nil {
+			if _, ok := err.(*bookingError); ok {
+				continue
+			}
+			return err
+		}
+		end, _ := parseAppointmentTime(candidate.EndTime)
+		if !entry.accepts(interval{start, end}) {
+			continue
+		}
+
+		// Each slot is offered to a patient once
+		var offered int64
+		if err := db.Model(&WaitlistOffer{}).Where("entry_id = ? AND date_time = ?", entry.ID, candidate.DateTime).
+			Count(&offered).Error; err != nil {
+			return err
+		}
+		if offered > 0 {
+			continue
+		}
+
+		offer := WaitlistOffer{
+			ID:                  uuid.New(),
+			EntryID:             entry.ID,
+			PatientID:           entry.PatientID,
+			DoctorID:            doctorID,
+			DateTime:            candidate.DateTime,
+			EndTime:             candidate.EndTime,
+			Type:                candidate.Type,
+			Status:              offerPending,
+			ExpiresAt:           time.Now().UTC().Add(waitlistHold),
+			SourceAppointmentID: source,
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&offer).Error; err != nil {
+				return err
+			}
+			return tx.Model(&WaitlistEntry{}).Where("id = ?", entry.ID).Update("status", entryOffered).Error
+		})
+		if err != nil {
+			return err
+		}
+
+		notifyWaitlistOffer(entry, offer)
+		return nil
+	}
+	return nil
+}
+
+// Tell the patient about an offer over every notification channel that
+// reaches them
+func notifyWaitlistOffer(entry WaitlistEntry, offer WaitlistOffer) {
+	var doctor Doctor
+	db.First(&doctor, "id = ?", offer.DoctorID)
+	start, _ := parseAppointmentTime(offer.DateTime)
+	expires := offer.ExpiresAt.In(time.Local)
+	what := strings.ToLower(offer.Type) + " appointment"
+	if doctor.Name != "" {
+		what += " with " + doctor.Name
+	}
+
+	channels := make([]string, 0, len(notifiers))
+	for channel, notifier := range notifiers {
+		n := Notification{
+			Channel:   channel,
+			To:        reminderRecipient(channel, entry.Patient),
+			Event:     "waitlist.offer",
+			PatientID: offer.PatientID,
+			DateTime:  offer.DateTime,
+		}
+		if offer.SourceAppointmentID != nil {
+			n.AppointmentID = *offer.SourceAppointmentID // the freed appointment
+		}
+		switch channel {
+		case channelWebhook:
+			// Webhooks carry IDs and times only
+		case channelSMS:
+			n.Body = fmt.Sprintf("An earlier %s is free on %s at %s. It is held for you until %s, please contact the clinic to take it.",
+				what, start.Format("Mon 2 Jan"), start.Format("15:04"), expires.Format("Mon 2 Jan 15:04"))
+		default:
+			n.Subject = "An earlier appointment is available"
+			n.Body = fmt.Sprintf("Hello %s,\n\nAn earlier %s has become available on %s at %s.\n\nIt is held for you until %s. Please contact the clinic to take it, or to let us know you cannot come.\n",
+				entry.Patient.Name, what, start.Format("Monday 2 January 2006"), start.Format("15:04"), expires.Format("15:04 on Monday 2 January"))
+		}
+		if n.To == "" && channel != channelWebhook {
+			continue
+		}
+		channels = append(channels, channel)
+
+		go func(notifier Notifier, n Notification) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			if err := notifier.Notify(ctx, n); err != nil {
+				log.Printf("ERROR: Failed to send %s waitlist offer %s: %v", n.Channel, offer.ID, err)
+			}
+		}(notifier, n)
+	}
+
+	details, _ := json.Marshal(fiber.Map{
+		"offerId":  offer.ID,
+		"dateTime": offer.DateTime,
+		"channels": channels,
+	})
+	recordAuditEvent(AuditEvent{
+		Action:       "waitlist.offer",
+		ResourceType: "waitlist_entry",
+		ResourceID:   entry.ID.String(),
+		PatientID:    &entry.PatientID,
+		Outcome:      auditSuccess,
+		Details:      string(details),
+	})
+}
+
+// Expire offers that were not answered in time, passing their slots on
+func expireWaitlistOffers() error {
+	var expired []WaitlistOffer
+	if err := db.Where("status = ? AND expires_at <= ?", offerPending, time.Now().UTC()).Find(&expired).Error; err != nil {
+		return err
+	}
+
+	for _, offer := range expired {
+		result := db.Model(&WaitlistOffer{}).Where("id = ? AND status = ?", offer.ID, offerPending).Update("status", offerExpired)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			continue
+		}
+		// The patient keeps their place in the queue
+		if err := db.Model(&WaitlistEntry{}).Where("id = ? AND status = ?", offer.EntryID, entryOffered).
+			Update("status", entryWaiting).Error; err != nil {
+			return err
+		}
+		if err := offerSlot(offer.DoctorID, offer.DateTime, offer.SourceAppointmentID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Expire unanswered offers once a minute
+func runWaitlistOffers() {
+	for {
+		if err := expireWaitlistOffers(); err != nil {
+			log.Printf("ERROR: Failed to expire waitlist offers: %v", err)
+		}
+		time.Sleep(time.Minute)
+	}
+}
+
+// Fields of a waitlist entry that can be set. Omitted fields keep their value
+// on update.
+type waitlistRequest struct {
+	PatientID uuid.UUID         `json:"patientId"`
+	DoctorID  uuid.UUID         `json:"doctorId"`
+	Type      string            `json:"type"`
+	Priority  *int              `json:"priority"`
+	NotBefore *string           `json:"notBefore"`
+	NotAfter  *string           `json:"notAfter"`
+	Windows   *[]WaitlistWindow `json:"windows"`
+	Notes     *string           `json:"notes"`
+}
+
+// Apply a request to an entry and validate the result
+func (req *waitlistRequest) apply(entry *WaitlistEntry) error {
+	if req.DoctorID != uuid.Nil {
+		entry.DoctorID = req.DoctorID
+	}
+	if req.Type != "" {
+		entry.Type = req.Type
+	}
+	if req.Priority != nil {
+		entry.Priority = *req.Priority
+	}
+	if req.NotBefore != nil {
+		entry.NotBefore = *req.NotBefore
+	}
+	if req.NotAfter != nil {
+		entry.NotAfter = *req.NotAfter
+	}
+	if req.Windows != nil {
+		entry.Windows = *req.Windows
+	}
+	if req.Notes != nil {
+		entry.Notes = *req.Notes
+	}
+
+	if entry.DoctorID == uuid.Nil {
+		return fmt.Errorf("doctorId is required")
+	}
+	var doctor Doctor
+	if err := db.First(&doctor, "id = ?", entry.DoctorID).Error; err != nil {
+		return fmt.Errorf("doctor not found")
+	}
+	if !seesPatients(doctor.Role) {
+		return fmt.Errorf("patients can only wait for a physician")
+	}
+	types, err := appointmentTypesFor(entry.DoctorID)
+	if err != nil {
+		return err
+	}
+	names := make([]string, len(types))
+	known := false
+	for i, t := range types {
+		names[i] = t.Name
+		if strings.EqualFold(t.Name, entry.Type) {
+			entry.Type, known = t.Name, true
+		}
+	}
+	if !known {
+		return fmt.Errorf("unknown appointment type, expected one of: %s", strings.Join(names, ", "))
+	}
+
+	for _, date := range []string{entry.NotBefore, entry.NotAfter} {
+		if _, err := time.Parse(scheduleDateLayout, date); date != "" && err != nil {
+			return fmt.Errorf("invalid date %q, expected YYYY-MM-DD", date)
+		}
+	}
+	if entry.NotBefore != "" && entry.NotAfter != "" && entry.NotAfter < entry.NotBefore {
+		return fmt.Errorf("notAfter must not be before notBefore")
+	}
+	for i := range entry.Windows {
+		w := &entry.Windows[i]
+		if err := validateWeeklyBlock(w.Weekday, w.Start, w.End); err != nil {
+			return fmt.Errorf("invalid window: %v", err)
+		}
+		w.ID, w.EntryID = 0, entry.ID
+	}
+	return nil
+}
+
+// List waitlist entries
+func getWaitlist(c *fiber.Ctx) error {
+	var entries []WaitlistEntry
+	query := db.Model(&WaitlistEntry{}).Scopes(scopePatientRecords(c)).Preload("Windows")
+	meta, err := listPage(c, query, waitlistListSpec, &entries)
+	if err != nil {
+		return listError(c, err, "Failed to fetch waitlist")
+	}
+
+	patientIDs := make([]uuid.UUID, len(entries))
+	for i, entry := range entries {
+		patientIDs[i] = entry.PatientID
+	}
+	auditList(c, "waitlist_entry", patientIDs)
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Waitlist retrieved successfully",
+		"data":    entries,
+		"meta":    meta,
+	})
+}
+
+// Put a patient on a doctor's waitlist
+func createWaitlistEntry(c *fiber.Ctx) error {
+	req := new(waitlistRequest)
+	if err := c.BodyParser(req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "Invalid request body",
+		})
+	}
+	if !canAccessPatient(c, req.PatientID) {
+		auditAccess(c, "create", "waitlist_entry", "", req.PatientID, auditNotFound)
+		return c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Patient not found",
+		})
+	}
+
+	entry := WaitlistEntry{
+		ID:        uuid.New(),
+		PatientID: req.PatientID,
+		DoctorID:  defaultDoctorID(c),
+		Status:    entryWaiting,
+		CreatedBy: currentDoctorID(c),
+	}
+	if err := req.apply(&entry); err != nil {
+		return c.Status(422).JSON(fiber.Map{
+			"success": false,
+			"message": "Invalid waitlist entry: " + err.Error(),
+		})
+	}
+
+	if err := db.Create(&entry).Error; err != nil {
+		auditAccess(c, "create", "waitlist_entry", "", entry.PatientID, auditError)
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to add to the waitlist",
+		})
+	}
+
+	auditAccess(c, "create", "waitlist_entry", entry.ID.String(), entry.PatientID, auditSuccess)
+	return c.Status(201).JSON(fiber.Map{
+		"success": true,
+		"message": "Patient added to the waitlist",
+		"data":    entry,
+	})
+}
+
+// Load a waitlist entry the caller may see, responding 404 if there is none
+func findWaitlistEntry(c *fiber.Ctx, action string) (*WaitlistEntry, error) {
+	id := c.Params("id")
+	var entry WaitlistEntry
+	if err := db.Scopes(scopePatientRecords(c)).Preload("Windows").First(&entry, "id = ?", id).Error; err != nil {
+		auditAccess(c, action, "waitlist_entry", id, uuid.Nil, auditNotFound)
+		return nil, c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Waitlist entry not found",
+		})
+	}
+	return &entry, nil
+}
+
+// Get a waitlist entry
+func getWaitlistEntry(c *fiber.Ctx) error {
+	entry, err := findWaitlistEntry(c, "read")
+	if entry == nil {
+		return err
+	}
+
+	auditAccess(c, "read", "waitlist_entry", entry.ID.String(), entry.PatientID, auditSuccess)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Waitlist entry retrieved successfully",
+		"data":    entry,
+	})
+}
+
+// Change a waitlist entry's type, priority, dates or preferred times
+func updateWaitlistEntry(c *fiber.Ctx) error {
+	entry, err := findWaitlistEntry(c, "update")
+	if entry == nil {
+		return err
+	}
+	req := new(waitlistRequest)
+	if err := c.BodyParser(req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"success": false,
+			"message": "Invalid request body",
+		})
+	}
+	if entry.Status == entryBooked || entry.Status == entryRemoved {
+		return c.Status(409).JSON(fiber.Map{
+			"success": false,
+			"message": "The waitlist entry is " + entry.Status,
+		})
+	}
+	if err := req.apply(entry); err != nil {
+		return c.Status(422).JSON(fiber.Map{
+			"success": false,
+			"message": "Invalid waitlist entry: " + err.Error(),
+		})
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("entry_id = ?", entry.ID).Delete(&WaitlistWindow{}).Error; err != nil {
+			return err
+		}
+		return tx.Session(&gorm.Session{FullSaveAssociations: true}).Save(entry).Error
+	})
+	if err != nil {
+		auditAccess(c, "update", "waitlist_entry", entry.ID.String(), entry.PatientID, auditError)
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to update waitlist entry",
+		})
+	}
+
+	auditAccess(c, "update", "waitlist_entry", entry.ID.String(), entry.PatientID, auditSuccess)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Waitlist entry updated successfully",
+		"data":    entry,
+	})
+}
+
+// Take a patient off the waitlist, passing on any slot held for them
+func removeWaitlistEntry(c *fiber.Ctx) error {
+	entry, err := findWaitlistEntry(c, "delete")
+	if entry == nil {
+		return err
+	}
+
+	var withdrawn []WaitlistOffer
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(entry).Update("status", entryRemoved).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("entry_id = ? AND status = ?", entry.ID, offerPending).Find(&withdrawn).Error; err != nil {
+			return err
+		}
+		return tx.Model(&WaitlistOffer{}).Where("entry_id = ? AND status = ?", entry.ID, offerPending).
+			Update("status", offerWithdrawn).Error
+	})
+	if err != nil {
+		auditAccess(c, "delete", "waitlist_entry", entry.ID.String(), entry.PatientID, auditError)
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to remove waitlist entry",
+		})
+	}
+	for _, offer := range withdrawn {
+		passOnOffer(offer)
+	}
+
+	auditAccess(c, "delete", "waitlist_entry", entry.ID.String(), entry.PatientID, auditSuccess)
+	return c.SendStatus(204)
+}
+
+// Offer a slot that was turned down to the next patient, in the background
+func passOnOffer(offer WaitlistOffer) {
+	go func() {
+		if err := offerSlot(offer.DoctorID, offer.DateTime, offer.SourceAppointmentID); err != nil {
+			log.Printf("ERROR: Failed to pass on waitlist offer %s: %v", offer.ID, err)
+		}
+	}()
+}
+
+// List waitlist offers
+func getWaitlistOffers(c *fiber.Ctx) error {
+	var offers []WaitlistOffer
+	query := db.Model(&WaitlistOffer{}).Scopes(scopePatientRecords(c))
+	meta, err := listPage(c, query, waitlistOfferListSpec, &offers)
+	if err != nil {
+		return listError(c, err, "Failed to fetch waitlist offers")
+	}
+
+	patientIDs := make([]uuid.UUID, len(offers))
+	for i, offer := range offers {
+		patientIDs[i] = offer.PatientID
+	}
+	auditList(c, "waitlist_offer", patientIDs)
+
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Waitlist offers retrieved successfully",
+		"data":    offers,
+		"meta":    meta,
+	})
+}
+
+// Load an open offer the caller may see, responding with an error if there
+// is none
+func findOpenOffer(c *fiber.Ctx) (*WaitlistOffer, error) {
+	id := c.Params("id")
+	var offer WaitlistOffer
+	err := db.Scopes(scopePatientRecords(c)).First(&offer, "id = ?", id).Error
+	if err != nil || !canAccessPatient(c, offer.PatientID) {
+		auditAccess(c, "update", "waitlist_offer", id, uuid.Nil, auditNotFound)
+		return nil, c.Status(404).JSON(fiber.Map{
+			"success": false,
+			"message": "Waitlist offer not found",
+		})
+	}
+	status := offer.Status
+	if status == offerPending && !offer.ExpiresAt.After(time.Now()) {
+		status = offerExpired
+	}
+	if status != offerPending {
+		return nil, c.Status(409).JSON(fiber.Map{
+			"success": false,
+			"message": "The offer is " + status,
+		})
+	}
+	return &offer, nil
+}
+
+// Accept an offer on the patient's behalf, booking the held slot
+func acceptWaitlistOffer(c *fiber.Ctx) error {
+	offer, err := findOpenOffer(c)
+	if offer == nil {
+		return err
+	}
+
+	appointment := Appointment{
+		PatientID: offer.PatientID,
+		DoctorID:  offer.DoctorID,
+		DateTime:  offer.DateTime,
+		Type:      offer.Type,
+		Status:    statusScheduled,
+	}
+
+	bookingMu.Lock()
+	defer bookingMu.Unlock()
+	if err := checkBooking(&appointment); err != nil {
+		auditAccess(c, "create", "appointment", "", offer.PatientID, auditDenied)
+		be, ok := err.(*bookingError)
+		if !ok {
+			return c.Status(500).JSON(fiber.Map{
+				"success": false,
+				"message": "Failed to check availability",
+			})
+		}
+		return c.Status(be.status).JSON(fiber.Map{
+			"success": false,
+			"message": be.message,
+		})
+	}
+
+	now := time.Now()
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&appointment).Error; err != nil {
+			return err
+		}
+		if err := recordStatusChange(tx, c, appointment.ID, "", statusScheduled, "Booked from the waitlist"); err != nil {
+			return err
+		}
+		if err := tx.Model(offer).Updates(map[string]interface{}{
+			"status":         offerAccepted,
+			"appointment_id": appointment.ID,
+			"responded_at":   now,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&WaitlistEntry{}).Where("id = ?", offer.EntryID).Update("status", entryBooked).Error
+	})
+	if err != nil {
+		auditAccess(c, "create", "appointment", "", offer.PatientID, auditError)
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to book the offered appointment",
+		})
+	}
+
+	auditAccess(c, "create", "appointment", appointment.ID.String(), appointment.PatientID, auditSuccess)
+	return c.Status(201).JSON(fiber.Map{
+		"success": true,
+		"message": "Offer accepted and appointment booked",
+		"data":    appointment,
+	})
+}
+
+// Decline an offer on the patient's behalf. They stay on the waitlist and the
+// slot is offered to the next patient.
+func declineWaitlistOffer(c *fiber.Ctx) error {
+	offer, err := findOpenOffer(c)
+	if offer == nil {
+		return err
+	}
+
+	now := time.Now()
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(offer).Updates(map[string]interface{}{
+			"status":       offerDeclined,
+			"responded_at": now,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&WaitlistEntry{}).Where("id = ? AND status = ?", offer.EntryID, entryOffered).
+			Update("status", entryWaiting).Error
+	})
+	if err != nil {
+		auditAccess(c, "update", "waitlist_offer", offer.ID.String(), offer.PatientID, auditError)
+		return c.Status(500).JSON(fiber.Map{
+			"success": false,
+			"message": "Failed to decline the offer",
+		})
+	}
+	passOnOffer(*offer)
+	offer.Status, offer.RespondedAt = offerDeclined, &now
+
+	auditAccess(c, "update", "waitlist_offer", offer.ID.String(), offer.PatientID, auditSuccess)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"message": "Offer declined",
+		"data":    offer,
+	})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// A freed slot is held for the first patient it suits, and passed on to the
+// next when the hold expires
+func TestOfferSlotHoldAndPassOn(t *testing.T) {
+	setupTestDB(t)
+	app := newTestApp()
+	doctor, token := createTestUser(t, RolePhysician, "password123")
+	slot := nextMonday(10).Format(appointmentTimeLayout)
+
+	waiting := func(name string, priority int, created time.Time, windows ...WaitlistWindow) WaitlistEntry {
+		patient := createTestPatient(t, name, doctor)
+		entry := WaitlistEntry{ID: uuid.New(), PatientID: patient.ID, DoctorID: doctor.ID, Type: "Consultation",
+			Priority: priority, Status: entryWaiting, Windows: windows, CreatedAt: created}
+		if err := db.Create(&entry).Error; err != nil {
+			t.Fatalf("failed to add %s to the waitlist: %v", name, err)
+		}
+		return entry
+	}
+	now := time.Now()
+	first := waiting("Grace Hopper", 0, now.Add(-2*time.Hour))
+	urgent := waiting("Alan Turing", 5, now.Add(-time.Hour))
+	// Only comes on Tuesdays, so the Monday slot never suits them
+	waiting("Edsger Dijkstra", 9, now.Add(-3*time.Hour), WaitlistWindow{Weekday: 2, Start: "08:00", End: "18:00"})
+	other := createTestPatient(t, "Barbara Liskov", doctor)
+
+	// Offers of the slot, oldest first
+	offers := func() []WaitlistOffer {
+		var offers []WaitlistOffer
+		db.Where("date_time = ?", slot).Order("created_at, rowid").Find(&offers)
+		return offers
+	}
+	entryStatus := func(e WaitlistEntry) string {
+		db.First(&e, "id = ?", e.ID)
+		return e.Status
+	}
+
+	if err := offerSlot(doctor.ID, slot, nil); err != nil {
+		t.Fatalf("offerSlot failed: %v", err)
+	}
+	got := offers()
+	if len(got) != 1 || got[0].EntryID != urgent.ID || got[0].Status != offerPending {
+		t.Fatalf("offers = %+v, want one pending offer to the higher priority patient", got)
+	}
+	if d := time.Until(got[0].ExpiresAt); d < waitlistHold-time.Minute || d > waitlistHold {
+		t.Errorf("offer expires in %s, want %s", d, waitlistHold)
+	}
+	if s := entryStatus(urgent); s != entryOffered {
+		t.Errorf("offered entry is %s, want %s", s, entryOffered)
+	}
+
+	// Held: nobody else can book it, and it is not offered again
+	resp := doRequest(t, app, http.MethodPost, "/api/appointments", token, fiber.Map{
+		"patientId": other.ID,
+		"dateTime":  slot,
+		"type":      "Consultation",
+	})
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("booking a held slot: status = %d, want %d", resp.StatusCode, http.StatusConflict)
+	}
+	if err := offerSlot(doctor.ID, slot, nil); err != nil {
+		t.Fatalf("offerSlot failed: %v", err)
+	}
+	if n := len(offers()); n != 1 {
+		t.Errorf("%d offers of a held slot, want 1", n)
+	}
+
+	// The hold expires and the slot moves on to the next patient it suits
+	db.Model(&WaitlistOffer{}).Where("id = ?", got[0].ID).Update("expires_at", time.Now().UTC().Add(-time.Minute))
+	if err := expireWaitlistOffers(); err != nil {
+		t.Fatalf("expireWaitlistOffers failed: %v", err)
+	}
+	got = offers()
+	if len(got) != 2 || got[0].Status != offerExpired || got[1].EntryID != first.ID || got[1].Status != offerPending {
+		t.Fatalf("offers = %+v, want the first expired and a pending one to the next patient", got)
+	}
+	if s := entryStatus(urgent); s != entryWaiting {
+		t.Errorf("entry whose offer expired is %s, want %s", s, entryWaiting)
+	}
+
+	// Each patient is offered the slot once, so nobody is left to take it
+	db.Model(&WaitlistOffer{}).Where("id = ?", got[1].ID).Update("expires_at", time.Now().UTC().Add(-time.Minute))
+	if err := expireWaitlistOffers(); err != nil {
+		t.Fatalf("expireWaitlistOffers failed: %v", err)
+	}
+	if n := len(offers()); n != 2 {
+		t.Errorf("%d offers after every suited patient had one, want 2", n)
+	}
+	resp = doRequest(t, app, http.MethodPost, "/api/appointments", token, fiber.Map{
+		"patientId": other.ID,
+		"dateTime":  slot,
+		"type":      "Consultation",
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("booking a slot no longer held: status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+}